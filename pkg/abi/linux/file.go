@@ -91,6 +91,11 @@ const (
 	AT_REMOVEDIR = 0x200
 )
 
+// Constants for faccessat2(2).
+const (
+	AT_EACCESS = 0x200
+)
+
 // Constants for linkat(2) and fchownat(2).
 const (
 	AT_SYMLINK_FOLLOW = 0x400
@@ -197,6 +202,10 @@ const (
 	RWF_DSYNC = 0x00000002
 	RWF_SYNC  = 0x00000004
 	RWF_VALID = RWF_HIPRI | RWF_DSYNC | RWF_SYNC
+
+	// RWF_NOWAIT is only supported by filesystems that implement it, and is
+	// not included in RWF_VALID.
+	RWF_NOWAIT = 0x00000008
 )
 
 // SizeOfStat is the size of a Stat struct.
@@ -226,6 +235,8 @@ const (
 	STATX_BASIC_STATS = 0x000007ff
 	STATX_BTIME       = 0x00000800
 	STATX_ALL         = 0x00000fff
+	STATX_MNT_ID      = 0x00001000
+	STATX_DIOALIGN    = 0x00002000
 	STATX__RESERVED   = 0x80000000
 )
 
@@ -264,6 +275,9 @@ type Statx struct {
 	RdevMinor      uint32
 	DevMajor       uint32
 	DevMinor       uint32
+	MntID          uint64
+	DioMemAlign    uint32
+	DioOffsetAlign uint32
 }
 
 // SizeOfStatx is the size of a Statx struct.
@@ -73,6 +73,38 @@ const (
 	SIOCGMIIREG   = 0x8948
 )
 
+// ioctl(2) requests provided by uapi/linux/fs.h
+const (
+	FICLONE         = 0x40049409
+	FICLONERANGE    = 0x4020940d
+	FS_IOC_GETFLAGS = 0x80086601
+	FS_IOC_SETFLAGS = 0x40086602
+)
+
+// Inode flags, as for ioctl(FS_IOC_GETFLAGS), from uapi/linux/fs.h.
+const (
+	FS_SECRM_FL       = 0x00000001
+	FS_UNRM_FL        = 0x00000002
+	FS_COMPR_FL       = 0x00000004
+	FS_SYNC_FL        = 0x00000008
+	FS_IMMUTABLE_FL   = 0x00000010
+	FS_APPEND_FL      = 0x00000020
+	FS_NODUMP_FL      = 0x00000040
+	FS_NOATIME_FL     = 0x00000080
+	FS_DIRSYNC_FL     = 0x00010000
+	FS_NOCOW_FL       = 0x00800000
+	FS_PROJINHERIT_FL = 0x20000000
+)
+
+// FileCloneRange is struct file_clone_range, the argument to
+// ioctl(FICLONERANGE), from uapi/linux/fs.h.
+type FileCloneRange struct {
+	SrcFD      int64
+	SrcOffset  uint64
+	SrcLength  uint64
+	DestOffset uint64
+}
+
 // ioctl(2) directions. Used to calculate requests number.
 // Constants from asm-generic/ioctl.h.
 const (
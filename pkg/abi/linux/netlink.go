@@ -14,6 +14,11 @@
 
 package linux
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
 // Netlink protocols, from uapi/linux/netlink.h.
 const (
 	NETLINK_ROUTE          = 0
@@ -105,10 +110,60 @@ type NetlinkAttrHeader struct {
 // NetlinkAttrHeaderSize is the size of NetlinkAttrHeader.
 const NetlinkAttrHeaderSize = 4
 
+// byteOrder returns the byte order of integer values of attributes with header
+// h. Attributes are in host byte order, which is little-endian on all
+// supported architectures, unless NLA_F_NET_BYTEORDER is set.
+func (h NetlinkAttrHeader) byteOrder() binary.ByteOrder {
+	if h.Type&NLA_F_NET_BYTEORDER != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// Uint16 decodes value, the payload of an attribute with header h, as a
+// uint16. If value is too short, ok is false.
+func (h NetlinkAttrHeader) Uint16(value []byte) (v uint16, ok bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	return h.byteOrder().Uint16(value), true
+}
+
+// Uint32 decodes value, the payload of an attribute with header h, as a
+// uint32. If value is too short, ok is false.
+func (h NetlinkAttrHeader) Uint32(value []byte) (v uint32, ok bool) {
+	if len(value) < 4 {
+		return 0, false
+	}
+	return h.byteOrder().Uint32(value), true
+}
+
+// String decodes value, the payload of an attribute with header h, as a
+// NUL-terminated string, excluding the NUL terminator and anything following
+// it. If value is empty, such that it cannot contain even an empty string's
+// terminator, ok is false. Unterminated strings are accepted, as by Linux's
+// nla_strlcpy().
+func (h NetlinkAttrHeader) String(value []byte) (s string, ok bool) {
+	if len(value) == 0 {
+		return "", false
+	}
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return string(value), true
+}
+
 // NLA_ALIGNTO is the alignment of netlink attributes, from
 // uapi/linux/netlink.h.
 const NLA_ALIGNTO = 4
 
+// Netlink attribute type flags, from uapi/linux/netlink.h.
+const (
+	NLA_F_NESTED        = 1 << 15
+	NLA_F_NET_BYTEORDER = 1 << 14
+	NLA_TYPE_MASK       = ^uint16(NLA_F_NESTED | NLA_F_NET_BYTEORDER)
+)
+
 // Socket options, from uapi/linux/netlink.h.
 const (
 	NETLINK_ADD_MEMBERSHIP   = 1
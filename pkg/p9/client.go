@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/flipcall"
@@ -33,6 +34,19 @@ var ErrOutOfTags = errors.New("out of tags -- messages lost?")
 // ErrOutOfFIDs indicates no more FIDs are available.
 var ErrOutOfFIDs = errors.New("out of FIDs -- messages lost?")
 
+// errCancelled is returned by sendRecvLegacyCancel when a request is
+// cancelled before the server responds.
+var errCancelled = errors.New("request cancelled")
+
+// errTimedOut is returned by sendRecvLegacyCancel when the server does not
+// respond to a request within the client's timeout.
+var errTimedOut = errors.New("request timed out")
+
+// errFlushFailed is returned by sendRecvLegacyCancel when a request is
+// cancelled, but flushing it fails, such that whether the server executed it
+// is unknown.
+var errFlushFailed = errors.New("failed to flush cancelled request")
+
 // ErrUnexpectedTag indicates a response with an unexpected tag was received.
 var ErrUnexpectedTag = errors.New("unexpected tag in response")
 
@@ -93,10 +107,20 @@ type Client struct {
 	// version 0 implies 9P2000.L.
 	version uint32
 
+	// timeout is the maximum time to wait for the server to respond to each
+	// request sent over the socket. If timeout is 0, requests never time
+	// out. timeout is immutable after SetTimeout.
+	timeout time.Duration
+
 	// closedWg is marked as done when the Client.watch() goroutine, which is
 	// responsible for closing channels and the socket fd, returns.
 	closedWg sync.WaitGroup
 
+	// disconnected is closed (exactly once, by disconnectOnce) when the
+	// client observes that its connection to the server has been lost.
+	disconnected   chan struct{}
+	disconnectOnce sync.Once
+
 	// sendRecv is the transport function.
 	//
 	// This is determined dynamically based on whether or not the server
@@ -135,33 +159,49 @@ type Client struct {
 	recvr chan bool
 }
 
+// minMessageSize is the smallest message size that leaves room for at least one
+// byte of payload in a read or write, after the message header and the
+// largest fixed-size portion of any message.
+func minMessageSize() uint32 {
+	return headerLength + msgRegistry.largestFixedSize + 1
+}
+
+// payloadSizeFor returns the maximum payload size of a read or write for the
+// given message size, rounded down to 512 (normal block size) if it's larger
+// than a single block. The message size limits entire messages, including
+// their headers, so these are accounted for along with fixed-size fields.
+//
+// Preconditions: messageSize >= minMessageSize().
+func payloadSizeFor(messageSize uint32) uint32 {
+	payloadSize := messageSize - headerLength - msgRegistry.largestFixedSize
+	if payloadSize > 512 && payloadSize%512 != 0 {
+		payloadSize -= (payloadSize % 512)
+	}
+	return payloadSize
+}
+
 // NewClient creates a new client.  It performs a Tversion exchange with
 // the server to assert that messageSize is ok to use.
 //
 // If NewClient succeeds, ownership of socket is transferred to the new Client.
 func NewClient(socket *unet.Socket, messageSize uint32, version string) (*Client, error) {
 	// Need at least one byte of payload.
-	if messageSize <= msgRegistry.largestFixedSize {
+	if messageSize < minMessageSize() {
 		return nil, &ErrMessageTooLarge{
 			size:  messageSize,
-			msize: msgRegistry.largestFixedSize,
+			msize: minMessageSize(),
 		}
 	}
 
-	// Compute a payload size and round to 512 (normal block size)
-	// if it's larger than a single block.
-	payloadSize := messageSize - msgRegistry.largestFixedSize
-	if payloadSize > 512 && payloadSize%512 != 0 {
-		payloadSize -= (payloadSize % 512)
-	}
 	c := &Client{
-		socket:      socket,
-		tagPool:     pool.Pool{Start: 1, Limit: uint64(NoTag)},
-		fidPool:     pool.Pool{Start: 1, Limit: uint64(NoFID)},
-		pending:     make(map[Tag]*response),
-		recvr:       make(chan bool, 1),
-		messageSize: messageSize,
-		payloadSize: payloadSize,
+		socket:       socket,
+		tagPool:      pool.Pool{Start: 1, Limit: uint64(NoTag)},
+		fidPool:      pool.Pool{Start: 1, Limit: uint64(NoFID)},
+		pending:      make(map[Tag]*response),
+		recvr:        make(chan bool, 1),
+		messageSize:  messageSize,
+		payloadSize:  payloadSizeFor(messageSize),
+		disconnected: make(chan struct{}),
 	}
 	// Agree upon a version.
 	requested, ok := parseVersion(version)
@@ -201,6 +241,19 @@ func NewClient(socket *unet.Socket, messageSize uint32, version string) (*Client
 			return nil, ErrBadVersionString
 		}
 		c.version = version
+
+		// The server may offer a smaller message size than we requested,
+		// in which case we must use it.
+		if rversion.MSize != 0 && rversion.MSize < messageSize {
+			if rversion.MSize < minMessageSize() {
+				return nil, &ErrMessageTooLarge{
+					size:  rversion.MSize,
+					msize: minMessageSize(),
+				}
+			}
+			c.messageSize = rversion.MSize
+			c.payloadSize = payloadSizeFor(rversion.MSize)
+		}
 		break
 	}
 
@@ -234,6 +287,21 @@ func NewClient(socket *unet.Socket, messageSize uint32, version string) (*Client
 	return c, nil
 }
 
+// SetTimeout sets the maximum time that c waits for the server to respond to
+// each request. If the server doesn't respond in time, the request is flushed
+// and fails with ETIMEDOUT. A timeout of 0 disables timeouts.
+//
+// Requests sent over flipcall channels can't be flushed, so if timeout is not
+// 0, all requests are sent over the socket.
+//
+// Preconditions: No requests have been made using c.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+	if timeout != 0 {
+		c.sendRecv = c.sendRecvLegacySyscallErr
+	}
+}
+
 // watch watches the given socket and releases resources on hangup events.
 //
 // This is intended to be called as a goroutine.
@@ -262,6 +330,7 @@ func (c *Client) watch(socket *unet.Socket) {
 		}
 		break
 	}
+	c.disconnect()
 
 	// Set availableChannels to nil so that future calls to c.sendRecvChannel()
 	// don't attempt to activate a channel, and concurrent calls to
@@ -435,8 +504,39 @@ func (c *Client) waitAndRecv(done chan error) error {
 // non-syscall errors to EIO.
 func (c *Client) sendRecvLegacySyscallErr(t message, r message) error {
 	received, err := c.sendRecvLegacy(t, r)
+	return c.legacySyscallErr(received, err)
+}
+
+// sendRecvCancel is like sendRecv, but if cancel becomes ready before the
+// server responds, the request is flushed. If the server responds to the
+// request before the flush completes, its response is used as usual;
+// otherwise, the server did not execute the request, and sendRecvCancel
+// returns EINTR. If cancel is nil, sendRecvCancel is equivalent to sendRecv.
+//
+// Requests sent over flipcall channels can't be flushed, so cancellable
+// requests are always sent over the socket.
+func (c *Client) sendRecvCancel(t message, r message, cancel <-chan struct{}) error {
+	if cancel == nil {
+		return c.sendRecv(t, r)
+	}
+	received, err := c.sendRecvLegacyCancel(t, r, cancel)
+	if err == errCancelled {
+		return syscall.EINTR
+	}
+	return c.legacySyscallErr(received, err)
+}
+
+// legacySyscallErr converts the result of sendRecvLegacy to a syscall error.
+func (c *Client) legacySyscallErr(received bool, err error) error {
+	if err == errTimedOut {
+		// The request has been flushed, so the connection is still usable.
+		return syscall.ETIMEDOUT
+	}
 	if !received {
 		log.Warningf("p9.Client.sendRecvChannel: %v", err)
+		if err != ErrOutOfTags {
+			c.disconnect()
+		}
 		return syscall.EIO
 	}
 	return err
@@ -450,23 +550,49 @@ func (c *Client) sendRecvLegacySyscallErr(t message, r message) error {
 //
 // This is called by internal functions.
 func (c *Client) sendRecvLegacy(t message, r message) (bool, error) {
+	return c.sendRecvLegacyCancel(t, r, nil)
+}
+
+// sendRecvLegacyCancel is like sendRecvLegacy, but if cancel becomes ready
+// before the server responds, sendRecvLegacyCancel flushes the request and
+// waits for the flush to complete. If the server responded to the request
+// first, sendRecvLegacyCancel returns its response; otherwise, it returns
+// errCancelled. A nil cancel channel is never ready. If c.timeout elapses
+// before the server responds, including while waiting for a flush, the
+// request is flushed in the background and sendRecvLegacyCancel returns
+// errTimedOut.
+func (c *Client) sendRecvLegacyCancel(t message, r message, cancel <-chan struct{}) (bool, error) {
+	return c.sendRecvLegacyTimeout(t, r, cancel, c.timeout)
+}
+
+// sendRecvLegacyTimeout is like sendRecvLegacyCancel, but with the given
+// timeout instead of c.timeout.
+func (c *Client) sendRecvLegacyTimeout(t message, r message, cancel <-chan struct{}, timeout time.Duration) (bool, error) {
 	tag, ok := c.tagPool.Get()
 	if !ok {
 		return false, ErrOutOfTags
 	}
-	defer c.tagPool.Put(tag)
 
 	// Indicate we're expecting a response.
 	//
 	// Note that the tag will be cleared from pending
 	// automatically (see handleOne for details).
 	resp := responsePool.Get().(*response)
-	defer responsePool.Put(resp)
 	resp.r = r
 	c.pendingMu.Lock()
 	c.pending[Tag(tag)] = resp
 	c.pendingMu.Unlock()
 
+	// The tag and response can't be reused until the server is done with
+	// them, which for cancelled requests is determined by c.flush().
+	cancelled := false
+	defer func() {
+		if !cancelled {
+			c.tagPool.Put(tag)
+			responsePool.Put(resp)
+		}
+	}()
+
 	// Send the request over the wire.
 	c.sendMu.Lock()
 	err := send(c.socket, Tag(tag), t)
@@ -476,7 +602,70 @@ func (c *Client) sendRecvLegacy(t message, r message) (bool, error) {
 	}
 
 	// Co-ordinate with other receivers.
-	if err := c.waitAndRecv(resp.done); err != nil {
+	if cancel == nil && timeout == 0 {
+		err = c.waitAndRecv(resp.done)
+	} else {
+		// Receiving may block indefinitely, so do it in another goroutine
+		// to remain responsive to cancel and the timeout.
+		result := make(chan error, 1)
+		go func() { // S/R-SAFE: not relevant.
+			result <- c.waitAndRecv(resp.done)
+		}()
+		var expired <-chan time.Time
+		if timeout != 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		var stopErr error
+		select {
+		case err = <-result:
+		case <-cancel:
+			stopErr = errCancelled
+		case <-expired:
+			stopErr = errTimedOut
+		}
+		if stopErr != nil {
+			select {
+			case err = <-result:
+				// The response arrived anyway; prefer it.
+			default:
+				flushed := make(chan struct{})
+				go func() { // S/R-SAFE: not relevant.
+					c.flush(Tag(tag), resp)
+					close(flushed)
+				}()
+				if stopErr == errCancelled {
+					// The server may have executed the request already,
+					// in which case its result must be returned.
+					select {
+					case <-flushed:
+					case <-expired:
+					}
+				}
+				select {
+				case <-flushed:
+					err = <-result
+					if err == errCancelled {
+						// The server didn't execute the request.
+						return false, stopErr
+					}
+				default:
+					// Release the tag and response once the server is
+					// done with them.
+					cancelled = true
+					go func() { // S/R-SAFE: not relevant.
+						<-flushed
+						<-result
+						c.tagPool.Put(tag)
+						responsePool.Put(resp)
+					}()
+					return false, errTimedOut
+				}
+			}
+		}
+	}
+	if err != nil {
 		return false, err
 	}
 
@@ -495,6 +684,32 @@ func (c *Client) sendRecvLegacy(t message, r message) (bool, error) {
 	return true, nil
 }
 
+// flush flushes the request with the given tag. When flush returns, resp.done
+// has received either the server's response to the request, errCancelled if
+// the server confirmed that it did not execute the request, or errFlushFailed
+// if the request's fate is unknown.
+func (c *Client) flush(tag Tag, resp *response) {
+	// The server either responds to the flushed request before responding
+	// to the Tflush, or not at all.
+	//
+	// The Tflush is not subject to c.timeout, since timing it out would
+	// require flushing it in turn.
+	received, err := c.sendRecvLegacyTimeout(&Tflush{OldTag: tag}, &Rflush{}, nil /* cancel */, 0 /* timeout */)
+
+	// If the server didn't respond to the flushed request, stop waiting for
+	// it.
+	c.pendingMu.Lock()
+	if _, ok := c.pending[tag]; ok {
+		delete(c.pending, tag)
+		if received && err == nil {
+			resp.done <- errCancelled
+		} else {
+			resp.done <- errFlushFailed
+		}
+	}
+	c.pendingMu.Unlock()
+}
+
 // sendRecvChannel uses channels to send a message.
 func (c *Client) sendRecvChannel(t message, r message) error {
 	// Acquire an available channel.
@@ -524,6 +739,7 @@ func (c *Client) sendRecvChannel(t message, r message) error {
 			// Map all transport errors to EIO, but ensure that the real error
 			// is logged.
 			log.Warningf("p9.Client.sendRecvChannel: flipcall.Endpoint.Connect: %v", err)
+			c.disconnect()
 			return syscall.EIO
 		}
 	}
@@ -537,6 +753,7 @@ func (c *Client) sendRecvChannel(t message, r message) error {
 		c.channelsMu.Unlock()
 		c.channelsWg.Done()
 		log.Warningf("p9.Client.sendRecvChannel: p9.channel.send: %v", err)
+		c.disconnect()
 		return syscall.EIO
 	}
 
@@ -544,6 +761,7 @@ func (c *Client) sendRecvChannel(t message, r message) error {
 	resp, retErr := ch.recv(r, rsz)
 	if resp == nil {
 		log.Warningf("p9.Client.sendRecvChannel: p9.channel.recv: %v", retErr)
+		c.disconnect()
 		retErr = syscall.EIO
 	}
 
@@ -566,6 +784,66 @@ func (c *Client) Version() uint32 {
 	return c.version
 }
 
+// MessageSize returns the negotiated maximum message size, which may be
+// smaller than the size requested by NewClient if the server does not
+// support messages that large.
+func (c *Client) MessageSize() uint32 {
+	return c.messageSize
+}
+
+// SupportsMessage returns true if the negotiated version permits requests of
+// type t. Note that the server's File implementation may still fail a
+// supported request with ENOSYS or EOPNOTSUPP.
+func (c *Client) SupportsMessage(t MsgType) bool {
+	switch t {
+	case MsgTflushf:
+		return VersionSupportsTflushf(c.version)
+	case MsgTwalkgetattr:
+		return versionSupportsTwalkgetattr(c.version)
+	case MsgTucreate, MsgTumkdir, MsgTumknod, MsgTusymlink:
+		return versionSupportsTucreation(c.version)
+	case MsgTlconnect:
+		return VersionSupportsConnect(c.version)
+	case MsgTallocate:
+		return versionSupportsTallocate(c.version)
+	case MsgTchannel:
+		return versionSupportsFlipcall(c.version)
+	case MsgTgetxattr, MsgTsetxattr:
+		return versionSupportsGetSetXattr(c.version)
+	case MsgTlistxattr, MsgTremovexattr:
+		return versionSupportsListRemoveXattr(c.version)
+	case MsgTseek:
+		return versionSupportsTseek(c.version)
+	case MsgTgetattrs:
+		return versionSupportsTgetattrs(c.version)
+	case MsgTcopyrange:
+		return versionSupportsTcopyrange(c.version)
+	case MsgTfdatasync:
+		return versionSupportsTfdatasync(c.version)
+	case MsgTrenameat2:
+		return versionSupportsTrenameat2(c.version)
+	case MsgTmultiwalk:
+		return versionSupportsTmultiwalk(c.version)
+	default:
+		return true
+	}
+}
+
+// Disconnected returns a channel that is closed once the client observes that
+// its connection to the server has been lost, either because the server hung
+// up or because an RPC failed in transport. Once this happens, all future RPCs
+// will fail with EIO.
+func (c *Client) Disconnected() <-chan struct{} {
+	return c.disconnected
+}
+
+// disconnect marks the client as disconnected.
+func (c *Client) disconnect() {
+	c.disconnectOnce.Do(func() {
+		close(c.disconnected)
+	})
+}
+
 // Close closes the underlying socket and channels.
 func (c *Client) Close() {
 	// unet.Socket.Shutdown() has no effect if unet.Socket.Close() has already
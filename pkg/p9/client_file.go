@@ -28,13 +28,20 @@ import (
 //
 // Note that authentication is not currently supported.
 func (c *Client) Attach(name string) (File, error) {
+	return c.AttachCancellable(name, nil)
+}
+
+// AttachCancellable is equivalent to Attach, except that if cancel becomes
+// ready before the server responds, the request is flushed, and
+// AttachCancellable returns EINTR if the server did not execute it.
+func (c *Client) AttachCancellable(name string, cancel <-chan struct{}) (File, error) {
 	fid, ok := c.fidPool.Get()
 	if !ok {
 		return nil, ErrOutOfFIDs
 	}
 
 	rattach := Rattach{}
-	if err := c.sendRecv(&Tattach{FID: FID(fid), Auth: Tauth{AttachName: name, AuthenticationFID: NoFID, UID: NoUID}}, &rattach); err != nil {
+	if err := c.sendRecvCancel(&Tattach{FID: FID(fid), Auth: Tauth{AttachName: name, AuthenticationFID: NoFID, UID: NoUID}}, &rattach, cancel); err != nil {
 		c.fidPool.Put(fid)
 		return nil, err
 	}
@@ -119,6 +126,55 @@ func (c *clientFile) WalkGetAttr(components []string) ([]QID, File, AttrMask, At
 	return rwalkgetattr.QIDs, c.client.newFile(FID(fid)), rwalkgetattr.Valid, rwalkgetattr.Attr, nil
 }
 
+// MultiWalk implements MultiWalker.MultiWalk.
+func (c *clientFile) MultiWalk(names []string) ([]File, []FullStat, error) {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return nil, nil, syscall.EBADF
+	}
+
+	if !versionSupportsTmultiwalk(c.client.version) {
+		return nil, nil, syscall.ENOSYS
+	}
+	if len(names) == 0 || len(names) > MaxWalkElements {
+		return nil, nil, syscall.EINVAL
+	}
+
+	fids := make([]FID, 0, len(names))
+	putFIDs := func(fids []FID) {
+		for _, fid := range fids {
+			c.client.fidPool.Put(uint64(fid))
+		}
+	}
+	for range names {
+		fid, ok := c.client.fidPool.Get()
+		if !ok {
+			putFIDs(fids)
+			return nil, nil, ErrOutOfFIDs
+		}
+		fids = append(fids, FID(fid))
+	}
+
+	rmultiwalk := Rmultiwalk{}
+	if err := c.client.sendRecv(&Tmultiwalk{FID: c.fid, NewFIDs: fids, Names: names}, &rmultiwalk); err != nil {
+		putFIDs(fids)
+		return nil, nil, err
+	}
+	if len(rmultiwalk.Stats) > len(names) {
+		// The server is misbehaving; the FIDs it may have installed are
+		// unknown, so leak them rather than reusing them.
+		return nil, nil, syscall.EIO
+	}
+
+	// Return new client files for each component walked, and release the
+	// FIDs that the server did not use.
+	files := make([]File, len(rmultiwalk.Stats))
+	for i := range rmultiwalk.Stats {
+		files[i] = c.client.newFile(fids[i])
+	}
+	putFIDs(fids[len(files):])
+	return files, rmultiwalk.Stats, nil
+}
+
 // StatFS implements File.StatFS.
 func (c *clientFile) StatFS() (FSStat, error) {
 	if atomic.LoadUint32(&c.closed) != 0 {
@@ -142,6 +198,19 @@ func (c *clientFile) FSync() error {
 	return c.client.sendRecv(&Tfsync{FID: c.fid}, &Rfsync{})
 }
 
+// FDataSync implements File.FDataSync.
+func (c *clientFile) FDataSync() error {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return syscall.EBADF
+	}
+
+	if !versionSupportsTfdatasync(c.client.version) {
+		// fsync(2) is a valid implementation of fdatasync(2).
+		return c.client.sendRecv(&Tfsync{FID: c.fid}, &Rfsync{})
+	}
+	return c.client.sendRecv(&Tfdatasync{FID: c.fid}, &Rfdatasync{})
+}
+
 // GetAttr implements File.GetAttr.
 func (c *clientFile) GetAttr(req AttrMask) (QID, AttrMask, Attr, error) {
 	if atomic.LoadUint32(&c.closed) != 0 {
@@ -156,6 +225,25 @@ func (c *clientFile) GetAttr(req AttrMask) (QID, AttrMask, Attr, error) {
 	return rgetattr.QID, rgetattr.Valid, rgetattr.Attr, nil
 }
 
+// GetAttrChildren implements File.GetAttrChildren.
+func (c *clientFile) GetAttrChildren(names []string, req AttrMask) ([]FullStat, error) {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return nil, syscall.EBADF
+	}
+	if !versionSupportsTgetattrs(c.client.version) {
+		return nil, syscall.EOPNOTSUPP
+	}
+
+	rgetattrs := Rgetattrs{}
+	if err := c.client.sendRecv(&Tgetattrs{FID: c.fid, Names: names, AttrMask: req}, &rgetattrs); err != nil {
+		return nil, err
+	}
+	if len(rgetattrs.Stats) != len(names) {
+		return nil, syscall.EIO
+	}
+	return rgetattrs.Stats, nil
+}
+
 // SetAttr implements File.SetAttr.
 func (c *clientFile) SetAttr(valid SetAttrMask, attr SetAttr) error {
 	if atomic.LoadUint32(&c.closed) != 0 {
@@ -165,6 +253,50 @@ func (c *clientFile) SetAttr(valid SetAttrMask, attr SetAttr) error {
 	return c.client.sendRecv(&Tsetattr{FID: c.fid, Valid: valid, SetAttr: attr}, &Rsetattr{})
 }
 
+// GetIno implements File.GetIno.
+func (c *clientFile) GetIno() (uint64, error) {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return 0, syscall.EBADF
+	}
+	if !versionSupportsTgetino(c.client.version) {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	rgetino := Rgetino{}
+	if err := c.client.sendRecv(&Tgetino{FID: c.fid}, &rgetino); err != nil {
+		return 0, err
+	}
+	return rgetino.Ino, nil
+}
+
+// GetFlags implements File.GetFlags.
+func (c *clientFile) GetFlags() (uint32, error) {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return 0, syscall.EBADF
+	}
+	if !versionSupportsTgetflags(c.client.version) {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	rgetflags := Rgetflags{}
+	if err := c.client.sendRecv(&Tgetflags{FID: c.fid}, &rgetflags); err != nil {
+		return 0, err
+	}
+	return rgetflags.Flags, nil
+}
+
+// SetFlags implements File.SetFlags.
+func (c *clientFile) SetFlags(flags uint32) error {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return syscall.EBADF
+	}
+	if !versionSupportsTgetflags(c.client.version) {
+		return syscall.EOPNOTSUPP
+	}
+
+	return c.client.sendRecv(&Tsetflags{FID: c.fid, Flags: flags}, &Rsetflags{})
+}
+
 // GetXattr implements File.GetXattr.
 func (c *clientFile) GetXattr(name string, size uint64) (string, error) {
 	if atomic.LoadUint32(&c.closed) != 0 {
@@ -173,6 +305,9 @@ func (c *clientFile) GetXattr(name string, size uint64) (string, error) {
 	if !versionSupportsGetSetXattr(c.client.version) {
 		return "", syscall.EOPNOTSUPP
 	}
+	if versionSupportsTreadxattr(c.client.version) {
+		return c.readXattr(name, size)
+	}
 
 	rgetxattr := Rgetxattr{}
 	if err := c.client.sendRecv(&Tgetxattr{FID: c.fid, Name: name, Size: size}, &rgetxattr); err != nil {
@@ -182,6 +317,41 @@ func (c *clientFile) GetXattr(name string, size uint64) (string, error) {
 	return rgetxattr.Value, nil
 }
 
+// readXattr reads the value of the extended attribute name in chunks of at
+// most c.client.payloadSize bytes, so that values that do not fit in a single
+// message can be retrieved.
+func (c *clientFile) readXattr(name string, size uint64) (string, error) {
+	var (
+		val   []byte
+		total uint64
+	)
+	for {
+		rreadxattr := Rreadxattr{}
+		if err := c.client.sendRecv(&Treadxattr{FID: c.fid, Name: name, Size: size, Offset: uint64(len(val)), Count: c.client.payloadSize}, &rreadxattr); err != nil {
+			return "", err
+		}
+		if val == nil {
+			total = rreadxattr.Size
+		} else if rreadxattr.Size != total {
+			// The value changed between chunks, so the chunks already read
+			// may be inconsistent with the rest of it.
+			return "", syscall.EAGAIN
+		}
+		if uint64(len(val)+len(rreadxattr.Data)) > total {
+			return "", syscall.EIO
+		}
+		val = append(val, rreadxattr.Data...)
+		if uint64(len(val)) == total {
+			return string(val), nil
+		}
+		if len(rreadxattr.Data) == 0 {
+			// The server is misbehaving; it claims that there is more of the
+			// value, but won't return it.
+			return "", syscall.EIO
+		}
+	}
+}
+
 // SetXattr implements File.SetXattr.
 func (c *clientFile) SetXattr(name, value string, flags uint32) error {
 	if atomic.LoadUint32(&c.closed) != 0 {
@@ -239,6 +409,66 @@ func (c *clientFile) Allocate(mode AllocateMode, offset, length uint64) error {
 	return c.client.sendRecv(&Tallocate{FID: c.fid, Mode: mode, Offset: offset, Length: length}, &Rallocate{})
 }
 
+// Seek implements File.Seek.
+func (c *clientFile) Seek(offset uint64, whence SeekWhence) (uint64, error) {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return 0, syscall.EBADF
+	}
+	if !versionSupportsTseek(c.client.version) {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	rseek := Rseek{}
+	if err := c.client.sendRecv(&Tseek{FID: c.fid, Offset: offset, Whence: whence}, &rseek); err != nil {
+		return 0, err
+	}
+	return rseek.Offset, nil
+}
+
+// CopyRange implements File.CopyRange.
+func (c *clientFile) CopyRange(offset uint64, dst File, dstOffset, length uint64) (uint64, error) {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return 0, syscall.EBADF
+	}
+	if !versionSupportsTcopyrange(c.client.version) {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	dstFile, ok := dst.(*clientFile)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	if dstFile.client != c.client {
+		return 0, syscall.EXDEV
+	}
+
+	rcopyrange := Rcopyrange{}
+	if err := c.client.sendRecv(&Tcopyrange{FID: c.fid, Offset: offset, DstFID: dstFile.fid, DstOffset: dstOffset, Length: length}, &rcopyrange); err != nil {
+		return 0, err
+	}
+	return rcopyrange.Count, nil
+}
+
+// CloneRange implements File.CloneRange.
+func (c *clientFile) CloneRange(offset uint64, dst File, dstOffset, length uint64) error {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return syscall.EBADF
+	}
+	if !versionSupportsTclonerange(c.client.version) {
+		return syscall.EOPNOTSUPP
+	}
+
+	dstFile, ok := dst.(*clientFile)
+	if !ok {
+		return syscall.EBADF
+	}
+	if dstFile.client != c.client {
+		return syscall.EXDEV
+	}
+
+	return c.client.sendRecv(&Tclonerange{FID: c.fid, Offset: offset, DstFID: dstFile.fid, DstOffset: dstOffset, Length: length}, &Rclonerange{})
+}
+
 // Remove implements File.Remove.
 //
 // N.B. This method is no longer part of the file interface and should be
@@ -364,16 +594,23 @@ func chunk(chunkSize uint32, fn func([]byte, uint64) (int, error), p []byte, off
 
 // ReadAt proxies File.ReadAt.
 func (c *clientFile) ReadAt(p []byte, offset uint64) (int, error) {
-	return chunk(c.client.payloadSize, c.readAt, p, offset)
+	return c.ReadAtCancellable(p, offset, nil)
+}
+
+// ReadAtCancellable implements CancellableFile.ReadAtCancellable.
+func (c *clientFile) ReadAtCancellable(p []byte, offset uint64, cancel <-chan struct{}) (int, error) {
+	return chunk(c.client.payloadSize, func(p []byte, offset uint64) (int, error) {
+		return c.readAt(p, offset, cancel)
+	}, p, offset)
 }
 
-func (c *clientFile) readAt(p []byte, offset uint64) (int, error) {
+func (c *clientFile) readAt(p []byte, offset uint64, cancel <-chan struct{}) (int, error) {
 	if atomic.LoadUint32(&c.closed) != 0 {
 		return 0, syscall.EBADF
 	}
 
 	rread := Rread{Data: p}
-	if err := c.client.sendRecv(&Tread{FID: c.fid, Offset: offset, Count: uint32(len(p))}, &rread); err != nil {
+	if err := c.client.sendRecvCancel(&Tread{FID: c.fid, Offset: offset, Count: uint32(len(p))}, &rread, cancel); err != nil {
 		return 0, err
 	}
 
@@ -395,16 +632,23 @@ func (c *clientFile) readAt(p []byte, offset uint64) (int, error) {
 
 // WriteAt proxies File.WriteAt.
 func (c *clientFile) WriteAt(p []byte, offset uint64) (int, error) {
-	return chunk(c.client.payloadSize, c.writeAt, p, offset)
+	return c.WriteAtCancellable(p, offset, nil)
 }
 
-func (c *clientFile) writeAt(p []byte, offset uint64) (int, error) {
+// WriteAtCancellable implements CancellableFile.WriteAtCancellable.
+func (c *clientFile) WriteAtCancellable(p []byte, offset uint64, cancel <-chan struct{}) (int, error) {
+	return chunk(c.client.payloadSize, func(p []byte, offset uint64) (int, error) {
+		return c.writeAt(p, offset, cancel)
+	}, p, offset)
+}
+
+func (c *clientFile) writeAt(p []byte, offset uint64, cancel <-chan struct{}) (int, error) {
 	if atomic.LoadUint32(&c.closed) != 0 {
 		return 0, syscall.EBADF
 	}
 
 	rwrite := Rwrite{}
-	if err := c.client.sendRecv(&Twrite{FID: c.fid, Offset: offset, Data: p}, &rwrite); err != nil {
+	if err := c.client.sendRecvCancel(&Twrite{FID: c.fid, Offset: offset, Data: p}, &rwrite, cancel); err != nil {
 		return 0, err
 	}
 
@@ -632,6 +876,28 @@ func (c *clientFile) RenameAt(oldname string, newdir File, newname string) error
 	return c.client.sendRecv(&Trenameat{OldDirectory: c.fid, OldName: oldname, NewDirectory: clientNewDir.fid, NewName: newname}, &Rrenameat{})
 }
 
+// RenameAt2 implements File.RenameAt2.
+func (c *clientFile) RenameAt2(oldname string, newdir File, newname string, flags uint32) error {
+	if atomic.LoadUint32(&c.closed) != 0 {
+		return syscall.EBADF
+	}
+
+	if flags == 0 {
+		return c.RenameAt(oldname, newdir, newname)
+	}
+	if !versionSupportsTrenameat2(c.client.version) {
+		// renameat2(2) returns EINVAL for unsupported flags.
+		return syscall.EINVAL
+	}
+
+	clientNewDir, ok := newdir.(*clientFile)
+	if !ok {
+		return syscall.EBADF
+	}
+
+	return c.client.sendRecv(&Trenameat2{OldDirectory: c.fid, OldName: oldname, NewDirectory: clientNewDir.fid, NewName: newname, Flags: flags}, &Rrenameat2{})
+}
+
 // UnlinkAt implements File.UnlinkAt.
 func (c *clientFile) UnlinkAt(name string, flags uint32) error {
 	if atomic.LoadUint32(&c.closed) != 0 {
@@ -17,6 +17,7 @@ package p9
 import (
 	"syscall"
 	"testing"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/unet"
 )
@@ -61,6 +62,47 @@ func TestVersion(t *testing.T) {
 	}
 }
 
+// TestVersionMessageSize tests that the client uses the server's maximum
+// message size if it is smaller than the requested size.
+func TestVersionMessageSize(t *testing.T) {
+	serverSocket, clientSocket, err := unet.SocketPair(false)
+	if err != nil {
+		t.Fatalf("socketpair got err %v expected nil", err)
+	}
+	defer clientSocket.Close()
+
+	s := NewServer(nil)
+	go s.Handle(serverSocket)
+
+	c, err := NewClient(clientSocket, 2*maximumLength, HighestVersionString())
+	if err != nil {
+		t.Fatalf("got %v, expected nil", err)
+	}
+	if got := c.MessageSize(); got != maximumLength {
+		t.Errorf("got message size %d, expected %d", got, maximumLength)
+	}
+	if c.payloadSize >= maximumLength {
+		t.Errorf("got payload size %d, expected less than %d", c.payloadSize, maximumLength)
+	}
+}
+
+// TestPayloadSize tests that reads and writes of the maximum payload size fit
+// in a message of the corresponding message size, including its header.
+func TestPayloadSize(t *testing.T) {
+	min := minMessageSize()
+	for _, messageSize := range []uint32{min, min + 1, 4095, 4096, 4097, DefaultMessageSize, maximumLength} {
+		payloadSize := payloadSizeFor(messageSize)
+		if payloadSize == 0 {
+			t.Errorf("message size %d: got payload size 0", messageSize)
+		}
+		for _, m := range []payloader{&Twrite{}, &Rread{}} {
+			if size := headerLength + m.FixedSize() + payloadSize; size > messageSize {
+				t.Errorf("message size %d: %T with payload size %d has size %d", messageSize, m, payloadSize, size)
+			}
+		}
+	}
+}
+
 func benchmarkSendRecv(b *testing.B, fn func(c *Client) func(message, message) error) {
 	// See above.
 	serverSocket, clientSocket, err := unet.SocketPair(false)
@@ -107,3 +149,197 @@ func BenchmarkSendRecvLegacy(b *testing.B) {
 func BenchmarkSendRecvChannel(b *testing.B) {
 	benchmarkSendRecv(b, func(c *Client) func(message, message) error { return c.sendRecvChannel })
 }
+
+// TestCancelFlush tests that cancelling a request that the server doesn't
+// respond to causes the request to be flushed.
+func TestCancelFlush(t *testing.T) {
+	serverSocket, clientSocket, err := unet.SocketPair(false)
+	if err != nil {
+		t.Fatalf("socketpair got err %v expected nil", err)
+	}
+	defer serverSocket.Close()
+
+	// Serve requests, except for Tattach, which blocks forever.
+	attached := make(chan Tag, 1)
+	flushed := make(chan Tag, 1)
+	go func() {
+		for {
+			tag, m, err := recv(serverSocket, DefaultMessageSize, msgRegistry.get)
+			if err != nil {
+				return
+			}
+			var r message
+			switch m := m.(type) {
+			case *Tversion:
+				r = &Rversion{MSize: m.MSize, Version: m.Version}
+			case *Tattach:
+				attached <- tag
+				continue
+			case *Tflush:
+				flushed <- m.OldTag
+				r = &Rflush{}
+			default:
+				r = newErr(syscall.ENOSYS)
+			}
+			if err := send(serverSocket, tag, r); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := NewClient(clientSocket, DefaultMessageSize, HighestVersionString())
+	if err != nil {
+		t.Fatalf("got %v, expected nil", err)
+	}
+	defer c.Close()
+
+	cancel := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.AttachCancellable("/", cancel)
+		errs <- err
+	}()
+	var attachTag Tag
+	select {
+	case attachTag = <-attached:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("server did not receive Tattach")
+	}
+	close(cancel)
+	if err := <-errs; err != syscall.EINTR {
+		t.Errorf("AttachCancellable got err %v expected %v", err, syscall.EINTR)
+	}
+	select {
+	case oldTag := <-flushed:
+		if oldTag != attachTag {
+			t.Errorf("got Tflush for tag %d expected %d", oldTag, attachTag)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("server did not receive Tflush")
+	}
+}
+
+// TestCancelFlushCompleted tests that if the server responds to a cancelled
+// request before responding to its Tflush, the response is used.
+func TestCancelFlushCompleted(t *testing.T) {
+	serverSocket, clientSocket, err := unet.SocketPair(false)
+	if err != nil {
+		t.Fatalf("socketpair got err %v expected nil", err)
+	}
+	defer serverSocket.Close()
+
+	// Serve requests, except for Tattach, which is only responded to when it
+	// is flushed.
+	attached := make(chan Tag, 1)
+	go func() {
+		for {
+			tag, m, err := recv(serverSocket, DefaultMessageSize, msgRegistry.get)
+			if err != nil {
+				return
+			}
+			var r message
+			switch m := m.(type) {
+			case *Tversion:
+				r = &Rversion{MSize: m.MSize, Version: m.Version}
+			case *Tattach:
+				attached <- tag
+				continue
+			case *Tflush:
+				if err := send(serverSocket, m.OldTag, &Rattach{}); err != nil {
+					return
+				}
+				r = &Rflush{}
+			default:
+				r = newErr(syscall.ENOSYS)
+			}
+			if err := send(serverSocket, tag, r); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := NewClient(clientSocket, DefaultMessageSize, HighestVersionString())
+	if err != nil {
+		t.Fatalf("got %v, expected nil", err)
+	}
+	defer c.Close()
+
+	cancel := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.AttachCancellable("/", cancel)
+		errs <- err
+	}()
+	select {
+	case <-attached:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("server did not receive Tattach")
+	}
+	close(cancel)
+	if err := <-errs; err != nil {
+		t.Errorf("AttachCancellable got err %v expected nil", err)
+	}
+}
+
+// TestTimeoutFlush tests that a request that the server doesn't respond to
+// times out, and is flushed.
+func TestTimeoutFlush(t *testing.T) {
+	serverSocket, clientSocket, err := unet.SocketPair(false)
+	if err != nil {
+		t.Fatalf("socketpair got err %v expected nil", err)
+	}
+	defer serverSocket.Close()
+
+	// Serve requests, except for Tattach, which never gets a response.
+	attached := make(chan Tag, 1)
+	flushed := make(chan Tag, 1)
+	go func() {
+		for {
+			tag, m, err := recv(serverSocket, DefaultMessageSize, msgRegistry.get)
+			if err != nil {
+				return
+			}
+			var r message
+			switch m := m.(type) {
+			case *Tversion:
+				r = &Rversion{MSize: m.MSize, Version: m.Version}
+			case *Tattach:
+				attached <- tag
+				continue
+			case *Tflush:
+				flushed <- m.OldTag
+				r = &Rflush{}
+			default:
+				r = newErr(syscall.ENOSYS)
+			}
+			if err := send(serverSocket, tag, r); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := NewClient(clientSocket, DefaultMessageSize, HighestVersionString())
+	if err != nil {
+		t.Fatalf("got %v, expected nil", err)
+	}
+	defer c.Close()
+	const timeout = 50 * time.Millisecond
+	c.SetTimeout(timeout)
+
+	start := time.Now()
+	if _, err := c.Attach("/"); err != syscall.ETIMEDOUT {
+		t.Errorf("Attach got err %v expected %v", err, syscall.ETIMEDOUT)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("Attach failed after %v, before timeout %v", elapsed, timeout)
+	}
+	attachTag := <-attached
+	select {
+	case oldTag := <-flushed:
+		if oldTag != attachTag {
+			t.Errorf("got Tflush for tag %d expected %d", oldTag, attachTag)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("server did not receive Tflush")
+	}
+}
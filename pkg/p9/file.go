@@ -73,6 +73,15 @@ type File interface {
 	// On the server, WalkGetAttr has a read concurrency guarantee.
 	WalkGetAttr([]string) ([]QID, File, AttrMask, Attr, error)
 
+	// GetAttrChildren returns the attributes of the children of this
+	// directory with the given names, as for GetAttr on the result of
+	// walking to each. The returned slice has one entry per name; entries
+	// for children whose attributes could not be obtained have an empty
+	// Valid mask.
+	//
+	// On the server, GetAttrChildren has a read concurrency guarantee.
+	GetAttrChildren(names []string, req AttrMask) ([]FullStat, error)
+
 	// StatFS returns information about the file system associated with
 	// this file.
 	//
@@ -89,6 +98,26 @@ type File interface {
 	// On the server, SetAttr has a write concurrency guarantee.
 	SetAttr(valid SetAttrMask, attr SetAttr) error
 
+	// GetIno returns the inode number of this node in the server's backing
+	// filesystem, which may differ from the QID path that identifies the
+	// node in the protocol.
+	//
+	// On the server, GetIno has a read concurrency guarantee.
+	GetIno() (uint64, error)
+
+	// GetFlags returns the inode flags of this node, as for
+	// ioctl(FS_IOC_GETFLAGS).
+	//
+	// On the server, GetFlags has a read concurrency guarantee.
+	GetFlags() (uint32, error)
+
+	// SetFlags sets the inode flags of this node, as for
+	// ioctl(FS_IOC_SETFLAGS). SetFlags returns EOPNOTSUPP if the backing
+	// filesystem does not support one of the given flags.
+	//
+	// On the server, SetFlags has a write concurrency guarantee.
+	SetFlags(flags uint32) error
+
 	// GetXattr returns extended attributes of this node.
 	//
 	// Size indicates the size of the buffer that has been allocated to hold the
@@ -125,6 +154,31 @@ type File interface {
 	// for the file. See fallocate(2) for more details.
 	Allocate(mode AllocateMode, offset, length uint64) error
 
+	// Seek returns the offset of the first data (for SeekData) or hole (for
+	// SeekHole) in the file at or after offset. See lseek(2) for more
+	// details.
+	//
+	// On the server, Seek has a read concurrency guarantee.
+	Seek(offset uint64, whence SeekWhence) (uint64, error)
+
+	// CopyRange copies up to length bytes from offset in this file to
+	// dstOffset in dst, as for copy_file_range(2), and returns the number
+	// of bytes copied. Both files must be open; this file for reading and
+	// dst for writing.
+	//
+	// On the server, CopyRange has a read concurrency guarantee.
+	CopyRange(offset uint64, dst File, dstOffset, length uint64) (uint64, error)
+
+	// CloneRange makes length bytes at dstOffset in dst share storage with
+	// the bytes at offset in this file, as for ioctl(FICLONERANGE). If
+	// length is 0, all bytes from offset to the end of this file are
+	// cloned. Both files must be open; this file for reading and dst for
+	// writing. CloneRange returns EOPNOTSUPP if the backing filesystem does
+	// not support sharing storage between files.
+	//
+	// On the server, CloneRange has a read concurrency guarantee.
+	CloneRange(offset uint64, dst File, dstOffset, length uint64) error
+
 	// Close is called when all references are dropped on the server side,
 	// and Close should be called by the client to drop all references.
 	//
@@ -171,6 +225,12 @@ type File interface {
 	// On the server, FSync has a read concurrency guarantee.
 	FSync() error
 
+	// FDataSync syncs this node's data, and only the metadata required to
+	// retrieve it. Open must be called first.
+	//
+	// On the server, FDataSync has a read concurrency guarantee.
+	FDataSync() error
+
 	// Create creates a new regular file and opens it according to the
 	// flags given. This file is already Open.
 	//
@@ -219,6 +279,12 @@ type File interface {
 	// On the server, RenameAt has a global concurrency guarantee.
 	RenameAt(oldName string, newDir File, newName string) error
 
+	// RenameAt2 is equivalent to RenameAt, but takes renameat2(2) flags.
+	// Only RENAME_NOREPLACE and RENAME_EXCHANGE are supported.
+	//
+	// On the server, RenameAt2 has a global concurrency guarantee.
+	RenameAt2(oldName string, newDir File, newName string, flags uint32) error
+
 	// UnlinkAt the given named file.
 	//
 	// name must be a file relative to this directory.
@@ -279,6 +345,35 @@ type File interface {
 	Renamed(newDir File, newName string)
 }
 
+// CancellableFile is implemented by client-side Files whose reads and writes
+// can be cancelled while waiting for the server.
+type CancellableFile interface {
+	// ReadAtCancellable is equivalent to File.ReadAt, except that if cancel
+	// becomes ready before the server responds, the outstanding request is
+	// flushed. If the server completed the request anyway, its result is
+	// returned; otherwise, ReadAtCancellable returns EINTR along with the
+	// number of bytes read before cancellation.
+	ReadAtCancellable(p []byte, offset uint64, cancel <-chan struct{}) (int, error)
+
+	// WriteAtCancellable is equivalent to File.WriteAt, with cancellation
+	// as for ReadAtCancellable.
+	WriteAtCancellable(p []byte, offset uint64, cancel <-chan struct{}) (int, error)
+}
+
+// MultiWalker is implemented by client-side Files that can walk multiple path
+// components in a single round trip.
+type MultiWalker interface {
+	// MultiWalk walks each of names in turn, starting from this File, and
+	// returns a new File and attributes for each component walked. At most
+	// MaxWalkElements names may be walked.
+	//
+	// If walking any name after the first fails, MultiWalk returns the
+	// Files and attributes for the preceding names and a nil error.
+	//
+	// MultiWalk returns ENOSYS if the server does not support it.
+	MultiWalk(names []string) ([]File, []FullStat, error)
+}
+
 // DefaultWalkGetAttr implements File.WalkGetAttr to return ENOSYS for server-side Files.
 type DefaultWalkGetAttr struct{}
 
@@ -23,6 +23,7 @@ import (
 	"sync/atomic"
 	"syscall"
 
+	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/fd"
 	"gvisor.dev/gvisor/pkg/log"
 )
@@ -79,10 +80,13 @@ func (t *Tversion) handle(cs *connState) message {
 	if t.MSize == 0 {
 		return newErr(syscall.EINVAL)
 	}
-	if t.MSize > maximumLength {
-		return newErr(syscall.EINVAL)
+	// From Tversion(9P): "The server responds with its own maximum, msize,
+	// which must be less than or equal to the client's value."
+	msize := t.MSize
+	if msize > maximumLength {
+		msize = maximumLength
 	}
-	atomic.StoreUint32(&cs.messageSize, t.MSize)
+	atomic.StoreUint32(&cs.messageSize, msize)
 	requested, ok := parseVersion(t.Version)
 	if !ok {
 		return newErr(syscall.EINVAL)
@@ -96,7 +100,7 @@ func (t *Tversion) handle(cs *connState) message {
 	// string, or a version string identifying an earlier defined protocol version".
 	atomic.StoreUint32(&cs.version, requested)
 	return &Rversion{
-		MSize:   t.MSize,
+		MSize:   msize,
 		Version: t.Version,
 	}
 }
@@ -511,6 +515,68 @@ func (t *Trenameat) handle(cs *connState) message {
 	return &Rrenameat{}
 }
 
+// handle implements handler.handle.
+func (t *Trenameat2) handle(cs *connState) message {
+	if err := checkSafeName(t.OldName); err != nil {
+		return newErr(err)
+	}
+	if err := checkSafeName(t.NewName); err != nil {
+		return newErr(err)
+	}
+
+	// Only RENAME_NOREPLACE and RENAME_EXCHANGE are supported, and they are
+	// mutually exclusive.
+	exchange := t.Flags&unix.RENAME_EXCHANGE != 0
+	if t.Flags&^(unix.RENAME_NOREPLACE|unix.RENAME_EXCHANGE) != 0 || (exchange && t.Flags&unix.RENAME_NOREPLACE != 0) {
+		return newErr(syscall.EINVAL)
+	}
+
+	ref, ok := cs.LookupFID(t.OldDirectory)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	refTarget, ok := cs.LookupFID(t.NewDirectory)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer refTarget.DecRef()
+
+	// Perform the rename holding the global lock.
+	if err := ref.safelyGlobal(func() (err error) {
+		// Don't allow renaming across deleted directories.
+		if ref.isDeleted() || !ref.mode.IsDir() || refTarget.isDeleted() || !refTarget.mode.IsDir() {
+			return syscall.EINVAL
+		}
+
+		// Not allowed on open directories.
+		if _, opened := ref.OpenFlags(); opened {
+			return syscall.EINVAL
+		}
+
+		// Attempt the actual rename.
+		if err := ref.file.RenameAt2(t.OldName, refTarget.file, t.NewName, t.Flags); err != nil {
+			return err
+		}
+
+		// Update the path tree.
+		if ref.pathNode == refTarget.pathNode && t.OldName == t.NewName {
+			return nil
+		}
+		if exchange {
+			ref.exchangeChildWith(t.OldName, refTarget, t.NewName)
+		} else {
+			ref.renameChildTo(t.OldName, refTarget, t.NewName)
+		}
+		return nil
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rrenameat2{}
+}
+
 // handle implements handler.handle.
 func (t *Tunlinkat) handle(cs *connState) message {
 	if err := checkSafeName(t.Name); err != nil {
@@ -831,6 +897,37 @@ func (t *Tgetattr) handle(cs *connState) message {
 	return &Rgetattr{QID: qid, Valid: valid, Attr: attr}
 }
 
+// handle implements handler.handle.
+func (t *Tgetattrs) handle(cs *connState) message {
+	for _, name := range t.Names {
+		if err := checkSafeName(name); err != nil {
+			return newErr(err)
+		}
+	}
+
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	var stats []FullStat
+	if err := ref.safelyRead(func() (err error) {
+		if !ref.mode.IsDir() {
+			return syscall.ENOTDIR
+		}
+		stats, err = ref.file.GetAttrChildren(t.Names, t.AttrMask)
+		return err
+	}); err != nil {
+		return newErr(err)
+	}
+	if len(stats) != len(t.Names) {
+		return newErr(syscall.EIO)
+	}
+
+	return &Rgetattrs{Stats: stats}
+}
+
 // handle implements handler.handle.
 func (t *Tsetattr) handle(cs *connState) message {
 	ref, ok := cs.LookupFID(t.FID)
@@ -857,6 +954,66 @@ func (t *Tsetattr) handle(cs *connState) message {
 	return &Rsetattr{}
 }
 
+// handle implements handler.handle.
+func (t *Tgetino) handle(cs *connState) message {
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	var ino uint64
+	if err := ref.safelyRead(func() (err error) {
+		ino, err = ref.file.GetIno()
+		return err
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rgetino{Ino: ino}
+}
+
+// handle implements handler.handle.
+func (t *Tgetflags) handle(cs *connState) message {
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	var flags uint32
+	if err := ref.safelyRead(func() (err error) {
+		flags, err = ref.file.GetFlags()
+		return err
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rgetflags{Flags: flags}
+}
+
+// handle implements handler.handle.
+func (t *Tsetflags) handle(cs *connState) message {
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	if err := ref.safelyWrite(func() error {
+		// As for Tsetattr, we don't allow changing the inode flags of
+		// deleted files.
+		if ref.isDeleted() {
+			return syscall.EINVAL
+		}
+		return ref.file.SetFlags(t.Flags)
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rsetflags{}
+}
+
 // handle implements handler.handle.
 func (t *Tallocate) handle(cs *connState) message {
 	ref, ok := cs.LookupFID(t.FID)
@@ -890,6 +1047,114 @@ func (t *Tallocate) handle(cs *connState) message {
 	return &Rallocate{}
 }
 
+// handle implements handler.handle.
+func (t *Tseek) handle(cs *connState) message {
+	if t.Whence != SeekData && t.Whence != SeekHole {
+		return newErr(syscall.EINVAL)
+	}
+
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	var offset uint64
+	if err := ref.safelyRead(func() (err error) {
+		// Has it been opened already?
+		if _, opened := ref.OpenFlags(); !opened {
+			return syscall.EINVAL
+		}
+
+		offset, err = ref.file.Seek(t.Offset, t.Whence)
+		return err
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rseek{Offset: offset}
+}
+
+// handle implements handler.handle.
+func (t *Tcopyrange) handle(cs *connState) message {
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	refDst, ok := cs.LookupFID(t.DstFID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer refDst.DecRef()
+
+	var count uint64
+	if err := ref.safelyRead(func() (err error) {
+		// Have both files been opened, with the right permissions?
+		openFlags, opened := ref.OpenFlags()
+		if !opened {
+			return syscall.EINVAL
+		}
+		if openFlags&OpenFlagsModeMask == WriteOnly {
+			return syscall.EPERM
+		}
+		dstOpenFlags, opened := refDst.OpenFlags()
+		if !opened {
+			return syscall.EINVAL
+		}
+		if dstOpenFlags&OpenFlagsModeMask == ReadOnly {
+			return syscall.EPERM
+		}
+
+		count, err = ref.file.CopyRange(t.Offset, refDst.file, t.DstOffset, t.Length)
+		return err
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rcopyrange{Count: count}
+}
+
+// handle implements handler.handle.
+func (t *Tclonerange) handle(cs *connState) message {
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	refDst, ok := cs.LookupFID(t.DstFID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer refDst.DecRef()
+
+	if err := ref.safelyRead(func() error {
+		// Have both files been opened, with the right permissions?
+		openFlags, opened := ref.OpenFlags()
+		if !opened {
+			return syscall.EINVAL
+		}
+		if openFlags&OpenFlagsModeMask == WriteOnly {
+			return syscall.EPERM
+		}
+		dstOpenFlags, opened := refDst.OpenFlags()
+		if !opened {
+			return syscall.EINVAL
+		}
+		if dstOpenFlags&OpenFlagsModeMask == ReadOnly {
+			return syscall.EPERM
+		}
+
+		return ref.file.CloneRange(t.Offset, refDst.file, t.DstOffset, t.Length)
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rclonerange{}
+}
+
 // handle implements handler.handle.
 func (t *Txattrwalk) handle(cs *connState) message {
 	ref, ok := cs.LookupFID(t.FID)
@@ -936,6 +1201,39 @@ func (t *Tgetxattr) handle(cs *connState) message {
 	return &Rgetxattr{Value: val}
 }
 
+// handle implements handler.handle.
+func (t *Treadxattr) handle(cs *connState) message {
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	var val string
+	if err := ref.safelyRead(func() (err error) {
+		// Don't allow getxattr on files that have been deleted.
+		if ref.isDeleted() {
+			return syscall.EINVAL
+		}
+		val, err = ref.file.GetXattr(t.Name, t.Size)
+		return err
+	}); err != nil {
+		return newErr(err)
+	}
+
+	// Return the requested part of the value, which may be empty.
+	size := uint64(len(val))
+	if t.Offset < size {
+		val = val[t.Offset:]
+	} else {
+		val = ""
+	}
+	if uint64(len(val)) > uint64(t.Count) {
+		val = val[:t.Count]
+	}
+	return &Rreadxattr{Size: size, Data: []byte(val)}
+}
+
 // handle implements handler.handle.
 func (t *Tsetxattr) handle(cs *connState) message {
 	ref, ok := cs.LookupFID(t.FID)
@@ -1059,6 +1357,29 @@ func (t *Tfsync) handle(cs *connState) message {
 	return &Rfsync{}
 }
 
+// handle implements handler.handle.
+func (t *Tfdatasync) handle(cs *connState) message {
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+	defer ref.DecRef()
+
+	if err := ref.safelyRead(func() (err error) {
+		// Has it been opened already?
+		if _, opened := ref.OpenFlags(); !opened {
+			return syscall.EINVAL
+		}
+
+		// Perform the sync.
+		return ref.file.FDataSync()
+	}); err != nil {
+		return newErr(err)
+	}
+
+	return &Rfdatasync{}
+}
+
 // handle implements handler.handle.
 func (t *Tstatfs) handle(cs *connState) message {
 	ref, ok := cs.LookupFID(t.FID)
@@ -1289,6 +1610,43 @@ func (t *Twalkgetattr) handle(cs *connState) message {
 	return &Rwalkgetattr{QIDs: qids, Valid: valid, Attr: attr}
 }
 
+// handle implements handler.handle.
+func (t *Tmultiwalk) handle(cs *connState) message {
+	if len(t.NewFIDs) != len(t.Names) || len(t.Names) > MaxWalkElements {
+		return newErr(syscall.EINVAL)
+	}
+
+	ref, ok := cs.LookupFID(t.FID)
+	if !ok {
+		return newErr(syscall.EBADF)
+	}
+
+	stats := make([]FullStat, 0, len(t.Names))
+	for i, name := range t.Names {
+		// Walk one name at a time, so that each component gets its own FID.
+		qids, newRef, valid, attr, err := doWalk(cs, ref, []string{name}, true)
+		ref.DecRef()
+		if err != nil {
+			if i == 0 {
+				return newErr(err)
+			}
+			// Return the components that were walked successfully.
+			return &Rmultiwalk{Stats: stats}
+		}
+
+		// Install the new FID.
+		cs.InsertFID(t.NewFIDs[i], newRef)
+		stats = append(stats, FullStat{
+			QID:   qids[0],
+			Valid: valid,
+			Attr:  attr,
+		})
+		ref = newRef
+	}
+	ref.DecRef()
+	return &Rmultiwalk{Stats: stats}
+}
+
 // handle implements handler.handle.
 func (t *Tucreate) handle(cs *connState) message {
 	rlcreate, err := t.Tlcreate.do(cs, t.UID)
@@ -820,6 +820,76 @@ func (r *Rrenameat) String() string {
 	return "Rrenameat{}"
 }
 
+// Trenameat2 is a rename request with flags, as for renameat2(2). This is an
+// extension to 9P protocol, not present in the 9P2000.L standard.
+type Trenameat2 struct {
+	// OldDirectory is the source directory.
+	OldDirectory FID
+
+	// OldName is the source file name.
+	OldName string
+
+	// NewDirectory is the target directory.
+	NewDirectory FID
+
+	// NewName is the new file name.
+	NewName string
+
+	// Flags are the renameat2(2) flags; only RENAME_NOREPLACE and
+	// RENAME_EXCHANGE are supported.
+	Flags uint32
+}
+
+// decode implements encoder.decode.
+func (t *Trenameat2) decode(b *buffer) {
+	t.OldDirectory = b.ReadFID()
+	t.OldName = b.ReadString()
+	t.NewDirectory = b.ReadFID()
+	t.NewName = b.ReadString()
+	t.Flags = b.Read32()
+}
+
+// encode implements encoder.encode.
+func (t *Trenameat2) encode(b *buffer) {
+	b.WriteFID(t.OldDirectory)
+	b.WriteString(t.OldName)
+	b.WriteFID(t.NewDirectory)
+	b.WriteString(t.NewName)
+	b.Write32(t.Flags)
+}
+
+// Type implements message.Type.
+func (*Trenameat2) Type() MsgType {
+	return MsgTrenameat2
+}
+
+// String implements fmt.Stringer.
+func (t *Trenameat2) String() string {
+	return fmt.Sprintf("Trenameat2{OldDirectoryFID: %d, OldName: %s, NewDirectoryFID: %d, NewName: %s, Flags: %#x}", t.OldDirectory, t.OldName, t.NewDirectory, t.NewName, t.Flags)
+}
+
+// Rrenameat2 is a renameat2 response.
+type Rrenameat2 struct {
+}
+
+// decode implements encoder.decode.
+func (*Rrenameat2) decode(*buffer) {
+}
+
+// encode implements encoder.encode.
+func (*Rrenameat2) encode(*buffer) {
+}
+
+// Type implements message.Type.
+func (*Rrenameat2) Type() MsgType {
+	return MsgRrenameat2
+}
+
+// String implements fmt.Stringer.
+func (r *Rrenameat2) String() string {
+	return "Rrenameat2{}"
+}
+
 // Tunlinkat is an unlink request.
 type Tunlinkat struct {
 	// Directory is the originating directory.
@@ -1483,6 +1553,267 @@ func (r *Rallocate) String() string {
 	return "Rallocate{}"
 }
 
+// Tseek is a request for the offset of the next data or hole in a file. This
+// is an extension to 9P protocol, not present in the 9P2000.L standard.
+type Tseek struct {
+	FID    FID
+	Offset uint64
+	Whence SeekWhence
+}
+
+// decode implements encoder.decode.
+func (t *Tseek) decode(b *buffer) {
+	t.FID = b.ReadFID()
+	t.Offset = b.Read64()
+	t.Whence = SeekWhence(b.Read32())
+}
+
+// encode implements encoder.encode.
+func (t *Tseek) encode(b *buffer) {
+	b.WriteFID(t.FID)
+	b.Write64(t.Offset)
+	b.Write32(uint32(t.Whence))
+}
+
+// Type implements message.Type.
+func (*Tseek) Type() MsgType {
+	return MsgTseek
+}
+
+// String implements fmt.Stringer.
+func (t *Tseek) String() string {
+	return fmt.Sprintf("Tseek{FID: %d, Offset: %d, Whence: %v}", t.FID, t.Offset, t.Whence)
+}
+
+// Rseek is a seek response.
+type Rseek struct {
+	Offset uint64
+}
+
+// decode implements encoder.decode.
+func (r *Rseek) decode(b *buffer) {
+	r.Offset = b.Read64()
+}
+
+// encode implements encoder.encode.
+func (r *Rseek) encode(b *buffer) {
+	b.Write64(r.Offset)
+}
+
+// Type implements message.Type.
+func (*Rseek) Type() MsgType {
+	return MsgRseek
+}
+
+// String implements fmt.Stringer.
+func (r *Rseek) String() string {
+	return fmt.Sprintf("Rseek{Offset: %d}", r.Offset)
+}
+
+// Tgetattrs is a request for the attributes of several children of a
+// directory. This is an extension to 9P protocol, not present in the 9P2000.L
+// standard.
+type Tgetattrs struct {
+	// FID is the directory.
+	FID FID
+
+	// Names are the names of the children.
+	Names []string
+
+	// AttrMask is the set of attributes to get.
+	AttrMask AttrMask
+}
+
+// decode implements encoder.decode.
+func (t *Tgetattrs) decode(b *buffer) {
+	t.FID = b.ReadFID()
+	n := b.Read16()
+	t.Names = t.Names[:0]
+	for i := 0; i < int(n); i++ {
+		t.Names = append(t.Names, b.ReadString())
+	}
+	t.AttrMask.decode(b)
+}
+
+// encode implements encoder.encode.
+func (t *Tgetattrs) encode(b *buffer) {
+	b.WriteFID(t.FID)
+	b.Write16(uint16(len(t.Names)))
+	for _, name := range t.Names {
+		b.WriteString(name)
+	}
+	t.AttrMask.encode(b)
+}
+
+// Type implements message.Type.
+func (*Tgetattrs) Type() MsgType {
+	return MsgTgetattrs
+}
+
+// String implements fmt.Stringer.
+func (t *Tgetattrs) String() string {
+	return fmt.Sprintf("Tgetattrs{FID: %d, Names: %v, AttrMask: %s}", t.FID, t.Names, t.AttrMask)
+}
+
+// Rgetattrs is a getattrs response.
+type Rgetattrs struct {
+	// Stats contains one entry for each name in the request, in order.
+	Stats []FullStat
+}
+
+// decode implements encoder.decode.
+func (r *Rgetattrs) decode(b *buffer) {
+	n := b.Read16()
+	r.Stats = r.Stats[:0]
+	for i := 0; i < int(n); i++ {
+		var s FullStat
+		s.decode(b)
+		r.Stats = append(r.Stats, s)
+	}
+}
+
+// encode implements encoder.encode.
+func (r *Rgetattrs) encode(b *buffer) {
+	b.Write16(uint16(len(r.Stats)))
+	for i := range r.Stats {
+		r.Stats[i].encode(b)
+	}
+}
+
+// Type implements message.Type.
+func (*Rgetattrs) Type() MsgType {
+	return MsgRgetattrs
+}
+
+// String implements fmt.Stringer.
+func (r *Rgetattrs) String() string {
+	return fmt.Sprintf("Rgetattrs{Stats: %v}", r.Stats)
+}
+
+// Tcopyrange is a request to copy data between two open files on the server,
+// as for copy_file_range(2). This is an extension to 9P protocol, not present
+// in the 9P2000.L standard.
+type Tcopyrange struct {
+	// FID is the file to copy from.
+	FID FID
+
+	// Offset is the offset in FID to copy from.
+	Offset uint64
+
+	// DstFID is the file to copy to.
+	DstFID FID
+
+	// DstOffset is the offset in DstFID to copy to.
+	DstOffset uint64
+
+	// Length is the maximum number of bytes to copy.
+	Length uint64
+}
+
+// decode implements encoder.decode.
+func (t *Tcopyrange) decode(b *buffer) {
+	t.FID = b.ReadFID()
+	t.Offset = b.Read64()
+	t.DstFID = b.ReadFID()
+	t.DstOffset = b.Read64()
+	t.Length = b.Read64()
+}
+
+// encode implements encoder.encode.
+func (t *Tcopyrange) encode(b *buffer) {
+	b.WriteFID(t.FID)
+	b.Write64(t.Offset)
+	b.WriteFID(t.DstFID)
+	b.Write64(t.DstOffset)
+	b.Write64(t.Length)
+}
+
+// Type implements message.Type.
+func (*Tcopyrange) Type() MsgType {
+	return MsgTcopyrange
+}
+
+// String implements fmt.Stringer.
+func (t *Tcopyrange) String() string {
+	return fmt.Sprintf("Tcopyrange{FID: %d, Offset: %d, DstFID: %d, DstOffset: %d, Length: %d}", t.FID, t.Offset, t.DstFID, t.DstOffset, t.Length)
+}
+
+// Rcopyrange is a copyrange response.
+type Rcopyrange struct {
+	// Count is the number of bytes copied.
+	Count uint64
+}
+
+// decode implements encoder.decode.
+func (r *Rcopyrange) decode(b *buffer) {
+	r.Count = b.Read64()
+}
+
+// encode implements encoder.encode.
+func (r *Rcopyrange) encode(b *buffer) {
+	b.Write64(r.Count)
+}
+
+// Type implements message.Type.
+func (*Rcopyrange) Type() MsgType {
+	return MsgRcopyrange
+}
+
+// String implements fmt.Stringer.
+func (r *Rcopyrange) String() string {
+	return fmt.Sprintf("Rcopyrange{Count: %d}", r.Count)
+}
+
+// Tfdatasync is a request to sync an open file's data, and only the metadata
+// required to retrieve it, as for fdatasync(2). This is an extension to 9P
+// protocol, not present in the 9P2000.L standard.
+type Tfdatasync struct {
+	// FID is the fid to sync.
+	FID FID
+}
+
+// decode implements encoder.decode.
+func (t *Tfdatasync) decode(b *buffer) {
+	t.FID = b.ReadFID()
+}
+
+// encode implements encoder.encode.
+func (t *Tfdatasync) encode(b *buffer) {
+	b.WriteFID(t.FID)
+}
+
+// Type implements message.Type.
+func (*Tfdatasync) Type() MsgType {
+	return MsgTfdatasync
+}
+
+// String implements fmt.Stringer.
+func (t *Tfdatasync) String() string {
+	return fmt.Sprintf("Tfdatasync{FID: %d}", t.FID)
+}
+
+// Rfdatasync is an fdatasync response.
+type Rfdatasync struct {
+}
+
+// decode implements encoder.decode.
+func (*Rfdatasync) decode(*buffer) {
+}
+
+// encode implements encoder.encode.
+func (*Rfdatasync) encode(*buffer) {
+}
+
+// Type implements message.Type.
+func (*Rfdatasync) Type() MsgType {
+	return MsgRfdatasync
+}
+
+// String implements fmt.Stringer.
+func (r *Rfdatasync) String() string {
+	return "Rfdatasync{}"
+}
+
 // Tlistxattr is a listxattr request.
 type Tlistxattr struct {
 	// FID refers to the file on which to list xattrs.
@@ -1737,6 +2068,340 @@ func (r *Rgetxattr) String() string {
 	return fmt.Sprintf("Rgetxattr{Value: %s}", r.Value)
 }
 
+// Treadxattr is a request to read part of an extended attribute's value. This
+// is an extension to 9P protocol, not present in the 9P2000.L standard.
+type Treadxattr struct {
+	// FID refers to the file for which to get xattrs.
+	FID FID
+
+	// Name is the xattr to get.
+	Name string
+
+	// Size is the buffer size for the whole xattr value, as for Tgetxattr.
+	Size uint64
+
+	// Offset is the offset into the xattr value at which to start reading.
+	Offset uint64
+
+	// Count is the maximum number of bytes of the value to return.
+	Count uint32
+}
+
+// decode implements encoder.decode.
+func (t *Treadxattr) decode(b *buffer) {
+	t.FID = b.ReadFID()
+	t.Name = b.ReadString()
+	t.Size = b.Read64()
+	t.Offset = b.Read64()
+	t.Count = b.Read32()
+}
+
+// encode implements encoder.encode.
+func (t *Treadxattr) encode(b *buffer) {
+	b.WriteFID(t.FID)
+	b.WriteString(t.Name)
+	b.Write64(t.Size)
+	b.Write64(t.Offset)
+	b.Write32(t.Count)
+}
+
+// Type implements message.Type.
+func (*Treadxattr) Type() MsgType {
+	return MsgTreadxattr
+}
+
+// String implements fmt.Stringer.
+func (t *Treadxattr) String() string {
+	return fmt.Sprintf("Treadxattr{FID: %d, Name: %s, Size: %d, Offset: %d, Count: %d}", t.FID, t.Name, t.Size, t.Offset, t.Count)
+}
+
+// Rreadxattr is a readxattr response.
+type Rreadxattr struct {
+	// Size is the length of the whole xattr value.
+	Size uint64
+
+	// Data is the part of the value starting at the requested offset.
+	Data []byte
+}
+
+// decode implements encoder.decode.
+//
+// Data is automatically decoded via Payload.
+func (r *Rreadxattr) decode(b *buffer) {
+	r.Size = b.Read64()
+	count := b.Read32()
+	if count != uint32(len(r.Data)) {
+		b.markOverrun()
+	}
+}
+
+// encode implements encoder.encode.
+//
+// Data is automatically encoded via Payload.
+func (r *Rreadxattr) encode(b *buffer) {
+	b.Write64(r.Size)
+	b.Write32(uint32(len(r.Data)))
+}
+
+// Type implements message.Type.
+func (*Rreadxattr) Type() MsgType {
+	return MsgRreadxattr
+}
+
+// FixedSize implements payloader.FixedSize.
+func (*Rreadxattr) FixedSize() uint32 {
+	return 12
+}
+
+// Payload implements payloader.Payload.
+func (r *Rreadxattr) Payload() []byte {
+	return r.Data
+}
+
+// SetPayload implements payloader.SetPayload.
+func (r *Rreadxattr) SetPayload(p []byte) {
+	r.Data = p
+}
+
+// String implements fmt.Stringer.
+func (r *Rreadxattr) String() string {
+	return fmt.Sprintf("Rreadxattr{Size: %d, len(Data): %d}", r.Size, len(r.Data))
+}
+
+// Tclonerange is a request to share the data of a range of one open file with
+// another open file on the server, as for ioctl(FICLONERANGE). This is an
+// extension to 9P protocol, not present in the 9P2000.L standard.
+type Tclonerange struct {
+	// FID is the file to clone from.
+	FID FID
+
+	// Offset is the offset in FID to clone from.
+	Offset uint64
+
+	// DstFID is the file to clone to.
+	DstFID FID
+
+	// DstOffset is the offset in DstFID to clone to.
+	DstOffset uint64
+
+	// Length is the number of bytes to clone. If Length is 0, all bytes from
+	// Offset to the end of FID are cloned.
+	Length uint64
+}
+
+// decode implements encoder.decode.
+func (t *Tclonerange) decode(b *buffer) {
+	t.FID = b.ReadFID()
+	t.Offset = b.Read64()
+	t.DstFID = b.ReadFID()
+	t.DstOffset = b.Read64()
+	t.Length = b.Read64()
+}
+
+// encode implements encoder.encode.
+func (t *Tclonerange) encode(b *buffer) {
+	b.WriteFID(t.FID)
+	b.Write64(t.Offset)
+	b.WriteFID(t.DstFID)
+	b.Write64(t.DstOffset)
+	b.Write64(t.Length)
+}
+
+// Type implements message.Type.
+func (*Tclonerange) Type() MsgType {
+	return MsgTclonerange
+}
+
+// String implements fmt.Stringer.
+func (t *Tclonerange) String() string {
+	return fmt.Sprintf("Tclonerange{FID: %d, Offset: %d, DstFID: %d, DstOffset: %d, Length: %d}", t.FID, t.Offset, t.DstFID, t.DstOffset, t.Length)
+}
+
+// Rclonerange is a clonerange response.
+type Rclonerange struct {
+}
+
+// decode implements encoder.decode.
+func (*Rclonerange) decode(*buffer) {
+}
+
+// encode implements encoder.encode.
+func (*Rclonerange) encode(*buffer) {
+}
+
+// Type implements message.Type.
+func (*Rclonerange) Type() MsgType {
+	return MsgRclonerange
+}
+
+// String implements fmt.Stringer.
+func (r *Rclonerange) String() string {
+	return "Rclonerange{}"
+}
+
+// Tgetino is a request to get the inode number of a file in the server's
+// backing filesystem. This is an extension to 9P protocol, not present in the
+// 9P2000.L standard.
+type Tgetino struct {
+	// FID is the FID to get the inode number of.
+	FID FID
+}
+
+// decode implements encoder.decode.
+func (t *Tgetino) decode(b *buffer) {
+	t.FID = b.ReadFID()
+}
+
+// encode implements encoder.encode.
+func (t *Tgetino) encode(b *buffer) {
+	b.WriteFID(t.FID)
+}
+
+// Type implements message.Type.
+func (*Tgetino) Type() MsgType {
+	return MsgTgetino
+}
+
+// String implements fmt.Stringer.
+func (t *Tgetino) String() string {
+	return fmt.Sprintf("Tgetino{FID: %d}", t.FID)
+}
+
+// Rgetino is a getino response.
+type Rgetino struct {
+	// Ino is the file's inode number in the server's backing filesystem.
+	Ino uint64
+}
+
+// decode implements encoder.decode.
+func (r *Rgetino) decode(b *buffer) {
+	r.Ino = b.Read64()
+}
+
+// encode implements encoder.encode.
+func (r *Rgetino) encode(b *buffer) {
+	b.Write64(r.Ino)
+}
+
+// Type implements message.Type.
+func (*Rgetino) Type() MsgType {
+	return MsgRgetino
+}
+
+// String implements fmt.Stringer.
+func (r *Rgetino) String() string {
+	return fmt.Sprintf("Rgetino{Ino: %d}", r.Ino)
+}
+
+// Tgetflags is a request to get the inode flags of a file, as for
+// ioctl(FS_IOC_GETFLAGS). This is an extension to 9P protocol, not present in
+// the 9P2000.L standard.
+type Tgetflags struct {
+	// FID is the FID to get flags for.
+	FID FID
+}
+
+// decode implements encoder.decode.
+func (t *Tgetflags) decode(b *buffer) {
+	t.FID = b.ReadFID()
+}
+
+// encode implements encoder.encode.
+func (t *Tgetflags) encode(b *buffer) {
+	b.WriteFID(t.FID)
+}
+
+// Type implements message.Type.
+func (*Tgetflags) Type() MsgType {
+	return MsgTgetflags
+}
+
+// String implements fmt.Stringer.
+func (t *Tgetflags) String() string {
+	return fmt.Sprintf("Tgetflags{FID: %d}", t.FID)
+}
+
+// Rgetflags is a getflags response.
+type Rgetflags struct {
+	// Flags are the file's inode flags (linux.FS_*_FL).
+	Flags uint32
+}
+
+// decode implements encoder.decode.
+func (r *Rgetflags) decode(b *buffer) {
+	r.Flags = b.Read32()
+}
+
+// encode implements encoder.encode.
+func (r *Rgetflags) encode(b *buffer) {
+	b.Write32(r.Flags)
+}
+
+// Type implements message.Type.
+func (*Rgetflags) Type() MsgType {
+	return MsgRgetflags
+}
+
+// String implements fmt.Stringer.
+func (r *Rgetflags) String() string {
+	return fmt.Sprintf("Rgetflags{Flags: %#x}", r.Flags)
+}
+
+// Tsetflags is a request to set the inode flags of a file, as for
+// ioctl(FS_IOC_SETFLAGS). This is an extension to 9P protocol, not present in
+// the 9P2000.L standard.
+type Tsetflags struct {
+	// FID is the FID to set flags for.
+	FID FID
+
+	// Flags are the new inode flags (linux.FS_*_FL).
+	Flags uint32
+}
+
+// decode implements encoder.decode.
+func (t *Tsetflags) decode(b *buffer) {
+	t.FID = b.ReadFID()
+	t.Flags = b.Read32()
+}
+
+// encode implements encoder.encode.
+func (t *Tsetflags) encode(b *buffer) {
+	b.WriteFID(t.FID)
+	b.Write32(t.Flags)
+}
+
+// Type implements message.Type.
+func (*Tsetflags) Type() MsgType {
+	return MsgTsetflags
+}
+
+// String implements fmt.Stringer.
+func (t *Tsetflags) String() string {
+	return fmt.Sprintf("Tsetflags{FID: %d, Flags: %#x}", t.FID, t.Flags)
+}
+
+// Rsetflags is a setflags response.
+type Rsetflags struct {
+}
+
+// decode implements encoder.decode.
+func (*Rsetflags) decode(*buffer) {
+}
+
+// encode implements encoder.encode.
+func (*Rsetflags) encode(*buffer) {
+}
+
+// Type implements message.Type.
+func (*Rsetflags) Type() MsgType {
+	return MsgRsetflags
+}
+
+// String implements fmt.Stringer.
+func (r *Rsetflags) String() string {
+	return "Rsetflags{}"
+}
+
 // Tsetxattr sets extended attributes.
 type Tsetxattr struct {
 	// FID refers to the file on which to set xattrs.
@@ -2200,6 +2865,96 @@ func (r *Rwalkgetattr) String() string {
 	return fmt.Sprintf("Rwalkgetattr{Valid: %s, Attr: %s, QIDs: %v}", r.Valid, r.Attr, r.QIDs)
 }
 
+// Tmultiwalk is a request to walk multiple path components, returning a new
+// FID and attributes for each component walked. This is an extension to 9P
+// protocol, not present in the 9P2000.L standard.
+type Tmultiwalk struct {
+	// FID is the FID to be walked.
+	FID FID
+
+	// NewFIDs are the resulting FIDs, one for each name in Names.
+	NewFIDs []FID
+
+	// Names are the set of names to be walked.
+	Names []string
+}
+
+// decode implements encoder.decode.
+func (t *Tmultiwalk) decode(b *buffer) {
+	t.FID = b.ReadFID()
+	n := b.Read16()
+	t.NewFIDs = t.NewFIDs[:0]
+	for i := 0; i < int(n); i++ {
+		t.NewFIDs = append(t.NewFIDs, b.ReadFID())
+	}
+	n = b.Read16()
+	t.Names = t.Names[:0]
+	for i := 0; i < int(n); i++ {
+		t.Names = append(t.Names, b.ReadString())
+	}
+}
+
+// encode implements encoder.encode.
+func (t *Tmultiwalk) encode(b *buffer) {
+	b.WriteFID(t.FID)
+	b.Write16(uint16(len(t.NewFIDs)))
+	for _, fid := range t.NewFIDs {
+		b.WriteFID(fid)
+	}
+	b.Write16(uint16(len(t.Names)))
+	for _, name := range t.Names {
+		b.WriteString(name)
+	}
+}
+
+// Type implements message.Type.
+func (*Tmultiwalk) Type() MsgType {
+	return MsgTmultiwalk
+}
+
+// String implements fmt.Stringer.
+func (t *Tmultiwalk) String() string {
+	return fmt.Sprintf("Tmultiwalk{FID: %d, NewFIDs: %v, Names: %v}", t.FID, t.NewFIDs, t.Names)
+}
+
+// Rmultiwalk is a multiwalk response.
+type Rmultiwalk struct {
+	// Stats contains one entry for each name successfully walked, in order.
+	// If fewer entries are returned than names were requested, walking the
+	// following name failed, and only the FIDs corresponding to returned
+	// entries are valid.
+	Stats []FullStat
+}
+
+// decode implements encoder.decode.
+func (r *Rmultiwalk) decode(b *buffer) {
+	n := b.Read16()
+	r.Stats = r.Stats[:0]
+	for i := 0; i < int(n); i++ {
+		var s FullStat
+		s.decode(b)
+		r.Stats = append(r.Stats, s)
+	}
+}
+
+// encode implements encoder.encode.
+func (r *Rmultiwalk) encode(b *buffer) {
+	b.Write16(uint16(len(r.Stats)))
+	for i := range r.Stats {
+		r.Stats[i].encode(b)
+	}
+}
+
+// Type implements message.Type.
+func (*Rmultiwalk) Type() MsgType {
+	return MsgRmultiwalk
+}
+
+// String implements fmt.Stringer.
+func (r *Rmultiwalk) String() string {
+	return fmt.Sprintf("Rmultiwalk{Stats: %v}", r.Stats)
+}
+
 // Tucreate is a Tlcreate message that includes a UID.
 type Tucreate struct {
 	Tlcreate
@@ -2657,6 +3412,28 @@ func init() {
 	msgRegistry.register(MsgRlconnect, func() message { return &Rlconnect{} })
 	msgRegistry.register(MsgTallocate, func() message { return &Tallocate{} })
 	msgRegistry.register(MsgRallocate, func() message { return &Rallocate{} })
+	msgRegistry.register(MsgTseek, func() message { return &Tseek{} })
+	msgRegistry.register(MsgRseek, func() message { return &Rseek{} })
+	msgRegistry.register(MsgTgetattrs, func() message { return &Tgetattrs{} })
+	msgRegistry.register(MsgRgetattrs, func() message { return &Rgetattrs{} })
+	msgRegistry.register(MsgTcopyrange, func() message { return &Tcopyrange{} })
+	msgRegistry.register(MsgRcopyrange, func() message { return &Rcopyrange{} })
+	msgRegistry.register(MsgTfdatasync, func() message { return &Tfdatasync{} })
+	msgRegistry.register(MsgRfdatasync, func() message { return &Rfdatasync{} })
+	msgRegistry.register(MsgTrenameat2, func() message { return &Trenameat2{} })
+	msgRegistry.register(MsgRrenameat2, func() message { return &Rrenameat2{} })
+	msgRegistry.register(MsgTmultiwalk, func() message { return &Tmultiwalk{} })
+	msgRegistry.register(MsgRmultiwalk, func() message { return &Rmultiwalk{} })
+	msgRegistry.register(MsgTreadxattr, func() message { return &Treadxattr{} })
+	msgRegistry.register(MsgRreadxattr, func() message { return &Rreadxattr{} })
+	msgRegistry.register(MsgTclonerange, func() message { return &Tclonerange{} })
+	msgRegistry.register(MsgRclonerange, func() message { return &Rclonerange{} })
+	msgRegistry.register(MsgTgetflags, func() message { return &Tgetflags{} })
+	msgRegistry.register(MsgRgetflags, func() message { return &Rgetflags{} })
+	msgRegistry.register(MsgTsetflags, func() message { return &Tsetflags{} })
+	msgRegistry.register(MsgRsetflags, func() message { return &Rsetflags{} })
+	msgRegistry.register(MsgTgetino, func() message { return &Tgetino{} })
+	msgRegistry.register(MsgRgetino, func() message { return &Rgetino{} })
 	msgRegistry.register(MsgTchannel, func() message { return &Tchannel{} })
 	msgRegistry.register(MsgRchannel, func() message { return &Rchannel{} })
 }
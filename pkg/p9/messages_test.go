@@ -376,6 +376,93 @@ func TestEncodeDecode(t *testing.T) {
 		&Rumknod{
 			Rmknod{QID: QID{Type: 1}},
 		},
+		&Tseek{
+			FID:    1,
+			Offset: 2,
+			Whence: SeekHole,
+		},
+		&Rseek{
+			Offset: 1,
+		},
+		&Tgetattrs{
+			FID:      1,
+			Names:    []string{"a", "b"},
+			AttrMask: AttrMask{Mode: true},
+		},
+		&Rgetattrs{
+			Stats: []FullStat{
+				{QID: QID{Type: 1}, Valid: AttrMask{Mode: true}, Attr: Attr{Mode: 2}},
+				{},
+			},
+		},
+		&Tcopyrange{
+			FID:       1,
+			Offset:    2,
+			DstFID:    3,
+			DstOffset: 4,
+			Length:    5,
+		},
+		&Rcopyrange{
+			Count: 5,
+		},
+		&Tfdatasync{
+			FID: 1,
+		},
+		&Rfdatasync{},
+		&Trenameat2{
+			OldDirectory: 1,
+			OldName:      "a",
+			NewDirectory: 2,
+			NewName:      "b",
+			Flags:        3,
+		},
+		&Rrenameat2{},
+		&Tmultiwalk{
+			FID:     1,
+			NewFIDs: []FID{2, 3},
+			Names:   []string{"a", "b"},
+		},
+		&Rmultiwalk{
+			Stats: []FullStat{
+				{QID: QID{Type: 1}, Valid: AttrMask{Mode: true}, Attr: Attr{Mode: 2}},
+			},
+		},
+		&Treadxattr{
+			FID:    1,
+			Name:   "a",
+			Size:   2,
+			Offset: 3,
+			Count:  4,
+		},
+		&Rreadxattr{
+			Size: 1,
+			Data: []byte{'a'},
+		},
+		&Tclonerange{
+			FID:       1,
+			Offset:    2,
+			DstFID:    3,
+			DstOffset: 4,
+			Length:    5,
+		},
+		&Rclonerange{},
+		&Tgetflags{
+			FID: 1,
+		},
+		&Rgetflags{
+			Flags: 2,
+		},
+		&Tsetflags{
+			FID:   1,
+			Flags: 2,
+		},
+		&Rsetflags{},
+		&Tgetino{
+			FID: 1,
+		},
+		&Rgetino{
+			Ino: 2,
+		},
 	}
 
 	for _, enc := range objs {
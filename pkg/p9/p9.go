@@ -310,6 +310,10 @@ const (
 	NoGID GID = math.MaxUint32
 )
 
+// MaxWalkElements is the maximum number of names that may be walked by a
+// single walk request (MAXWELEM in Plan 9).
+const MaxWalkElements = 16
+
 // MsgType is a type identifier.
 type MsgType uint8
 
@@ -393,6 +397,28 @@ const (
 	MsgRlconnect            = 137
 	MsgTallocate            = 138
 	MsgRallocate            = 139
+	MsgTseek                = 140
+	MsgRseek                = 141
+	MsgTgetattrs            = 142
+	MsgRgetattrs            = 143
+	MsgTcopyrange           = 144
+	MsgRcopyrange           = 145
+	MsgTfdatasync           = 146
+	MsgRfdatasync           = 147
+	MsgTrenameat2           = 148
+	MsgRrenameat2           = 149
+	MsgTmultiwalk           = 150
+	MsgRmultiwalk           = 151
+	MsgTreadxattr           = 152
+	MsgRreadxattr           = 153
+	MsgTclonerange          = 154
+	MsgRclonerange          = 155
+	MsgTgetflags            = 156
+	MsgRgetflags            = 157
+	MsgTsetflags            = 158
+	MsgRsetflags            = 159
+	MsgTgetino              = 160
+	MsgRgetino              = 161
 	MsgTchannel             = 250
 	MsgRchannel             = 251
 )
@@ -1080,6 +1106,65 @@ func (d *Dirent) encode(b *buffer) {
 	b.WriteString(d.Name)
 }
 
+// FullStat is the attributes of a single file, as returned by
+// p9.File.GetAttrChildren.
+type FullStat struct {
+	// QID is the QID of the file.
+	QID QID
+
+	// Valid indicates which fields of Attr are valid. If Valid is empty, the
+	// file's attributes could not be obtained, e.g. because it does not
+	// exist.
+	Valid AttrMask
+
+	// Attr is the set of attributes.
+	Attr Attr
+}
+
+// String implements fmt.Stringer.
+func (s FullStat) String() string {
+	return fmt.Sprintf("FullStat{QID: %v, Valid: %v, Attr: %s}", s.QID, s.Valid, s.Attr)
+}
+
+// decode implements encoder.decode.
+func (s *FullStat) decode(b *buffer) {
+	s.QID.decode(b)
+	s.Valid.decode(b)
+	s.Attr.decode(b)
+}
+
+// encode implements encoder.encode.
+func (s *FullStat) encode(b *buffer) {
+	s.QID.encode(b)
+	s.Valid.encode(b)
+	s.Attr.encode(b)
+}
+
+// SeekWhence specifies the kind of offset that p9.File.Seek() searches for.
+type SeekWhence uint32
+
+const (
+	// SeekData searches for the next offset containing data, as for
+	// lseek(2)'s SEEK_DATA.
+	SeekData SeekWhence = 3
+
+	// SeekHole searches for the next offset in a hole, as for lseek(2)'s
+	// SEEK_HOLE. The end of the file is considered to be a hole.
+	SeekHole SeekWhence = 4
+)
+
+// String implements fmt.Stringer.
+func (w SeekWhence) String() string {
+	switch w {
+	case SeekData:
+		return "SeekData"
+	case SeekHole:
+		return "SeekHole"
+	default:
+		return fmt.Sprintf("SeekWhence(%d)", uint32(w))
+	}
+}
+
 // AllocateMode are possible modes to p9.File.Allocate().
 type AllocateMode struct {
 	KeepSize      bool
@@ -79,6 +79,10 @@ type connState struct {
 	tagMu sync.Mutex
 	tags  map[Tag]chan struct{}
 
+	// sendingTags is the set of tags that have been cleared, but whose
+	// responses have not yet been sent. sendingTags is protected by tagMu.
+	sendingTags map[Tag]chan struct{}
+
 	// messageSize is the maximum message size. The server does not
 	// do automatic splitting of messages.
 	messageSize uint32
@@ -291,6 +295,44 @@ func (f *fidRef) renameChildTo(oldName string, target *fidRef, newName string) {
 	}
 }
 
+// exchangeChildWith exchanges the child oldName of f with the child newName of
+// target, as for renameat2(RENAME_EXCHANGE).
+//
+// Precondition: this must be called via safelyGlobal.
+func (f *fidRef) exchangeChildWith(oldName string, target *fidRef, newName string) {
+	var oldRefs, newRefs []*fidRef
+	oldPathNode := f.pathNode.removeWithName(oldName, func(ref *fidRef) {
+		oldRefs = append(oldRefs, ref)
+	})
+	newPathNode := target.pathNode.removeWithName(newName, func(ref *fidRef) {
+		newRefs = append(newRefs, ref)
+	})
+
+	move := func(refs []*fidRef, parent *fidRef, name string) {
+		for _, ref := range refs {
+			// N.B. DecRef can take the original parent's parent's childMu.
+			// This is allowed because renameMu is held for write via
+			// safelyGlobal.
+			ref.parent.DecRef() // Drop original reference.
+			ref.parent = parent // Change parent.
+			ref.parent.IncRef() // Acquire new one.
+			parent.pathNode.addChild(ref, name)
+			ref.file.Renamed(parent.file, name)
+		}
+	}
+	move(oldRefs, target, newName)
+	move(newRefs, f, oldName)
+
+	if oldPathNode != nil {
+		target.pathNode.addPathNodeFor(newName, oldPathNode)
+		notifyNameChange(oldPathNode)
+	}
+	if newPathNode != nil {
+		f.pathNode.addPathNodeFor(oldName, newPathNode)
+		notifyNameChange(newPathNode)
+	}
+}
+
 // safelyRead executes the given operation with the local path node locked.
 // This implies that paths will not change during the operation.
 func (f *fidRef) safelyRead(fn func() error) (err error) {
@@ -376,8 +418,9 @@ func (cs *connState) StartTag(t Tag) bool {
 	return true
 }
 
-// ClearTag finishes handling a tag.
-func (cs *connState) ClearTag(t Tag) {
+// ClearTag finishes handling a tag, such that it may be reused. Waiters for
+// the tag are not released until SentTag is called with the returned channel.
+func (cs *connState) ClearTag(t Tag) chan struct{} {
 	cs.tagMu.Lock()
 	defer cs.tagMu.Unlock()
 	ch, ok := cs.tags[t]
@@ -386,15 +429,31 @@ func (cs *connState) ClearTag(t Tag) {
 		panic("unused tag cleared")
 	}
 	delete(cs.tags, t)
+	cs.sendingTags[t] = ch
+	return ch
+}
+
+// SentTag indicates that the response for a tag cleared by ClearTag, which
+// returned ch, has been sent.
+func (cs *connState) SentTag(t Tag, ch chan struct{}) {
+	cs.tagMu.Lock()
+	defer cs.tagMu.Unlock()
+	// The tag may have been reused and cleared again since.
+	if cs.sendingTags[t] == ch {
+		delete(cs.sendingTags, t)
+	}
 
 	// Notify.
 	close(ch)
 }
 
-// WaitTag waits for a tag to finish.
+// WaitTag waits for a tag to finish, including sending its response.
 func (cs *connState) WaitTag(t Tag) {
 	cs.tagMu.Lock()
 	ch, ok := cs.tags[t]
+	if !ok {
+		ch, ok = cs.sendingTags[t]
+	}
 	cs.tagMu.Unlock()
 	if !ok {
 		return
@@ -548,13 +607,16 @@ func (cs *connState) handleRequest() {
 	r := cs.handle(m)
 
 	// Clear the tag before sending. That's because as soon as this hits
-	// the wire, the client can legally send the same tag.
-	cs.ClearTag(tag)
+	// the wire, the client can legally send the same tag. A Tflush waiting
+	// for the tag is only released once the response has been sent, since
+	// flush(9P) requires the Rflush to follow it.
+	ch := cs.ClearTag(tag)
 
 	// Send back the result.
 	cs.sendMu.Lock()
 	err = send(cs.conn, tag, r)
 	cs.sendMu.Unlock()
+	cs.SentTag(tag, ch)
 	cs.sendDone <- err
 
 	// Return the message to the cache.
@@ -657,13 +719,14 @@ func (cs *connState) service() error {
 // Handle handles a single connection.
 func (s *Server) Handle(conn *unet.Socket) error {
 	cs := &connState{
-		server:   s,
-		conn:     conn,
-		fids:     make(map[FID]*fidRef),
-		tags:     make(map[Tag]chan struct{}),
-		recvOkay: make(chan bool),
-		recvDone: make(chan error, 10),
-		sendDone: make(chan error, 10),
+		server:      s,
+		conn:        conn,
+		fids:        make(map[FID]*fidRef),
+		tags:        make(map[Tag]chan struct{}),
+		sendingTags: make(map[Tag]chan struct{}),
+		recvOkay:    make(chan bool),
+		recvDone:    make(chan error, 10),
+		sendDone:    make(chan error, 10),
 	}
 	defer cs.stop()
 	return cs.service()
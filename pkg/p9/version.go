@@ -26,7 +26,7 @@ const (
 	//
 	// Clients are expected to start requesting this version number and
 	// to continuously decrement it until a Tversion request succeeds.
-	highestSupportedVersion uint32 = 11
+	highestSupportedVersion uint32 = 21
 
 	// lowestSupportedVersion is the lowest supported version X in a
 	// version string of the format 9P2000.L.Google.X.
@@ -173,3 +173,73 @@ func versionSupportsGetSetXattr(v uint32) bool {
 func versionSupportsListRemoveXattr(v uint32) bool {
 	return v >= 11
 }
+
+// versionSupportsTseek returns true if version v supports the Tseek message.
+// This predicate must be checked by clients before attempting to make a Tseek
+// request.
+func versionSupportsTseek(v uint32) bool {
+	return v >= 12
+}
+
+// versionSupportsTgetattrs returns true if version v supports the
+// Tgetattrs message. This predicate must be checked by clients before
+// attempting to make a Tgetattrs request.
+func versionSupportsTgetattrs(v uint32) bool {
+	return v >= 13
+}
+
+// versionSupportsTcopyrange returns true if version v supports the Tcopyrange
+// message. This predicate must be checked by clients before attempting to make
+// a Tcopyrange request.
+func versionSupportsTcopyrange(v uint32) bool {
+	return v >= 14
+}
+
+// versionSupportsTfdatasync returns true if version v supports the
+// Tfdatasync message. This predicate must be checked by clients before
+// attempting to make a Tfdatasync request.
+func versionSupportsTfdatasync(v uint32) bool {
+	return v >= 15
+}
+
+// versionSupportsTrenameat2 returns true if version v supports the
+// Trenameat2 message. This predicate must be checked by clients before
+// attempting to make a Trenameat2 request.
+func versionSupportsTrenameat2(v uint32) bool {
+	return v >= 16
+}
+
+// versionSupportsTmultiwalk returns true if version v supports the
+// Tmultiwalk message. This predicate must be checked by clients before
+// attempting to make a Tmultiwalk request.
+func versionSupportsTmultiwalk(v uint32) bool {
+	return v >= 17
+}
+
+// versionSupportsTreadxattr returns true if version v supports the
+// Treadxattr message. This predicate must be checked by clients before
+// attempting to make a Treadxattr request.
+func versionSupportsTreadxattr(v uint32) bool {
+	return v >= 18
+}
+
+// versionSupportsTclonerange returns true if version v supports the
+// Tclonerange message. This predicate must be checked by clients before
+// attempting to make a Tclonerange request.
+func versionSupportsTclonerange(v uint32) bool {
+	return v >= 19
+}
+
+// versionSupportsTgetflags returns true if version v supports the Tgetflags
+// and Tsetflags messages. This predicate must be checked by clients before
+// attempting to make a Tgetflags or Tsetflags request.
+func versionSupportsTgetflags(v uint32) bool {
+	return v >= 20
+}
+
+// versionSupportsTgetino returns true if version v supports the Tgetino
+// message. This predicate must be checked by clients before attempting to make
+// a Tgetino request.
+func versionSupportsTgetino(v uint32) bool {
+	return v >= 21
+}
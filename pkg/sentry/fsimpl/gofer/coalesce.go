@@ -0,0 +1,101 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/fs/fsutil"
+	"gvisor.dev/gvisor/pkg/sentry/memmap"
+	"gvisor.dev/gvisor/pkg/sentry/usage"
+)
+
+// Small writes to uncached parts of a file are normally sent to the remote
+// file immediately, since caching them would require reading the remainder of
+// each page they touch from the remote file. Writes beyond the end of the
+// file are an exception, since the pages they touch can be zero-filled
+// instead. Such writes, and writes contiguous with them, are coalesced in the
+// cache and written back together once they span fs.opts.msize bytes, or
+// when a non-contiguous write is coalesced, or when an FD on the file is
+// closed. This significantly reduces the number of RPCs issued by
+// applications that append to files in small increments.
+//
+// Coalescing is only performed in InteropModeExclusive, since other interop
+// modes require writes to be sent to the remote file synchronously.
+
+// canCoalesceWriteLocked returns true if a write to mr, which must lie in a
+// gap in d.cache, may be coalesced in zero-filled cache pages.
+//
+// Preconditions: d.dataMu must be locked.
+func (d *dentry) canCoalesceWriteLocked(mr memmap.MappableRange) bool {
+	return d.fs.opts.interop == InteropModeExclusive && mr.Length() < uint64(d.fs.opts.msize) && pageRoundDown(mr.Start) >= pageRoundUp(d.size)
+}
+
+// allocateCachePagesLocked inserts zero-filled pages spanning mr into d.cache,
+// and returns an iterator to the segment containing them.
+//
+// Preconditions: d.dataMu must be locked. gap.Range().IsSupersetOf(mr).
+// Either d.canCoalesceWriteLocked(mr) == true, or the remote file contains
+// only zeroes in mr (see dentry.extendCacheLocked()).
+func (d *dentry) allocateCachePagesLocked(gap fsutil.FileRangeGapIterator, mr memmap.MappableRange) (fsutil.FileRangeIterator, error) {
+	pgMR := memmap.MappableRange{pageRoundDown(mr.Start), pageRoundUp(mr.End)}.Intersect(gap.Range())
+	fr, err := d.fs.mfp.MemoryFile().Allocate(pgMR.Length(), usage.PageCache)
+	if err != nil {
+		return fsutil.FileRangeIterator{}, err
+	}
+	return d.cache.Insert(gap, pgMR, fr.Start), nil
+}
+
+// coalesceWriteLocked records that data was written to d.cache in wr. If
+// allocated is true, the write was stored in pages allocated by
+// d.allocateCachePagesLocked(). Errors from writing back coalesced writes are
+// logged rather than returned, since the data remains dirty in the cache and
+// will be written back again by a later sync.
+//
+// Preconditions: d.handleMu must be locked. d.dataMu must be locked.
+func (d *dentry) coalesceWriteLocked(ctx context.Context, wr memmap.MappableRange, allocated bool) {
+	// d.coalesced.End is retained after coalesced writes are written back,
+	// so that subsequent contiguous writes continue the run.
+	contiguous := d.coalesced.End != 0 && d.coalesced.End == wr.Start
+	switch {
+	case contiguous:
+		d.coalesced.End = wr.End
+	case allocated:
+		if err := d.flushCoalescedWritesLocked(ctx); err != nil {
+			log.Warningf("gofer.dentry.coalesceWriteLocked: failed to write back coalesced writes: %v", err)
+		}
+		d.coalesced = wr
+	default:
+		// This write doesn't extend a run of coalesced writes.
+		return
+	}
+	if d.coalesced.Length() >= uint64(d.fs.opts.msize) {
+		if err := d.flushCoalescedWritesLocked(ctx); err != nil {
+			log.Warningf("gofer.dentry.coalesceWriteLocked: failed to write back coalesced writes: %v", err)
+		}
+	}
+}
+
+// flushCoalescedWritesLocked writes coalesced writes back to the remote file.
+//
+// Preconditions: d.handleMu must be locked. d.dataMu must be locked.
+func (d *dentry) flushCoalescedWritesLocked(ctx context.Context) error {
+	if d.coalesced.Length() == 0 {
+		return nil
+	}
+	mr := d.coalesced
+	d.coalesced.Start = d.coalesced.End
+	return fsutil.SyncDirty(ctx, mr, &d.cache, &d.dirty, d.size, d.fs.mfp.MemoryFile(), d.handle.writeFromBlocksAt)
+}
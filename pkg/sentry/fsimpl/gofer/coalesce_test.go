@@ -0,0 +1,254 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestCoalesceGetattr(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{interop: InteropModeShared})
+	file := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1, Size: 1},
+		data: []byte("a"),
+	}
+	root := newTestRoot(ctx, t, fs, &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755},
+		children: map[string]*testP9File{"file": file},
+	}, nil)
+	defer root.DecRef()
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt: %v", err)
+	}
+	defer fd.DecRef()
+	d := fd.Impl().(*regularFileFD).dentry()
+
+	// Hold the first GetAttr RPC in flight until all stats have started.
+	file.getAttrs = nil
+	file.attr.Size = 2
+	file.getAttrGate = make(chan struct{})
+	const stats = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, stats)
+	stat := func() {
+		defer wg.Done()
+		stat, err := fd.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_SIZE})
+		if err == nil && stat.Size != 2 {
+			err = fmt.Errorf("got size %d, want 2", stat.Size)
+		}
+		errs <- err
+	}
+	wg.Add(1)
+	go stat()
+	for {
+		d.getattrMu.Lock()
+		inFlight := d.getattr != nil
+		d.getattrMu.Unlock()
+		if inFlight {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var started sync.WaitGroup
+	for i := 1; i < stats; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			started.Done()
+			stat()
+		}()
+	}
+	started.Wait()
+	time.Sleep(10 * time.Millisecond)
+	close(file.getAttrGate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Stat: %v", err)
+		}
+	}
+	if got := len(file.getAttrs); got != 1 {
+		t.Errorf("got %d GetAttr RPCs for %d concurrent stats, want 1", got, stats)
+	}
+}
+
+// newAppendTestFile returns an FD for an empty regular file on a filesystem
+// with the given options, along with the corresponding server file. The FD
+// and the returned root must be released by the caller.
+func newAppendTestFile(ctx context.Context, t testing.TB, opts filesystemOptions) (*testP9File, vfs.VirtualDentry, *vfs.FileDescription) {
+	fs := newTestFilesystem(ctx, opts)
+	file := &testP9File{}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+	fd, err := openAt(ctx, root, "file", linux.O_WRONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(O_WRONLY): %v", err)
+	}
+	return file, root, fd
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	ctx := contexttest.Context(t)
+	file, root, wfd := newAppendTestFile(ctx, t, filesystemOptions{})
+	defer root.DecRef()
+	defer wfd.DecRef()
+	const (
+		appenders = 4
+		appends   = 50
+	)
+	record := func(a, i int) string {
+		return fmt.Sprintf("%d:%03d;", a, i)
+	}
+	recordLen := len(record(0, 0))
+
+	var wg sync.WaitGroup
+	for a := 0; a < appenders; a++ {
+		fd, err := openAt(ctx, root, "file", linux.O_WRONLY|linux.O_APPEND)
+		if err != nil {
+			t.Fatalf("OpenAt(O_APPEND): %v", err)
+		}
+		defer fd.DecRef()
+		wg.Add(1)
+		go func(a int, fd *vfs.FileDescription) {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				if _, err := fd.Write(ctx, usermem.BytesIOSequence([]byte(record(a, i))), vfs.WriteOptions{}); err != nil {
+					t.Errorf("Write(): %v", err)
+					return
+				}
+			}
+			if err := fd.Sync(ctx); err != nil {
+				t.Errorf("Sync(): %v", err)
+			}
+		}(a, fd)
+	}
+	wg.Wait()
+
+	// Each record must appear exactly once, at a record boundary.
+	got := file.contents()
+	if want := appenders * appends * recordLen; len(got) != want {
+		t.Fatalf("remote file has size %d, want %d", len(got), want)
+	}
+	seen := make(map[string]bool)
+	for off := 0; off < len(got); off += recordLen {
+		seen[string(got[off:off+recordLen])] = true
+	}
+	for a := 0; a < appenders; a++ {
+		for i := 0; i < appends; i++ {
+			if !seen[record(a, i)] {
+				t.Errorf("record %q was lost or overwritten", record(a, i))
+			}
+		}
+	}
+}
+
+func TestCoalesceAppends(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const msize = 1024
+	chunk := []byte("0123456789abcdef")
+	file, root, fd := newAppendTestFile(ctx, t, filesystemOptions{msize: msize})
+	defer root.DecRef()
+	defer fd.DecRef()
+	writes := func() int {
+		file.dataMu.Lock()
+		defer file.dataMu.Unlock()
+		return file.writes
+	}
+	var want []byte
+	appendChunk := func() {
+		if _, err := fd.Write(ctx, usermem.BytesIOSequence(chunk), vfs.WriteOptions{}); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+		want = append(want, chunk...)
+	}
+
+	// Appends are coalesced until they span msize bytes.
+	for i := 0; i < msize/len(chunk)-1; i++ {
+		appendChunk()
+	}
+	if got := writes(); got != 0 {
+		t.Errorf("got %d write RPCs before reaching msize, want 0", got)
+	}
+	appendChunk()
+	if got := writes(); got != 1 {
+		t.Errorf("got %d write RPCs after reaching msize, want 1", got)
+	}
+	if got := file.contents(); !bytes.Equal(got, want) {
+		t.Errorf("remote file contains %q after reaching msize, want %q", got, want)
+	}
+
+	// Coalescing a non-contiguous write flushes coalesced appends.
+	appendChunk()
+	gapOff := int64(4 * usermem.PageSize)
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(chunk), gapOff, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(): %v", err)
+	}
+	if got := writes(); got != 2 {
+		t.Errorf("got %d write RPCs after non-contiguous write, want 2", got)
+	}
+	if got := file.contents(); !bytes.Equal(got, want) {
+		t.Errorf("remote file contains %q after non-contiguous write, want %q", got, want)
+	}
+
+	// Closing the FD flushes remaining coalesced writes.
+	if err := fd.OnClose(ctx); err != nil {
+		t.Fatalf("OnClose(): %v", err)
+	}
+	if got := writes(); got != 3 {
+		t.Errorf("got %d write RPCs after close, want 3", got)
+	}
+	want = append(want, make([]byte, int(gapOff)-len(want))...)
+	want = append(want, chunk...)
+	if got := file.contents(); !bytes.Equal(got, want) {
+		t.Errorf("remote file contains %q after close, want %q", got, want)
+	}
+}
+
+func BenchmarkCoalescedAppend(b *testing.B) {
+	ctx := contexttest.Context(b)
+	chunk := make([]byte, 64)
+	for _, msize := range []uint32{0, 1024 * 1024} {
+		b.Run(fmt.Sprintf("msize=%d", msize), func(b *testing.B) {
+			file, root, fd := newAppendTestFile(ctx, b, filesystemOptions{msize: msize})
+			defer root.DecRef()
+			defer fd.DecRef()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fd.Write(ctx, usermem.BytesIOSequence(chunk), vfs.WriteOptions{}); err != nil {
+					b.Fatalf("Write(): %v", err)
+				}
+			}
+			if err := fd.OnClose(ctx); err != nil {
+				b.Fatalf("OnClose(): %v", err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(file.writes)/float64(b.N), "rpcs/op")
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// CheckConsistency validates fs' internal invariants and returns a list of
+// the violations it detects. It is intended for debugging only: it locks
+// fs.renameMu for writing for its duration, and its results are only
+// meaningful if no other filesystem operations are in progress, since
+// invariants may be transiently violated by in-flight operations (e.g. a
+// dentry whose reference count has just dropped to 0 may not have been
+// cached yet).
+//
+// Note that, as documented on filesystem.cachedDentries, a cached dentry may
+// legitimately have a non-zero reference count if it was obtained by path
+// resolution after being cached; this is not reported as a violation.
+func (fs *filesystem) CheckConsistency() []error {
+	var errs []error
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+	fs.syncMu.Lock()
+	defer fs.syncMu.Unlock()
+
+	// Check the LRU of cached dentries.
+	inList := make(map[*dentry]struct{})
+	var n uint64
+	for d := fs.cachedDentries.Front(); d != nil; d = d.Next() {
+		n++
+		if _, ok := inList[d]; ok {
+			errs = append(errs, fmt.Errorf("dentry %p appears more than once in cachedDentries", d))
+			break
+		}
+		inList[d] = struct{}{}
+		if !d.cached {
+			errs = append(errs, fmt.Errorf("dentry %p is in cachedDentries, but cached is false", d))
+		}
+		if refs := atomic.LoadInt64(&d.refs); refs < 0 {
+			errs = append(errs, fmt.Errorf("dentry %p is in cachedDentries, but has been destroyed (refs=%d)", d, refs))
+		}
+		if _, ok := fs.dentries[d]; !ok {
+			errs = append(errs, fmt.Errorf("dentry %p is in cachedDentries, but not in dentries", d))
+		}
+	}
+	if n != fs.cachedDentriesLen {
+		errs = append(errs, fmt.Errorf("cachedDentriesLen is %d, but cachedDentries contains %d dentries", fs.cachedDentriesLen, n))
+	}
+
+	// Check each dentry in the filesystem, counting the references that each
+	// holds on its parent.
+	childRefs := make(map[*dentry]int64)
+	for d := range fs.dentries {
+		refs := atomic.LoadInt64(&d.refs)
+		if refs < 0 {
+			errs = append(errs, fmt.Errorf("dentry %p is in dentries, but has been destroyed (refs=%d)", d, refs))
+		}
+		if _, ok := inList[d]; d.cached && !ok {
+			errs = append(errs, fmt.Errorf("dentry %p has cached set, but is not in cachedDentries", d))
+		}
+		if refs == 0 && !d.cached {
+			errs = append(errs, fmt.Errorf("dentry %p has no references, but is not cached", d))
+		}
+
+		d.handleMu.RLock()
+		if hasHandle := !d.handle.file.isNil(); hasHandle != (d.handleReadable || d.handleWritable) {
+			errs = append(errs, fmt.Errorf("dentry %p has handleReadable=%t, handleWritable=%t, but handle.file != nil is %t", d, d.handleReadable, d.handleWritable, hasHandle))
+		}
+		d.handleMu.RUnlock()
+
+		if parentVFSD := d.vfsd.Parent(); parentVFSD != nil {
+			parent := parentVFSD.Impl().(*dentry)
+			if _, ok := fs.dentries[parent]; !ok {
+				errs = append(errs, fmt.Errorf("dentry %p has parent %p, which is not in dentries", d, parent))
+			}
+			childRefs[parent]++
+		}
+	}
+	for parent, n := range childRefs {
+		if refs := atomic.LoadInt64(&parent.refs); refs < n {
+			errs = append(errs, fmt.Errorf("dentry %p has %d references, but %d children hold references on it", parent, refs, n))
+		}
+	}
+	return errs
+}
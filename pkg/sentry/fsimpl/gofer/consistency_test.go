@@ -0,0 +1,146 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt func(fs *filesystem, parent, child *dentry)
+		// want is a substring of the expected violation. If want is empty, no
+		// violations are expected.
+		want string
+	}{
+		{
+			name:    "consistent",
+			corrupt: func(*filesystem, *dentry, *dentry) {},
+		},
+		{
+			name: "cachedDentriesLen mismatch",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				fs.cachedDentriesLen = 1
+			},
+			want: "cachedDentriesLen is 1, but cachedDentries contains 2 dentries",
+		},
+		{
+			name: "listed dentry not marked cached",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				child.cached = false
+			},
+			want: "is in cachedDentries, but cached is false",
+		},
+		{
+			name: "cached dentry not listed",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				fs.cachedDentries.Remove(child)
+				fs.cachedDentriesLen--
+			},
+			want: "has cached set, but is not in cachedDentries",
+		},
+		{
+			name: "cached dentry not in dentries",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				delete(fs.dentries, child)
+			},
+			want: "is in cachedDentries, but not in dentries",
+		},
+		{
+			name: "destroyed dentry",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				atomic.StoreInt64(&child.refs, -1)
+			},
+			want: "is in cachedDentries, but has been destroyed",
+		},
+		{
+			name: "unreferenced dentry not cached",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				fs.cachedDentries.Remove(child)
+				fs.cachedDentriesLen--
+				child.cached = false
+			},
+			want: "has no references, but is not cached",
+		},
+		{
+			name: "readable without handle",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				child.handleReadable = true
+			},
+			want: "handleReadable=true, handleWritable=false, but handle.file != nil is false",
+		},
+		{
+			name: "handle without access",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				child.handle.file = p9file{file: &testP9File{}}
+			},
+			want: "handleReadable=false, handleWritable=false, but handle.file != nil is true",
+		},
+		{
+			name: "missing parent reference",
+			corrupt: func(fs *filesystem, parent, child *dentry) {
+				atomic.StoreInt64(&parent.refs, 1)
+			},
+			want: "has 1 references, but 2 children hold references on it",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := contexttest.Context(t)
+			fs := newTestFilesystem(ctx, filesystemOptions{maxCachedDentries: 2})
+			mask := p9.AttrMask{Mode: true}
+			attr := &p9.Attr{Mode: p9.ModeDirectory}
+			parent, err := fs.newDentry(ctx, p9file{}, p9.QID{}, mask, attr)
+			if err != nil {
+				t.Fatalf("fs.newDentry(): %v", err)
+			}
+			parent.refs = 1
+			// Create two unreferenced, and therefore cached, children.
+			var child *dentry
+			for _, name := range []string{"a", "b"} {
+				child, err = fs.newDentry(ctx, p9file{}, p9.QID{}, mask, attr)
+				if err != nil {
+					t.Fatalf("fs.newDentry(): %v", err)
+				}
+				parent.IncRef() // reference held by child on its parent.
+				parent.vfsd.InsertChild(&child.vfsd, name)
+				child.checkCachingLocked()
+			}
+
+			test.corrupt(fs, parent, child)
+			errs := fs.CheckConsistency()
+			if test.want == "" {
+				if len(errs) != 0 {
+					t.Errorf("CheckConsistency(): got %v, want no violations", errs)
+				}
+				return
+			}
+			found := false
+			for _, err := range errs {
+				if strings.Contains(err.Error(), test.want) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("CheckConsistency(): got %v, want violation containing %q", errs, test.want)
+			}
+		})
+	}
+}
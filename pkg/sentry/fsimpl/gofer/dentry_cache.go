@@ -0,0 +1,128 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+// defaultMaxCachedDentries is the default value of
+// filesystemOptions.maxCachedDentries.
+const defaultMaxCachedDentries = 1000
+
+// dentryCachePolicy determines the order of filesystem.cachedDentries. When
+// the dentry cache becomes over-full, the dentry at the back of
+// filesystem.cachedDentries is evicted.
+//
+// All methods require that filesystem.renameMu is locked for writing.
+type dentryCachePolicy interface {
+	// insert adds d, which has just become cached, to l.
+	insert(l *dentryList, d *dentry)
+
+	// touch records that d, which is already in l, has been used again.
+	touch(l *dentryList, d *dentry)
+
+	// remove removes d from l.
+	remove(l *dentryList, d *dentry)
+}
+
+// newDentryCachePolicy returns the dentryCachePolicy selected by opts.
+func newDentryCachePolicy(opts *filesystemOptions) dentryCachePolicy {
+	if opts.dentryCachePolicy == "2q" {
+		return &twoQueueDentryCachePolicy{
+			protectedMax: opts.maxCachedDentries * 3 / 4,
+		}
+	}
+	return lruDentryCachePolicy{}
+}
+
+// lruDentryCachePolicy evicts the least recently used dentry.
+type lruDentryCachePolicy struct{}
+
+// insert implements dentryCachePolicy.insert.
+func (lruDentryCachePolicy) insert(l *dentryList, d *dentry) {
+	l.PushFront(d)
+}
+
+// touch implements dentryCachePolicy.touch.
+func (lruDentryCachePolicy) touch(l *dentryList, d *dentry) {
+	l.Remove(d)
+	l.PushFront(d)
+}
+
+// remove implements dentryCachePolicy.remove.
+func (lruDentryCachePolicy) remove(l *dentryList, d *dentry) {
+	l.Remove(d)
+}
+
+// twoQueueDentryCachePolicy is a segmented LRU, or "2Q", policy. The dentry
+// cache is divided into a protected segment at the front, containing dentries
+// that have been used again while cached, and a probationary segment at the
+// back, containing dentries that have been used only once since becoming
+// cached. Newly cached dentries enter the front of the probationary segment,
+// so dentries that are used only once (e.g. by a scan of a large directory)
+// are evicted without disturbing the protected segment.
+type twoQueueDentryCachePolicy struct {
+	// protectedMax is the maximum number of dentries in the protected
+	// segment. protectedMax is immutable.
+	protectedMax uint64
+
+	// protectedLen is the number of dentries in the protected segment.
+	protectedLen uint64
+
+	// probationFront is the first dentry in the probationary segment, or nil
+	// if the probationary segment is empty.
+	probationFront *dentry
+}
+
+// insert implements dentryCachePolicy.insert.
+func (p *twoQueueDentryCachePolicy) insert(l *dentryList, d *dentry) {
+	d.cacheProtected = false
+	if p.probationFront != nil {
+		l.InsertBefore(p.probationFront, d)
+	} else {
+		l.PushBack(d)
+	}
+	p.probationFront = d
+}
+
+// touch implements dentryCachePolicy.touch.
+func (p *twoQueueDentryCachePolicy) touch(l *dentryList, d *dentry) {
+	p.remove(l, d)
+	l.PushFront(d)
+	d.cacheProtected = true
+	p.protectedLen++
+	if p.protectedLen > p.protectedMax {
+		// Demote the least recently used protected dentry, which is
+		// immediately in front of the probationary segment.
+		var demoted *dentry
+		if p.probationFront != nil {
+			demoted = p.probationFront.Prev()
+		} else {
+			demoted = l.Back()
+		}
+		demoted.cacheProtected = false
+		p.protectedLen--
+		p.probationFront = demoted
+	}
+}
+
+// remove implements dentryCachePolicy.remove.
+func (p *twoQueueDentryCachePolicy) remove(l *dentryList, d *dentry) {
+	if d == p.probationFront {
+		p.probationFront = d.Next()
+	}
+	if d.cacheProtected {
+		d.cacheProtected = false
+		p.protectedLen--
+	}
+	l.Remove(d)
+}
@@ -0,0 +1,355 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestDestroyIdempotent(t *testing.T) {
+	fs := filesystem{
+		dentries: make(map[*dentry]struct{}),
+		opts: filesystemOptions{
+			// Test relies on no dentry being held in the cache.
+			maxCachedDentries: 0,
+		},
+		cachePolicy: lruDentryCachePolicy{},
+	}
+
+	ctx := contexttest.Context(t)
+	attr := &p9.Attr{
+		Mode: p9.ModeRegular,
+	}
+	mask := p9.AttrMask{
+		Mode: true,
+		Size: true,
+	}
+	parent, err := fs.newDentry(ctx, p9file{}, p9.QID{}, mask, attr)
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+
+	child, err := fs.newDentry(ctx, p9file{}, p9.QID{}, mask, attr)
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	parent.IncRef() // reference held by child on its parent.
+	parent.vfsd.InsertChild(&child.vfsd, "child")
+
+	child.checkCachingLocked()
+	if got := atomic.LoadInt64(&child.refs); got != -1 {
+		t.Fatalf("child.refs=%d, want: -1", got)
+	}
+	// Parent will also be destroyed when child reference is removed.
+	if got := atomic.LoadInt64(&parent.refs); got != -1 {
+		t.Fatalf("parent.refs=%d, want: -1", got)
+	}
+	child.checkCachingLocked()
+	child.checkCachingLocked()
+}
+
+func TestEvictUnderMemoryPressure(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		maxCachedDentries: 100,
+	})
+	const size = usermem.PageSize
+	newFile := func() (*testP9File, *dentry) {
+		file := &testP9File{data: make([]byte, size)}
+		d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: size})
+		return file, d
+	}
+	_, open := newFile()
+	_, clean := newFile()
+	dirtyFile, dirty := newFile()
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{
+		"open":  open,
+		"clean": clean,
+		"dirty": dirty,
+	})
+	defer root.DecRef()
+
+	// Fill each file's page cache by reading it, and dirty the cached page of
+	// "dirty". Only "open" remains referenced afterward.
+	var openFD *vfs.FileDescription
+	for _, name := range []string{"open", "clean", "dirty"} {
+		fd, err := openAt(ctx, root, name, linux.O_RDWR)
+		if err != nil {
+			t.Fatalf("OpenAt(%q): %v", name, err)
+		}
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, size)), 0, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("PRead(%q): %v", name, err)
+		}
+		if name == "dirty" {
+			if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(bytes.Repeat([]byte{'a'}, size)), 0, vfs.WriteOptions{}); err != nil {
+				t.Fatalf("PWrite(%q): %v", name, err)
+			}
+		}
+		if name == "open" {
+			openFD = fd
+		} else {
+			fd.DecRef()
+		}
+	}
+	defer openFD.DecRef()
+	for _, d := range []*dentry{open, clean, dirty} {
+		if d.cache.IsEmpty() {
+			t.Fatalf("dentry %p has no cached pages before eviction", d)
+		}
+	}
+	if !clean.cached || !dirty.cached {
+		t.Fatalf("unreferenced dentries are not cached before eviction")
+	}
+
+	// Simulate memory pressure.
+	fs.Evict(ctx, filesystemEvictableRange)
+
+	if refs := atomic.LoadInt64(&clean.refs); refs != -1 {
+		t.Errorf("clean cached dentry was not destroyed: refs=%d", refs)
+	}
+	if !open.cache.IsEmpty() {
+		t.Errorf("clean cached pages of referenced dentry were not released")
+	}
+	if refs := atomic.LoadInt64(&open.refs); refs <= 0 {
+		t.Errorf("referenced dentry has refs=%d after eviction", refs)
+	}
+	if refs := atomic.LoadInt64(&dirty.refs); refs != 0 || !dirty.cached {
+		t.Errorf("dentry with dirty data was evicted: refs=%d, cached=%t", refs, dirty.cached)
+	}
+	if dirty.cache.IsEmpty() || dirty.dirty.IsEmpty() {
+		t.Errorf("dirty cached pages were released")
+	}
+	if got := dirtyFile.contents(); got[0] != 0 {
+		t.Errorf("dirty data was written back by eviction")
+	}
+	if errs := fs.CheckConsistency(); len(errs) != 0 {
+		t.Errorf("CheckConsistency() after eviction: %v", errs)
+	}
+}
+
+func TestNoNegativeCache(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, noNegativeCache := range []bool{false, true} {
+		rootFile := &testP9File{
+			attr:     p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+			children: map[string]*testP9File{},
+		}
+		addr, _ := serveTestP9(t, rootFile)
+		data := "trans=unix,addr=" + addr
+		if noNegativeCache {
+			data += ",no_negative_cache"
+		}
+		root := mountTestP9(ctx, t, data)
+		vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+		creds := auth.CredentialsFromContext(ctx)
+		pop := pathOp(root, "file")
+
+		if _, err := vfsObj.StatAt(ctx, creds, pop, &vfs.StatOptions{}); err != syserror.ENOENT {
+			t.Fatalf("no_negative_cache=%t: StatAt() before creation: got err %v, want %v", noNegativeCache, err, syserror.ENOENT)
+		}
+
+		// Another user of the remote filesystem creates the file.
+		rootFile.children["file"] = &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}}
+
+		_, err := vfsObj.StatAt(ctx, creds, pop, &vfs.StatOptions{})
+		if noNegativeCache {
+			if err != nil {
+				t.Errorf("no_negative_cache=%t: StatAt() after creation: %v", noNegativeCache, err)
+			}
+		} else if err != syserror.ENOENT {
+			t.Errorf("no_negative_cache=%t: StatAt() after creation: got err %v, want %v (cached)", noNegativeCache, err, syserror.ENOENT)
+		}
+		root.DecRef()
+	}
+}
+
+func TestDentryCacheStats(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{maxCachedDentries: 1})
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"a": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}},
+			"b": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}},
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+	stat := func(path string) {
+		if _, err := vfsObj.StatAt(ctx, creds, pathOp(root, path), &vfs.StatOptions{}); err != nil {
+			t.Fatalf("StatAt(%s): %v", path, err)
+		}
+	}
+
+	for _, step := range []struct {
+		name string
+		op   func()
+		want DentryCacheStats
+	}{
+		{
+			name: "first lookup of a",
+			op:   func() { stat("a") },
+			want: DentryCacheStats{Misses: 1, Insertions: 1},
+		},
+		{
+			name: "second lookup of a",
+			op:   func() { stat("a") },
+			want: DentryCacheStats{Hits: 1, Misses: 1, Insertions: 1},
+		},
+		{
+			// Caching b exceeds maxCachedDentries, evicting a.
+			name: "first lookup of b",
+			op:   func() { stat("b") },
+			want: DentryCacheStats{Hits: 1, Misses: 2, Insertions: 2, Evictions: 1},
+		},
+		{
+			name: "unlink b",
+			op: func() {
+				if err := vfsObj.UnlinkAt(ctx, creds, pathOp(root, "b")); err != nil {
+					t.Fatalf("UnlinkAt(b): %v", err)
+				}
+			},
+			want: DentryCacheStats{Hits: 1, Misses: 2, Insertions: 2, Evictions: 1, Invalidations: 1},
+		},
+		{
+			name: "lookup of evicted a",
+			op:   func() { stat("a") },
+			want: DentryCacheStats{Hits: 1, Misses: 3, Insertions: 3, Evictions: 1, Invalidations: 1},
+		},
+	} {
+		step.op()
+		if got := fs.DentryCacheStats(); got != step.want {
+			t.Errorf("after %s: got %+v, want %+v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestDentryCachePolicy(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, test := range []struct {
+		policy        string
+		wantHotCached bool
+	}{
+		{policy: "lru", wantHotCached: false},
+		{policy: "2q", wantHotCached: true},
+	} {
+		fs := newTestFilesystem(ctx, filesystemOptions{maxCachedDentries: 4, dentryCachePolicy: test.policy})
+		parent, err := fs.newDentry(ctx, p9file{}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeDirectory | 0755})
+		if err != nil {
+			t.Fatalf("%s: fs.newDentry(): %v", test.policy, err)
+		}
+		parent.IncRef() // prevent parent from being cached
+		newChild := func(name string) *dentry {
+			child, err := fs.newDentry(ctx, p9file{}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeRegular | 0644})
+			if err != nil {
+				t.Fatalf("%s: fs.newDentry(): %v", test.policy, err)
+			}
+			parent.IncRef() // reference held by child on its parent
+			parent.vfsd.InsertChild(&child.vfsd, name)
+			return child
+		}
+		// use simulates a path resolution that finds d, after which d has no
+		// references.
+		use := func(d *dentry) {
+			fs.renameMu.Lock()
+			d.checkCachingLocked()
+			fs.renameMu.Unlock()
+		}
+
+		// Use a hot dentry repeatedly, then scan more dentries than fit in
+		// the cache once each.
+		hot := newChild("hot")
+		use(hot)
+		use(hot)
+		for i := 0; i < 2*int(fs.opts.maxCachedDentries); i++ {
+			use(newChild(fmt.Sprintf("scan%d", i)))
+		}
+		if got := atomic.LoadInt64(&hot.refs) != -1; got != test.wantHotCached {
+			t.Errorf("%s: hot dentry retained after scan: got %t, want %t", test.policy, got, test.wantHotCached)
+		}
+		if fs.cachedDentriesLen != fs.opts.maxCachedDentries {
+			t.Errorf("%s: got %d cached dentries, want %d", test.policy, fs.cachedDentriesLen, fs.opts.maxCachedDentries)
+		}
+	}
+}
+
+func TestDentryCacheTrimmer(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	const lowWater = 1
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		maxCachedDentries:       10,
+		dentryCacheTrimInterval: time.Millisecond,
+		dentryCacheLowWater:     lowWater,
+	})
+	rootFile := &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{},
+	}
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		rootFile.children[name] = &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}}
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+	for _, name := range names {
+		pop := pathOp(root, name)
+		if _, err := vfsObj.StatAt(ctx, creds, pop, &vfs.StatOptions{}); err != nil {
+			t.Fatalf("StatAt(%s): %v", name, err)
+		}
+	}
+	cachedDentries := func() uint64 {
+		fs.renameMu.Lock()
+		defer fs.renameMu.Unlock()
+		return fs.cachedDentriesLen
+	}
+	if got, want := cachedDentries(), uint64(len(names)); got != want {
+		t.Fatalf("got %d cached dentries before trimming, want %d", got, want)
+	}
+
+	// Once the filesystem is idle, the trimmer shrinks the cache to the
+	// low-water mark, and no further.
+	fs.startDentryCacheTrimmer()
+	deadline := time.Now().Add(10 * time.Second)
+	for cachedDentries() > lowWater {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d cached dentries after idling, want %d", cachedDentries(), lowWater)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	fs.stopDentryCacheTrimmer()
+	if got := cachedDentries(); got != lowWater {
+		t.Errorf("got %d cached dentries after trimming, want %d", got, lowWater)
+	}
+	if got, want := fs.DentryCacheStats().Evictions, uint64(len(names)-lowWater); got != want {
+		t.Errorf("got %d evictions, want %d", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"time"
+)
+
+// startDentryCacheTrimmer starts fs' dentry cache trimmer, which periodically
+// evicts cached dentries, down to fs.opts.dentryCacheLowWater, if the dentry
+// cache has not been used for at least fs.opts.dentryCacheTrimInterval.
+//
+// Preconditions: fs.opts.dentryCacheTrimInterval != 0.
+// startDentryCacheTrimmer has not been called previously.
+func (fs *filesystem) startDentryCacheTrimmer() {
+	fs.dentryTrimStop = make(chan struct{})
+	fs.dentryTrimDone = make(chan struct{})
+	go fs.dentryCacheTrimmer() // S/R-SAFE: stopped by fs.Release().
+}
+
+// stopDentryCacheTrimmer stops fs' dentry cache trimmer, if one was started,
+// and waits for it to exit.
+func (fs *filesystem) stopDentryCacheTrimmer() {
+	if fs.dentryTrimStop == nil {
+		return
+	}
+	close(fs.dentryTrimStop)
+	<-fs.dentryTrimDone
+}
+
+func (fs *filesystem) dentryCacheTrimmer() {
+	defer close(fs.dentryTrimDone)
+	ticker := time.NewTicker(fs.opts.dentryCacheTrimInterval)
+	defer ticker.Stop()
+	lastUses := fs.dentryCacheUses()
+	for {
+		select {
+		case <-fs.dentryTrimStop:
+			return
+		case <-ticker.C:
+		}
+		if fs.dentryCacheUses() == lastUses {
+			fs.trimDentryCache()
+		}
+		// Trimming may cache the parents of evicted dentries, which must not
+		// count as activity.
+		lastUses = fs.dentryCacheUses()
+	}
+}
+
+// dentryCacheUses returns a value that changes whenever fs' dentry cache is
+// used by path resolution or has a dentry inserted.
+func (fs *filesystem) dentryCacheUses() uint64 {
+	return fs.dentryCacheStats.load(dentryCacheHit) + fs.dentryCacheStats.load(dentryCacheMiss) + fs.dentryCacheStats.load(dentryCacheInsert)
+}
+
+// trimDentryCache evicts cached dentries, in the order chosen by
+// fs.cachePolicy, until at most fs.opts.dentryCacheLowWater remain. This
+// clunks the fids of evicted dentries, so that the server can release the
+// files they represent.
+func (fs *filesystem) trimDentryCache() {
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+	// As in dentry.checkCachingLocked(), evicting a dentry may cause its
+	// parent to become cached, but each iteration destroys at least one
+	// dentry with no references, so this terminates.
+	for fs.cachedDentriesLen > fs.opts.dentryCacheLowWater {
+		fs.evictCachedDentryLocked(fs.cachedDentries.Back())
+		fs.dentryCacheStats.count(dentryCacheEvict)
+	}
+}
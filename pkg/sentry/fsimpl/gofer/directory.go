@@ -15,6 +15,8 @@
 package gofer
 
 import (
+	"math"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -32,23 +34,108 @@ func (d *dentry) isDir() bool {
 // Preconditions: d.dirMu must be locked. d.isDir(). fs.opts.interop !=
 // InteropModeShared.
 func (d *dentry) cacheNegativeChildLocked(name string) {
+	if d.fs.opts.noNegativeCache {
+		return
+	}
 	if d.negativeChildren == nil {
 		d.negativeChildren = make(map[string]struct{})
 	}
 	d.negativeChildren[name] = struct{}{}
 }
 
+// invalidateDirentsLocked records that the client has mutated d's children,
+// invalidating d.dirents.
+//
+// Preconditions: d.dirMu must be locked. d.isDir().
+func (d *dentry) invalidateDirentsLocked() {
+	d.dirGen++
+	d.dirents = nil
+	d.casefoldNames = nil
+}
+
+// casefoldChildLocked returns the name of an entry in d that matches name
+// case-insensitively, or "" if no such entry exists. If multiple entries
+// match, the first returned by the server is used.
+//
+// Preconditions: d.dirMu must be locked. d.isDir(). d.fs.opts.casefold.
+func (d *dentry) casefoldChildLocked(ctx context.Context, name string) (string, error) {
+	if d.casefoldNames == nil {
+		names, err := d.readdirNames(ctx)
+		if err != nil {
+			return "", err
+		}
+		d.casefoldNames = make(map[string]string, len(names))
+		for _, childName := range names {
+			folded := strings.ToLower(childName)
+			if _, ok := d.casefoldNames[folded]; !ok {
+				d.casefoldNames[folded] = childName
+			}
+		}
+	}
+	return d.casefoldNames[strings.ToLower(name)], nil
+}
+
+// readdirNames returns the names of all entries in d, other than "." and
+// "..". Unlike d.getDirents(), it opens a new handle to read the directory,
+// so it does not require d to be open.
+func (d *dentry) readdirNames(ctx context.Context) ([]string, error) {
+	_, file, err := d.file.walk(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer file.close(ctx)
+	fdobj, _, _, err := file.open(ctx, p9.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if fdobj != nil {
+		fdobj.Close()
+	}
+	var names []string
+	off := uint64(0)
+	const count = 64 * 1024 // as in getDirents
+	for {
+		p9ds, err := file.readdir(ctx, off, count)
+		if err != nil {
+			return nil, err
+		}
+		if len(p9ds) == 0 {
+			return names, nil
+		}
+		for _, p9d := range p9ds {
+			if p9d.Name != "." && p9d.Name != ".." {
+				names = append(names, p9d.Name)
+			}
+		}
+		off = p9ds[len(p9ds)-1].Offset
+	}
+}
+
 type directoryFD struct {
 	fileDescription
 	vfs.DirectoryFileDescriptionDefaultImpl
 
-	mu      sync.Mutex
-	off     int64
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// off is the directory offset of the next entry to be returned, as
+	// reported by getdents(2) and accepted by lseek(2). Offsets 1 and 2
+	// follow "." and ".." respectively. For other entries, if
+	// fs.opts.interop == InteropModeShared, off is the server's directory
+	// offset plus 2, such that it remains meaningful across directory
+	// mutations; otherwise, off indexes into dirents.
+	off int64
+
+	// dirents is the snapshot of the directory being iterated, and idx is
+	// the index into dirents of the entry at off. If dirents is nil, the
+	// next call to IterDirents reads a new snapshot.
 	dirents []vfs.Dirent
+	idx     int
 }
 
 // Release implements vfs.FileDescriptionImpl.Release.
 func (fd *directoryFD) Release() {
+	fd.dentry().decOpenFDs()
 }
 
 // IterDirents implements vfs.FileDescriptionImpl.IterDirents.
@@ -57,27 +144,74 @@ func (fd *directoryFD) IterDirents(ctx context.Context, cb vfs.IterDirentsCallba
 	defer fd.mu.Unlock()
 
 	d := fd.dentry()
+	if fd.dirents == nil && d.fs.opts.interop == InteropModeShared && fd.off > 2 {
+		// fd.off is meaningful to the server, so resume reading from it
+		// rather than rereading the directory from the beginning only to
+		// discard the entries that have already been consumed. The directory
+		// is only reread from the beginning after a seek to offset 0.
+		ds, err := d.getDirentsFrom(ctx, uint64(fd.off-2))
+		if err != nil {
+			return err
+		}
+		fd.dirents = ds
+		fd.idx = 0
+	}
 	if fd.dirents == nil {
 		ds, err := d.getDirents(ctx)
 		if err != nil {
 			return err
 		}
+		idx, ok := fd.direntIndex(ds, fd.off)
+		if !ok {
+			// The entry at fd.off is no longer in the directory, so resume
+			// from the server's directory offset instead.
+			if ds, err = d.getDirentsFrom(ctx, uint64(fd.off-2)); err != nil {
+				return err
+			}
+			idx = 0
+		}
 		fd.dirents = ds
+		fd.idx = idx
 	}
 
 	if d.fs.opts.interop != InteropModeShared {
 		d.touchAtime(fd.vfsfd.Mount())
 	}
 
-	for fd.off < int64(len(fd.dirents)) {
-		if err := cb.Handle(fd.dirents[fd.off]); err != nil {
+	for fd.idx < len(fd.dirents) {
+		if err := cb.Handle(fd.dirents[fd.idx]); err != nil {
 			return err
 		}
-		fd.off++
+		fd.off = fd.dirents[fd.idx].NextOff
+		fd.idx++
 	}
 	return nil
 }
 
+// direntIndex returns the index into ds of the entry at directory offset off,
+// and true if off is a valid offset for ds.
+//
+// Preconditions: fd.mu must be locked.
+func (fd *directoryFD) direntIndex(ds []vfs.Dirent, off int64) (int, bool) {
+	if off == 0 {
+		return 0, true
+	}
+	if fd.dentry().fs.opts.interop != InteropModeShared {
+		// Offsets past the end of the directory are valid, and cause
+		// IterDirents to return no entries.
+		if off > int64(len(ds)) {
+			return len(ds), true
+		}
+		return int(off), true
+	}
+	for i := range ds {
+		if ds[i].NextOff == off {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
 // Preconditions: d.isDir(). There exists at least one directoryFD representing d.
 func (d *dentry) getDirents(ctx context.Context) ([]vfs.Dirent, error) {
 	// 9P2000.L's readdir does not specify behavior in the presence of
@@ -101,7 +235,30 @@ func (d *dentry) getDirents(ctx context.Context) ([]vfs.Dirent, error) {
 	defer d.fs.renameMu.RUnlock()
 	d.dirMu.Lock()
 	defer d.dirMu.Unlock()
-	if d.dirents != nil {
+	var version uint32
+	if d.fs.opts.interop == InteropModeShared {
+		// Cached dirents may be reused only if neither the client nor the
+		// server has changed the directory since they were read. Since the
+		// directory may change while it is being read, use its version from
+		// before reading to validate the result.
+		if err := d.updateFromGetattr(ctx); err != nil {
+			return nil, err
+		}
+		version = atomic.LoadUint32(&d.qidVersion)
+		// Under cache=none, directory reads always go to the server, since
+		// servers may not update directory QID versions for out-of-band
+		// changes.
+		if d.fs.opts.regularFilesUseSpecialFileFD {
+			version = 0
+		}
+		if d.dirents != nil {
+			if version != 0 && version == d.direntsVersion && d.dirGen == d.direntsGen {
+				d.revalidateChildrenLocked(ctx, d.dirents[2:])
+				return d.dirents, nil
+			}
+			d.dirents = nil
+		}
+	} else if d.dirents != nil {
 		return d.dirents, nil
 	}
 
@@ -112,59 +269,181 @@ func (d *dentry) getDirents(ctx context.Context) ([]vfs.Dirent, error) {
 		{
 			Name:    ".",
 			Type:    linux.DT_DIR,
-			Ino:     d.ino,
+			Ino:     d.statIno(),
 			NextOff: 1,
 		},
 		{
 			Name:    "..",
 			Type:    uint8(atomic.LoadUint32(&parent.mode) >> 12),
-			Ino:     parent.ino,
+			Ino:     parent.statIno(),
 			NextOff: 2,
 		},
 	}
-	off := uint64(0)
-	const count = 64 * 1024 // for consistency with the vfs1 client
 	d.handleMu.RLock()
-	defer d.handleMu.RUnlock()
 	if !d.handleReadable {
 		// This should not be possible because a readable handle should have
 		// been opened when the calling directoryFD was opened.
 		panic("gofer.dentry.getDirents called without a readable handle")
 	}
+	dirents, err := d.appendServerDirentsLocked(ctx, dirents, 0)
+	// d.handleMu must be unlocked before updating cached metadata, which
+	// requires locking dentry.metadataMu.
+	d.handleMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	// Cache dirents for future directoryFDs if permitted.
+	if d.fs.opts.interop != InteropModeShared {
+		d.dirents = dirents
+	} else {
+		if version != 0 {
+			d.dirents = dirents
+			d.direntsGen = d.dirGen
+			d.direntsVersion = version
+		}
+		// Directory reads are usually followed by stats of the directory's
+		// children (e.g. by ls -l), which would otherwise require
+		// revalidating each child separately.
+		d.revalidateChildrenLocked(ctx, dirents[2:])
+	}
+	return dirents, nil
+}
+
+// getDirentsFrom returns the entries in d that follow the server's directory
+// offset off. Unlike d.getDirents(), it neither caches nor reuses cached
+// entries, and does not generate "." and "..".
+//
+// Preconditions: d.isDir(). There exists at least one directoryFD representing
+// d. d.fs.opts.interop == InteropModeShared.
+func (d *dentry) getDirentsFrom(ctx context.Context, off uint64) ([]vfs.Dirent, error) {
+	d.handleMu.RLock()
+	defer d.handleMu.RUnlock()
+	if !d.handleReadable {
+		panic("gofer.dentry.getDirentsFrom called without a readable handle")
+	}
+	return d.appendServerDirentsLocked(ctx, nil, off)
+}
+
+// appendServerDirentsLocked appends the entries returned by the server for d,
+// starting from the server's directory offset off, to dirents and returns the
+// result. If d.fs.opts.interop == InteropModeShared, the NextOff of each
+// appended entry is derived from the server's directory offset (see
+// directoryFD.off); otherwise, it is the entry's index in dirents plus 1.
+//
+// Preconditions: d.handleMu must be locked. d.handleReadable.
+func (d *dentry) appendServerDirentsLocked(ctx context.Context, dirents []vfs.Dirent, off uint64) ([]vfs.Dirent, error) {
+	const count = 64 * 1024 // for consistency with the vfs1 client
 	for {
 		p9ds, err := d.handle.file.readdir(ctx, off, count)
 		if err != nil {
 			return nil, err
 		}
 		if len(p9ds) == 0 {
-			// Cache dirents for future directoryFDs if permitted.
-			if d.fs.opts.interop != InteropModeShared {
-				d.dirents = dirents
-			}
 			return dirents, nil
 		}
 		for _, p9d := range p9ds {
 			if p9d.Name == "." || p9d.Name == ".." {
 				continue
 			}
-			dirent := vfs.Dirent{
+			nextOff := int64(len(dirents) + 1)
+			if d.fs.opts.interop == InteropModeShared {
+				if p9d.Offset > math.MaxInt64-2 {
+					return nil, syserror.EOVERFLOW
+				}
+				nextOff = int64(p9d.Offset) + 2
+			}
+			dirents = append(dirents, vfs.Dirent{
 				Name:    p9d.Name,
+				Type:    direntTypeFromP9(p9d.Type),
 				Ino:     p9d.QID.Path,
-				NextOff: int64(len(dirents) + 1),
+				NextOff: nextOff,
+			})
+		}
+		off = p9ds[len(p9ds)-1].Offset
+	}
+}
+
+// direntTypeFromP9 returns the d_type of a directory entry whose QID type,
+// as returned by p9.File.Readdir, is t, so that getdents(2) callers needn't
+// stat each entry to learn its type.
+func direntTypeFromP9(t p9.QIDType) uint8 {
+	switch {
+	case t&p9.TypeDir != 0:
+		return linux.DT_DIR
+	case t&p9.TypeSymlink != 0:
+		return linux.DT_LNK
+	case t&(p9.TypeAppendOnly|p9.TypeMount|p9.TypeAuth) != 0:
+		// p9 does not expose 9P2000.U's DMDEVICE, DMNAMEDPIPE, or
+		// DMSOCKET; servers report such files as append-only (see
+		// p9.FileMode.QIDType()), so their actual type is unknown.
+		return linux.DT_UNKNOWN
+	default:
+		// The remaining QID type bits are flags of regular files.
+		return linux.DT_REG
+	}
+}
+
+// maxGetAttrChildren is the maximum number of children whose attributes are
+// requested by a single call to p9file.getAttrChildren(), bounding the size of
+// the response.
+const maxGetAttrChildren = 256
+
+// revalidateChildrenLocked refreshes the cached metadata of d and of cached
+// dentries for the given children of d using a small number of RPCs. This
+// does not replace revalidation of the children by later lookups. Children
+// without cached dentries, and children that have been replaced on the remote
+// filesystem, are skipped. Errors are ignored, since revalidation is
+// best-effort.
+//
+// Preconditions: d.fs.renameMu must be locked. d.dirMu must be locked.
+// d.handle must be readable. d.isDir(). d.fs.opts.interop ==
+// InteropModeShared.
+func (d *dentry) revalidateChildrenLocked(ctx context.Context, dirents []vfs.Dirent) {
+	if atomic.LoadUint32(&d.fs.getAttrChildrenUnsupported) != 0 {
+		return
+	}
+	var (
+		names    []string
+		children []*dentry
+	)
+	for _, dirent := range dirents {
+		if childVFSD := d.vfsd.Child(dirent.Name); childVFSD != nil {
+			names = append(names, dirent.Name)
+			children = append(children, childVFSD.Impl().(*dentry))
+		}
+	}
+	if len(children) == 0 {
+		return
+	}
+	d.handleMu.RLock()
+	_, attrMask, attr, err := d.handle.file.getAttr(ctx, dentryAttrMask())
+	d.handleMu.RUnlock()
+	if err != nil {
+		return
+	}
+	d.updateFromP9Attrs(attrMask, &attr)
+	for len(names) != 0 {
+		n := len(names)
+		if n > maxGetAttrChildren {
+			n = maxGetAttrChildren
+		}
+		stats, err := d.file.getAttrChildren(ctx, names[:n], dentryAttrMask())
+		if err != nil {
+			if err == syserror.EOPNOTSUPP || err == syserror.ENOSYS {
+				atomic.StoreUint32(&d.fs.getAttrChildrenUnsupported, 1)
 			}
-			// p9 does not expose 9P2000.U's DMDEVICE, DMNAMEDPIPE, or
-			// DMSOCKET.
-			switch p9d.Type {
-			case p9.TypeSymlink:
-				dirent.Type = linux.DT_LNK
-			case p9.TypeDir:
-				dirent.Type = linux.DT_DIR
-			default:
-				dirent.Type = linux.DT_REG
+			return
+		}
+		for i := range stats {
+			child := children[i]
+			if stats[i].Valid.Empty() || stats[i].QID.Path != child.ino {
+				continue
 			}
-			dirents = append(dirents, dirent)
+			atomic.StoreUint32(&child.qidVersion, stats[i].QID.Version)
+			child.updateFromP9Attrs(stats[i].Valid, &stats[i].Attr)
 		}
-		off = p9ds[len(p9ds)-1].Offset
+		names = names[n:]
+		children = children[n:]
 	}
 }
 
@@ -183,7 +462,7 @@ func (fd *directoryFD) Seek(ctx context.Context, offset int64, whence int32) (in
 			// fd.dentry().getDirents().
 			fd.dirents = nil
 		}
-		fd.off = offset
+		fd.setOffLocked(offset)
 		return fd.off, nil
 	case linux.SEEK_CUR:
 		offset += fd.off
@@ -191,9 +470,25 @@ func (fd *directoryFD) Seek(ctx context.Context, offset int64, whence int32) (in
 			return 0, syserror.EINVAL
 		}
 		// Don't clear fd.dirents in this case, even if offset == 0.
-		fd.off = offset
+		fd.setOffLocked(offset)
 		return fd.off, nil
 	default:
 		return 0, syserror.EINVAL
 	}
 }
+
+// setOffLocked sets fd.off to off, resuming iteration from the entry at off in
+// fd.dirents if possible, or from a new snapshot otherwise.
+//
+// Preconditions: fd.mu must be locked.
+func (fd *directoryFD) setOffLocked(off int64) {
+	fd.off = off
+	if fd.dirents == nil {
+		return
+	}
+	if idx, ok := fd.direntIndex(fd.dirents, off); ok {
+		fd.idx = idx
+	} else {
+		fd.dirents = nil
+	}
+}
@@ -0,0 +1,592 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// direntsCallback is a vfs.IterDirentsCallback that accepts remaining dirents,
+// and then fails with EINVAL, as getdents(2) does when its buffer is full.
+type direntsCallback struct {
+	remaining int
+	names     []string
+	types     []uint8
+}
+
+// Handle implements vfs.IterDirentsCallback.Handle.
+func (cb *direntsCallback) Handle(dirent vfs.Dirent) error {
+	if cb.remaining == 0 {
+		return syserror.EINVAL
+	}
+	cb.remaining--
+	cb.names = append(cb.names, dirent.Name)
+	cb.types = append(cb.types, dirent.Type)
+	return nil
+}
+
+func TestIterDirentsBufferSize(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	d, err := fs.newDentry(ctx, p9file{}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeDirectory | 0755})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	dirents := []vfs.Dirent{
+		{Name: ".", Type: linux.DT_DIR, NextOff: 1},
+		{Name: "..", Type: linux.DT_DIR, NextOff: 2},
+		{Name: "a", Type: linux.DT_REG, NextOff: 3},
+		{Name: "b", Type: linux.DT_REG, NextOff: 4},
+	}
+
+	for _, test := range []struct {
+		name    string
+		limit   int
+		wantErr error
+		want    []string
+		// If resume is true, a second read with a large enough buffer should
+		// return the remaining entries.
+		resume bool
+	}{
+		{
+			name:    "exactly one entry",
+			limit:   1,
+			wantErr: syserror.EINVAL,
+			want:    []string{"."},
+			resume:  true,
+		},
+		{
+			name:    "no entries",
+			limit:   0,
+			wantErr: syserror.EINVAL,
+		},
+		{
+			name:  "all entries",
+			limit: len(dirents),
+			want:  []string{".", "..", "a", "b"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fd := &directoryFD{dirents: dirents}
+			if err := fd.vfsfd.Init(fd, linux.O_RDONLY, newTestMount(t), &d.vfsd, &vfs.FileDescriptionOptions{}); err != nil {
+				t.Fatalf("vfsfd.Init(): %v", err)
+			}
+			cb := &direntsCallback{remaining: test.limit}
+			if err := fd.IterDirents(ctx, cb); err != test.wantErr {
+				t.Errorf("IterDirents(): got err %v, want %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(cb.names, test.want) {
+				t.Errorf("IterDirents(): got names %v, want %v", cb.names, test.want)
+			}
+			if !test.resume {
+				return
+			}
+			cb = &direntsCallback{remaining: len(dirents)}
+			if err := fd.IterDirents(ctx, cb); err != nil {
+				t.Errorf("resumed IterDirents(): %v", err)
+			}
+			if want := []string{"..", "a", "b"}; !reflect.DeepEqual(cb.names, want) {
+				t.Errorf("resumed IterDirents(): got names %v, want %v", cb.names, want)
+			}
+		})
+	}
+}
+
+// readdirNames returns the names of all entries in the directory at path
+// relative to root, as returned by a new directory FD.
+func readdirNames(ctx context.Context, t *testing.T, root vfs.VirtualDentry, path string) []string {
+	fd, err := openAt(ctx, root, path, linux.O_RDONLY|linux.O_DIRECTORY)
+	if err != nil {
+		t.Fatalf("OpenAt(%q): %v", path, err)
+	}
+	defer fd.DecRef()
+	cb := &direntsCallback{remaining: math.MaxInt32}
+	if err := fd.IterDirents(ctx, cb); err != nil {
+		t.Fatalf("IterDirents(): %v", err)
+	}
+	return cb.names
+}
+
+func TestDirentsServerOrderAfterMutation(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	rootFile := &testP9File{
+		dirents: []p9.Dirent{
+			{Name: "a", Type: p9.TypeRegular},
+			{Name: "c", Type: p9.TypeRegular},
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+
+	if got, want := readdirNames(ctx, t, root, "."), []string{".", "..", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dirents before mkdir: got %v, want %v", got, want)
+	}
+
+	// The server inserts "b" between the existing entries. Cached dirents must
+	// reflect this, rather than appending "b".
+	pop := pathOp(root, "b")
+	if err := root.Mount().Filesystem().VirtualFilesystem().MkdirAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.MkdirOptions{Mode: 0755}); err != nil {
+		t.Fatalf("MkdirAt(): %v", err)
+	}
+	if got, want := readdirNames(ctx, t, root, "."), []string{".", "..", "a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dirents after mkdir: got %v, want %v", got, want)
+	}
+}
+
+func TestDirentTypes(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	children := map[string]*testP9File{
+		"dir":     {attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}},
+		"file":    {attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}},
+		"fifo":    {attr: p9.Attr{Mode: p9.ModeNamedPipe | 0644, NLink: 1}},
+		"symlink": {attr: p9.Attr{Mode: p9.ModeSymlink | 0777, NLink: 1}},
+	}
+	rootFile := &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 3},
+		children: children,
+		dirents: []p9.Dirent{
+			{Name: "dir", Type: p9.TypeDir},
+			{Name: "fifo", Type: p9.TypeAppendOnly},
+			{Name: "file", Type: p9.TypeRegular},
+			{Name: "symlink", Type: p9.TypeSymlink},
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+
+	fd, err := openAt(ctx, root, ".", linux.O_RDONLY|linux.O_DIRECTORY)
+	if err != nil {
+		t.Fatalf("OpenAt(.): %v", err)
+	}
+	defer fd.DecRef()
+	cb := &direntsCallback{remaining: math.MaxInt32}
+	if err := fd.IterDirents(ctx, cb); err != nil {
+		t.Fatalf("IterDirents(): %v", err)
+	}
+	want := map[string]uint8{
+		".":       linux.DT_DIR,
+		"..":      linux.DT_DIR,
+		"dir":     linux.DT_DIR,
+		"fifo":    linux.DT_UNKNOWN,
+		"file":    linux.DT_REG,
+		"symlink": linux.DT_LNK,
+	}
+	if len(cb.names) != len(want) {
+		t.Errorf("got entries %v, want %d entries", cb.names, len(want))
+	}
+	for i, name := range cb.names {
+		if got := cb.types[i]; got != want[name] {
+			t.Errorf("%s: got d_type %d, want %d", name, got, want[name])
+		}
+	}
+	// Types are reported without looking up or stating any entry.
+	for name, child := range children {
+		if len(child.getAttrs) != 0 {
+			t.Errorf("%s: got %d GetAttr RPCs, want 0", name, len(child.getAttrs))
+		}
+	}
+}
+
+func TestDirentsSharedCache(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{interop: InteropModeShared})
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		qid:  p9.QID{Type: p9.TypeDir, Version: 1},
+		dirents: []p9.Dirent{
+			{Name: "a", Type: p9.TypeRegular},
+			{Name: "c", Type: p9.TypeRegular},
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+
+	// Listing the directory twice with no intervening change reads it from
+	// the server only once.
+	want := []string{".", "..", "a", "c"}
+	for i := 0; i < 2; i++ {
+		if got := readdirNames(ctx, t, root, "."); !reflect.DeepEqual(got, want) {
+			t.Errorf("listing %d: got %v, want %v", i, got, want)
+		}
+	}
+	if rootFile.readdirs != 1 {
+		t.Errorf("after unchanged listings: got %d directory reads, want 1", rootFile.readdirs)
+	}
+
+	// Client mutations invalidate cached dirents, even though the server
+	// doesn't change the directory's version.
+	pop := pathOp(root, "b")
+	if err := root.Mount().Filesystem().VirtualFilesystem().MkdirAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.MkdirOptions{Mode: 0755}); err != nil {
+		t.Fatalf("MkdirAt(): %v", err)
+	}
+	want = []string{".", "..", "a", "b", "c"}
+	if got := readdirNames(ctx, t, root, "."); !reflect.DeepEqual(got, want) {
+		t.Errorf("after mkdir: got %v, want %v", got, want)
+	}
+	if rootFile.readdirs != 2 {
+		t.Errorf("after mkdir: got %d directory reads, want 2", rootFile.readdirs)
+	}
+
+	// Changes by other users of the remote filesystem, which change the
+	// directory's version, also invalidate cached dirents.
+	rootFile.dirents = append(rootFile.dirents, p9.Dirent{Name: "d", Type: p9.TypeRegular})
+	rootFile.qid.Version++
+	want = []string{".", "..", "a", "b", "c", "d"}
+	if got := readdirNames(ctx, t, root, "."); !reflect.DeepEqual(got, want) {
+		t.Errorf("after remote change: got %v, want %v", got, want)
+	}
+	if rootFile.readdirs != 3 {
+		t.Errorf("after remote change: got %d directory reads, want 3", rootFile.readdirs)
+	}
+}
+
+func TestDirentsCacheNone(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{interop: InteropModeShared, regularFilesUseSpecialFileFD: true})
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		qid:  p9.QID{Type: p9.TypeDir, Version: 1},
+		dirents: []p9.Dirent{
+			{Name: "a", Type: p9.TypeRegular},
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+
+	want := []string{".", "..", "a"}
+	if got := readdirNames(ctx, t, root, "."); !reflect.DeepEqual(got, want) {
+		t.Errorf("first listing: got %v, want %v", got, want)
+	}
+
+	// Changes by other users of the remote filesystem are visible
+	// immediately, even if the server doesn't change the directory's
+	// version.
+	rootFile.dirents = append(rootFile.dirents, p9.Dirent{Name: "b", Type: p9.TypeRegular})
+	want = []string{".", "..", "a", "b"}
+	if got := readdirNames(ctx, t, root, "."); !reflect.DeepEqual(got, want) {
+		t.Errorf("after remote change: got %v, want %v", got, want)
+	}
+	if rootFile.readdirs != 2 {
+		t.Errorf("got %d directory reads, want 2", rootFile.readdirs)
+	}
+}
+
+func TestDirentsResumeFromServerOffset(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{interop: InteropModeShared})
+	// The directory's QID version is 0, so its entries are never cached by
+	// the dentry, and every read from the beginning goes to the server.
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		qid:  p9.QID{Type: p9.TypeDir},
+	}
+	want := []string{".", ".."}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("f%03d", i)
+		rootFile.dirents = append(rootFile.dirents, p9.Dirent{Name: name, Type: p9.TypeRegular})
+		want = append(want, name)
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+
+	// Read the directory in chunks of 8 entries, as by getdents(2) with a
+	// small buffer, remembering the offset after the first chunk.
+	fd, err := openAt(ctx, root, ".", linux.O_RDONLY|linux.O_DIRECTORY)
+	if err != nil {
+		t.Fatalf("OpenAt(): %v", err)
+	}
+	defer fd.DecRef()
+	const chunk = 8
+	var got []string
+	var savedOff int64
+	for {
+		cb := &direntsCallback{remaining: chunk}
+		if err := fd.IterDirents(ctx, cb); err != nil && err != syserror.EINVAL {
+			t.Fatalf("IterDirents(): %v", err)
+		}
+		if len(cb.names) == 0 {
+			break
+		}
+		got = append(got, cb.names...)
+		if savedOff == 0 {
+			if savedOff, err = fd.Seek(ctx, 0, linux.SEEK_CUR); err != nil {
+				t.Fatalf("Seek(SEEK_CUR): %v", err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chunked reads: got %v, want %v", got, want)
+	}
+	if rootFile.readdirs != 1 {
+		t.Errorf("after chunked reads: got %d reads from offset 0, want 1", rootFile.readdirs)
+	}
+
+	// Seeking a new FD to a saved offset resumes reading from the server at
+	// that offset, without rereading the beginning of the directory.
+	fd2, err := openAt(ctx, root, ".", linux.O_RDONLY|linux.O_DIRECTORY)
+	if err != nil {
+		t.Fatalf("OpenAt(): %v", err)
+	}
+	defer fd2.DecRef()
+	if _, err := fd2.Seek(ctx, savedOff, linux.SEEK_SET); err != nil {
+		t.Fatalf("Seek(%d, SEEK_SET): %v", savedOff, err)
+	}
+	cb := &direntsCallback{remaining: math.MaxInt32}
+	if err := fd2.IterDirents(ctx, cb); err != nil {
+		t.Fatalf("IterDirents(): %v", err)
+	}
+	if !reflect.DeepEqual(cb.names, want[8:]) {
+		t.Errorf("after seek: got %v, want %v", cb.names, want[8:])
+	}
+	if rootFile.readdirs != 1 {
+		t.Errorf("after seek: got %d reads from offset 0, want 1", rootFile.readdirs)
+	}
+
+	// Seeking to offset 0 rereads the directory from the beginning.
+	if _, err := fd2.Seek(ctx, 0, linux.SEEK_SET); err != nil {
+		t.Fatalf("Seek(0, SEEK_SET): %v", err)
+	}
+	cb = &direntsCallback{remaining: math.MaxInt32}
+	if err := fd2.IterDirents(ctx, cb); err != nil {
+		t.Fatalf("IterDirents(): %v", err)
+	}
+	if !reflect.DeepEqual(cb.names, want) {
+		t.Errorf("after rewind: got %v, want %v", cb.names, want)
+	}
+	if rootFile.readdirs != 2 {
+		t.Errorf("after rewind: got %d reads from offset 0, want 2", rootFile.readdirs)
+	}
+}
+
+func TestDirentsSeek(t *testing.T) {
+	for _, interop := range []InteropMode{InteropModeExclusive, InteropModeShared} {
+		t.Run(fmt.Sprintf("interop=%v", interop), func(t *testing.T) {
+			ctx := contexttest.RootContext(t)
+			fs := newTestFilesystem(ctx, filesystemOptions{interop: interop})
+			rootFile := &testP9File{
+				attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+				qid:  p9.QID{Type: p9.TypeDir, Version: 1},
+				dirents: []p9.Dirent{
+					{Name: "a", Type: p9.TypeRegular},
+					{Name: "b", Type: p9.TypeRegular},
+					{Name: "c", Type: p9.TypeRegular},
+				},
+			}
+			root := newTestRoot(ctx, t, fs, rootFile, nil)
+			defer root.DecRef()
+			openDir := func() *vfs.FileDescription {
+				fd, err := openAt(ctx, root, ".", linux.O_RDONLY|linux.O_DIRECTORY)
+				if err != nil {
+					t.Fatalf("OpenAt(.): %v", err)
+				}
+				return fd
+			}
+			read := func(fd *vfs.FileDescription) []string {
+				cb := &direntsCallback{remaining: math.MaxInt32}
+				if err := fd.IterDirents(ctx, cb); err != nil {
+					t.Fatalf("IterDirents(): %v", err)
+				}
+				return cb.names
+			}
+			seek := func(fd *vfs.FileDescription, off int64, whence int32) int64 {
+				off, err := fd.Seek(ctx, off, whence)
+				if err != nil {
+					t.Fatalf("Seek(): %v", err)
+				}
+				return off
+			}
+
+			// Read up to and including "a", and remember the offset that
+			// follows it, as for telldir(3).
+			fd := openDir()
+			defer fd.DecRef()
+			cb := &direntsCallback{remaining: 3}
+			if err := fd.IterDirents(ctx, cb); err != syserror.EINVAL {
+				t.Fatalf("IterDirents(): got error %v, want EINVAL", err)
+			}
+			if want := []string{".", "..", "a"}; !reflect.DeepEqual(cb.names, want) {
+				t.Fatalf("IterDirents(): got %v, want %v", cb.names, want)
+			}
+			afterA := seek(fd, 0, linux.SEEK_CUR)
+			if got, want := read(fd), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("continued read: got %v, want %v", got, want)
+			}
+
+			// Resuming from the remembered offset returns the same entries.
+			seek(fd, afterA, linux.SEEK_SET)
+			if got, want := read(fd), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("resumed read: got %v, want %v", got, want)
+			}
+
+			// Rewinding returns all entries.
+			seek(fd, 0, linux.SEEK_SET)
+			if got, want := read(fd), []string{".", "..", "a", "b", "c"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("rewound read: got %v, want %v", got, want)
+			}
+
+			if interop != InteropModeShared {
+				return
+			}
+			// Offsets are server directory offsets, so they remain valid
+			// after the directory is changed remotely, even for a new FD.
+			rootFile.dirents = append(rootFile.dirents, p9.Dirent{Name: "d", Type: p9.TypeRegular})
+			rootFile.qid.Version++
+			fd2 := openDir()
+			defer fd2.DecRef()
+			seek(fd2, afterA, linux.SEEK_SET)
+			if got, want := read(fd2), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("resumed read after remote change: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDirectorySearchPermission(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		mode    p9.FileMode
+		wantErr error
+	}{
+		{
+			name: "searchable",
+			mode: 0555,
+		},
+		{
+			name:    "not searchable",
+			mode:    0666,
+			wantErr: syserror.EACCES,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// contexttest.Context() carries credentials without capabilities,
+			// so access is determined by the "other" permission bits.
+			ctx := contexttest.Context(t)
+			fs := newTestFilesystem(ctx, filesystemOptions{})
+			dirFile := &testP9File{
+				children: map[string]*testP9File{
+					"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0444}},
+				},
+			}
+			dir, err := fs.newDentry(ctx, p9file{file: dirFile}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeDirectory | test.mode})
+			if err != nil {
+				t.Fatalf("fs.newDentry(): %v", err)
+			}
+			root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"dir": dir})
+			defer root.DecRef()
+
+			// access(dir, X_OK) checks for search permission.
+			pop := pathOp(root, "dir")
+			if err := root.Mount().Filesystem().VirtualFilesystem().AccessAt(ctx, auth.CredentialsFromContext(ctx), vfs.MayExec, pop); err != test.wantErr {
+				t.Errorf("AccessAt(dir, X_OK): got err %v, want %v", err, test.wantErr)
+			}
+
+			// Traversal into dir also requires search permission.
+			fd, err := openAt(ctx, root, "dir/file", linux.O_RDONLY)
+			if err != test.wantErr {
+				t.Errorf("OpenAt(dir/file): got err %v, want %v", err, test.wantErr)
+			}
+			if fd != nil {
+				fd.DecRef()
+			}
+		})
+	}
+}
+
+func TestBatchRevalidateDirectoryRead(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const numChildren = 20
+	rootFile := &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: make(map[string]*testP9File),
+	}
+	var names []string
+	for i := 0; i < numChildren; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		names = append(names, name)
+		rootFile.children[name] = &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}}
+		rootFile.dirents = append(rootFile.dirents, p9.Dirent{Name: name, Type: p9.TypeRegular})
+	}
+	addr, _ := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",cache=remote_revalidating")
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+	vfsObj := fs.vfsfs.VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+	statAll := func() {
+		for _, name := range names {
+			stat, err := vfsObj.StatAt(ctx, creds, pathOp(root, name), &vfs.StatOptions{Mask: linux.STATX_SIZE})
+			if err != nil {
+				t.Fatalf("StatAt(%s): %v", name, err)
+			}
+			if want := rootFile.children[name].attr.Size; stat.Size != want {
+				t.Errorf("StatAt(%s): got size %d, want %d", name, stat.Size, want)
+			}
+		}
+	}
+
+	// Instantiate dentries for all children.
+	statAll()
+
+	// Change the children's metadata on the server, then list the directory.
+	for _, name := range names {
+		rootFile.children[name].attr.Size = 1
+	}
+	before := fs.Stats()
+	readdirNames(ctx, t, root, ".")
+	listing := fs.Stats()
+	if got := listing.GetAttrs - before.GetAttrs; got >= numChildren {
+		t.Errorf("directory read issued %d getattrs, want fewer than %d", got, numChildren)
+	}
+
+	// The directory read should have updated the children's cached dentries.
+	rootDentry := root.Dentry().Impl().(*dentry)
+	rootDentry.dirMu.Lock()
+	for _, name := range names {
+		childVFSD := rootDentry.vfsd.Child(name)
+		if childVFSD == nil {
+			t.Errorf("no cached dentry for %s after directory read", name)
+			continue
+		}
+		if got := atomic.LoadUint64(&childVFSD.Impl().(*dentry).size); got != 1 {
+			t.Errorf("cached size of %s after directory read: got %d, want 1", name, got)
+		}
+	}
+	rootDentry.dirMu.Unlock()
+
+	// Later lookups must still revalidate the children, so changes made
+	// after the directory read are observed.
+	for _, name := range names {
+		rootFile.children[name].attr.Size = 2
+	}
+	statAll()
+	after := fs.Stats()
+	if got := (after.Walks + after.GetAttrs) - (listing.Walks + listing.GetAttrs); got == 0 {
+		t.Errorf("stats after directory read issued no revalidation RPCs")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/sentry/pgalloc"
+)
+
+// filesystemEvictableRange is the EvictableRange with which a filesystem
+// registers itself as an EvictableMemoryUser. filesystem.Evict() always
+// considers all of the filesystem's cached state, so the range itself is
+// arbitrary.
+var filesystemEvictableRange = pgalloc.EvictableRange{0, 1}
+
+// markEvictable informs the MemoryFile that fs may have clean cached pages or
+// unreferenced cached dentries that can be released under memory pressure.
+//
+// This is only done if the MemoryFile delays evictions until memory pressure
+// is indicated; otherwise, it would evict fs' cached dentries as soon as they
+// become cached, defeating the dentry cache.
+func (fs *filesystem) markEvictable() {
+	mf := fs.mfp.MemoryFile()
+	if !mf.ShouldCacheEvictable() {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&fs.evictable, 0, 1) {
+		mf.MarkEvictable(fs, filesystemEvictableRange)
+	}
+}
+
+// Evict implements pgalloc.EvictableMemoryUser.Evict. It is called by the
+// MemoryFile under memory pressure, and releases clean cached pages from all
+// dentries and destroys cached dentries with no references. Dentries with
+// dirty cached data are skipped, since releasing them would require writing
+// back to the remote filesystem.
+func (fs *filesystem) Evict(ctx context.Context, er pgalloc.EvictableRange) {
+	// The MemoryFile won't call Evict again until fs is re-marked evictable.
+	// Do this before releasing anything, so that state cached concurrently
+	// re-marks fs.
+	atomic.StoreUint32(&fs.evictable, 0)
+
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+
+	// Evict cached dentries, in the order chosen by fs.cachePolicy. Evicting a
+	// dentry may cause its parent to become cached (or be evicted), so
+	// determine the candidates before evicting any.
+	var victims []*dentry
+	for d := fs.cachedDentries.Back(); d != nil; d = d.Prev() {
+		victims = append(victims, d)
+	}
+	for _, d := range victims {
+		if !d.cached || atomic.LoadInt64(&d.refs) != 0 || d.hasDirtyData() {
+			continue
+		}
+		fs.evictCachedDentryLocked(d)
+		fs.dentryCacheStats.count(dentryCacheEvict)
+	}
+
+	// Drop clean pages from the remaining dentries.
+	fs.syncMu.Lock()
+	ds := make([]*dentry, 0, len(fs.dentries))
+	for d := range fs.dentries {
+		ds = append(ds, d)
+	}
+	fs.syncMu.Unlock()
+	mf := fs.mfp.MemoryFile()
+	for _, d := range ds {
+		d.mapsMu.Lock()
+		d.dataMu.Lock()
+		d.dropCleanPagesLocked(mf)
+		d.updateCachedBytesLocked()
+		d.dataMu.Unlock()
+		d.mapsMu.Unlock()
+	}
+}
+
+// hasDirtyData returns true if d has cached data that has not been written
+// back to the remote file.
+func (d *dentry) hasDirtyData() bool {
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	return !d.dirty.IsEmpty()
+}
+
+// dropCleanPagesLocked releases cached pages that are neither dirty nor
+// memory-mapped.
+//
+// Preconditions: d.mapsMu and d.dataMu must be locked.
+func (d *dentry) dropCleanPagesLocked(mf *pgalloc.MemoryFile) {
+	if d.cache.IsEmpty() {
+		return
+	}
+	if d.mappings.IsEmpty() && d.dirty.IsEmpty() {
+		d.cache.DropAll(mf)
+		return
+	}
+	for mgap := d.mappings.FirstGap(); mgap.Ok(); mgap = mgap.NextGap() {
+		mgapMR := mgap.Range()
+		for dgap := d.dirty.LowerBoundGap(mgapMR.Start); dgap.Ok() && dgap.Start() < mgapMR.End; dgap = dgap.NextGap() {
+			if mr := dgap.Range().Intersect(mgapMR); mr.Length() != 0 {
+				d.cache.Drop(mr, mf)
+			}
+		}
+	}
+}
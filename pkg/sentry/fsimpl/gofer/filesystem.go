@@ -15,10 +15,13 @@
 package gofer
 
 import (
+	"math"
 	"sync"
+	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/fd"
 	"gvisor.dev/gvisor/pkg/fspath"
 	"gvisor.dev/gvisor/pkg/p9"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
@@ -27,8 +30,15 @@ import (
 	"gvisor.dev/gvisor/pkg/syserror"
 )
 
-// Sync implements vfs.FilesystemImpl.Sync.
+// Sync implements vfs.FilesystemImpl.Sync. It writes back all dirty cached
+// data and syncs all writable remote files, without affecting the connection
+// to the server, so the filesystem remains usable afterward.
 func (fs *filesystem) Sync(ctx context.Context) error {
+	// All dirty data is written back below, so the writeback worker needn't
+	// do so. Report errors that it encountered since the last sync, since
+	// they were not otherwise reported to the application.
+	writebackErr := fs.drainWriteback()
+
 	// Snapshot current dentries and special files.
 	fs.syncMu.Lock()
 	ds := make([]*dentry, 0, len(fs.dentries))
@@ -50,7 +60,7 @@ func (fs *filesystem) Sync(ctx context.Context) error {
 		if !d.TryIncRef() {
 			continue
 		}
-		err := d.syncSharedHandle(ctx)
+		err := d.syncSharedHandle(ctx, false /* dataOnly */)
 		d.DecRef()
 		if err != nil && retErr == nil {
 			retErr = err
@@ -70,6 +80,9 @@ func (fs *filesystem) Sync(ctx context.Context) error {
 		}
 	}
 
+	if retErr == nil {
+		retErr = writebackErr
+	}
 	return retErr
 }
 
@@ -153,6 +166,14 @@ afterSymlink:
 	if err != nil {
 		return nil, err
 	}
+	cachedVFSD := childVFSD
+	if childVFSD == nil && !rp.Final() {
+		// Look up this and following uncached path components in a single
+		// RPC, so that they are cached when we step through them.
+		if child := fs.lookupMultipleLocked(ctx, d, rp.PeekComponents(p9.MaxWalkElements), ds); child != nil {
+			childVFSD = &child.vfsd
+		}
+	}
 	// FIXME(jamieliu): Linux performs revalidation before mount lookup
 	// (fs/namei.c:lookup_fast() => __d_lookup_rcu(), d_revalidate(),
 	// __follow_mount_rcu()).
@@ -160,6 +181,11 @@ afterSymlink:
 	if err != nil {
 		return nil, err
 	}
+	if child != nil && cachedVFSD == &child.vfsd {
+		fs.dentryCacheStats.count(dentryCacheHit)
+	} else {
+		fs.dentryCacheStats.count(dentryCacheMiss)
+	}
 	if child == nil {
 		return nil, syserror.ENOENT
 	}
@@ -210,9 +236,14 @@ func (fs *filesystem) revalidateChildLocked(ctx context.Context, vfsObj *vfs.Vir
 	if childVFSD != nil {
 		child := childVFSD.Impl().(*dentry)
 		if !file.isNil() && qid.Path == child.ino {
-			// The file at this path hasn't changed. Just update cached
-			// metadata.
+			// The file at this path hasn't been replaced. Just update
+			// cached metadata, unless the QID version shows that the file
+			// hasn't been modified either.
 			file.close(ctx)
+			if qid.Version != 0 && qid.Version == atomic.LoadUint32(&child.qidVersion) {
+				return child, nil
+			}
+			atomic.StoreUint32(&child.qidVersion, qid.Version)
 			child.updateFromP9Attrs(attrMask, &attr)
 			return child, nil
 		}
@@ -224,6 +255,21 @@ func (fs *filesystem) revalidateChildLocked(ctx context.Context, vfsObj *vfs.Vir
 		childVFSD = nil
 	}
 	if file.isNil() {
+		if fs.opts.casefold {
+			canonical, err := parent.casefoldChildLocked(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			if canonical != "" && canonical != name {
+				child, err := fs.revalidateChildLocked(ctx, vfsObj, parent, canonical, parent.vfsd.Child(canonical), ds)
+				if child == nil && err == nil {
+					// canonical was removed by another remote filesystem
+					// user, so parent.casefoldNames is stale.
+					parent.casefoldNames = nil
+				}
+				return child, err
+			}
+		}
 		// No file exists at this path now. Cache the negative lookup if
 		// allowed.
 		if fs.opts.interop != InteropModeShared {
@@ -238,13 +284,83 @@ func (fs *filesystem) revalidateChildLocked(ctx context.Context, vfsObj *vfs.Vir
 		return nil, err
 	}
 	parent.IncRef() // reference held by child on its parent
-	parent.vfsd.InsertChild(&child.vfsd, name)
+	parent.insertChildLocked(child, name)
 	// For now, child has 0 references, so our caller should call
 	// child.checkCachingLocked().
 	*ds = appendDentry(*ds, child)
 	return child, nil
 }
 
+// lookupMultipleLocked looks up each of names in turn, starting from parent,
+// using a single RPC, and caches a dentry for each name that exists. Walking
+// stops early at the first name that does not exist or is not a directory
+// (e.g. a symlink, which must be followed by our caller), and at names that
+// cannot be walked as ordinary children. Any later names are left to be
+// looked up one at a time.
+//
+// lookupMultipleLocked returns the new dentry for names[0], or nil if the
+// lookup was not batched, in which case the caller should fall back to
+// revalidateChildLocked. Errors are ignored, since batching is best-effort.
+//
+// Preconditions: fs.renameMu must be locked. parent.dirMu must be locked.
+// parent.isDir(). parent.vfsd.Child(names[0]) == nil.
+func (fs *filesystem) lookupMultipleLocked(ctx context.Context, parent *dentry, names []string, ds **[]*dentry) *dentry {
+	if atomic.LoadUint32(&fs.multiWalkUnsupported) != 0 {
+		return nil
+	}
+	for i, name := range names {
+		if name == "." || name == ".." || len(name) > maxFilenameLen {
+			names = names[:i]
+			break
+		}
+	}
+	if len(names) < 2 {
+		return nil
+	}
+	if _, ok := parent.negativeChildren[names[0]]; ok {
+		return nil
+	}
+	files, stats, err := parent.file.walkMultiple(ctx, names)
+	if err != nil {
+		if err == syserror.EOPNOTSUPP || err == syserror.ENOSYS {
+			atomic.StoreUint32(&fs.multiWalkUnsupported, 1)
+		}
+		return nil
+	}
+	var first *dentry
+	for i, file := range files {
+		child, err := fs.newDentry(ctx, file, stats[i].QID, stats[i].Valid, &stats[i].Attr)
+		if err != nil {
+			for _, file := range files[i:] {
+				file.close(ctx)
+			}
+			break
+		}
+		parent.IncRef() // reference held by child on its parent
+		if first == nil {
+			parent.insertChildLocked(child, names[i])
+			first = child
+		} else {
+			// parent is a dentry created by this function, so its dirMu
+			// can't be contended.
+			parent.dirMu.Lock()
+			parent.insertChildLocked(child, names[i])
+			parent.dirMu.Unlock()
+		}
+		// For now, child has 0 references, so our caller should call
+		// child.checkCachingLocked().
+		*ds = appendDentry(*ds, child)
+		if !child.isDir() {
+			for _, file := range files[i+1:] {
+				file.close(ctx)
+			}
+			break
+		}
+		parent = child
+	}
+	return first
+}
+
 // walkParentDirLocked resolves all but the last path component of rp to an
 // existing directory, starting from the given directory (which is usually
 // rp.Start().Impl().(*dentry)). It does not check that the returned directory
@@ -275,7 +391,7 @@ func (fs *filesystem) resolveLocked(ctx context.Context, rp *vfs.ResolvingPath,
 	d := rp.Start().Impl().(*dentry)
 	if fs.opts.interop == InteropModeShared {
 		// Get updated metadata for rp.Start() as required by fs.stepLocked().
-		if err := d.updateFromGetattr(ctx); err != nil {
+		if err := d.revalidate(ctx); err != nil {
 			return nil, err
 		}
 	}
@@ -294,12 +410,24 @@ func (fs *filesystem) resolveLocked(ctx context.Context, rp *vfs.ResolvingPath,
 	return d, nil
 }
 
+// checkBeginWrite is equivalent to mnt.CheckBeginWrite(), except that it also
+// returns EROFS if fs was mounted with the "ro" mount option. If
+// checkBeginWrite succeeds, mnt.EndWrite() must be called when the write
+// operation is complete.
+func (fs *filesystem) checkBeginWrite(mnt *vfs.Mount) error {
+	if fs.opts.readonly {
+		return syserror.EROFS
+	}
+	return mnt.CheckBeginWrite()
+}
+
 // doCreateAt checks that creating a file at rp is permitted, then invokes
-// create to do so.
+// create to do so. If create inserts a dentry into the tree, it must append
+// the dentry to ds.
 //
 // Preconditions: !rp.Done(). For the final path component in rp,
 // !rp.ShouldFollowSymlink().
-func (fs *filesystem) doCreateAt(ctx context.Context, rp *vfs.ResolvingPath, dir bool, create func(parent *dentry, name string) error) error {
+func (fs *filesystem) doCreateAt(ctx context.Context, rp *vfs.ResolvingPath, dir bool, create func(parent *dentry, name string, ds **[]*dentry) error) error {
 	var ds *[]*dentry
 	fs.renameMu.RLock()
 	defer fs.renameMuRUnlockAndCheckCaching(&ds)
@@ -307,7 +435,7 @@ func (fs *filesystem) doCreateAt(ctx context.Context, rp *vfs.ResolvingPath, dir
 	if fs.opts.interop == InteropModeShared {
 		// Get updated metadata for start as required by
 		// fs.walkParentDirLocked().
-		if err := start.updateFromGetattr(ctx); err != nil {
+		if err := start.revalidate(ctx); err != nil {
 			return err
 		}
 	}
@@ -332,7 +460,7 @@ func (fs *filesystem) doCreateAt(ctx context.Context, rp *vfs.ResolvingPath, dir
 		return syserror.ENOENT
 	}
 	mnt := rp.Mount()
-	if err := mnt.CheckBeginWrite(); err != nil {
+	if err := fs.checkBeginWrite(mnt); err != nil {
 		return err
 	}
 	defer mnt.EndWrite()
@@ -346,21 +474,21 @@ func (fs *filesystem) doCreateAt(ctx context.Context, rp *vfs.ResolvingPath, dir
 		// will fail with EEXIST like we would have. If the RPC succeeds, and a
 		// stale dentry exists, the dentry will fail revalidation next time
 		// it's used.
-		return create(parent, name)
+		return create(parent, name, &ds)
 	}
 	if parent.vfsd.Child(name) != nil {
 		return syserror.EEXIST
 	}
 	// No cached dentry exists; however, there might still be an existing file
 	// at name. As above, we attempt the file creation RPC anyway.
-	if err := create(parent, name); err != nil {
+	if err := create(parent, name, &ds); err != nil {
 		return err
 	}
 	if fs.opts.interop != InteropModeShared {
 		parent.touchCMtime()
 	}
 	delete(parent.negativeChildren, name)
-	parent.dirents = nil
+	parent.invalidateDirentsLocked()
 	return nil
 }
 
@@ -373,7 +501,7 @@ func (fs *filesystem) unlinkAt(ctx context.Context, rp *vfs.ResolvingPath, dir b
 	if fs.opts.interop == InteropModeShared {
 		// Get updated metadata for start as required by
 		// fs.walkParentDirLocked().
-		if err := start.updateFromGetattr(ctx); err != nil {
+		if err := start.revalidate(ctx); err != nil {
 			return err
 		}
 	}
@@ -384,7 +512,7 @@ func (fs *filesystem) unlinkAt(ctx context.Context, rp *vfs.ResolvingPath, dir b
 	if err := parent.checkPermissions(rp.Credentials(), vfs.MayWrite|vfs.MayExec); err != nil {
 		return err
 	}
-	if err := rp.Mount().CheckBeginWrite(); err != nil {
+	if err := fs.checkBeginWrite(rp.Mount()); err != nil {
 		return err
 	}
 	defer rp.Mount().EndWrite()
@@ -466,8 +594,8 @@ func (fs *filesystem) unlinkAt(ctx context.Context, rp *vfs.ResolvingPath, dir b
 			parent.decLinks()
 		}
 		parent.cacheNegativeChildLocked(name)
-		parent.dirents = nil
 	}
+	parent.invalidateDirentsLocked()
 	if child != nil {
 		child.setDeleted()
 		vfsObj.CommitDeleteDentry(childVFSD)
@@ -553,7 +681,7 @@ func (fs *filesystem) GetParentDentryAt(ctx context.Context, rp *vfs.ResolvingPa
 	if fs.opts.interop == InteropModeShared {
 		// Get updated metadata for start as required by
 		// fs.walkParentDirLocked().
-		if err := start.updateFromGetattr(ctx); err != nil {
+		if err := start.revalidate(ctx); err != nil {
 			return nil, err
 		}
 	}
@@ -567,18 +695,60 @@ func (fs *filesystem) GetParentDentryAt(ctx context.Context, rp *vfs.ResolvingPa
 
 // LinkAt implements vfs.FilesystemImpl.LinkAt.
 func (fs *filesystem) LinkAt(ctx context.Context, rp *vfs.ResolvingPath, vd vfs.VirtualDentry) error {
-	return fs.doCreateAt(ctx, rp, false /* dir */, func(parent *dentry, childName string) error {
+	return fs.doCreateAt(ctx, rp, false /* dir */, func(parent *dentry, childName string, _ **[]*dentry) error {
 		if rp.Mount() != vd.Mount() {
 			return syserror.EXDEV
 		}
-		// 9P2000.L supports hard links, but we don't.
-		return syserror.EPERM
+		d := vd.Dentry().Impl().(*dentry)
+		if d.isDir() {
+			return syserror.EPERM
+		}
+		// If the server didn't report the file's link count, d.nlink is 0;
+		// leave it to the server to fail the link if the file has actually
+		// been deleted.
+		nlink := atomic.LoadUint32(&d.nlink)
+		if nlink == math.MaxUint32 {
+			return syserror.EMLINK
+		}
+		// The new link is represented by a distinct dentry, created from the
+		// server's metadata when it is first looked up. Write back and drop
+		// d's cached data first, so that the new dentry observes d's writes
+		// and d rereads the file from the server.
+		if d.isRegularFile() {
+			d.metadataMu.Lock()
+			err := d.writebackAndEvictLocked(ctx, 0, int64(atomic.LoadUint64(&d.size)))
+			d.metadataMu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		if err := parent.file.link(ctx, d.file, childName); err != nil {
+			return err
+		}
+		if fs.opts.interop == InteropModeShared {
+			// Other remote filesystem users may have changed the link count
+			// concurrently, so get it from the server.
+			return d.updateFromGetattrUncoalesced(ctx, dentryAttrMask())
+		}
+		// Get the link count from the server if possible, since d's cached
+		// link count may be out of date. d's other cached metadata is
+		// authoritative.
+		_, attrMask, attr, err := d.getAttrFromServer(ctx, p9.AttrMask{NLink: true})
+		if err == nil && attrMask.NLink {
+			d.metadataMu.Lock()
+			atomic.StoreUint32(&d.nlink, uint32(attr.NLink))
+			d.metadataMu.Unlock()
+		} else if nlink != 0 {
+			d.incLinks()
+		}
+		d.touchCtime()
+		return nil
 	})
 }
 
 // MkdirAt implements vfs.FilesystemImpl.MkdirAt.
 func (fs *filesystem) MkdirAt(ctx context.Context, rp *vfs.ResolvingPath, opts vfs.MkdirOptions) error {
-	return fs.doCreateAt(ctx, rp, true /* dir */, func(parent *dentry, name string) error {
+	return fs.doCreateAt(ctx, rp, true /* dir */, func(parent *dentry, name string, _ **[]*dentry) error {
 		creds := rp.Credentials()
 		if _, err := parent.file.mkdir(ctx, name, (p9.FileMode)(opts.Mode), (p9.UID)(creds.EffectiveKUID), (p9.GID)(creds.EffectiveKGID)); err != nil {
 			return err
@@ -592,10 +762,25 @@ func (fs *filesystem) MkdirAt(ctx context.Context, rp *vfs.ResolvingPath, opts v
 
 // MknodAt implements vfs.FilesystemImpl.MknodAt.
 func (fs *filesystem) MknodAt(ctx context.Context, rp *vfs.ResolvingPath, opts vfs.MknodOptions) error {
-	return fs.doCreateAt(ctx, rp, false /* dir */, func(parent *dentry, name string) error {
+	switch opts.Mode.FileType() {
+	case 0, linux.S_IFREG, linux.S_IFCHR, linux.S_IFBLK, linux.S_IFIFO, linux.S_IFSOCK:
+	default:
+		return syserror.EPERM
+	}
+	return fs.doCreateAt(ctx, rp, false /* dir */, func(parent *dentry, name string, ds **[]*dentry) error {
 		creds := rp.Credentials()
-		_, err := parent.file.mknod(ctx, name, (p9.FileMode)(opts.Mode), opts.DevMajor, opts.DevMinor, (p9.UID)(creds.EffectiveKUID), (p9.GID)(creds.EffectiveKGID))
-		return err
+		if _, err := parent.file.mknod(ctx, name, (p9.FileMode)(opts.Mode), opts.DevMajor, opts.DevMinor, (p9.UID)(creds.EffectiveKUID), (p9.GID)(creds.EffectiveKGID)); err != nil {
+			return err
+		}
+		// Instantiate a dentry for the new file, so that it needn't be walked
+		// again when it is opened. In InteropModeShared, this also replaces
+		// any stale dentry cached at name. The file has been created even if
+		// this fails, so don't report failure to our caller.
+		delete(parent.negativeChildren, name)
+		if _, err := fs.revalidateChildLocked(ctx, rp.VirtualFilesystem(), parent, name, parent.vfsd.Child(name), ds); err != nil {
+			ctx.Debugf("gofer.filesystem.MknodAt: failed to revalidate created file %q: %v", name, err)
+		}
+		return nil
 	})
 }
 
@@ -609,6 +794,11 @@ func (fs *filesystem) OpenAt(ctx context.Context, rp *vfs.ResolvingPath, opts vf
 		return nil, syserror.EOPNOTSUPP
 	}
 	mayCreate := opts.Flags&linux.O_CREAT != 0
+	// O_EXCL without O_CREAT is ignored, except for block devices, for which
+	// Linux fails with EBUSY if the device is in use (e.g. mounted). Block
+	// devices on the remote filesystem are never mounted by the sentry, so
+	// this reduces to ignoring O_EXCL for them as well; note that openHandle()
+	// doesn't pass it to the server.
 	mustCreate := opts.Flags&(linux.O_CREAT|linux.O_EXCL) == (linux.O_CREAT | linux.O_EXCL)
 
 	var ds *[]*dentry
@@ -618,7 +808,7 @@ func (fs *filesystem) OpenAt(ctx context.Context, rp *vfs.ResolvingPath, opts vf
 	start := rp.Start().Impl().(*dentry)
 	if fs.opts.interop == InteropModeShared {
 		// Get updated metadata for start as required by fs.stepLocked().
-		if err := start.updateFromGetattr(ctx); err != nil {
+		if err := start.revalidate(ctx); err != nil {
 			return nil, err
 		}
 	}
@@ -676,13 +866,19 @@ func (d *dentry) openLocked(ctx context.Context, rp *vfs.ResolvingPath, opts *vf
 	filetype := d.fileType()
 	switch {
 	case filetype == linux.S_IFREG && !d.fs.opts.regularFilesUseSpecialFileFD:
+		d.incOpenFDs()
 		if err := d.ensureSharedHandle(ctx, ats&vfs.MayRead != 0, ats&vfs.MayWrite != 0, opts.Flags&linux.O_TRUNC != 0); err != nil {
+			d.decOpenFDs()
 			return nil, err
 		}
+		if ats&vfs.MayRead != 0 && opts.Flags&linux.O_DIRECT == 0 {
+			d.prefetchSmallFile(ctx)
+		}
 		fd := &regularFileFD{}
 		if err := fd.vfsfd.Init(fd, opts.Flags, mnt, &d.vfsd, &vfs.FileDescriptionOptions{
 			AllowDirectIO: true,
 		}); err != nil {
+			d.decOpenFDs()
 			return nil, err
 		}
 		return &fd.vfsfd, nil
@@ -698,11 +894,14 @@ func (d *dentry) openLocked(ctx context.Context, rp *vfs.ResolvingPath, opts *vf
 		if opts.Flags&linux.O_DIRECT != 0 {
 			return nil, syserror.EINVAL
 		}
+		d.incOpenFDs()
 		if err := d.ensureSharedHandle(ctx, ats&vfs.MayRead != 0, false /* write */, false /* trunc */); err != nil {
+			d.decOpenFDs()
 			return nil, err
 		}
 		fd := &directoryFD{}
 		if err := fd.vfsfd.Init(fd, opts.Flags, mnt, &d.vfsd, &vfs.FileDescriptionOptions{}); err != nil {
+			d.decOpenFDs()
 			return nil, err
 		}
 		return &fd.vfsfd, nil
@@ -713,14 +912,17 @@ func (d *dentry) openLocked(ctx context.Context, rp *vfs.ResolvingPath, opts *vf
 		if opts.Flags&linux.O_DIRECT != 0 {
 			return nil, syserror.EINVAL
 		}
+		if filetype == linux.S_IFREG && ats&vfs.MayWrite != 0 && d.fs.opts.readonly {
+			// Writes to device special files, FIFOs and sockets don't modify
+			// the filesystem, so only regular files are affected.
+			return nil, syserror.EROFS
+		}
 		h, err := openHandle(ctx, d.file, ats&vfs.MayRead != 0, ats&vfs.MayWrite != 0, opts.Flags&linux.O_TRUNC != 0)
 		if err != nil {
 			return nil, err
 		}
-		fd := &specialFileFD{
-			handle: h,
-		}
-		if err := fd.vfsfd.Init(fd, opts.Flags, mnt, &d.vfsd, &vfs.FileDescriptionOptions{}); err != nil {
+		fd, err := newSpecialFileFD(h, mnt, d, opts.Flags)
+		if err != nil {
 			h.close(ctx)
 			return nil, err
 		}
@@ -737,7 +939,7 @@ func (d *dentry) createAndOpenChildLocked(ctx context.Context, rp *vfs.Resolving
 		return nil, syserror.ENOENT
 	}
 	mnt := rp.Mount()
-	if err := mnt.CheckBeginWrite(); err != nil {
+	if err := d.fs.checkBeginWrite(mnt); err != nil {
 		return nil, err
 	}
 	defer mnt.EndWrite()
@@ -789,61 +991,70 @@ func (d *dentry) createAndOpenChildLocked(ctx context.Context, rp *vfs.Resolving
 		}
 		return nil, err
 	}
-	// Incorporate the fid that was opened by lcreate.
-	useRegularFileFD := child.fileType() == linux.S_IFREG && !d.fs.opts.regularFilesUseSpecialFileFD
-	if useRegularFileFD {
-		child.handleMu.Lock()
-		child.handle.file = openFile
-		if fdobj != nil {
-			child.handle.fd = int32(fdobj.Release())
-		}
-		child.handleReadable = vfs.MayReadFileWithOpenFlags(opts.Flags)
-		child.handleWritable = vfs.MayWriteFileWithOpenFlags(opts.Flags)
-		child.handleMu.Unlock()
-	}
 	// Take a reference on the new dentry to be held by the new file
 	// description. (This reference also means that the new dentry is not
 	// eligible for caching yet, so we don't need to append to a dentry slice.)
 	child.refs = 1
 	// Insert the dentry into the tree.
 	d.IncRef() // reference held by child on its parent d
-	d.vfsd.InsertChild(&child.vfsd, name)
+	d.insertChildLocked(child, name)
 	if d.fs.opts.interop != InteropModeShared {
 		delete(d.negativeChildren, name)
-		d.dirents = nil
 	}
+	d.invalidateDirentsLocked()
 
 	// Finally, construct a file description representing the created file.
-	var childVFSFD *vfs.FileDescription
+	childVFSFD, err := child.newCreatedFD(ctx, mnt, opts, openFile, fdobj)
+	if err != nil {
+		return nil, err
+	}
+	if d.fs.opts.interop != InteropModeShared {
+		d.touchCMtime()
+	}
+	return childVFSFD, nil
+}
+
+// newCreatedFD returns a file description representing d, which must have
+// just been created by an lcreate that returned openFile and fdobj.
+// newCreatedFD takes ownership of openFile and fdobj.
+//
+// Preconditions: d.refs includes a reference to be held by the returned file
+// description.
+func (d *dentry) newCreatedFD(ctx context.Context, mnt *vfs.Mount, opts *vfs.OpenOptions, openFile p9file, fdobj *fd.FD) (*vfs.FileDescription, error) {
 	mnt.IncRef()
-	if useRegularFileFD {
+	if d.fileType() == linux.S_IFREG && !d.fs.opts.regularFilesUseSpecialFileFD {
+		// Incorporate the fid that was opened by lcreate.
+		d.incOpenFDs()
+		d.handleMu.Lock()
+		d.handle.file = openFile
+		if fdobj != nil {
+			d.handle.fd = int32(fdobj.Release())
+		}
+		d.handleReadable = vfs.MayReadFileWithOpenFlags(opts.Flags)
+		d.handleWritable = vfs.MayWriteFileWithOpenFlags(opts.Flags)
+		d.handleMu.Unlock()
 		fd := &regularFileFD{}
-		if err := fd.vfsfd.Init(fd, opts.Flags, mnt, &child.vfsd, &vfs.FileDescriptionOptions{
+		if err := fd.vfsfd.Init(fd, opts.Flags, mnt, &d.vfsd, &vfs.FileDescriptionOptions{
 			AllowDirectIO: true,
 		}); err != nil {
+			d.decOpenFDs()
 			return nil, err
 		}
-		childVFSFD = &fd.vfsfd
-	} else {
-		fd := &specialFileFD{
-			handle: handle{
-				file: openFile,
-				fd:   -1,
-			},
-		}
-		if fdobj != nil {
-			fd.handle.fd = int32(fdobj.Release())
-		}
-		if err := fd.vfsfd.Init(fd, opts.Flags, mnt, &child.vfsd, &vfs.FileDescriptionOptions{}); err != nil {
-			fd.handle.close(ctx)
-			return nil, err
-		}
-		childVFSFD = &fd.vfsfd
+		return &fd.vfsfd, nil
 	}
-	if d.fs.opts.interop != InteropModeShared {
-		d.touchCMtime()
+	h := handle{
+		file: openFile,
+		fd:   -1,
 	}
-	return childVFSFD, nil
+	if fdobj != nil {
+		h.fd = int32(fdobj.Release())
+	}
+	fd, err := newSpecialFileFD(h, mnt, d, opts.Flags)
+	if err != nil {
+		h.close(ctx)
+		return nil, err
+	}
+	return &fd.vfsfd, nil
 }
 
 // ReadlinkAt implements vfs.FilesystemImpl.ReadlinkAt.
@@ -863,8 +1074,11 @@ func (fs *filesystem) ReadlinkAt(ctx context.Context, rp *vfs.ResolvingPath) (st
 
 // RenameAt implements vfs.FilesystemImpl.RenameAt.
 func (fs *filesystem) RenameAt(ctx context.Context, rp *vfs.ResolvingPath, oldParentVD vfs.VirtualDentry, oldName string, opts vfs.RenameOptions) error {
-	if opts.Flags != 0 {
-		// Requires 9P support.
+	// Only RENAME_NOREPLACE and RENAME_EXCHANGE are supported, and they are
+	// mutually exclusive.
+	noReplace := opts.Flags&linux.RENAME_NOREPLACE != 0
+	exchange := opts.Flags&linux.RENAME_EXCHANGE != 0
+	if opts.Flags&^(linux.RENAME_NOREPLACE|linux.RENAME_EXCHANGE) != 0 || (noReplace && exchange) {
 		return syserror.EINVAL
 	}
 
@@ -877,20 +1091,29 @@ func (fs *filesystem) RenameAt(ctx context.Context, rp *vfs.ResolvingPath, oldPa
 	}
 	newName := rp.Component()
 	if newName == "." || newName == ".." {
+		if noReplace {
+			return syserror.EEXIST
+		}
 		return syserror.EBUSY
 	}
 	mnt := rp.Mount()
 	if mnt != oldParentVD.Mount() {
 		return syserror.EXDEV
 	}
-	if err := mnt.CheckBeginWrite(); err != nil {
+	// Renames between filesystems must be implemented by the caller as a
+	// copy followed by an unlink, since we can't move a file between servers
+	// and can't link a dentry into another filesystem's dentry tree.
+	oldParent, ok := oldParentVD.Dentry().Impl().(*dentry)
+	if !ok || oldParent.fs != fs {
+		return syserror.EXDEV
+	}
+	if err := fs.checkBeginWrite(mnt); err != nil {
 		return err
 	}
 	defer mnt.EndWrite()
 
-	oldParent := oldParentVD.Dentry().Impl().(*dentry)
 	if fs.opts.interop == InteropModeShared {
-		if err := oldParent.updateFromGetattr(ctx); err != nil {
+		if err := oldParent.revalidate(ctx); err != nil {
 			return err
 		}
 	}
@@ -919,7 +1142,7 @@ func (fs *filesystem) RenameAt(ctx context.Context, rp *vfs.ResolvingPath, oldPa
 			}
 		}
 	} else {
-		if opts.MustBeDir || rp.MustBeDir() {
+		if opts.MustBeDir || (rp.MustBeDir() && !exchange) {
 			return syserror.ENOTDIR
 		}
 	}
@@ -942,12 +1165,40 @@ func (fs *filesystem) RenameAt(ctx context.Context, rp *vfs.ResolvingPath, oldPa
 	//
 	// - If rp.MustBeDir(), then we need a dentry representing the replaced
 	// file regardless to confirm that it's a directory.
-	if replacedVFSD != nil || rp.MustBeDir() {
+	//
+	// - If opts.Flags != 0, then we need to know whether the replaced file
+	// exists regardless.
+	if replacedVFSD != nil || rp.MustBeDir() || opts.Flags != 0 {
 		replaced, err = fs.revalidateChildLocked(ctx, vfsObj, newParent, newName, replacedVFSD, &ds)
 		if err != nil {
 			return err
 		}
-		if replaced != nil {
+		switch {
+		case replaced == nil:
+			if exchange {
+				return syserror.ENOENT
+			}
+			replacedVFSD = nil
+		case noReplace:
+			return syserror.EEXIST
+		case exchange:
+			if rp.MustBeDir() && !replaced.isDir() {
+				return syserror.ENOTDIR
+			}
+			// The exchanged file moves to oldParent, so it may not be
+			// oldParent or an ancestor of it.
+			if replaced.isDir() {
+				if replaced == oldParent || replaced.vfsd.IsAncestorOf(&oldParent.vfsd) {
+					return syserror.EINVAL
+				}
+				if oldParent != newParent {
+					if err := replaced.checkPermissions(rp.Credentials(), vfs.MayWrite); err != nil {
+						return err
+					}
+				}
+			}
+			replacedVFSD = &replaced.vfsd
+		default:
 			if replaced.isDir() {
 				if !renamed.isDir() {
 					return syserror.EISDIR
@@ -958,28 +1209,36 @@ func (fs *filesystem) RenameAt(ctx context.Context, rp *vfs.ResolvingPath, oldPa
 				}
 			}
 			replacedVFSD = &replaced.vfsd
-		} else {
-			replacedVFSD = nil
 		}
 	}
 
 	if oldParent == newParent && oldName == newName {
 		return nil
 	}
+	if exchange {
+		return fs.exchangeLocked(ctx, vfsObj, oldParent, oldName, renamed, newParent, newName, replaced)
+	}
 	mntns := vfs.MountNamespaceFromContext(ctx)
 	defer mntns.DecRef()
 	if err := vfsObj.PrepareRenameDentry(mntns, &renamed.vfsd, replacedVFSD); err != nil {
 		return err
 	}
-	if err := renamed.file.rename(ctx, newParent.file, newName); err != nil {
+	if noReplace {
+		// The remote filesystem checks again that newName doesn't exist,
+		// atomically with the rename.
+		err = oldParent.file.renameAt2(ctx, oldName, newParent.file, newName, linux.RENAME_NOREPLACE)
+	} else {
+		err = renamed.file.rename(ctx, newParent.file, newName)
+	}
+	if err != nil {
 		vfsObj.AbortRenameDentry(&renamed.vfsd, replacedVFSD)
 		return err
 	}
+	oldParent.invalidateDirentsLocked()
+	newParent.invalidateDirentsLocked()
 	if fs.opts.interop != InteropModeShared {
 		oldParent.cacheNegativeChildLocked(oldName)
-		oldParent.dirents = nil
 		delete(newParent.negativeChildren, newName)
-		newParent.dirents = nil
 		if renamed.isDir() {
 			oldParent.decLinks()
 			newParent.incLinks()
@@ -992,6 +1251,43 @@ func (fs *filesystem) RenameAt(ctx context.Context, rp *vfs.ResolvingPath, oldPa
 	return nil
 }
 
+// exchangeLocked implements RenameAt for RENAME_EXCHANGE, exchanging renamed
+// (oldName in oldParent) with replaced (newName in newParent).
+//
+// Preconditions: fs.renameMu must be locked for writing. oldParent.dirMu and
+// newParent.dirMu must be locked.
+func (fs *filesystem) exchangeLocked(ctx context.Context, vfsObj *vfs.VirtualFilesystem, oldParent *dentry, oldName string, renamed *dentry, newParent *dentry, newName string, replaced *dentry) error {
+	mntns := vfs.MountNamespaceFromContext(ctx)
+	defer mntns.DecRef()
+	if err := vfsObj.PrepareRenameDentry(mntns, &renamed.vfsd, &replaced.vfsd); err != nil {
+		return err
+	}
+	if err := oldParent.file.renameAt2(ctx, oldName, newParent.file, newName, linux.RENAME_EXCHANGE); err != nil {
+		vfsObj.AbortRenameDentry(&renamed.vfsd, &replaced.vfsd)
+		return err
+	}
+	oldParent.invalidateDirentsLocked()
+	newParent.invalidateDirentsLocked()
+	if fs.opts.interop != InteropModeShared {
+		// Both names still exist, so negative lookups are unaffected.
+		if oldParent != newParent && renamed.isDir() != replaced.isDir() {
+			if renamed.isDir() {
+				oldParent.decLinks()
+				newParent.incLinks()
+			} else {
+				newParent.decLinks()
+				oldParent.incLinks()
+			}
+		}
+		oldParent.touchCMtime()
+		newParent.touchCMtime()
+		renamed.touchCtime()
+		replaced.touchCtime()
+	}
+	vfsObj.CommitRenameExchangeDentry(&renamed.vfsd, &replaced.vfsd)
+	return nil
+}
+
 // RmdirAt implements vfs.FilesystemImpl.RmdirAt.
 func (fs *filesystem) RmdirAt(ctx context.Context, rp *vfs.ResolvingPath) error {
 	return fs.unlinkAt(ctx, rp, true /* dir */)
@@ -1020,9 +1316,16 @@ func (fs *filesystem) StatAt(ctx context.Context, rp *vfs.ResolvingPath, opts vf
 	}
 	// Since walking updates metadata for all traversed dentries under
 	// InteropModeShared, including the returned one, we can return cached
-	// metadata here regardless of fs.opts.interop.
+	// metadata here regardless of fs.opts.interop, except for ctime if
+	// fs.opts.serverCtime is true.
+	if fs.opts.serverCtime && fs.opts.interop != InteropModeShared && opts.Mask&linux.STATX_CTIME != 0 && opts.Sync != linux.AT_STATX_DONT_SYNC {
+		if err := d.updateCtimeFromServer(ctx); err != nil {
+			return linux.Statx{}, err
+		}
+	}
 	var stat linux.Statx
 	d.statTo(&stat)
+	d.statDIOAlignTo(opts.Mask, &stat)
 	return stat, nil
 }
 
@@ -1035,32 +1338,12 @@ func (fs *filesystem) StatFSAt(ctx context.Context, rp *vfs.ResolvingPath) (linu
 	if err != nil {
 		return linux.Statfs{}, err
 	}
-	fsstat, err := d.file.statFS(ctx)
-	if err != nil {
-		return linux.Statfs{}, err
-	}
-	nameLen := uint64(fsstat.NameLength)
-	if nameLen > maxFilenameLen {
-		nameLen = maxFilenameLen
-	}
-	return linux.Statfs{
-		// This is primarily for distinguishing a gofer file system in
-		// tests. Testing is important, so instead of defining
-		// something completely random, use a standard value.
-		Type:            linux.V9FS_MAGIC,
-		BlockSize:       int64(fsstat.BlockSize),
-		Blocks:          fsstat.Blocks,
-		BlocksFree:      fsstat.BlocksFree,
-		BlocksAvailable: fsstat.BlocksAvailable,
-		Files:           fsstat.Files,
-		FilesFree:       fsstat.FilesFree,
-		NameLength:      nameLen,
-	}, nil
+	return d.statfs(ctx)
 }
 
 // SymlinkAt implements vfs.FilesystemImpl.SymlinkAt.
 func (fs *filesystem) SymlinkAt(ctx context.Context, rp *vfs.ResolvingPath, target string) error {
-	return fs.doCreateAt(ctx, rp, false /* dir */, func(parent *dentry, name string) error {
+	return fs.doCreateAt(ctx, rp, false /* dir */, func(parent *dentry, name string, _ **[]*dentry) error {
 		creds := rp.Credentials()
 		_, err := parent.file.symlink(ctx, target, name, (p9.UID)(creds.EffectiveKUID), (p9.GID)(creds.EffectiveKGID))
 		return err
@@ -1073,10 +1356,21 @@ func (fs *filesystem) UnlinkAt(ctx context.Context, rp *vfs.ResolvingPath) error
 }
 
 // BoundEndpointAt implements FilesystemImpl.BoundEndpointAt.
-//
-// TODO(gvisor.dev/issue/1476): Implement BoundEndpointAt.
 func (fs *filesystem) BoundEndpointAt(ctx context.Context, rp *vfs.ResolvingPath) (transport.BoundEndpoint, error) {
-	return nil, syserror.ECONNREFUSED
+	var ds *[]*dentry
+	fs.renameMu.RLock()
+	defer fs.renameMuRUnlockAndCheckCaching(&ds)
+	d, err := fs.resolveLocked(ctx, rp, &ds)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkPermissions(rp.Credentials(), vfs.MayWrite); err != nil {
+		return nil, err
+	}
+	if !d.isSocket() {
+		return nil, syserror.ECONNREFUSED
+	}
+	return d.boundEndpointLocked(), nil
 }
 
 // ListxattrAt implements vfs.FilesystemImpl.ListxattrAt.
@@ -0,0 +1,1124 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/fspath"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestOpenExclWithoutCreate(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	file := newTestDentry(ctx, t, fs, &testP9File{}, p9.Attr{Mode: p9.ModeRegular | 0644})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": file})
+
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY|linux.O_EXCL)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDONLY|O_EXCL): %v", err)
+	}
+	defer fd.DecRef()
+	if _, ok := fd.Impl().(*regularFileFD); !ok {
+		t.Errorf("OpenAt(O_RDONLY|O_EXCL): got %T, want *regularFileFD", fd.Impl())
+	}
+}
+
+func TestStatFS(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		fsstat p9.FSStat
+		want   linux.Statfs
+	}{
+		{
+			name: "all fields",
+			fsstat: p9.FSStat{
+				BlockSize:       4096,
+				Blocks:          1000,
+				BlocksFree:      600,
+				BlocksAvailable: 500,
+				Files:           300,
+				FilesFree:       200,
+				NameLength:      255,
+			},
+			want: linux.Statfs{
+				Type:            linux.V9FS_MAGIC,
+				BlockSize:       4096,
+				Blocks:          1000,
+				BlocksFree:      600,
+				BlocksAvailable: 500,
+				Files:           300,
+				FilesFree:       200,
+				NameLength:      255,
+				FragmentSize:    4096,
+			},
+		},
+		{
+			name: "zero fields use defaults",
+			fsstat: p9.FSStat{
+				Blocks:     1000,
+				BlocksFree: 600,
+				Files:      300,
+			},
+			want: linux.Statfs{
+				Type:         linux.V9FS_MAGIC,
+				BlockSize:    512, // from the dentry
+				Blocks:       1000,
+				BlocksFree:   600,
+				Files:        300,
+				NameLength:   maxFilenameLen,
+				FragmentSize: 512,
+			},
+		},
+		{
+			name: "name length clamped",
+			fsstat: p9.FSStat{
+				BlockSize:  1024,
+				NameLength: maxFilenameLen + 1,
+			},
+			want: linux.Statfs{
+				Type:         linux.V9FS_MAGIC,
+				BlockSize:    1024,
+				NameLength:   maxFilenameLen,
+				FragmentSize: 1024,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := contexttest.Context(t)
+			fs := newTestFilesystem(ctx, filesystemOptions{})
+			file := &testP9File{fsstat: test.fsstat}
+			d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0644, BlockSize: 512})
+			fd := openTestFile(ctx, t, fs, d, linux.O_RDONLY)
+
+			got, err := fd.StatFS(ctx)
+			if err != nil {
+				t.Fatalf("StatFS(): %v", err)
+			}
+			if got != test.want {
+				t.Errorf("StatFS(): got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLink(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	rootFile := &testP9File{
+		children: map[string]*testP9File{
+			"a": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}},
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+
+	// Hold a reference on the dentry for "a", so that its cached link count
+	// must be updated by the link, and write to it through the page cache.
+	fd, err := openAt(ctx, root, "a", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(a): %v", err)
+	}
+	defer fd.DecRef()
+	data := []byte("hello")
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(data), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(a): %v", err)
+	}
+
+	if err := vfsObj.LinkAt(ctx, creds, pathOp(root, "a"), pathOp(root, "b")); err != nil {
+		t.Fatalf("LinkAt(a, b): %v", err)
+	}
+	for _, path := range []string{"a", "b"} {
+		stat, err := vfsObj.StatAt(ctx, creds, pathOp(root, path), &vfs.StatOptions{Mask: linux.STATX_NLINK | linux.STATX_SIZE | linux.STATX_BLOCKS})
+		if err != nil {
+			t.Fatalf("StatAt(%s): %v", path, err)
+		}
+		if stat.Nlink != 2 {
+			t.Errorf("StatAt(%s): got nlink %d, want 2", path, stat.Nlink)
+		}
+		if stat.Size != uint64(len(data)) || stat.Blocks != 1 {
+			t.Errorf("StatAt(%s): got size %d, blocks %d, want size %d, blocks 1", path, stat.Size, stat.Blocks, len(data))
+		}
+	}
+
+	// Data written through "a" before the link must be visible through "b".
+	bfd, err := openAt(ctx, root, "b", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(b): %v", err)
+	}
+	defer bfd.DecRef()
+	buf := make([]byte, len(data))
+	if n, err := bfd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Errorf("PRead(b): got (%q, %v), want (%q, nil)", buf[:n], err, data)
+	}
+	if err := vfsObj.LinkAt(ctx, creds, pathOp(root, "a"), pathOp(root, "b")); err != syserror.EEXIST {
+		t.Errorf("LinkAt(a, b) with existing b: got err %v, want %v", err, syserror.EEXIST)
+	}
+}
+
+func TestTmpfile(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	for _, interop := range []InteropMode{InteropModeExclusive, InteropModeShared} {
+		fs := newTestFilesystem(ctx, filesystemOptions{interop: interop})
+		rootFile := &testP9File{
+			attr:     p9.Attr{Mode: p9.ModeDirectory | 0755},
+			children: map[string]*testP9File{},
+		}
+		root := newTestRoot(ctx, t, fs, rootFile, nil)
+		vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+		pop := pathOp(root, ".")
+		flags := uint32(linux.O_RDWR | linux.O_TMPFILE | linux.O_DIRECTORY)
+		if _, err := vfsObj.OpenAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.OpenOptions{Flags: flags, Mode: 0644}); err != syserror.EOPNOTSUPP {
+			t.Errorf("interop=%v: OpenAt(O_TMPFILE): got err %v, want %v", interop, err, syserror.EOPNOTSUPP)
+		}
+		if len(rootFile.children) != 0 {
+			t.Errorf("interop=%v: OpenAt(O_TMPFILE) created files on the server: %v", interop, rootFile.children)
+		}
+		root.DecRef()
+	}
+}
+
+func TestXattrNamespaces(t *testing.T) {
+	ctx := contexttest.Context(t)
+	userns := auth.NewRootUserNamespace()
+	root := auth.NewRootCredentials(userns)
+	unprivileged := auth.NewUserCredentials(1000, 1000, nil, &auth.TaskCapabilities{}, userns)
+	setfcap := auth.NewUserCredentials(1000, 1000, nil, &auth.TaskCapabilities{
+		PermittedCaps: auth.CapabilitySetOf(linux.CAP_SETFCAP),
+		EffectiveCaps: auth.CapabilitySetOf(linux.CAP_SETFCAP),
+	}, userns)
+
+	for _, test := range []struct {
+		name  string
+		opts  filesystemOptions
+		creds *auth.Credentials
+		xattr string
+		// setErr is the expected error from setting xattr. getErr is the
+		// expected error from getting xattr after it is set on the server.
+		// If listed is true, xattr is expected to be returned by listxattr.
+		setErr error
+		getErr error
+		listed bool
+	}{
+		{
+			name:   "user",
+			creds:  unprivileged,
+			xattr:  "user.foo",
+			listed: true,
+		},
+		{
+			name:   "trusted disabled",
+			creds:  root,
+			xattr:  "trusted.foo",
+			setErr: syserror.EOPNOTSUPP,
+			getErr: syserror.EOPNOTSUPP,
+		},
+		{
+			name:   "trusted privileged",
+			opts:   filesystemOptions{trustedXattrs: true},
+			creds:  root,
+			xattr:  "trusted.foo",
+			listed: true,
+		},
+		{
+			name:   "trusted unprivileged",
+			opts:   filesystemOptions{trustedXattrs: true},
+			creds:  unprivileged,
+			xattr:  "trusted.foo",
+			setErr: syserror.EPERM,
+			getErr: syserror.ENODATA,
+		},
+		{
+			name:   "security disabled",
+			creds:  root,
+			xattr:  "security.selinux",
+			setErr: syserror.EOPNOTSUPP,
+			getErr: syserror.EOPNOTSUPP,
+		},
+		{
+			name:   "security privileged",
+			opts:   filesystemOptions{securityXattrs: true},
+			creds:  root,
+			xattr:  "security.selinux",
+			listed: true,
+		},
+		{
+			name:   "security unprivileged",
+			opts:   filesystemOptions{securityXattrs: true},
+			creds:  unprivileged,
+			xattr:  "security.selinux",
+			setErr: syserror.EPERM,
+			listed: true,
+		},
+		{
+			name:   "security.capability with CAP_SETFCAP",
+			opts:   filesystemOptions{securityXattrs: true},
+			creds:  setfcap,
+			xattr:  "security.capability",
+			listed: true,
+		},
+		{
+			name:   "security.selinux with CAP_SETFCAP",
+			opts:   filesystemOptions{securityXattrs: true},
+			creds:  setfcap,
+			xattr:  "security.selinux",
+			setErr: syserror.EPERM,
+			listed: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := newTestFilesystem(ctx, test.opts)
+			file := &testP9File{}
+			d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeRegular | 0666})
+			if err != nil {
+				t.Fatalf("fs.newDentry(): %v", err)
+			}
+
+			if err := d.setxattr(ctx, test.creds, &vfs.SetxattrOptions{Name: test.xattr, Value: "val"}); err != test.setErr {
+				t.Errorf("setxattr(%q): got error %v, want %v", test.xattr, err, test.setErr)
+			}
+			if test.setErr == nil {
+				if got := file.xattrs[test.xattr]; got != "val" {
+					t.Errorf("server xattr %q: got %q, want %q", test.xattr, got, "val")
+				}
+			}
+
+			// The remaining checks are of xattrs that already exist on the
+			// server.
+			file.xattrs = map[string]string{test.xattr: "val"}
+			val, err := d.getxattr(ctx, test.creds, &vfs.GetxattrOptions{Name: test.xattr, Size: linux.XATTR_SIZE_MAX})
+			if err != test.getErr {
+				t.Errorf("getxattr(%q): got error %v, want %v", test.xattr, err, test.getErr)
+			} else if err == nil && val != "val" {
+				t.Errorf("getxattr(%q): got %q, want %q", test.xattr, val, "val")
+			}
+			names, err := d.listxattr(ctx, test.creds, linux.XATTR_LIST_MAX)
+			if err != nil {
+				t.Fatalf("listxattr(): %v", err)
+			}
+			if listed := len(names) == 1 && names[0] == test.xattr; listed != test.listed {
+				t.Errorf("listxattr(): got %v, want %q listed: %t", names, test.xattr, test.listed)
+			}
+			if err := d.removexattr(ctx, test.creds, test.xattr); err != test.setErr {
+				t.Errorf("removexattr(%q): got error %v, want %v", test.xattr, err, test.setErr)
+			}
+		})
+	}
+}
+
+func TestConcurrentXattrs(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	const fixed = "user.fixed"
+	file := &testP9File{xattrs: map[string]string{fixed: "val"}}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666})
+
+	const (
+		setters    = 4
+		listers    = 4
+		iterations = 100
+	)
+	// Each setter repeatedly sets and removes its own xattr, so every list
+	// must contain fixed, plus any subset of the setters' xattrs.
+	valid := map[string]bool{fixed: true}
+	for i := 0; i < setters; i++ {
+		valid[fmt.Sprintf("user.x%d", i)] = true
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, setters+listers)
+	for i := 0; i < setters; i++ {
+		name := fmt.Sprintf("user.x%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if err := d.setxattr(ctx, creds, &vfs.SetxattrOptions{Name: name, Value: "v"}); err != nil {
+					errs <- fmt.Errorf("setxattr(%q): %v", name, err)
+					return
+				}
+				if err := d.removexattr(ctx, creds, name); err != nil {
+					errs <- fmt.Errorf("removexattr(%q): %v", name, err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < listers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				names, err := d.listxattr(ctx, creds, linux.XATTR_LIST_MAX)
+				if err != nil {
+					errs <- fmt.Errorf("listxattr(): %v", err)
+					return
+				}
+				seen := make(map[string]bool)
+				for _, name := range names {
+					if !valid[name] || seen[name] {
+						errs <- fmt.Errorf("listxattr(): got %v, containing unexpected or duplicate xattr %q", names, name)
+						return
+					}
+					seen[name] = true
+				}
+				if !seen[fixed] {
+					errs <- fmt.Errorf("listxattr(): got %v, missing %q", names, fixed)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if names, err := d.listxattr(ctx, creds, linux.XATTR_LIST_MAX); err != nil || len(names) != 1 || names[0] != fixed {
+		t.Errorf("listxattr() after all operations: got (%v, %v), want ([%s], nil)", names, err, fixed)
+	}
+}
+
+func TestLargeXattr(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const msize = 4096
+	// The value is too large to be returned in a single message.
+	val := make([]byte, 3*msize+1)
+	for i := range val {
+		val[i] = byte('a' + i%26)
+	}
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"file": {
+				attr:   p9.Attr{Mode: p9.ModeRegular | 0666, NLink: 1},
+				xattrs: map[string]string{"user.big": string(val)},
+			},
+		},
+	}
+	addr, _ := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, fmt.Sprintf("trans=unix,addr=%s,msize=%d", addr, msize))
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+	pop := pathOp(root, "file")
+
+	// Both the size query and the read of the value return the whole value.
+	for _, size := range []uint64{0, uint64(len(val))} {
+		got, err := vfsObj.GetxattrAt(ctx, creds, pop, &vfs.GetxattrOptions{Name: "user.big", Size: size})
+		if err != nil {
+			t.Fatalf("GetxattrAt(size=%d): %v", size, err)
+		}
+		if got != string(val) {
+			t.Errorf("GetxattrAt(size=%d): got %d bytes that differ from the xattr's value", size, len(got))
+		}
+	}
+}
+
+func TestCasefold(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	for _, casefold := range []bool{false, true} {
+		for _, interop := range []InteropMode{InteropModeExclusive, InteropModeShared} {
+			fs := newTestFilesystem(ctx, filesystemOptions{interop: interop, casefold: casefold})
+			rootFile := &testP9File{
+				attr: p9.Attr{Mode: p9.ModeDirectory | 0755},
+				children: map[string]*testP9File{
+					"file.txt": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1, Size: 3}},
+				},
+				dirents: []p9.Dirent{{Name: "file.txt", Type: p9.TypeRegular}},
+			}
+			root := newTestRoot(ctx, t, fs, rootFile, nil)
+			rootDentry := root.Dentry().Impl().(*dentry)
+			vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+			pop := pathOp(root, "FILE.TXT")
+
+			for i := 0; i < 2; i++ {
+				stat, err := vfsObj.StatAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.StatOptions{Mask: linux.STATX_SIZE})
+				if !casefold {
+					if err != syserror.ENOENT {
+						t.Errorf("casefold=%t, interop=%v: StatAt(FILE.TXT): got err %v, want %v", casefold, interop, err, syserror.ENOENT)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("casefold=%t, interop=%v: StatAt(FILE.TXT): %v", casefold, interop, err)
+				}
+				if stat.Size != 3 {
+					t.Errorf("casefold=%t, interop=%v: StatAt(FILE.TXT): got size %d, want 3", casefold, interop, stat.Size)
+				}
+			}
+			if casefold {
+				// FILE.TXT is represented by the dentry for file.txt, and the
+				// directory is listed only once.
+				if rootDentry.vfsd.Child("file.txt") == nil {
+					t.Errorf("casefold=%t, interop=%v: file.txt has no cached dentry", casefold, interop)
+				}
+				if rootDentry.vfsd.Child("FILE.TXT") != nil {
+					t.Errorf("casefold=%t, interop=%v: FILE.TXT has a cached dentry", casefold, interop)
+				}
+				if rootFile.readdirs != 1 {
+					t.Errorf("casefold=%t, interop=%v: got %d directory reads, want 1", casefold, interop, rootFile.readdirs)
+				}
+			}
+			root.DecRef()
+		}
+	}
+}
+
+func TestMknod(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	for _, interop := range []InteropMode{InteropModeExclusive, InteropModeShared} {
+		fs := newTestFilesystem(ctx, filesystemOptions{interop: interop})
+		rootFile := &testP9File{
+			attr:     p9.Attr{Mode: p9.ModeDirectory | 0755},
+			children: map[string]*testP9File{},
+		}
+		root := newTestRoot(ctx, t, fs, rootFile, nil)
+		rootDentry := root.Dentry().Impl().(*dentry)
+		vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+		creds := auth.CredentialsFromContext(ctx)
+
+		for _, test := range []struct {
+			name  string
+			mode  linux.FileMode
+			major uint32
+			minor uint32
+		}{
+			{name: "fifo", mode: linux.S_IFIFO | 0644},
+			{name: "chr", mode: linux.S_IFCHR | 0600, major: 1, minor: 3},
+		} {
+			if err := vfsObj.MknodAt(ctx, creds, pathOp(root, test.name), &vfs.MknodOptions{Mode: test.mode, DevMajor: test.major, DevMinor: test.minor}); err != nil {
+				t.Fatalf("interop=%v: MknodAt(%s): %v", interop, test.name, err)
+			}
+			child, ok := rootFile.children[test.name]
+			if !ok {
+				t.Fatalf("interop=%v: MknodAt(%s) did not create a file on the server", interop, test.name)
+			}
+			if got, want := child.attr.RDev, uint64(linux.MakeDeviceID(uint16(test.major), test.minor)); got != want {
+				t.Errorf("interop=%v: MknodAt(%s): got rdev %#x, want %#x", interop, test.name, got, want)
+			}
+			if interop == InteropModeExclusive && rootDentry.vfsd.Child(test.name) == nil {
+				t.Errorf("interop=%v: MknodAt(%s) did not cache a dentry", interop, test.name)
+			}
+			stat, err := vfsObj.StatAt(ctx, creds, pathOp(root, test.name), &vfs.StatOptions{Mask: linux.STATX_TYPE | linux.STATX_MODE})
+			if err != nil {
+				t.Fatalf("interop=%v: StatAt(%s): %v", interop, test.name, err)
+			}
+			if got, want := linux.FileMode(stat.Mode), test.mode; got != want {
+				t.Errorf("interop=%v: StatAt(%s): got mode %v, want %v", interop, test.name, got, want)
+			}
+			if err := vfsObj.MknodAt(ctx, creds, pathOp(root, test.name), &vfs.MknodOptions{Mode: test.mode}); err != syserror.EEXIST {
+				t.Errorf("interop=%v: MknodAt(%s) with existing file: got err %v, want %v", interop, test.name, err, syserror.EEXIST)
+			}
+		}
+
+		if err := vfsObj.MknodAt(ctx, creds, pathOp(root, "dir"), &vfs.MknodOptions{Mode: linux.S_IFDIR | 0755}); err != syserror.EPERM {
+			t.Errorf("interop=%v: MknodAt(dir) with S_IFDIR: got err %v, want %v", interop, err, syserror.EPERM)
+		}
+		if _, ok := rootFile.children["dir"]; ok {
+			t.Errorf("interop=%v: MknodAt(dir) with S_IFDIR created a file on the server", interop)
+		}
+		root.DecRef()
+	}
+}
+
+func TestReadOnlyMount(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{readonly: true})
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755},
+		children: map[string]*testP9File{
+			"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}, data: []byte("data")},
+			"dir":  {attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}},
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+
+	// Reads are unaffected.
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(file, O_RDONLY): %v", err)
+	}
+	fd.DecRef()
+
+	for _, test := range []struct {
+		name string
+		op   func() error
+	}{
+		{"open O_WRONLY", func() error {
+			fd, err := openAt(ctx, root, "file", linux.O_WRONLY)
+			if err == nil {
+				fd.DecRef()
+			}
+			return err
+		}},
+		{"open O_TRUNC", func() error {
+			fd, err := openAt(ctx, root, "file", linux.O_RDONLY|linux.O_TRUNC)
+			if err == nil {
+				fd.DecRef()
+			}
+			return err
+		}},
+		{"open O_CREAT", func() error {
+			fd, err := openAt(ctx, root, "new", linux.O_RDWR|linux.O_CREAT)
+			if err == nil {
+				fd.DecRef()
+			}
+			return err
+		}},
+		{"mkdir", func() error {
+			return vfsObj.MkdirAt(ctx, creds, pathOp(root, "new"), &vfs.MkdirOptions{Mode: 0755})
+		}},
+		{"mknod", func() error {
+			return vfsObj.MknodAt(ctx, creds, pathOp(root, "new"), &vfs.MknodOptions{Mode: linux.S_IFIFO | 0644})
+		}},
+		{"symlink", func() error {
+			return vfsObj.SymlinkAt(ctx, creds, pathOp(root, "new"), "file")
+		}},
+		{"link", func() error {
+			return vfsObj.LinkAt(ctx, creds, pathOp(root, "file"), pathOp(root, "new"))
+		}},
+		{"unlink", func() error {
+			return vfsObj.UnlinkAt(ctx, creds, pathOp(root, "file"))
+		}},
+		{"rmdir", func() error {
+			return vfsObj.RmdirAt(ctx, creds, pathOp(root, "dir"))
+		}},
+		{"rename", func() error {
+			return vfsObj.RenameAt(ctx, creds, pathOp(root, "file"), pathOp(root, "new"), &vfs.RenameOptions{})
+		}},
+		{"chmod", func() error {
+			return vfsObj.SetStatAt(ctx, creds, pathOp(root, "file"), &vfs.SetStatOptions{Stat: linux.Statx{Mask: linux.STATX_MODE, Mode: 0600}})
+		}},
+		{"truncate", func() error {
+			return vfsObj.SetStatAt(ctx, creds, pathOp(root, "file"), &vfs.SetStatOptions{Stat: linux.Statx{Mask: linux.STATX_SIZE}})
+		}},
+		{"setxattr", func() error {
+			return vfsObj.SetxattrAt(ctx, creds, pathOp(root, "file"), &vfs.SetxattrOptions{Name: "user.a", Value: "b"})
+		}},
+		{"removexattr", func() error {
+			return vfsObj.RemovexattrAt(ctx, creds, pathOp(root, "file"), "user.a")
+		}},
+	} {
+		if err := test.op(); err != syserror.EROFS {
+			t.Errorf("%s: got err %v, want %v", test.name, err, syserror.EROFS)
+		}
+	}
+
+	// None of the operations should have reached the server.
+	if len(rootFile.children) != 2 {
+		t.Errorf("server directory has %d children, want 2", len(rootFile.children))
+	}
+	file := rootFile.children["file"]
+	if len(file.setAttrs) != 0 {
+		t.Errorf("server file received %d SetAttrs, want 0", len(file.setAttrs))
+	}
+	if got, want := string(file.contents()), "data"; got != want {
+		t.Errorf("server file contents: got %q, want %q", got, want)
+	}
+}
+
+func TestSharedSymlinkTargetCache(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{interop: InteropModeShared, maxCachedDentries: 10})
+	link := &testP9File{
+		attr:   p9.Attr{Mode: p9.ModeSymlink | 0777, NLink: 1},
+		qid:    p9.QID{Type: p9.TypeSymlink, Version: 1, Path: 1},
+		target: "target",
+	}
+	rootFile := &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755},
+		children: map[string]*testP9File{"link": link},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	readlink := func() string {
+		target, err := vfsObj.ReadlinkAt(ctx, auth.CredentialsFromContext(ctx), pathOp(root, "link"))
+		if err != nil {
+			t.Fatalf("ReadlinkAt: %v", err)
+		}
+		return target
+	}
+
+	// While the server reports the same QID version, the target is only
+	// fetched once.
+	for i := 0; i < 2; i++ {
+		if got, want := readlink(), "target"; got != want {
+			t.Errorf("ReadlinkAt: got %q, want %q", got, want)
+		}
+	}
+	if link.readlinks != 1 {
+		t.Errorf("got %d Readlink RPCs, want 1", link.readlinks)
+	}
+
+	// A new version invalidates the cached target.
+	link.qid.Version = 2
+	link.target = "new target"
+	if got, want := readlink(), "new target"; got != want {
+		t.Errorf("ReadlinkAt after version change: got %q, want %q", got, want)
+	}
+	if link.readlinks != 2 {
+		t.Errorf("got %d Readlink RPCs after version change, want 2", link.readlinks)
+	}
+
+	// Servers that don't version files get no caching.
+	link.qid.Version = 0
+	readlink()
+	readlink()
+	if link.readlinks != 4 {
+		t.Errorf("got %d Readlink RPCs without QID versions, want 4", link.readlinks)
+	}
+}
+
+func TestRenameFlags(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	fileA := &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1, Size: 1}, data: []byte("a")}
+	fileB := &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1, Size: 1}, data: []byte("b")}
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755},
+		children: map[string]*testP9File{
+			"a": fileA,
+			"b": fileB,
+		},
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	rename := func(oldName, newName string, flags uint32) error {
+		return vfsObj.RenameAt(ctx, auth.CredentialsFromContext(ctx), pathOp(root, oldName), pathOp(root, newName), &vfs.RenameOptions{Flags: flags})
+	}
+	// contents returns the contents of the file at name, as seen by the
+	// client.
+	contents := func(name string) string {
+		fd, err := openAt(ctx, root, name, linux.O_RDONLY)
+		if err != nil {
+			t.Fatalf("OpenAt(%s): %v", name, err)
+		}
+		defer fd.DecRef()
+		buf := make([]byte, 1)
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("PRead(%s): %v", name, err)
+		}
+		return string(buf)
+	}
+
+	if err := rename("a", "b", linux.RENAME_NOREPLACE|linux.RENAME_EXCHANGE); err != syserror.EINVAL {
+		t.Errorf("rename with both flags: got err %v, want %v", err, syserror.EINVAL)
+	}
+
+	// RENAME_NOREPLACE fails if the target exists.
+	if err := rename("a", "b", linux.RENAME_NOREPLACE); err != syserror.EEXIST {
+		t.Errorf("RENAME_NOREPLACE onto existing file: got err %v, want %v", err, syserror.EEXIST)
+	}
+	if rootFile.children["a"] != fileA || rootFile.children["b"] != fileB {
+		t.Errorf("failed RENAME_NOREPLACE changed the remote directory")
+	}
+
+	// ... and otherwise renames the file.
+	if err := rename("a", "c", linux.RENAME_NOREPLACE); err != nil {
+		t.Fatalf("RENAME_NOREPLACE onto new name: %v", err)
+	}
+	if _, ok := rootFile.children["a"]; ok || rootFile.children["c"] != fileA {
+		t.Errorf("RENAME_NOREPLACE didn't rename the remote file")
+	}
+	if _, err := openAt(ctx, root, "a", linux.O_RDONLY); err != syserror.ENOENT {
+		t.Errorf("OpenAt(a) after rename: got err %v, want %v", err, syserror.ENOENT)
+	}
+	if got := contents("c"); got != "a" {
+		t.Errorf("c contains %q after rename, want %q", got, "a")
+	}
+
+	// RENAME_EXCHANGE fails if the target doesn't exist.
+	if err := rename("c", "d", linux.RENAME_EXCHANGE); err != syserror.ENOENT {
+		t.Errorf("RENAME_EXCHANGE with nonexistent file: got err %v, want %v", err, syserror.ENOENT)
+	}
+
+	// ... and otherwise swaps the files, both remotely and in the dentry
+	// tree.
+	if err := rename("c", "b", linux.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("RENAME_EXCHANGE: %v", err)
+	}
+	if rootFile.children["c"] != fileB || rootFile.children["b"] != fileA {
+		t.Errorf("RENAME_EXCHANGE didn't exchange the remote files")
+	}
+	if got := contents("b"); got != "a" {
+		t.Errorf("b contains %q after exchange, want %q", got, "a")
+	}
+	if got := contents("c"); got != "b" {
+		t.Errorf("c contains %q after exchange, want %q", got, "b")
+	}
+}
+
+func TestRevalidateQIDVersion(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{interop: InteropModeShared})
+	file := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1, Size: 1},
+		qid:  p9.QID{Version: 1},
+		data: []byte("a"),
+	}
+	root := newTestRoot(ctx, t, fs, &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755},
+		children: map[string]*testP9File{"file": file},
+	}, nil)
+	defer root.DecRef()
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt: %v", err)
+	}
+	defer fd.DecRef()
+	fullRefreshes := func() int {
+		n := 0
+		for _, mask := range file.getAttrs {
+			if !mask.Empty() {
+				n++
+			}
+		}
+		return n
+	}
+	size := func() uint64 {
+		stat, err := fd.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_SIZE})
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		return stat.Size
+	}
+
+	// While the server reports the same version, cached metadata is used
+	// without being refreshed.
+	file.attr.Size = 2
+	if got := size(); got != 1 {
+		t.Errorf("got size %d with unchanged version, want 1", got)
+	}
+	if got := fullRefreshes(); got != 0 {
+		t.Errorf("got %d full GetAttr RPCs with unchanged version, want 0", got)
+	}
+	if len(file.getAttrs) != 1 {
+		t.Errorf("got %d GetAttr RPCs, want 1", len(file.getAttrs))
+	}
+
+	// Once the version changes, metadata is refreshed.
+	file.qid.Version++
+	if got := size(); got != 2 {
+		t.Errorf("got size %d after version change, want 2", got)
+	}
+	if got := fullRefreshes(); got != 1 {
+		t.Errorf("got %d full GetAttr RPCs after version change, want 1", got)
+	}
+}
+
+func TestSizeOnlyGetattr(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{interop: InteropModeShared})
+	file := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1, Size: 1},
+		qid:  p9.QID{Version: 1},
+		data: []byte("a"),
+	}
+	root := newTestRoot(ctx, t, fs, &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755},
+		children: map[string]*testP9File{"file": file},
+	}, nil)
+	defer root.DecRef()
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt: %v", err)
+	}
+	defer fd.DecRef()
+	d := fd.Impl().(*regularFileFD).dentry()
+
+	// The file is extended by another remote filesystem user.
+	file.attr.Size = 5
+	file.qid.Version++
+	file.getAttrs = nil
+	off, err := fd.Seek(ctx, 0, linux.SEEK_END)
+	if err != nil {
+		t.Fatalf("Seek(SEEK_END): %v", err)
+	}
+	if off != 5 {
+		t.Errorf("Seek(SEEK_END): got offset %d, want 5", off)
+	}
+	if len(file.getAttrs) != 1 {
+		t.Fatalf("Seek(SEEK_END): got %d GetAttr RPCs, want 1", len(file.getAttrs))
+	}
+	if got, want := file.getAttrs[0], (p9.AttrMask{Size: true}); got != want {
+		t.Errorf("Seek(SEEK_END): got GetAttr mask %v, want %v", got, want)
+	}
+	// A size-only refresh doesn't make the rest of d's metadata current, so
+	// it must not update d's QID version.
+	if got := atomic.LoadUint32(&d.qidVersion); got != 1 {
+		t.Errorf("Seek(SEEK_END): got qidVersion %d, want 1", got)
+	}
+}
+
+func TestSyncMount(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, syncMount := range []bool{false, true} {
+		fs := newTestFilesystem(ctx, filesystemOptions{sync: syncMount})
+		file := &testP9File{data: []byte("hello, world")}
+		d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: uint64(len(file.data))})
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+		fd, err := openAt(ctx, root, "file", linux.O_RDWR)
+		if err != nil {
+			t.Fatalf("OpenAt(O_RDWR): %v", err)
+		}
+
+		// Reading first fills the cache, so that the write would otherwise
+		// be buffered.
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 5)), 0, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("PRead(): %v", err)
+		}
+		if _, err := fd.PWrite(ctx, usermem.BytesIOSequence([]byte("HELLO")), 0, vfs.WriteOptions{}); err != nil {
+			t.Fatalf("PWrite(): %v", err)
+		}
+		want, wantFsyncs := "hello, world", 0
+		if syncMount {
+			want, wantFsyncs = "HELLO, world", 1
+		}
+		if got := string(file.contents()); got != want {
+			t.Errorf("sync=%t: remote file contains %q after write, want %q", syncMount, got, want)
+		}
+		if file.fsyncs != wantFsyncs {
+			t.Errorf("sync=%t: got %d fsyncs after write, want %d", syncMount, file.fsyncs, wantFsyncs)
+		}
+		fd.DecRef()
+		root.DecRef()
+	}
+}
+
+func TestRootPath(t *testing.T) {
+	ctx := contexttest.Context(t)
+	dirAttr := p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}
+	data := &testP9File{
+		attr: dirAttr,
+		children: map[string]*testP9File{
+			"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}},
+		},
+	}
+	addr, _ := serveTestP9(t, &testP9File{
+		attr: dirAttr,
+		children: map[string]*testP9File{
+			"export": {
+				attr:     dirAttr,
+				children: map[string]*testP9File{"data": data},
+			},
+		},
+	})
+
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",root_path=export/data")
+	defer root.DecRef()
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(file) relative to root_path: %v", err)
+	}
+	fd.DecRef()
+	if _, err := openAt(ctx, root, "data", linux.O_RDONLY); err != syserror.ENOENT {
+		t.Errorf("OpenAt(data) relative to root_path: got err %v, want %v", err, syserror.ENOENT)
+	}
+
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+	for _, test := range []struct {
+		rootPath string
+		want     error
+	}{
+		{"export/missing", syserror.ENOENT},
+		{"export/../export", syserror.EINVAL},
+	} {
+		data := "trans=unix,addr=" + addr + ",root_path=" + test.rootPath
+		if _, _, err := (FilesystemType{}).GetFilesystem(ctx, vfsObj, creds, "", vfs.GetFilesystemOptions{Data: data}); err != test.want {
+			t.Errorf("GetFilesystem(root_path=%s): got err %v, want %v", test.rootPath, err, test.want)
+		}
+	}
+}
+
+func TestWalkMultiple(t *testing.T) {
+	ctx := contexttest.Context(t)
+	dirAttr := p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}
+	leaf := &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1}}
+	dir := &testP9File{attr: dirAttr, children: map[string]*testP9File{"e": leaf}}
+	for _, name := range []string{"d", "c", "b"} {
+		dir = &testP9File{attr: dirAttr, children: map[string]*testP9File{name: dir}}
+	}
+	dir.children["link"] = &testP9File{attr: p9.Attr{Mode: p9.ModeSymlink | 0777, NLink: 1}, target: "b"}
+	addr, _ := serveTestP9(t, &testP9File{
+		attr:     dirAttr,
+		children: map[string]*testP9File{"a": dir},
+	})
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr)
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+	vfsObj := fs.vfsfs.VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+	stat := func(path string) error {
+		_, err := vfsObj.StatAt(ctx, creds, &vfs.PathOperation{Root: root, Start: root, Path: fspath.Parse(path), FollowFinalSymlink: true}, &vfs.StatOptions{Mask: linux.STATX_TYPE})
+		return err
+	}
+
+	// All 5 components are walked by a single RPC.
+	before := fs.Stats()
+	if err := stat("a/b/c/d/e"); err != nil {
+		t.Fatalf("StatAt(a/b/c/d/e): %v", err)
+	}
+	if got := fs.Stats().Walks - before.Walks; got != 1 {
+		t.Errorf("StatAt(a/b/c/d/e) issued %d walks, want 1", got)
+	}
+
+	// Walking stops at symlinks, which are then followed.
+	before = fs.Stats()
+	if err := stat("a/link/c/d/e"); err != nil {
+		t.Fatalf("StatAt(a/link/c/d/e): %v", err)
+	}
+	if got := fs.Stats().Walks - before.Walks; got != 1 {
+		t.Errorf("StatAt(a/link/c/d/e) issued %d walks, want 1", got)
+	}
+
+	// Missing components are still reported.
+	if err := stat("a/b/x/d/e"); err != syserror.ENOENT {
+		t.Errorf("StatAt(a/b/x/d/e): got err %v, want %v", err, syserror.ENOENT)
+	}
+	if atomic.LoadUint32(&fs.multiWalkUnsupported) != 0 {
+		t.Errorf("multiWalkUnsupported set after failed walk")
+	}
+}
+
+func TestSyncFilesystem(t *testing.T) {
+	ctx := contexttest.Context(t)
+	names := []string{"a", "b", "c"}
+	rootFile := &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: make(map[string]*testP9File),
+	}
+	for _, name := range names {
+		rootFile.children[name] = &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0666, NLink: 1}}
+	}
+	addr, _ := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr)
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+
+	fds := make(map[string]*vfs.FileDescription)
+	want := make(map[string][]byte)
+	for _, name := range names {
+		fd, err := openAt(ctx, root, name, linux.O_WRONLY)
+		if err != nil {
+			t.Fatalf("OpenAt(%s): %v", name, err)
+		}
+		defer fd.DecRef()
+		fds[name] = fd
+	}
+	writeAll := func() {
+		for _, name := range names {
+			data := []byte("data for " + name)
+			if _, err := fds[name].Write(ctx, usermem.BytesIOSequence(data), vfs.WriteOptions{}); err != nil {
+				t.Fatalf("Write(%s): %v", name, err)
+			}
+			want[name] = append(want[name], data...)
+		}
+	}
+	checkAll := func(when string) {
+		for _, name := range names {
+			if got := rootFile.children[name].contents(); !bytes.Equal(got, want[name]) {
+				t.Errorf("%s: remote file %s contains %q, want %q", when, name, got, want[name])
+			}
+			if got := rootFile.children[name].fsyncs; got == 0 {
+				t.Errorf("%s: remote file %s was not synced", when, name)
+			}
+		}
+	}
+
+	// Small appends are coalesced in the cache, so they remain dirty until
+	// the filesystem is synced.
+	writeAll()
+	if err := fs.Sync(ctx); err != nil {
+		t.Fatalf("Sync(): %v", err)
+	}
+	checkAll("after first sync")
+
+	// The filesystem remains usable after syncing.
+	writeAll()
+	if err := fs.Sync(ctx); err != nil {
+		t.Fatalf("Sync(): %v", err)
+	}
+	checkAll("after second sync")
+}
+
+func TestRenameAcrossFilesystems(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	creds := auth.CredentialsFromContext(ctx)
+
+	fs1 := newTestFilesystem(ctx, filesystemOptions{})
+	mntDir, err := fs1.newDentry(ctx, p9file{file: &testP9File{}}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeDirectory | 0755})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	file1, err := fs1.newDentry(ctx, p9file{file: &testP9File{}}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeRegular | 0644})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	root := newTestRoot(ctx, t, fs1, &testP9File{}, map[string]*dentry{"mnt": mntDir, "file1": file1})
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+
+	// Mount a second gofer filesystem at /mnt.
+	fs2 := newTestFilesystem(ctx, filesystemOptions{})
+	root2, err := fs2.newDentry(ctx, p9file{file: &testP9File{}}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeDirectory | 0755})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	root2.refs = 1
+	file2, err := fs2.newDentry(ctx, p9file{file: &testP9File{}}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeRegular | 0644})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	root2.IncRef() // reference held by child on its parent.
+	root2.vfsd.InsertChild(&file2.vfsd, "file2")
+	vfsObj.MustRegisterFilesystemType("gofer_test2", &testFilesystemType{fs: fs2, root: root2}, &vfs.RegisterFilesystemTypeOptions{})
+	if err := vfsObj.MountAt(ctx, creds, "", pathOp(root, "mnt"), "gofer_test2", &vfs.MountOptions{InternalMount: true}); err != nil {
+		t.Fatalf("MountAt(/mnt): %v", err)
+	}
+
+	for _, test := range []struct {
+		oldPath string
+		newPath string
+	}{
+		{oldPath: "file1", newPath: "mnt/file1"},
+		{oldPath: "mnt/file2", newPath: "file2"},
+	} {
+		if err := vfsObj.RenameAt(ctx, creds, pathOp(root, test.oldPath), pathOp(root, test.newPath), &vfs.RenameOptions{}); err != syserror.EXDEV {
+			t.Errorf("RenameAt(%s, %s): got err %v, want %v", test.oldPath, test.newPath, err, syserror.EXDEV)
+		}
+		if _, err := vfsObj.StatAt(ctx, creds, pathOp(root, test.oldPath), &vfs.StatOptions{}); err != nil {
+			t.Errorf("StatAt(%s) after failed rename: %v", test.oldPath, err)
+		}
+	}
+}
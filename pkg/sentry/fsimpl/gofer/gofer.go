@@ -26,9 +26,14 @@
 //             *** "memmap.Mappable locks taken by Translate" below this point
 //             dentry.handleMu
 //               dentry.dataMu
+//                 filesystem.writebackMu
 //
 // Locking dentry.dirMu in multiple dentries requires holding
 // filesystem.renameMu for writing.
+//
+// In race builds, locking filesystem.renameMu, dentry.dirMu,
+// filesystem.syncMu, dentry.metadataMu, dentry.mapsMu, dentry.handleMu or
+// dentry.dataMu out of order panics; see lock_order.go.
 package gofer
 
 import (
@@ -38,17 +43,21 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/arch"
 	"gvisor.dev/gvisor/pkg/sentry/fs/fsutil"
+	fslock "gvisor.dev/gvisor/pkg/sentry/fs/lock"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
 	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
 	"gvisor.dev/gvisor/pkg/sentry/memmap"
 	"gvisor.dev/gvisor/pkg/sentry/pgalloc"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/sentry/vfs/lock"
 	"gvisor.dev/gvisor/pkg/syserror"
 	"gvisor.dev/gvisor/pkg/unet"
 	"gvisor.dev/gvisor/pkg/usermem"
@@ -71,9 +80,23 @@ type filesystem struct {
 	// Immutable options.
 	opts filesystemOptions
 
-	// client is the client used by this filesystem. client is immutable.
+	// client is the client used by this filesystem. If opts.reconnect is
+	// true, client may be replaced by the reconnect worker while renameMu is
+	// locked for writing. client is also replaced by CompleteRestore.
 	client *p9.Client
 
+	// stats counts RPCs issued by this filesystem. stats is immutable, and
+	// may be nil in tests.
+	stats *rpcStats
+
+	// limiter bounds the number of concurrent RPCs issued by this filesystem.
+	// limiter is immutable, and is nil if fs.opts.maxInflightRPCs == 0.
+	limiter *rpcLimiter
+
+	// rootQID is the QID of the file attached to as the filesystem root, as
+	// reported by the server at mount time. rootQID is immutable.
+	rootQID p9.QID
+
 	// clock is a realtime clock used to set timestamps in file operations.
 	clock ktime.Clock
 
@@ -93,39 +116,218 @@ type filesystem struct {
 	// reference count (such that it is usable as vfs.ResolvingPath.Start() or
 	// is reachable from its children), or if it is a child dentry (such that
 	// it is reachable from its parent).
-	renameMu sync.RWMutex
+	renameMu renameMutex
 
 	// cachedDentries contains all dentries with 0 references. (Due to race
 	// conditions, it may also contain dentries with non-zero references.)
-	// cachedDentriesLen is the number of dentries in cachedDentries. These
-	// fields are protected by renameMu.
+	// cachedDentries is ordered by cachePolicy, and the dentry at its back is
+	// evicted first. cachedDentriesLen is the number of dentries in
+	// cachedDentries. These fields are protected by renameMu.
 	cachedDentries    dentryList
 	cachedDentriesLen uint64
+	cachePolicy       dentryCachePolicy
+
+	// dentryCacheStats counts dentry cache hits, misses, insertions,
+	// evictions and invalidations.
+	dentryCacheStats dentryCacheStats
 
 	// dentries contains all dentries in this filesystem. specialFileFDs
 	// contains all open specialFileFDs. These fields are protected by syncMu.
-	syncMu         sync.Mutex
+	syncMu         syncMutex
 	dentries       map[*dentry]struct{}
 	specialFileFDs map[*specialFileFD]struct{}
+
+	// If opts.writebackLimit != 0, writebackQueue contains dentries whose
+	// dirty cached data should be written back by the writeback worker, which
+	// is woken by sending to writebackWake and stopped by closing
+	// writebackStop; it closes writebackDone when it exits. writebackErr is
+	// the first error encountered by the writeback worker since the last call
+	// to filesystem.Sync(). writebackQueue and writebackErr are protected by
+	// writebackMu. The channels are immutable.
+	writebackMu    sync.Mutex
+	writebackQueue map[*dentry]struct{}
+	writebackErr   error
+	writebackWake  chan struct{}
+	writebackStop  chan struct{}
+	writebackDone  chan struct{}
+
+	// If opts.idleHandleTimeout != 0, the idle handle reaper is stopped by
+	// closing idleHandleStop, and closes idleHandleDone when it exits. These
+	// channels are immutable.
+	idleHandleStop chan struct{}
+	idleHandleDone chan struct{}
+
+	// If opts.dentryCacheTrimInterval != 0, the dentry cache trimmer is
+	// stopped by closing dentryTrimStop, and closes dentryTrimDone when it
+	// exits. These channels are immutable.
+	dentryTrimStop chan struct{}
+	dentryTrimDone chan struct{}
+
+	// If opts.pageCacheLimit != 0, cachedBytes is the total number of bytes
+	// cached by all dentries in fs, and the page cache reclaimer is woken by
+	// sending to pageCacheWake and stopped by closing pageCacheStop; it closes
+	// pageCacheDone when it exits. cacheUses is incremented each time a
+	// dentry's cached pages are used, to order dentries for reclaim.
+	// cachedBytes and cacheUses are accessed using atomic memory operations.
+	// The channels are immutable.
+	cachedBytes   int64
+	cacheUses     uint64
+	pageCacheWake chan struct{}
+	pageCacheStop chan struct{}
+	pageCacheDone chan struct{}
+
+	// evictable is 1 if fs is registered with the MemoryFile as an
+	// EvictableMemoryUser, such that fs.Evict() will be called under memory
+	// pressure, and 0 otherwise. evictable is accessed using atomic memory
+	// operations.
+	evictable uint32
+
+	// If opts.reconnect is true, the reconnect worker re-establishes the
+	// connection to the server when it is lost. It is stopped by closing
+	// reconnectStop, and closes reconnectDone when it exits. reconnects is the
+	// number of times the connection has been re-established, and is accessed
+	// using atomic memory operations. The channels are only changed while the
+	// worker is not running.
+	reconnectStop chan struct{}
+	reconnectDone chan struct{}
+	reconnects    uint64
+
+	// saved is the state of the filesystem's dentry tree captured by
+	// PrepareSave, and consumed by CompleteRestore. saved is nil if
+	// opts.restorable is false, or if no save is in progress.
+	saved *savedState
+
+	// The following fields are initialized from opts.features, and may also
+	// be set if a server that claims to support an operation fails it.
+
+	// seekUnsupported is 1 if the server has reported that it does not
+	// support p9.File.Seek, such that SEEK_DATA and SEEK_HOLE should not be
+	// forwarded to it, and 0 otherwise. seekUnsupported is accessed using
+	// atomic memory operations.
+	seekUnsupported uint32
+
+	// getAttrChildrenUnsupported is 1 if the server has reported that it does
+	// not support p9.File.GetAttrChildren, such that directory reads under
+	// InteropModeShared do not revalidate children, and 0 otherwise.
+	// getAttrChildrenUnsupported is accessed using atomic memory operations.
+	getAttrChildrenUnsupported uint32
+
+	// copyRangeUnsupported is 1 if the server has reported that it does not
+	// support p9.File.CopyRange, such that copies between files on this
+	// filesystem must be done by the caller, and 0 otherwise.
+	// copyRangeUnsupported is accessed using atomic memory operations.
+	copyRangeUnsupported uint32
+
+	// multiWalkUnsupported is 1 if the server has reported that it does not
+	// support p9.MultiWalker.MultiWalk, such that path components are always
+	// walked one at a time, and 0 otherwise. multiWalkUnsupported is accessed
+	// using atomic memory operations.
+	multiWalkUnsupported uint32
 }
 
 type filesystemOptions struct {
 	// "Standard" 9P options.
+	//
+	// Exactly one of fd and addr identifies the connection to the server:
+	// fd is a connected socket FD if "trans=fd", and addr is the path of a
+	// unix domain socket to connect to if "trans=unix" (in which case fd is
+	// -1).
 	fd      int
+	addr    string
 	aname   string
 	interop InteropMode // derived from the "cache" mount option
-	msize   uint32
+	msize   uint32      // the negotiated message size, which may be less than the "msize" mount option
 	version string
 
+	// If rcvbuf or sndbuf are non-zero, they are the sizes in bytes of the
+	// receive and send buffers requested for the connection to the server,
+	// set by the "rcvbuf" and "sndbuf" mount options respectively. If zero,
+	// the kernel's defaults are used.
+	rcvbuf uint32
+	sndbuf uint32
+
+	// rootPath is the path, relative to the file attached to, of the
+	// directory used as the filesystem root. rootPath is set by the
+	// "root_path" mount option.
+	rootPath []string
+
 	// maxCachedDentries is the maximum number of dentries with 0 references
 	// retained by the client.
 	maxCachedDentries uint64
 
+	// If dentryCacheTrimInterval is non-zero, a background worker checks
+	// every dentryCacheTrimInterval whether the dentry cache has been used
+	// since the previous check; if not, it evicts cached dentries until at
+	// most dentryCacheLowWater remain, releasing their fids on the server.
+	// These are set by the "dentry_cache_trim_interval_ns" and
+	// "dentry_cache_low_water" mount options respectively.
+	dentryCacheTrimInterval time.Duration
+	dentryCacheLowWater     uint64
+
+	// dentryCachePolicy selects the policy used to evict dentries retained
+	// by the client: "lru" (the default) or "2q" (see
+	// twoQueueDentryCachePolicy). dentryCachePolicy is set by the
+	// "dentry_cache_policy" mount option.
+	dentryCachePolicy string
+
+	// If writebackLimit is non-zero, a regular file's dirty cached data is
+	// written back by a background worker once it exceeds writebackLimit
+	// bytes, rather than only when the file is synced or its dentry is
+	// evicted. writebackLimit is non-zero only under "cache=writeback".
+	writebackLimit uint64
+
+	// If readahead is non-zero, reads through the page cache that miss fill up
+	// to readahead bytes past the end of the read, rather than the default
+	// maxFillRange() window. readahead is set by the "readahead" mount
+	// option.
+	readahead uint64
+
+	// If prefetchSmallFiles is non-zero, opening a regular file smaller than
+	// prefetchSmallFiles bytes for reading reads the whole file into the page
+	// cache, so that subsequent reads of it don't need to contact the server.
+	// prefetchSmallFiles is set by the "prefetch_small_files" mount option.
+	prefetchSmallFiles uint64
+
+	// atime controls when reads update cached atimes. It is set by the
+	// "noatime", "relatime" and "strictatime" mount options, and defaults to
+	// atimeStrict.
+	atime atimePolicy
+
+	// If serverCtime is true, stats of files fetch and report the server's
+	// ctime even if InteropModeShared is not in effect, so that changes made
+	// by other remote filesystem users are visible to applications that use
+	// ctime to detect them (e.g. rsync). Other timestamps are unaffected.
+	// serverCtime is set by the "ctime=server" mount option.
+	serverCtime bool
+
 	// If forcePageCache is true, host FDs may not be used for application
 	// memory mappings even if available; instead, the client must perform its
 	// own caching of regular file pages. This is primarily useful for testing.
 	forcePageCache bool
 
+	// If realIno is true, the inode numbers reported for files are those of
+	// the files in the server's backing filesystem, rather than their QID
+	// paths, which the server may construct differently (e.g. runsc's gofer
+	// encodes the host device in the QID path). This costs an additional RPC
+	// for each file looked up, and requires a server that supports the
+	// Tgetino extension; files whose inode numbers the server can't report
+	// fall back to their QID paths. Directory entries returned by the server
+	// are unaffected. realIno is set by the "real_ino" mount option.
+	realIno bool
+
+	// If hashIno is true, the inode numbers reported for files other than
+	// the root are derived from a hash of the file's path (relative to the
+	// filesystem root) and QID version when the file is first looked up,
+	// rather than from its QID path. This avoids collisions between live
+	// files on servers that recycle QID paths, at the cost of inode numbers
+	// that aren't stable: a file that is looked up again after it is renamed
+	// or its QID version changes (e.g. after its dentry is evicted) is
+	// reported with a different inode number, and hard links to the same file
+	// are reported with distinct inode numbers. The QID path is still used to determine file
+	// identity. hashIno is set by the "ino_source=hash" mount option, and is
+	// superseded by realIno.
+	hashIno bool
+
 	// If limitHostFDTranslation is true, apply maxFillRange() constraints to
 	// host FD mappings returned by dentry.(memmap.Mappable).Translate(). This
 	// makes memory accounting behavior more consistent between cases where
@@ -140,11 +342,127 @@ type filesystemOptions struct {
 	// mount on Linux < 4.19.
 	overlayfsStaleRead bool
 
+	// If traceHandles is true, changes to dentries' shared handles are
+	// logged, for debugging. traceHandles is set by the "trace_handles" mount
+	// option.
+	traceHandles bool
+
+	// If noNegativeCache is true, lookups of names that do not exist are not
+	// cached, so that files created by other users of the remote filesystem
+	// are visible without InteropModeShared. noNegativeCache is set by the
+	// "no_negative_cache" mount option.
+	noNegativeCache bool
+
+	// If casefold is true, lookups of names that do not exist fall back to
+	// names that match case-insensitively, for applications that expect
+	// case-insensitive filesystem behavior. Since names that do not exist may
+	// later match differently cased files, casefold implies noNegativeCache.
+	// casefold is set by the "casefold" mount option.
+	casefold bool
+
+	// If trustedXattrs is true, extended attributes in the "trusted."
+	// namespace are passed through to the server, in addition to those in the
+	// "user." namespace. securityXattrs is analogous for the "security."
+	// namespace. These are set by the "xattr_namespaces" mount option.
+	trustedXattrs  bool
+	securityXattrs bool
+
+	// serverClockOffset is added to timestamps reported by the server, and
+	// subtracted from timestamps sent to it, to compensate for the difference
+	// between the server's clock and the sandbox's. It is set by the
+	// "server_clock_offset_ns" mount option.
+	serverClockOffset int64
+
+	// If idleHandleTimeout is non-zero, the shared handles of regular files
+	// and directories that have had no open FDs for at least
+	// idleHandleTimeout are closed by a background worker, after writing
+	// back dirty cached data, to reduce the number of files held open by the
+	// server. idleHandleTimeout is set by the "idle_handle_timeout_ns" mount
+	// option.
+	idleHandleTimeout time.Duration
+
+	// If rpcTimeout is non-zero, RPCs to which the server does not respond
+	// within rpcTimeout are flushed and fail with ETIMEDOUT, so that a hung
+	// server cannot block tasks indefinitely. rpcTimeout is set by the
+	// "rpc_timeout_ns" mount option.
+	rpcTimeout time.Duration
+
+	// If maxInflightRPCs is non-zero, it is the maximum number of RPCs that
+	// may be outstanding at once; tasks issuing further RPCs wait for earlier
+	// ones to complete. maxInflightRPCs is set by the "max_inflight_rpcs"
+	// mount option.
+	maxInflightRPCs int
+
+	// If pageCacheLimit is non-zero, cached regular file pages are released,
+	// least recently used first and after writing back dirty pages, by a
+	// background worker when the total size of the filesystem's page cache
+	// exceeds pageCacheLimit bytes. pageCacheLimit is set by the
+	// "page_cache_limit" mount option.
+	pageCacheLimit uint64
+
+	// If reconnect is true, the connection to the server is re-established if
+	// it is lost, and remote files are reopened. reconnect is set by the
+	// "reconnect" mount option, and requires "trans=unix".
+	reconnect bool
+
+	// If restorable is true, the filesystem's dentry tree is preserved across
+	// save/restore, and the connection to the server is re-established on
+	// restore. restorable is set by the "restorable" mount option, and
+	// requires "trans=unix".
+	restorable bool
+
+	// If readonly is true, operations that would modify the filesystem fail
+	// with EROFS without contacting the server. readonly is set by the "ro"
+	// mount option.
+	readonly bool
+
+	// If sync is true, every write to a regular file is written back to the
+	// remote file and synced before returning, as if the file was opened with
+	// O_SYNC. sync is set by the "sync" mount option.
+	sync bool
+
 	// If regularFilesUseSpecialFileFD is true, application FDs representing
 	// regular files will use distinct file handles for each FD, in the same
 	// way that application FDs representing "special files" such as sockets
 	// do. Note that this disables client caching and mmap for regular files.
 	regularFilesUseSpecialFileFD bool
+
+	// features records the optional operations supported by the server. It
+	// is not set by a mount option, but by GetFilesystem after attaching to
+	// the server.
+	features serverFeatures
+}
+
+// serverFeatures records which optional operations a server supports, as
+// determined at mount time from the negotiated protocol version and, for
+// operations that all versions permit, by querying the server. Operations
+// that a server supports may still fail with ENOSYS or EOPNOTSUPP (e.g. if
+// the server's host kernel doesn't support them); see the *Unsupported fields
+// of filesystem.
+type serverFeatures struct {
+	statFS          bool
+	allocate        bool
+	seek            bool
+	copyRange       bool
+	getAttrChildren bool
+	multiWalk       bool
+}
+
+// probeServerFeatures returns the serverFeatures of the server to which
+// client is connected. f is a file on the server.
+func probeServerFeatures(ctx context.Context, client *p9.Client, f p9file) serverFeatures {
+	features := serverFeatures{
+		allocate:        client.SupportsMessage(p9.MsgTallocate),
+		seek:            client.SupportsMessage(p9.MsgTseek),
+		copyRange:       client.SupportsMessage(p9.MsgTcopyrange),
+		getAttrChildren: client.SupportsMessage(p9.MsgTgetattrs),
+		multiWalk:       client.SupportsMessage(p9.MsgTmultiwalk),
+	}
+	// Tstatfs is permitted by all versions, but is optional for servers.
+	if _, err := f.statFS(ctx); err != syserror.ENOSYS && err != syserror.EOPNOTSUPP {
+		features.statFS = true
+	}
+	return features
 }
 
 // InteropMode controls the client's interaction with other remote filesystem
@@ -167,7 +485,9 @@ const (
 	// and consistent with Linux's semantics. However, since it is not always
 	// possible for clients to set arbitrary atimes and mtimes, and never
 	// possible for clients to set arbitrary ctimes, file timestamp changes are
-	// stored in the client only and never sent to the remote filesystem.
+	// stored in the client only and never sent to the remote filesystem. (The
+	// "ctime=server" mount option is an exception; see
+	// filesystemOptions.serverCtime.)
 	InteropModeExclusive InteropMode = iota
 
 	// InteropModeWritethrough is appropriate when there are read-only users of
@@ -179,9 +499,9 @@ const (
 	// - Client changes to filesystem state must be sent to the remote
 	// filesystem synchronously.
 	//
-	// - File timestamps are based on client clocks. As a corollary, access
-	// timestamp changes from other remote filesystem users will not be visible
-	// to the client.
+	// - File timestamps are based on client clocks, except as for
+	// InteropModeExclusive. As a corollary, access timestamp changes from
+	// other remote filesystem users will not be visible to the client.
 	InteropModeWritethrough
 
 	// InteropModeShared is appropriate when there are users of the remote
@@ -201,9 +521,37 @@ const (
 	// single filesystem object), even in the presence of remote filesystem
 	// mutations from other users. If this is violated, the behavior of the
 	// client is undefined.
+	//
+	// Directory entries and symlink targets are only cached while the server
+	// reports an unchanged, nonzero QID version for the directory or symlink.
+	// Servers that don't version files, including runsc's fsgofer, which
+	// always reports QID version 0, therefore get no such caching; they are
+	// read from the server every time they are used. A server that reports
+	// QID versions must change a file's version whenever the file changes.
+	//
+	// Mutations by other remote filesystem users do not generate inotify
+	// events, since 9P provides no way for the server to notify the client of
+	// them, and VFS2 does not yet support inotify.
+	// TODO(gvisor.dev/issue/1479): Once VFS2 supports inotify, consider a
+	// server-initiated notification message that both generates events and
+	// invalidates affected dentries.
 	InteropModeShared
 )
 
+// String implements fmt.Stringer.String.
+func (mode InteropMode) String() string {
+	switch mode {
+	case InteropModeExclusive:
+		return "exclusive"
+	case InteropModeWritethrough:
+		return "writethrough"
+	case InteropModeShared:
+		return "shared"
+	default:
+		return fmt.Sprintf("InteropMode(%d)", uint32(mode))
+	}
+}
+
 // Name implements vfs.FilesystemType.Name.
 func (FilesystemType) Name() string {
 	return Name
@@ -220,47 +568,111 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 	mopts := vfs.GenericParseMountOptions(opts.Data)
 	var fsopts filesystemOptions
 
-	// Check that the transport is "fd".
+	// Check that the transport is "fd" or "unix".
 	trans, ok := mopts["trans"]
 	if !ok {
-		ctx.Warningf("gofer.FilesystemType.GetFilesystem: transport must be specified as 'trans=fd'")
+		ctx.Warningf("gofer.FilesystemType.GetFilesystem: transport must be specified as 'trans=fd' or 'trans=unix'")
 		return nil, nil, syserror.EINVAL
 	}
 	delete(mopts, "trans")
-	if trans != "fd" {
+	switch trans {
+	case "fd":
+		// Check that read and write FDs are provided and identical.
+		rfdstr, ok := mopts["rfdno"]
+		if !ok {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: read FD must be specified as 'rfdno=<file descriptor>")
+			return nil, nil, syserror.EINVAL
+		}
+		delete(mopts, "rfdno")
+		rfd, err := strconv.Atoi(rfdstr)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid read FD: rfdno=%s", rfdstr)
+			return nil, nil, syserror.EINVAL
+		}
+		wfdstr, ok := mopts["wfdno"]
+		if !ok {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: write FD must be specified as 'wfdno=<file descriptor>")
+			return nil, nil, syserror.EINVAL
+		}
+		delete(mopts, "wfdno")
+		wfd, err := strconv.Atoi(wfdstr)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid write FD: wfdno=%s", wfdstr)
+			return nil, nil, syserror.EINVAL
+		}
+		if rfd != wfd {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: read FD (%d) and write FD (%d) must be equal", rfd, wfd)
+			return nil, nil, syserror.EINVAL
+		}
+		fsopts.fd = rfd
+	case "unix":
+		// Check that a socket path is provided, and that FDs are not.
+		addr, ok := mopts["addr"]
+		if !ok || addr == "" {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: socket path must be specified as 'addr=<path>'")
+			return nil, nil, syserror.EINVAL
+		}
+		delete(mopts, "addr")
+		for _, key := range []string{"rfdno", "wfdno"} {
+			if _, ok := mopts[key]; ok {
+				ctx.Warningf("gofer.FilesystemType.GetFilesystem: %s is not supported with trans=unix", key)
+				return nil, nil, syserror.EINVAL
+			}
+		}
+		fsopts.fd = -1
+		fsopts.addr = addr
+	default:
 		ctx.Warningf("gofer.FilesystemType.GetFilesystem: unsupported transport: trans=%s", trans)
 		return nil, nil, syserror.EINVAL
 	}
 
-	// Check that read and write FDs are provided and identical.
-	rfdstr, ok := mopts["rfdno"]
-	if !ok {
-		ctx.Warningf("gofer.FilesystemType.GetFilesystem: read FD must be specified as 'rfdno=<file descriptor>")
-		return nil, nil, syserror.EINVAL
+	if err := parseFilesystemOptions(ctx, mopts, &fsopts); err != nil {
+		return nil, nil, err
+	}
+
+	// Establish a connection with the server.
+	var (
+		conn *unet.Socket
+		err  error
+	)
+	if fsopts.addr != "" {
+		ctx.UninterruptibleSleepStart(false)
+		conn, err = unet.Connect(fsopts.addr, false /* packet */)
+		ctx.UninterruptibleSleepFinish(false)
+	} else {
+		conn, err = unet.NewSocket(fsopts.fd)
 	}
-	delete(mopts, "rfdno")
-	rfd, err := strconv.Atoi(rfdstr)
 	if err != nil {
-		ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid read FD: rfdno=%s", rfdstr)
-		return nil, nil, syserror.EINVAL
+		return nil, nil, err
 	}
-	wfdstr, ok := mopts["wfdno"]
-	if !ok {
-		ctx.Warningf("gofer.FilesystemType.GetFilesystem: write FD must be specified as 'wfdno=<file descriptor>")
-		return nil, nil, syserror.EINVAL
+	if err := setSocketBufferSizes(conn, &fsopts); err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
-	delete(mopts, "wfdno")
-	wfd, err := strconv.Atoi(wfdstr)
+
+	// Perform version negotiation with the server.
+	ctx.UninterruptibleSleepStart(false)
+	client, err := p9.NewClient(conn, fsopts.msize, fsopts.version)
+	ctx.UninterruptibleSleepFinish(false)
 	if err != nil {
-		ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid write FD: wfdno=%s", wfdstr)
-		return nil, nil, syserror.EINVAL
+		conn.Close()
+		return nil, nil, err
 	}
-	if rfd != wfd {
-		ctx.Warningf("gofer.FilesystemType.GetFilesystem: read FD (%d) and write FD (%d) must be equal", rfd, wfd)
-		return nil, nil, syserror.EINVAL
+	// Ownership of conn has been transferred to client.
+	client.SetTimeout(fsopts.rpcTimeout)
+	if msize := client.MessageSize(); msize != fsopts.msize {
+		ctx.Warningf("gofer.FilesystemType.GetFilesystem: server reduced message size from %d to %d", fsopts.msize, msize)
+		fsopts.msize = msize
 	}
-	fsopts.fd = rfd
 
+	return fstype.newFilesystem(ctx, vfsObj, creds, mfp, client, fsopts)
+}
+
+// parseFilesystemOptions parses the mount options in mopts other than
+// transport options into fsopts, applying defaults for options that are not
+// specified. fsopts.addr must already be set, since some options require
+// "trans=unix".
+func parseFilesystemOptions(ctx context.Context, mopts map[string]string, fsopts *filesystemOptions) error {
 	// Get the attach name.
 	fsopts.aname = "/"
 	if aname, ok := mopts["aname"]; ok {
@@ -268,6 +680,21 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 		fsopts.aname = aname
 	}
 
+	// Get the path of the filesystem root relative to the attach point.
+	if rootPath, ok := mopts["root_path"]; ok {
+		delete(mopts, "root_path")
+		for _, name := range strings.Split(rootPath, "/") {
+			switch name {
+			case "", ".":
+				continue
+			case "..":
+				ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid root path: root_path=%s", rootPath)
+				return syserror.EINVAL
+			}
+			fsopts.rootPath = append(fsopts.rootPath, name)
+		}
+	}
+
 	// Parse the cache policy. For historical reasons, this defaults to the
 	// least generally-applicable option, InteropModeExclusive.
 	fsopts.interop = InteropModeExclusive
@@ -278,6 +705,9 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 			fsopts.interop = InteropModeExclusive
 		case "fscache_writethrough":
 			fsopts.interop = InteropModeWritethrough
+		case "writeback":
+			fsopts.interop = InteropModeExclusive
+			fsopts.writebackLimit = defaultWritebackLimit
 		case "none":
 			fsopts.regularFilesUseSpecialFileFD = true
 			fallthrough
@@ -285,7 +715,7 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 			fsopts.interop = InteropModeShared
 		default:
 			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid cache policy: cache=%s", cache)
-			return nil, nil, syserror.EINVAL
+			return syserror.EINVAL
 		}
 	}
 
@@ -296,11 +726,32 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 		msize, err := strconv.ParseUint(msizestr, 10, 32)
 		if err != nil {
 			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid message size: msize=%s", msizestr)
-			return nil, nil, syserror.EINVAL
+			return syserror.EINVAL
 		}
 		fsopts.msize = uint32(msize)
 	}
 
+	// Parse socket buffer sizes.
+	for _, opt := range []struct {
+		name string
+		size *uint32
+	}{
+		{"rcvbuf", &fsopts.rcvbuf},
+		{"sndbuf", &fsopts.sndbuf},
+	} {
+		str, ok := mopts[opt.name]
+		if !ok {
+			continue
+		}
+		delete(mopts, opt.name)
+		size, err := strconv.ParseUint(str, 10, 31)
+		if err != nil || size == 0 {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid socket buffer size: %s=%s", opt.name, str)
+			return syserror.EINVAL
+		}
+		*opt.size = uint32(size)
+	}
+
 	// Parse the 9P protocol version.
 	fsopts.version = p9.HighestVersionString()
 	if version, ok := mopts["version"]; ok {
@@ -309,22 +760,219 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 	}
 
 	// Parse the dentry cache limit.
-	fsopts.maxCachedDentries = 1000
+	fsopts.maxCachedDentries = defaultMaxCachedDentries
 	if str, ok := mopts["dentry_cache_limit"]; ok {
 		delete(mopts, "dentry_cache_limit")
 		maxCachedDentries, err := strconv.ParseUint(str, 10, 64)
 		if err != nil {
 			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid dentry cache limit: dentry_cache_limit=%s", str)
-			return nil, nil, syserror.EINVAL
+			return syserror.EINVAL
 		}
 		fsopts.maxCachedDentries = maxCachedDentries
 	}
 
+	// Parse the dentry cache trimming options.
+	if str, ok := mopts["dentry_cache_trim_interval_ns"]; ok {
+		delete(mopts, "dentry_cache_trim_interval_ns")
+		interval, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || interval <= 0 {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid dentry cache trim interval: dentry_cache_trim_interval_ns=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.dentryCacheTrimInterval = time.Duration(interval)
+	}
+	if str, ok := mopts["dentry_cache_low_water"]; ok {
+		delete(mopts, "dentry_cache_low_water")
+		lowWater, err := strconv.ParseUint(str, 10, 64)
+		if err != nil || lowWater > fsopts.maxCachedDentries {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid dentry cache low-water mark: dentry_cache_low_water=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.dentryCacheLowWater = lowWater
+	}
+
+	// Parse the dentry cache policy.
+	fsopts.dentryCachePolicy = "lru"
+	if str, ok := mopts["dentry_cache_policy"]; ok {
+		delete(mopts, "dentry_cache_policy")
+		switch str {
+		case "lru", "2q":
+			fsopts.dentryCachePolicy = str
+		default:
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid dentry cache policy: dentry_cache_policy=%s", str)
+			return syserror.EINVAL
+		}
+	}
+
+	// Parse the writeback limit.
+	if str, ok := mopts["writeback_limit"]; ok {
+		delete(mopts, "writeback_limit")
+		if fsopts.writebackLimit == 0 {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: writeback_limit requires cache=writeback")
+			return syserror.EINVAL
+		}
+		writebackLimit, err := strconv.ParseUint(str, 10, 64)
+		if err != nil || writebackLimit == 0 {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid writeback limit: writeback_limit=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.writebackLimit = writebackLimit
+	}
+
+	// Parse the server clock offset.
+	if str, ok := mopts["server_clock_offset_ns"]; ok {
+		delete(mopts, "server_clock_offset_ns")
+		offset, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid server clock offset: server_clock_offset_ns=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.serverClockOffset = offset
+	}
+
+	// Parse the idle handle timeout.
+	if str, ok := mopts["idle_handle_timeout_ns"]; ok {
+		delete(mopts, "idle_handle_timeout_ns")
+		timeout, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || timeout <= 0 {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid idle handle timeout: idle_handle_timeout_ns=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.idleHandleTimeout = time.Duration(timeout)
+	}
+
+	// Parse the RPC timeout.
+	if str, ok := mopts["rpc_timeout_ns"]; ok {
+		delete(mopts, "rpc_timeout_ns")
+		timeout, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || timeout < 0 {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid RPC timeout: rpc_timeout_ns=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.rpcTimeout = time.Duration(timeout)
+	}
+
+	// Parse the RPC concurrency limit.
+	if str, ok := mopts["max_inflight_rpcs"]; ok {
+		delete(mopts, "max_inflight_rpcs")
+		maxInflightRPCs, err := strconv.Atoi(str)
+		if err != nil || maxInflightRPCs <= 0 {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid RPC concurrency limit: max_inflight_rpcs=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.maxInflightRPCs = maxInflightRPCs
+	}
+
+	// Parse the page cache limit.
+	if str, ok := mopts["page_cache_limit"]; ok {
+		delete(mopts, "page_cache_limit")
+		pageCacheLimit, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid page cache limit: page_cache_limit=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.pageCacheLimit = pageCacheLimit
+	}
+
+	// Parse the readahead window.
+	if str, ok := mopts["readahead"]; ok {
+		delete(mopts, "readahead")
+		readahead, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid readahead window: readahead=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.readahead = readahead
+	}
+
+	// Parse the small file prefetch threshold.
+	if str, ok := mopts["prefetch_small_files"]; ok {
+		delete(mopts, "prefetch_small_files")
+		threshold, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid small file prefetch threshold: prefetch_small_files=%s", str)
+			return syserror.EINVAL
+		}
+		fsopts.prefetchSmallFiles = threshold
+	}
+
+	// Parse the enabled extended attribute namespaces. Since mount options
+	// are comma-separated, namespaces are separated by colons.
+	if str, ok := mopts["xattr_namespaces"]; ok {
+		delete(mopts, "xattr_namespaces")
+		for _, ns := range strings.Split(str, ":") {
+			switch ns {
+			case "user":
+				// Always enabled.
+			case "trusted":
+				fsopts.trustedXattrs = true
+			case "security":
+				fsopts.securityXattrs = true
+			default:
+				ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid xattr namespace: xattr_namespaces=%s", str)
+				return syserror.EINVAL
+			}
+		}
+	}
+
+	// Parse the ctime source.
+	if str, ok := mopts["ctime"]; ok {
+		delete(mopts, "ctime")
+		switch str {
+		case "client":
+			fsopts.serverCtime = false
+		case "server":
+			fsopts.serverCtime = true
+		default:
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid ctime source: ctime=%s", str)
+			return syserror.EINVAL
+		}
+	}
+
+	// Parse the inode number source.
+	if str, ok := mopts["ino_source"]; ok {
+		delete(mopts, "ino_source")
+		switch str {
+		case "qid":
+			fsopts.hashIno = false
+		case "hash":
+			fsopts.hashIno = true
+		default:
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid inode number source: ino_source=%s", str)
+			return syserror.EINVAL
+		}
+	}
+
+	// Parse the atime policy. At most one may be specified.
+	var atimeOpts []string
+	for _, opt := range []struct {
+		name   string
+		policy atimePolicy
+	}{
+		{"strictatime", atimeStrict},
+		{"relatime", atimeRelative},
+		{"noatime", atimeNone},
+	} {
+		if _, ok := mopts[opt.name]; ok {
+			delete(mopts, opt.name)
+			atimeOpts = append(atimeOpts, opt.name)
+			fsopts.atime = opt.policy
+		}
+	}
+	if len(atimeOpts) > 1 {
+		ctx.Warningf("gofer.FilesystemType.GetFilesystem: conflicting atime options: %v", atimeOpts)
+		return syserror.EINVAL
+	}
+
 	// Handle simple flags.
 	if _, ok := mopts["force_page_cache"]; ok {
 		delete(mopts, "force_page_cache")
 		fsopts.forcePageCache = true
 	}
+	if _, ok := mopts["real_ino"]; ok {
+		delete(mopts, "real_ino")
+		fsopts.realIno = true
+	}
 	if _, ok := mopts["limit_host_fd_translation"]; ok {
 		delete(mopts, "limit_host_fd_translation")
 		fsopts.limitHostFDTranslation = true
@@ -333,46 +981,151 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 		delete(mopts, "overlayfs_stale_read")
 		fsopts.overlayfsStaleRead = true
 	}
+	if _, ok := mopts["ro"]; ok {
+		delete(mopts, "ro")
+		fsopts.readonly = true
+	}
+	if _, ok := mopts["sync"]; ok {
+		delete(mopts, "sync")
+		fsopts.sync = true
+	}
+	if _, ok := mopts["trace_handles"]; ok {
+		delete(mopts, "trace_handles")
+		fsopts.traceHandles = true
+	}
+	if _, ok := mopts["no_negative_cache"]; ok {
+		delete(mopts, "no_negative_cache")
+		fsopts.noNegativeCache = true
+	}
+	if _, ok := mopts["casefold"]; ok {
+		delete(mopts, "casefold")
+		fsopts.casefold = true
+		fsopts.noNegativeCache = true
+	}
+	if str, ok := mopts["reconnect"]; ok {
+		delete(mopts, "reconnect")
+		reconnect, err := strconv.ParseBool(str)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid reconnect: reconnect=%s", str)
+			return syserror.EINVAL
+		}
+		if reconnect && fsopts.addr == "" {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: reconnect requires trans=unix")
+			return syserror.EINVAL
+		}
+		fsopts.reconnect = reconnect
+	}
+	if str, ok := mopts["restorable"]; ok {
+		delete(mopts, "restorable")
+		restorable, err := strconv.ParseBool(str)
+		if err != nil {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: invalid restorable: restorable=%s", str)
+			return syserror.EINVAL
+		}
+		if restorable && fsopts.addr == "" {
+			ctx.Warningf("gofer.FilesystemType.GetFilesystem: restorable requires trans=unix")
+			return syserror.EINVAL
+		}
+		fsopts.restorable = restorable
+	}
 	// fsopts.regularFilesUseSpecialFileFD can only be enabled by specifying
 	// "cache=none".
 
 	// Check for unparsed options.
 	if len(mopts) != 0 {
 		ctx.Warningf("gofer.FilesystemType.GetFilesystem: unknown options: %v", mopts)
-		return nil, nil, syserror.EINVAL
+		return syserror.EINVAL
 	}
+	return nil
+}
 
-	// Establish a connection with the server.
-	conn, err := unet.NewSocket(fsopts.fd)
-	if err != nil {
-		return nil, nil, err
+// NewFilesystemWithClient returns a gofer filesystem that communicates with
+// the server using client, which must have completed version negotiation,
+// rather than a connection established from mount options. This allows
+// embedders that run a gofer in the same process to use the filesystem
+// without a socket. data contains mount options as accepted by
+// FilesystemType.GetFilesystem, which are parsed and defaulted in the same
+// way, except that options that configure the connection (transport options,
+// "msize", "rcvbuf", "sndbuf" and "version") are not permitted, and
+// "reconnect" and "restorable" can't be enabled, since client has already
+// been established.
+//
+// Ownership of client is transferred to NewFilesystemWithClient; it is closed
+// if an error is returned, and when the returned filesystem is released
+// otherwise.
+func NewFilesystemWithClient(ctx context.Context, vfsObj *vfs.VirtualFilesystem, creds *auth.Credentials, client *p9.Client, data string) (*vfs.Filesystem, *vfs.Dentry, error) {
+	mfp := pgalloc.MemoryFileProviderFromContext(ctx)
+	if mfp == nil {
+		ctx.Warningf("gofer.NewFilesystemWithClient: context does not provide a pgalloc.MemoryFileProvider")
+		client.Close()
+		return nil, nil, syserror.EINVAL
 	}
 
-	// Perform version negotiation with the server.
-	ctx.UninterruptibleSleepStart(false)
-	client, err := p9.NewClient(conn, fsopts.msize, fsopts.version)
-	ctx.UninterruptibleSleepFinish(false)
-	if err != nil {
-		conn.Close()
+	mopts := vfs.GenericParseMountOptions(data)
+	for _, key := range []string{"trans", "rfdno", "wfdno", "addr", "msize", "rcvbuf", "sndbuf", "version"} {
+		if _, ok := mopts[key]; ok {
+			ctx.Warningf("gofer.NewFilesystemWithClient: %s is not supported with a pre-established client", key)
+			client.Close()
+			return nil, nil, syserror.EINVAL
+		}
+	}
+	// Since fsopts.addr is empty, parseFilesystemOptions rejects "reconnect"
+	// and "restorable".
+	fsopts := filesystemOptions{fd: -1}
+	if err := parseFilesystemOptions(ctx, mopts, &fsopts); err != nil {
+		client.Close()
 		return nil, nil, err
 	}
-	// Ownership of conn has been transferred to client.
+	fsopts.msize = client.MessageSize()
+	fsopts.version = fmt.Sprintf("9P2000.L.Google.%d", client.Version())
+	client.SetTimeout(fsopts.rpcTimeout)
+	return FilesystemType{}.newFilesystem(ctx, vfsObj, creds, mfp, client, fsopts)
+}
 
-	// Perform attach to obtain the filesystem root.
-	ctx.UninterruptibleSleepStart(false)
-	attached, err := client.Attach(fsopts.aname)
-	ctx.UninterruptibleSleepFinish(false)
+// newFilesystem attaches to the server using client and constructs a
+// filesystem rooted at the file attached to (or fsopts.rootPath relative to
+// it). Ownership of client is transferred to newFilesystem.
+func (fstype FilesystemType) newFilesystem(ctx context.Context, vfsObj *vfs.VirtualFilesystem, creds *auth.Credentials, mfp pgalloc.MemoryFileProvider, client *p9.Client, fsopts filesystemOptions) (*vfs.Filesystem, *vfs.Dentry, error) {
+	// Perform attach to obtain the filesystem root. The server may block
+	// indefinitely (e.g. if the attach point is on a hung remote
+	// filesystem), so allow the attach to be interrupted.
+	attached, err := client.AttachCancellable(fsopts.aname, ctx.SleepStart())
+	ctx.SleepFinish(err != syserror.EINTR)
+	if err == syserror.EINTR {
+		err = syserror.ErrInterrupted
+	}
 	if err != nil {
 		client.Close()
 		return nil, nil, err
 	}
-	attachFile := p9file{attached}
+	stats := &rpcStats{}
+	var limiter *rpcLimiter
+	if fsopts.maxInflightRPCs != 0 {
+		limiter = newRPCLimiter(fsopts.maxInflightRPCs)
+	}
+	attachFile := p9file{attached, stats, limiter}
+	if len(fsopts.rootPath) != 0 {
+		// Walk from the file attached to to the filesystem root.
+		_, rootFile, err := attachFile.walk(ctx, fsopts.rootPath)
+		attachFile.close(ctx)
+		if err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+		attachFile = rootFile
+	}
+	if fsopts.reconnect || fsopts.restorable {
+		// Remote files must be replaceable if the connection is
+		// re-established, either by the reconnect worker or on restore.
+		attachFile.file = &reconnectFile{file: attachFile.file}
+	}
 	qid, attrMask, attr, err := attachFile.getAttr(ctx, dentryAttrMask())
 	if err != nil {
 		attachFile.close(ctx)
 		client.Close()
 		return nil, nil, err
 	}
+	fsopts.features = probeServerFeatures(ctx, client, attachFile)
 
 	// Construct the filesystem object.
 	fs := &filesystem{
@@ -381,10 +1134,26 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 		uid:            creds.EffectiveKUID,
 		gid:            creds.EffectiveKGID,
 		client:         client,
+		rootQID:        qid,
+		stats:          stats,
+		limiter:        limiter,
 		clock:          ktime.RealtimeClockFromContext(ctx),
 		dentries:       make(map[*dentry]struct{}),
 		specialFileFDs: make(map[*specialFileFD]struct{}),
 	}
+	fs.cachePolicy = newDentryCachePolicy(&fs.opts)
+	if !fsopts.features.seek {
+		fs.seekUnsupported = 1
+	}
+	if !fsopts.features.copyRange {
+		fs.copyRangeUnsupported = 1
+	}
+	if !fsopts.features.getAttrChildren {
+		fs.getAttrChildrenUnsupported = 1
+	}
+	if !fsopts.features.multiWalk {
+		fs.multiWalkUnsupported = 1
+	}
 	fs.vfsfs.Init(vfsObj, &fstype, fs)
 
 	// Construct the root dentry.
@@ -394,20 +1163,265 @@ func (fstype FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.Virt
 		fs.vfsfs.DecRef()
 		return nil, nil, err
 	}
+	if fsopts.writebackLimit != 0 {
+		fs.startWriteback()
+	}
+	if fsopts.reconnect {
+		fs.startReconnect()
+	}
+	if fsopts.idleHandleTimeout != 0 {
+		fs.startIdleHandleReaper()
+	}
+	if fsopts.dentryCacheTrimInterval != 0 {
+		fs.startDentryCacheTrimmer()
+	}
+	if fsopts.pageCacheLimit != 0 {
+		fs.startPageCacheReclaim()
+	}
 	// Set the root's reference count to 2. One reference is returned to the
 	// caller, and the other is deliberately leaked to prevent the root from
 	// being "cached" and subsequently evicted. Its resources will still be
 	// cleaned up by fs.Release().
 	root.refs = 2
 
+	ctx.Debugf("gofer.FilesystemType.GetFilesystem: mounted %v", fs.MountInfo())
 	return &fs.vfsfs, &root.vfsd, nil
 }
 
+// setSocketBufferSizes applies the socket buffer sizes in opts to conn. The
+// kernel may clamp the requested sizes, which is logged but not an error.
+func setSocketBufferSizes(conn *unet.Socket, opts *filesystemOptions) error {
+	for _, buf := range []struct {
+		name string
+		opt  int
+		size uint32
+	}{
+		{"rcvbuf", syscall.SO_RCVBUF, opts.rcvbuf},
+		{"sndbuf", syscall.SO_SNDBUF, opts.sndbuf},
+	} {
+		if buf.size == 0 {
+			continue
+		}
+		val := make([]byte, 4)
+		usermem.ByteOrder.PutUint32(val, buf.size)
+		if err := conn.SetSockOpt(syscall.SOL_SOCKET, buf.opt, val); err != nil {
+			return err
+		}
+		size, err := socketBufferSize(conn, buf.opt)
+		if err != nil {
+			return err
+		}
+		// Linux doubles the requested size to allow for bookkeeping overhead,
+		// so the effective size is only less than requested if clamped.
+		if size < buf.size {
+			log.Warningf("gofer: %s=%d was clamped to %d by the kernel", buf.name, buf.size, size)
+		}
+	}
+	return nil
+}
+
+// socketBufferSize returns the effective size of conn's socket buffer
+// selected by opt, which is SO_RCVBUF or SO_SNDBUF.
+func socketBufferSize(conn *unet.Socket, opt int) (uint32, error) {
+	val := make([]byte, 4)
+	if _, err := conn.GetSockOpt(syscall.SOL_SOCKET, opt, val); err != nil {
+		return 0, err
+	}
+	return usermem.ByteOrder.Uint32(val), nil
+}
+
+// MountInfo describes the server-side file that a gofer filesystem is rooted
+// at, for diagnostic purposes. This is useful when multiple mounts share a
+// server with different attach names.
+type MountInfo struct {
+	// AttachName is the attach name ("aname" mount option) with which the
+	// filesystem root was obtained from the server.
+	AttachName string
+
+	// RootQID is the QID of the filesystem root, as reported by the server at
+	// mount time.
+	RootQID p9.QID
+
+	// Interop is the filesystem's interop mode, derived from the "cache"
+	// mount option.
+	Interop InteropMode
+
+	// MessageSize is the maximum 9P message size ("msize" mount option)
+	// requested from the server.
+	MessageSize uint32
+
+	// Version is the 9P protocol version ("version" mount option) requested
+	// from the server.
+	Version string
+}
+
+// String implements fmt.Stringer.String.
+func (mi MountInfo) String() string {
+	return fmt.Sprintf("aname=%q root=%v", mi.AttachName, mi.RootQID)
+}
+
+// MountInfo returns information about the server-side file that fs is rooted
+// at, as captured at mount time, and fs' immutable connection options.
+func (fs *filesystem) MountInfo() MountInfo {
+	return MountInfo{
+		AttachName:  fs.opts.aname,
+		RootQID:     fs.rootQID,
+		Interop:     fs.opts.interop,
+		MessageSize: fs.opts.msize,
+		Version:     fs.opts.version,
+	}
+}
+
+// SuperBlockOptions implements vfs.SuperBlockOptioner.SuperBlockOptions. The
+// options are those accepted by FilesystemType.GetFilesystem, other than the
+// transport options, which identify host resources, and "ro", which VFS
+// reports. Options other than aname, cache, msize and version are only
+// included if they differ from their defaults.
+func (fs *filesystem) SuperBlockOptions() string {
+	mi := fs.MountInfo()
+	opts := []string{"aname=" + escapeMountOption(mi.AttachName)}
+	if len(fs.opts.rootPath) != 0 {
+		opts = append(opts, "root_path="+escapeMountOption(strings.Join(fs.opts.rootPath, "/")))
+	}
+	opts = append(opts, "cache="+fs.cacheOption(), fmt.Sprintf("msize=%d", mi.MessageSize))
+	if fs.opts.rcvbuf != 0 {
+		opts = append(opts, fmt.Sprintf("rcvbuf=%d", fs.opts.rcvbuf))
+	}
+	if fs.opts.sndbuf != 0 {
+		opts = append(opts, fmt.Sprintf("sndbuf=%d", fs.opts.sndbuf))
+	}
+	opts = append(opts, "version="+escapeMountOption(mi.Version))
+	if fs.opts.maxCachedDentries != defaultMaxCachedDentries {
+		opts = append(opts, fmt.Sprintf("dentry_cache_limit=%d", fs.opts.maxCachedDentries))
+	}
+	if fs.opts.dentryCacheTrimInterval != 0 {
+		opts = append(opts, fmt.Sprintf("dentry_cache_trim_interval_ns=%d", fs.opts.dentryCacheTrimInterval.Nanoseconds()))
+	}
+	if fs.opts.dentryCacheLowWater != 0 {
+		opts = append(opts, fmt.Sprintf("dentry_cache_low_water=%d", fs.opts.dentryCacheLowWater))
+	}
+	if fs.opts.dentryCachePolicy != "" && fs.opts.dentryCachePolicy != "lru" {
+		opts = append(opts, "dentry_cache_policy="+fs.opts.dentryCachePolicy)
+	}
+	if fs.opts.writebackLimit != 0 && fs.opts.writebackLimit != defaultWritebackLimit {
+		opts = append(opts, fmt.Sprintf("writeback_limit=%d", fs.opts.writebackLimit))
+	}
+	if fs.opts.serverClockOffset != 0 {
+		opts = append(opts, fmt.Sprintf("server_clock_offset_ns=%d", fs.opts.serverClockOffset))
+	}
+	if fs.opts.idleHandleTimeout != 0 {
+		opts = append(opts, fmt.Sprintf("idle_handle_timeout_ns=%d", fs.opts.idleHandleTimeout.Nanoseconds()))
+	}
+	if fs.opts.rpcTimeout != 0 {
+		opts = append(opts, fmt.Sprintf("rpc_timeout_ns=%d", fs.opts.rpcTimeout.Nanoseconds()))
+	}
+	if fs.opts.maxInflightRPCs != 0 {
+		opts = append(opts, fmt.Sprintf("max_inflight_rpcs=%d", fs.opts.maxInflightRPCs))
+	}
+	if fs.opts.pageCacheLimit != 0 {
+		opts = append(opts, fmt.Sprintf("page_cache_limit=%d", fs.opts.pageCacheLimit))
+	}
+	if fs.opts.readahead != 0 {
+		opts = append(opts, fmt.Sprintf("readahead=%d", fs.opts.readahead))
+	}
+	if fs.opts.prefetchSmallFiles != 0 {
+		opts = append(opts, fmt.Sprintf("prefetch_small_files=%d", fs.opts.prefetchSmallFiles))
+	}
+	if fs.opts.trustedXattrs || fs.opts.securityXattrs {
+		namespaces := []string{"user"}
+		if fs.opts.trustedXattrs {
+			namespaces = append(namespaces, "trusted")
+		}
+		if fs.opts.securityXattrs {
+			namespaces = append(namespaces, "security")
+		}
+		opts = append(opts, "xattr_namespaces="+strings.Join(namespaces, ":"))
+	}
+	if fs.opts.serverCtime {
+		opts = append(opts, "ctime=server")
+	}
+	if fs.opts.hashIno {
+		opts = append(opts, "ino_source=hash")
+	}
+	switch fs.opts.atime {
+	case atimeRelative:
+		opts = append(opts, "relatime")
+	case atimeNone:
+		opts = append(opts, "noatime")
+	}
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"force_page_cache", fs.opts.forcePageCache},
+		{"real_ino", fs.opts.realIno},
+		{"limit_host_fd_translation", fs.opts.limitHostFDTranslation},
+		{"overlayfs_stale_read", fs.opts.overlayfsStaleRead},
+		{"sync", fs.opts.sync},
+		{"trace_handles", fs.opts.traceHandles},
+		// casefold implies no_negative_cache.
+		{"no_negative_cache", fs.opts.noNegativeCache && !fs.opts.casefold},
+		{"casefold", fs.opts.casefold},
+		{"reconnect=true", fs.opts.reconnect},
+		{"restorable=true", fs.opts.restorable},
+	} {
+		if opt.set {
+			opts = append(opts, opt.name)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// cacheOption returns the value of the "cache" mount option that selects fs'
+// caching behavior.
+func (fs *filesystem) cacheOption() string {
+	switch fs.opts.interop {
+	case InteropModeWritethrough:
+		return "fscache_writethrough"
+	case InteropModeShared:
+		if fs.opts.regularFilesUseSpecialFileFD {
+			return "none"
+		}
+		return "remote_revalidating"
+	default:
+		if fs.opts.writebackLimit != 0 {
+			return "writeback"
+		}
+		return "fscache"
+	}
+}
+
+// escapeMountOption escapes characters in a mount option value that would
+// make mount options shown in /proc/[pid]/mountinfo ambiguous, as octal
+// escapes. Compare Linux's fs/seq_file.c:seq_show_option().
+func escapeMountOption(val string) string {
+	var b strings.Builder
+	for i := 0; i < len(val); i++ {
+		switch c := val[i]; c {
+		case ',', ' ', '\t', '\n', '\\':
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
 // Release implements vfs.FilesystemImpl.Release.
 func (fs *filesystem) Release() {
 	ctx := context.Background()
 	mf := fs.mfp.MemoryFile()
 
+	// Stop the writeback worker, idle handle reaper, dentry cache trimmer and
+	// page cache reclaimer before writing back everything below, and the
+	// reconnect worker before closing the client.
+	fs.stopWriteback()
+	fs.stopIdleHandleReaper()
+	fs.stopDentryCacheTrimmer()
+	fs.stopPageCacheReclaim()
+	fs.stopReconnect()
+	mf.MarkAllUnevictable(fs)
+
 	fs.syncMu.Lock()
 	for d := range fs.dentries {
 		d.handleMu.Lock()
@@ -424,6 +1438,9 @@ func (fs *filesystem) Release() {
 		d.dirty.RemoveAll()
 		d.dataMu.Unlock()
 		// Close the host fd if one exists.
+		if !d.handle.file.isNil() {
+			d.traceHandleLocked("close")
+		}
 		if d.handle.fd >= 0 {
 			syscall.Close(int(d.handle.fd))
 			d.handle.fd = -1
@@ -452,7 +1469,11 @@ type dentry struct {
 	// fs is the owning filesystem. fs is immutable.
 	fs *filesystem
 
-	// We don't support hard links, so each dentry maps 1:1 to an inode.
+	// Each hard link to a file is represented by a distinct dentry, and
+	// dentries representing the same file do not share cached metadata or
+	// data. filesystem.LinkAt writes back and drops the cached data of the
+	// dentry being linked, so that the dentry for the new link, which is
+	// created from the server's metadata, starts out consistent with it.
 
 	// file is the unopened p9.File that backs this dentry. file is immutable.
 	file p9file
@@ -462,28 +1483,52 @@ type dentry struct {
 	deleted uint32
 
 	// If cached is true, dentryEntry links dentry into
-	// filesystem.cachedDentries. cached and dentryEntry are protected by
-	// filesystem.renameMu.
-	cached bool
+	// filesystem.cachedDentries. cacheProtected is used by
+	// twoQueueDentryCachePolicy. cached, cacheProtected and dentryEntry are
+	// protected by filesystem.renameMu.
+	cached         bool
+	cacheProtected bool
 	dentryEntry
 
-	dirMu sync.Mutex
+	dirMu dirMutex
 
-	// If this dentry represents a directory, and InteropModeShared is not in
-	// effect, negativeChildren is a set of child names in this directory that
-	// are known not to exist. negativeChildren is protected by dirMu.
+	// If this dentry represents a directory, and neither InteropModeShared nor
+	// opts.noNegativeCache is in effect, negativeChildren is a set of child
+	// names in this directory that are known not to exist. negativeChildren is
+	// protected by dirMu.
 	negativeChildren map[string]struct{}
 
-	// If this dentry represents a directory, InteropModeShared is not in
-	// effect, and dirents is not nil, it is a cache of all entries in the
-	// directory, in the order they were returned by the server. dirents is
-	// protected by dirMu.
+	// If this dentry represents a directory, opts.casefold is in effect, and
+	// casefoldNames is not nil, casefoldNames maps the lower-cased names of
+	// entries in the directory to their actual names. casefoldNames is
+	// invalidated along with dirents. casefoldNames is protected by dirMu.
+	casefoldNames map[string]string
+
+	// If this dentry represents a directory and dirents is not nil, it is a
+	// cache of all entries in the directory, in the order they were returned
+	// by the server. Directory mutations invalidate dirents rather than
+	// updating it in place, so that it is always consistent with the server's
+	// order. If InteropModeShared is in effect, dirents is only valid while
+	// dirGen == direntsGen and qidVersion == direntsVersion != 0, so it is
+	// never reused if the server doesn't report QID versions (see
+	// InteropModeShared). dirents is protected by dirMu.
 	dirents []vfs.Dirent
 
+	// If this dentry represents a directory, dirGen is incremented whenever
+	// the client creates, removes, or renames a child of the directory.
+	// direntsGen and direntsVersion are the values of dirGen and qidVersion
+	// respectively when dirents was read from the server. dirGen, direntsGen
+	// and direntsVersion are protected by dirMu.
+	dirGen         uint64
+	direntsGen     uint64
+	direntsVersion uint32
+
 	// Cached metadata; protected by metadataMu and accessed using atomic
 	// memory operations unless otherwise specified.
-	metadataMu sync.Mutex
+	metadataMu metadataMutex
 	ino        uint64 // immutable
+	realIno    uint64 // immutable; 0 unless fs.opts.realIno is true
+	hashedIno  uint64 // immutable after insertion; 0 unless fs.opts.hashIno is true
 	mode       uint32 // type is immutable, perms are mutable
 	uid        uint32 // auth.KUID, but stored as raw uint32 for sync/atomic
 	gid        uint32 // auth.KGID, but ...
@@ -496,13 +1541,54 @@ type dentry struct {
 	// File size, protected by both metadataMu and dataMu (i.e. both must be
 	// locked to mutate it).
 	size uint64
+	// allocEnd is the end of the range preallocated by
+	// fallocate(FALLOC_FL_KEEP_SIZE), if it extends beyond size, and is
+	// reported by stat as allocated blocks. It is protected in the same way
+	// as size, and is reset by truncation.
+	allocEnd uint64
 
 	// nlink counts the number of hard links to this dentry. It's updated and
 	// accessed using atomic operations. It's not protected by metadataMu like the
 	// other metadata fields.
 	nlink uint32
 
-	mapsMu sync.Mutex
+	// If inodeFlagsCached is true, inodeFlags are the remote file's inode
+	// flags (linux.FS_*_FL) as of the last call to dentry.getFlags() or
+	// dentry.setFlags(). Inode flags are never cached if fs.opts.interop ==
+	// InteropModeShared. These fields are protected by metadataMu.
+	inodeFlags       uint32
+	inodeFlagsCached bool
+
+	// qidVersion is the version of the remote file's QID, as of the last
+	// time d's metadata was updated from the server. qidVersion is accessed
+	// using atomic memory operations.
+	qidVersion uint32
+
+	// If getattr is not nil, it represents a call to d.updateFromGetattr()
+	// whose RPC is in flight, and whose result is shared by concurrent calls.
+	// getattr is protected by getattrMu, which is never held while acquiring
+	// other locks.
+	getattrMu sync.Mutex
+	getattr   *getattrCall
+
+	// If this dentry represents a regular file or directory, openFDs is the
+	// number of regularFileFDs or directoryFDs that are open (or being
+	// opened) on it, and idleSince is the time (per fs.clock, in nanoseconds)
+	// at which openFDs last became 0. Both are accessed using atomic memory
+	// operations.
+	openFDs   int64
+	idleSince int64
+
+	// If this dentry represents a regular file and fs.opts.pageCacheLimit !=
+	// 0, cachedBytes is the number of bytes in cache, and cacheLastUse is the
+	// value of fs.cacheUses when cache was last used. cachedBytes is
+	// protected by dataMu, but may be read using atomic memory operations
+	// without holding it. cacheLastUse is accessed using atomic memory
+	// operations.
+	cachedBytes  int64
+	cacheLastUse uint64
+
+	mapsMu mapsMutex
 
 	// If this dentry represents a regular file, mappings tracks mappings of
 	// the file into memmap.MappingSpaces. mappings is protected by mapsMu.
@@ -525,15 +1611,17 @@ type dentry struct {
 	// handle).
 	//
 	// - handleReadable and handleWritable cannot transition from true to false
-	// (i.e. handles may not be downgraded).
+	// (i.e. handles may not be downgraded), except when both become false
+	// because the handle is closed by dentry.closeIdleHandle() while openFDs
+	// == 0 and mappings is empty.
 	//
 	// These fields are protected by handleMu.
-	handleMu       sync.RWMutex
+	handleMu       handleMutex
 	handle         handle
 	handleReadable bool
 	handleWritable bool
 
-	dataMu sync.RWMutex
+	dataMu dataMutex
 
 	// If this dentry represents a regular file that is client-cached, cache
 	// maps offsets into the cached file to offsets into
@@ -545,14 +1633,42 @@ type dentry struct {
 	// tracks dirty segments in cache. dirty is protected by dataMu.
 	dirty fsutil.DirtySet
 
+	// If this dentry represents a regular file that is client-cached,
+	// writebackErr is the first error encountered while asynchronously
+	// writing back dirty cached data (by the writeback worker or page cache
+	// reclaimer) since it was last reported by closing a writable FD.
+	// writebackErr is protected by dataMu.
+	writebackErr error
+
+	// If this dentry represents a regular file that is client-cached,
+	// coalesced is the range of small writes that have been coalesced in the
+	// cache but not yet written back (see coalesce.go). coalesced is
+	// protected by dataMu.
+	coalesced memmap.MappableRange
+
 	// pf implements platform.File for mappings of handle.fd.
 	pf dentryPlatformFile
 
-	// If this dentry represents a symbolic link, InteropModeShared is not in
-	// effect, and haveTarget is true, target is the symlink target. haveTarget
-	// and target are protected by dataMu.
-	haveTarget bool
-	target     string
+	// If this dentry represents a symbolic link and haveTarget is true,
+	// target is the symlink target, as read when qidVersion was
+	// targetVersion. If InteropModeShared is in effect, target is only valid
+	// while qidVersion == targetVersion != 0. haveTarget, target and
+	// targetVersion are protected by dataMu.
+	haveTarget    bool
+	target        string
+	targetVersion uint32
+
+	// If this dentry represents a regular file, seekCache caches the results
+	// of SEEK_DATA and SEEK_HOLE queries forwarded to the server. seekCache is
+	// only used if InteropModeShared is not in effect, and is invalidated
+	// whenever the file's data may change. seekCache is protected by dataMu.
+	seekCache map[seekCacheKey]int64
+
+	// locks contains advisory file locks held on this dentry by FDs in this
+	// sandbox. Since the p9 package does not implement 9P2000.L's
+	// Tlock/Tgetlock, these locks are not forwarded to the server, and do not
+	// conflict with locks held by other clients of the server.
+	locks lock.FileLocks
 }
 
 // dentryAttrMask returns a p9.AttrMask enabling all attributes used by the
@@ -597,6 +1713,14 @@ func (fs *filesystem) newDentry(ctx context.Context, file p9file, qid p9.QID, ma
 		},
 	}
 	d.pf.dentry = d
+	d.qidVersion = qid.Version
+	if fs.opts.realIno {
+		// Fall back to the QID path if the server can't provide the inode
+		// number.
+		if ino, err := file.getIno(ctx); err == nil {
+			d.realIno = ino
+		}
+	}
 	if mask.UID {
 		d.uid = uint32(attr.UID)
 	}
@@ -610,16 +1734,16 @@ func (fs *filesystem) newDentry(ctx context.Context, file p9file, qid p9.QID, ma
 		d.blockSize = uint32(attr.BlockSize)
 	}
 	if mask.ATime {
-		d.atime = dentryTimestampFromP9(attr.ATimeSeconds, attr.ATimeNanoSeconds)
+		d.atime = fs.dentryTimestampFromServer(attr.ATimeSeconds, attr.ATimeNanoSeconds)
 	}
 	if mask.MTime {
-		d.mtime = dentryTimestampFromP9(attr.MTimeSeconds, attr.MTimeNanoSeconds)
+		d.mtime = fs.dentryTimestampFromServer(attr.MTimeSeconds, attr.MTimeNanoSeconds)
 	}
 	if mask.CTime {
-		d.ctime = dentryTimestampFromP9(attr.CTimeSeconds, attr.CTimeNanoSeconds)
+		d.ctime = fs.dentryTimestampFromServer(attr.CTimeSeconds, attr.CTimeNanoSeconds)
 	}
 	if mask.BTime {
-		d.btime = dentryTimestampFromP9(attr.BTimeSeconds, attr.BTimeNanoSeconds)
+		d.btime = fs.dentryTimestampFromServer(attr.BTimeSeconds, attr.BTimeNanoSeconds)
 	}
 	if mask.NLink {
 		d.nlink = uint32(attr.NLink)
@@ -636,9 +1760,16 @@ func (fs *filesystem) newDentry(ctx context.Context, file p9file, qid p9.QID, ma
 // remote filesystem.
 func (d *dentry) updateFromP9Attrs(mask p9.AttrMask, attr *p9.Attr) {
 	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	d.updateFromP9AttrsLocked(mask, attr)
+}
+
+// updateFromP9AttrsLocked is equivalent to updateFromP9Attrs.
+//
+// Preconditions: d.metadataMu must be locked.
+func (d *dentry) updateFromP9AttrsLocked(mask p9.AttrMask, attr *p9.Attr) {
 	if mask.Mode {
 		if got, want := uint32(attr.Mode.FileType()), d.fileType(); got != want {
-			d.metadataMu.Unlock()
 			panic(fmt.Sprintf("gofer.dentry file type changed from %#o to %#o", want, got))
 		}
 		atomic.StoreUint32(&d.mode, uint32(attr.Mode))
@@ -654,16 +1785,16 @@ func (d *dentry) updateFromP9Attrs(mask p9.AttrMask, attr *p9.Attr) {
 		atomic.StoreUint32(&d.blockSize, uint32(attr.BlockSize))
 	}
 	if mask.ATime {
-		atomic.StoreInt64(&d.atime, dentryTimestampFromP9(attr.ATimeSeconds, attr.ATimeNanoSeconds))
+		atomic.StoreInt64(&d.atime, d.fs.dentryTimestampFromServer(attr.ATimeSeconds, attr.ATimeNanoSeconds))
 	}
 	if mask.MTime {
-		atomic.StoreInt64(&d.mtime, dentryTimestampFromP9(attr.MTimeSeconds, attr.MTimeNanoSeconds))
+		atomic.StoreInt64(&d.mtime, d.fs.dentryTimestampFromServer(attr.MTimeSeconds, attr.MTimeNanoSeconds))
 	}
 	if mask.CTime {
-		atomic.StoreInt64(&d.ctime, dentryTimestampFromP9(attr.CTimeSeconds, attr.CTimeNanoSeconds))
+		atomic.StoreInt64(&d.ctime, d.fs.dentryTimestampFromServer(attr.CTimeSeconds, attr.CTimeNanoSeconds))
 	}
 	if mask.BTime {
-		atomic.StoreInt64(&d.btime, dentryTimestampFromP9(attr.BTimeSeconds, attr.BTimeNanoSeconds))
+		atomic.StoreInt64(&d.btime, d.fs.dentryTimestampFromServer(attr.BTimeSeconds, attr.BTimeNanoSeconds))
 	}
 	if mask.NLink {
 		atomic.StoreUint32(&d.nlink, uint32(attr.NLink))
@@ -673,40 +1804,216 @@ func (d *dentry) updateFromP9Attrs(mask p9.AttrMask, attr *p9.Attr) {
 		atomic.StoreUint64(&d.size, attr.Size)
 		d.dataMu.Unlock()
 	}
-	d.metadataMu.Unlock()
 }
 
-func (d *dentry) updateFromGetattr(ctx context.Context) error {
-	// Use d.handle.file, which represents a 9P fid that has been opened, in
-	// preference to d.file, which represents a 9P fid that has not. This may
-	// be significantly more efficient in some implementations.
-	var (
-		file            p9file
-		handleMuRLocked bool
-	)
+// updateCtimeFromServer updates d's cached ctime from the server. It is used
+// when opts.serverCtime is true and InteropModeShared is not in effect, such
+// that d's other metadata is not refreshed.
+func (d *dentry) updateCtimeFromServer(ctx context.Context) error {
 	d.handleMu.RLock()
-	if !d.handle.file.isNil() {
-		file = d.handle.file
-		handleMuRLocked = true
-	} else {
+	file := d.handle.file
+	if file.isNil() {
 		file = d.file
-		d.handleMu.RUnlock()
 	}
-	_, attrMask, attr, err := file.getAttr(ctx, dentryAttrMask())
-	if handleMuRLocked {
-		d.handleMu.RUnlock()
+	_, attrMask, attr, err := file.getAttr(ctx, p9.AttrMask{CTime: true})
+	d.handleMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if attrMask.CTime {
+		d.metadataMu.Lock()
+		atomic.StoreInt64(&d.ctime, d.fs.dentryTimestampFromServer(attr.CTimeSeconds, attr.CTimeNanoSeconds))
+		d.metadataMu.Unlock()
 	}
+	return nil
+}
+
+// getattrCall tracks an in-flight getattr RPC issued by
+// dentry.updateFromGetattrMask().
+type getattrCall struct {
+	// mask is the set of attributes requested by the RPC. mask is immutable.
+	mask p9.AttrMask
+
+	// done is closed when the RPC completes and d's metadata has been updated
+	// from its result. err is immutable after done is closed.
+	done chan struct{}
+	err  error
+}
+
+// updateFromGetattr updates d's cached metadata from the server. If another
+// call to updateFromGetattr is already in flight, it waits for that call to
+// complete and returns its result instead of issuing another RPC, so callers
+// that must observe the effects of their own mutations should use
+// d.updateFromGetattrUncoalesced() instead.
+func (d *dentry) updateFromGetattr(ctx context.Context) error {
+	return d.updateFromGetattrMask(ctx, dentryAttrMask())
+}
+
+// updateFromGetattrMask is equivalent to updateFromGetattr, but only requests
+// the attributes in mask, which callers that need only some of d's metadata
+// (e.g. its size) should use to reduce the work done by the server. It only
+// waits for an in-flight call that requested all attributes in mask.
+func (d *dentry) updateFromGetattrMask(ctx context.Context, mask p9.AttrMask) error {
+	d.getattrMu.Lock()
+	if call := d.getattr; call != nil {
+		d.getattrMu.Unlock()
+		if !call.mask.Contains(mask) {
+			return d.updateFromGetattrUncoalesced(ctx, mask)
+		}
+		<-call.done
+		return call.err
+	}
+	call := &getattrCall{
+		mask: mask,
+		done: make(chan struct{}),
+	}
+	d.getattr = call
+	d.getattrMu.Unlock()
+
+	call.err = d.updateFromGetattrUncoalesced(ctx, mask)
+	d.getattrMu.Lock()
+	d.getattr = nil
+	d.getattrMu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// updateFromGetattrUncoalesced updates d's cached metadata for the attributes
+// in mask from the server, using a getattr RPC issued by the caller.
+func (d *dentry) updateFromGetattrUncoalesced(ctx context.Context, mask p9.AttrMask) error {
+	qid, attrMask, attr, err := d.getAttrFromServer(ctx, mask)
 	if err != nil {
 		return err
 	}
-	d.updateFromP9Attrs(attrMask, &attr)
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	d.updateFromGetattrResultLocked(mask, qid, attrMask, &attr)
 	return nil
 }
 
+// updateFromGetattrLocked is equivalent to updateFromGetattrUncoalesced, but
+// holds d.metadataMu across the RPC, so that the result can't be overwritten
+// by concurrent updates before the caller observes it.
+//
+// Preconditions: d.metadataMu must be locked.
+func (d *dentry) updateFromGetattrLocked(ctx context.Context, mask p9.AttrMask) error {
+	qid, attrMask, attr, err := d.getAttrFromServer(ctx, mask)
+	if err != nil {
+		return err
+	}
+	d.updateFromGetattrResultLocked(mask, qid, attrMask, &attr)
+	return nil
+}
+
+// updateFromGetattrResultLocked updates d's cached metadata from the result of
+// a getattr RPC that requested the attributes in mask.
+//
+// Preconditions: d.metadataMu must be locked.
+func (d *dentry) updateFromGetattrResultLocked(mask p9.AttrMask, qid p9.QID, attrMask p9.AttrMask, attr *p9.Attr) {
+	// d.qidVersion indicates to d.revalidate() that all of d's cached
+	// metadata is current as of that version, so it can only be updated by a
+	// full refresh.
+	if mask.Contains(dentryAttrMask()) {
+		atomic.StoreUint32(&d.qidVersion, qid.Version)
+	}
+	d.updateFromP9AttrsLocked(attrMask, attr)
+}
+
+// getAttrFromServer returns d's metadata for the attributes in mask from the
+// server.
+func (d *dentry) getAttrFromServer(ctx context.Context, mask p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	// Use d.handle.file, which represents a 9P fid that has been opened, in
+	// preference to d.file, which represents a 9P fid that has not. This may
+	// be significantly more efficient in some implementations.
+	d.handleMu.RLock()
+	if !d.handle.file.isNil() {
+		defer d.handleMu.RUnlock()
+		return d.handle.file.getAttr(ctx, mask)
+	}
+	d.handleMu.RUnlock()
+	return d.file.getAttr(ctx, mask)
+}
+
+// revalidate updates d's cached metadata from the server if the remote file's
+// QID version has changed since it was last updated. Servers that don't
+// version files report QID version 0, in which case d's cached metadata is
+// always updated.
+func (d *dentry) revalidate(ctx context.Context) error {
+	if version := atomic.LoadUint32(&d.qidVersion); version != 0 {
+		// Request only the QID, which the server can return without
+		// producing the file's metadata.
+		qid, _, _, err := d.file.getAttr(ctx, p9.AttrMask{})
+		if err != nil {
+			return err
+		}
+		if qid.Version == version {
+			return nil
+		}
+	}
+	return d.updateFromGetattr(ctx)
+}
+
 func (d *dentry) fileType() uint32 {
 	return atomic.LoadUint32(&d.mode) & linux.S_IFMT
 }
 
+// statfs returns metadata for the remote filesystem containing d. It always
+// queries the server, so results are never stale regardless of interop mode.
+func (d *dentry) statfs(ctx context.Context) (linux.Statfs, error) {
+	if !d.fs.opts.features.statFS {
+		// Report defaults rather than failing statfs(2), which many
+		// applications don't expect to fail.
+		return d.statfsFromP9(&p9.FSStat{}), nil
+	}
+	fsstat, err := d.file.statFS(ctx)
+	if err != nil {
+		return linux.Statfs{}, err
+	}
+	return d.statfsFromP9(&fsstat), nil
+}
+
+// statfsFromP9 translates fsstat, returned by the server for the filesystem
+// containing d, to a linux.Statfs. Fields that the server leaves zero but
+// that applications expect to be non-zero are given defaults.
+func (d *dentry) statfsFromP9(fsstat *p9.FSStat) linux.Statfs {
+	blockSize := int64(fsstat.BlockSize)
+	if blockSize == 0 {
+		blockSize = int64(atomic.LoadUint32(&d.blockSize))
+		if blockSize == 0 {
+			blockSize = usermem.PageSize
+		}
+	}
+	nameLen := uint64(fsstat.NameLength)
+	if nameLen == 0 || nameLen > maxFilenameLen {
+		nameLen = maxFilenameLen
+	}
+	return linux.Statfs{
+		// This is primarily for distinguishing a gofer file system in
+		// tests. Testing is important, so instead of defining
+		// something completely random, use a standard value.
+		Type:            linux.V9FS_MAGIC,
+		BlockSize:       blockSize,
+		Blocks:          fsstat.Blocks,
+		BlocksFree:      fsstat.BlocksFree,
+		BlocksAvailable: fsstat.BlocksAvailable,
+		Files:           fsstat.Files,
+		FilesFree:       fsstat.FilesFree,
+		NameLength:      nameLen,
+		FragmentSize:    blockSize,
+	}
+}
+
+// statIno returns the inode number reported for d by stat and getdents.
+func (d *dentry) statIno() uint64 {
+	if d.realIno != 0 {
+		return d.realIno
+	}
+	if d.hashedIno != 0 {
+		return d.hashedIno
+	}
+	return d.ino
+}
+
 func (d *dentry) statTo(stat *linux.Statx) {
 	stat.Mask = linux.STATX_TYPE | linux.STATX_MODE | linux.STATX_NLINK | linux.STATX_UID | linux.STATX_GID | linux.STATX_ATIME | linux.STATX_MTIME | linux.STATX_CTIME | linux.STATX_INO | linux.STATX_SIZE | linux.STATX_BLOCKS | linux.STATX_BTIME
 	stat.Blksize = atomic.LoadUint32(&d.blockSize)
@@ -714,11 +2021,15 @@ func (d *dentry) statTo(stat *linux.Statx) {
 	stat.UID = atomic.LoadUint32(&d.uid)
 	stat.GID = atomic.LoadUint32(&d.gid)
 	stat.Mode = uint16(atomic.LoadUint32(&d.mode))
-	stat.Ino = d.ino
+	stat.Ino = d.statIno()
 	stat.Size = atomic.LoadUint64(&d.size)
 	// This is consistent with regularFileFD.Seek(), which treats regular files
 	// as having no holes.
-	stat.Blocks = (stat.Size + 511) / 512
+	allocated := stat.Size
+	if allocEnd := atomic.LoadUint64(&d.allocEnd); allocEnd > allocated {
+		allocated = allocEnd
+	}
+	stat.Blocks = (allocated + 511) / 512
 	stat.Atime = statxTimestampFromDentry(atomic.LoadInt64(&d.atime))
 	stat.Btime = statxTimestampFromDentry(atomic.LoadInt64(&d.btime))
 	stat.Ctime = statxTimestampFromDentry(atomic.LoadInt64(&d.ctime))
@@ -726,18 +2037,43 @@ func (d *dentry) statTo(stat *linux.Statx) {
 	// TODO(gvisor.dev/issue/1198): device number
 }
 
+// statDIOAlignTo populates stat's direct I/O alignment fields, which are only
+// reported for regular files (the only files that support O_DIRECT) and only
+// if requested by mask.
+func (d *dentry) statDIOAlignTo(mask uint32, stat *linux.Statx) {
+	if mask&linux.STATX_DIOALIGN == 0 || !d.isRegularFile() {
+		return
+	}
+	align := d.directIOAlignment()
+	stat.Mask |= linux.STATX_DIOALIGN
+	stat.DioMemAlign = align
+	stat.DioOffsetAlign = align
+}
+
 func (d *dentry) setStat(ctx context.Context, creds *auth.Credentials, stat *linux.Statx, mnt *vfs.Mount) error {
+	// UTIME_OMIT leaves the corresponding timestamp unchanged, both on the
+	// server and locally.
+	if stat.Mask&linux.STATX_ATIME != 0 && stat.Atime.Nsec == linux.UTIME_OMIT {
+		stat.Mask &^= linux.STATX_ATIME
+	}
+	if stat.Mask&linux.STATX_MTIME != 0 && stat.Mtime.Nsec == linux.UTIME_OMIT {
+		stat.Mask &^= linux.STATX_MTIME
+	}
 	if stat.Mask == 0 {
 		return nil
 	}
+	// Attributes not listed here, including ctime, which is only updated as a
+	// side effect of other changes, can't be set explicitly.
 	if stat.Mask&^(linux.STATX_MODE|linux.STATX_UID|linux.STATX_GID|linux.STATX_ATIME|linux.STATX_MTIME|linux.STATX_SIZE) != 0 {
 		return syserror.EPERM
 	}
 	mode := linux.FileMode(atomic.LoadUint32(&d.mode))
+	// vfs.CheckSetStat also enforces RLIMIT_FSIZE for truncations, which must
+	// fail before the remote file is modified.
 	if err := vfs.CheckSetStat(ctx, creds, stat, mode, auth.KUID(atomic.LoadUint32(&d.uid)), auth.KGID(atomic.LoadUint32(&d.gid))); err != nil {
 		return err
 	}
-	if err := mnt.CheckBeginWrite(); err != nil {
+	if err := d.fs.checkBeginWrite(mnt); err != nil {
 		return err
 	}
 	defer mnt.EndWrite()
@@ -756,7 +2092,25 @@ func (d *dentry) setStat(ctx context.Context, creds *auth.Credentials, stat *lin
 	}
 	d.metadataMu.Lock()
 	defer d.metadataMu.Unlock()
+	// Cached metadata, including d.size, is only updated after the server
+	// has applied the change, since the server may reject it (e.g. truncation
+	// of a file that is append-only on the host fails with EPERM).
 	if stat.Mask != 0 {
+		// Timestamps are only sent to the server under InteropModeShared;
+		// otherwise they were handled locally above.
+		var atimeSec, atimeNsec, mtimeSec, mtimeNsec uint64
+		if stat.Mask&linux.STATX_ATIME != 0 {
+			var err error
+			if atimeSec, atimeNsec, err = d.fs.p9TimestampFromStatx(stat.Atime); err != nil {
+				return err
+			}
+		}
+		if stat.Mask&linux.STATX_MTIME != 0 {
+			var err error
+			if mtimeSec, mtimeNsec, err = d.fs.p9TimestampFromStatx(stat.Mtime); err != nil {
+				return err
+			}
+		}
 		if err := d.file.setAttr(ctx, p9.SetAttrMask{
 			Permissions:        stat.Mask&linux.STATX_MODE != 0,
 			UID:                stat.Mask&linux.STATX_UID != 0,
@@ -771,10 +2125,10 @@ func (d *dentry) setStat(ctx context.Context, creds *auth.Credentials, stat *lin
 			UID:              p9.UID(stat.UID),
 			GID:              p9.GID(stat.GID),
 			Size:             stat.Size,
-			ATimeSeconds:     uint64(stat.Atime.Sec),
-			ATimeNanoSeconds: uint64(stat.Atime.Nsec),
-			MTimeSeconds:     uint64(stat.Mtime.Sec),
-			MTimeNanoSeconds: uint64(stat.Mtime.Nsec),
+			ATimeSeconds:     atimeSec,
+			ATimeNanoSeconds: atimeNsec,
+			MTimeSeconds:     mtimeSec,
+			MTimeNanoSeconds: mtimeNsec,
 		}); err != nil {
 			return err
 		}
@@ -815,6 +2169,9 @@ func (d *dentry) setStat(ctx context.Context, creds *auth.Credentials, stat *lin
 		d.dataMu.Lock()
 		oldSize := d.size
 		d.size = stat.Size
+		// Truncation frees blocks preallocated beyond the new size.
+		atomic.StoreUint64(&d.allocEnd, 0)
+		d.seekCache = nil
 		// d.dataMu must be unlocked to lock d.mapsMu and invalidate mappings
 		// below. This allows concurrent calls to Read/Translate/etc. These
 		// functions synchronize with truncation by refusing to use cache
@@ -841,7 +2198,16 @@ func (d *dentry) setStat(ctx context.Context, creds *auth.Credentials, stat *lin
 			d.dataMu.Lock()
 			d.cache.Truncate(d.size, d.fs.mfp.MemoryFile())
 			d.dirty.KeepClean(memmap.MappableRange{d.size, oldpgend})
+			d.updateCachedBytesLocked()
 			d.dataMu.Unlock()
+		} else if d.size > oldSize {
+			// There are no translations of pages beyond the old EOF, so
+			// mappings needn't be invalidated.
+			d.handleMu.RLock()
+			d.dataMu.Lock()
+			d.extendCacheLocked(oldSize)
+			d.dataMu.Unlock()
+			d.handleMu.RUnlock()
 		}
 	}
 	return nil
@@ -851,6 +2217,48 @@ func (d *dentry) checkPermissions(creds *auth.Credentials, ats vfs.AccessTypes)
 	return vfs.GenericCheckPermissions(creds, ats, linux.FileMode(atomic.LoadUint32(&d.mode)), auth.KUID(atomic.LoadUint32(&d.uid)), auth.KGID(atomic.LoadUint32(&d.gid)))
 }
 
+// checkXattrPermissions checks that creds may access the extended attribute
+// with the given name in the way specified by ats, and that the attribute's
+// namespace is enabled. Compare Linux's fs/xattr.c:xattr_permission() and
+// security/commoncap.c:cap_inode_setxattr().
+func (d *dentry) checkXattrPermissions(creds *auth.Credentials, name string, ats vfs.AccessTypes) error {
+	switch {
+	case strings.HasPrefix(name, linux.XATTR_USER_PREFIX):
+		return d.checkPermissions(creds, ats)
+	case strings.HasPrefix(name, linux.XATTR_TRUSTED_PREFIX) && d.fs.opts.trustedXattrs:
+		if !hasTrustedXattrCapability(creds) {
+			if ats.MayWrite() {
+				return syserror.EPERM
+			}
+			return syserror.ENODATA
+		}
+		return nil
+	case strings.HasPrefix(name, linux.XATTR_SECURITY_PREFIX) && d.fs.opts.securityXattrs:
+		// Security xattrs are readable without any file permissions; modifying
+		// them requires CAP_SETFCAP for file capabilities, and CAP_SYS_ADMIN
+		// otherwise.
+		if !ats.MayWrite() {
+			return nil
+		}
+		cp := linux.CAP_SYS_ADMIN
+		if name == linux.XATTR_SECURITY_PREFIX+"capability" {
+			cp = linux.CAP_SETFCAP
+		}
+		if !creds.HasCapability(cp) {
+			return syserror.EPERM
+		}
+		return nil
+	default:
+		return syserror.EOPNOTSUPP
+	}
+}
+
+// hasTrustedXattrCapability returns true if creds may access extended
+// attributes in the "trusted." namespace.
+func hasTrustedXattrCapability(creds *auth.Credentials) bool {
+	return creds.HasCapabilityIn(linux.CAP_SYS_ADMIN, creds.UserNamespace.Root())
+}
+
 // IncRef implements vfs.DentryImpl.IncRef.
 func (d *dentry) IncRef() {
 	// d.refs may be 0 if d.fs.renameMu is locked, which serializes against
@@ -900,7 +2308,7 @@ func (d *dentry) checkCachingLocked() {
 	refs := atomic.LoadInt64(&d.refs)
 	if refs > 0 {
 		if d.cached {
-			d.fs.cachedDentries.Remove(d)
+			d.fs.cachePolicy.remove(&d.fs.cachedDentries, d)
 			d.fs.cachedDentriesLen--
 			d.cached = false
 		}
@@ -914,52 +2322,65 @@ func (d *dentry) checkCachingLocked() {
 	// resolution and should be dropped immediately.
 	if d.vfsd.Parent() == nil || d.vfsd.IsDisowned() {
 		if d.cached {
-			d.fs.cachedDentries.Remove(d)
+			d.fs.cachePolicy.remove(&d.fs.cachedDentries, d)
 			d.fs.cachedDentriesLen--
 			d.cached = false
 		}
+		if d.vfsd.IsDisowned() {
+			d.fs.dentryCacheStats.count(dentryCacheInvalidate)
+		}
 		d.destroyLocked()
 		return
 	}
-	// If d is already cached, just move it to the front of the LRU.
+	// If d is already cached, just record that it was used again.
 	if d.cached {
-		d.fs.cachedDentries.Remove(d)
-		d.fs.cachedDentries.PushFront(d)
+		d.fs.cachePolicy.touch(&d.fs.cachedDentries, d)
 		return
 	}
-	// Cache the dentry, then evict the least recently used cached dentry if
-	// the cache becomes over-full.
-	d.fs.cachedDentries.PushFront(d)
+	// Cache the dentry, then evict a cached dentry, as chosen by the cache
+	// policy, if the cache becomes over-full.
+	d.fs.cachePolicy.insert(&d.fs.cachedDentries, d)
 	d.fs.cachedDentriesLen++
 	d.cached = true
+	d.fs.dentryCacheStats.count(dentryCacheInsert)
 	if d.fs.cachedDentriesLen > d.fs.opts.maxCachedDentries {
-		victim := d.fs.cachedDentries.Back()
-		d.fs.cachedDentries.Remove(victim)
-		d.fs.cachedDentriesLen--
-		victim.cached = false
 		// victim.refs may have become non-zero from an earlier path
 		// resolution since it was inserted into fs.cachedDentries; see
-		// dentry.incRefLocked(). Either way, we brought
-		// fs.cachedDentriesLen back down to fs.opts.maxCachedDentries, so
-		// we don't loop.
-		if atomic.LoadInt64(&victim.refs) == 0 {
-			if victimParentVFSD := victim.vfsd.Parent(); victimParentVFSD != nil {
-				victimParent := victimParentVFSD.Impl().(*dentry)
-				victimParent.dirMu.Lock()
-				if !victim.vfsd.IsDisowned() {
-					// victim can't be a mount point (in any mount
-					// namespace), since VFS holds references on mount
-					// points.
-					d.fs.vfsfs.VirtualFilesystem().ForceDeleteDentry(&victim.vfsd)
-					// We're only deleting the dentry, not the file it
-					// represents, so we don't need to update
-					// victimParent.dirents etc.
-				}
-				victimParent.dirMu.Unlock()
-			}
-			victim.destroyLocked()
+		// dentry.incRefLocked(). Either way, we bring fs.cachedDentriesLen
+		// back down to fs.opts.maxCachedDentries, so we don't loop.
+		d.fs.evictCachedDentryLocked(d.fs.cachedDentries.Back())
+		d.fs.dentryCacheStats.count(dentryCacheEvict)
+		return
+	}
+	// d may be evicted early under memory pressure.
+	d.fs.markEvictable()
+}
+
+// evictCachedDentryLocked removes victim from fs.cachedDentries, and destroys
+// it if it has no references.
+//
+// Preconditions: fs.renameMu must be locked for writing. victim.cached ==
+// true.
+func (fs *filesystem) evictCachedDentryLocked(victim *dentry) {
+	fs.cachePolicy.remove(&fs.cachedDentries, victim)
+	fs.cachedDentriesLen--
+	victim.cached = false
+	if atomic.LoadInt64(&victim.refs) != 0 {
+		return
+	}
+	if victimParentVFSD := victim.vfsd.Parent(); victimParentVFSD != nil {
+		victimParent := victimParentVFSD.Impl().(*dentry)
+		victimParent.dirMu.Lock()
+		if !victim.vfsd.IsDisowned() {
+			// victim can't be a mount point (in any mount namespace), since
+			// VFS holds references on mount points.
+			fs.vfsfs.VirtualFilesystem().ForceDeleteDentry(&victim.vfsd)
+			// We're only deleting the dentry, not the file it represents, so
+			// we don't need to update victimParent.dirents etc.
 		}
+		victimParent.dirMu.Unlock()
 	}
+	victim.destroyLocked()
 }
 
 // destroyLocked destroys the dentry. It may flushes dirty pages from cache,
@@ -992,8 +2413,10 @@ func (d *dentry) destroyLocked() {
 		// Discard cached data.
 		d.cache.DropAll(mf)
 		d.dirty.RemoveAll()
+		d.updateCachedBytesLocked()
 		d.dataMu.Unlock()
 		// Clunk open fids and close open host FDs.
+		d.traceHandleLocked("close")
 		d.handle.close(ctx)
 	}
 	d.handleMu.Unlock()
@@ -1025,8 +2448,81 @@ func (d *dentry) setDeleted() {
 	atomic.StoreUint32(&d.deleted, 1)
 }
 
-// We only support xattrs prefixed with "user." (see b/148380782). Currently,
-// there is no need to expose any other xattrs through a gofer.
+// settableInodeFlags are the inode flags that may be changed by
+// ioctl(FS_IOC_SETFLAGS). Other flags (e.g. FS_EXTENT_FL) reflect the remote
+// filesystem's implementation, and may be passed back unchanged but not
+// altered.
+const settableInodeFlags = linux.FS_SYNC_FL | linux.FS_IMMUTABLE_FL | linux.FS_APPEND_FL | linux.FS_NODUMP_FL | linux.FS_NOATIME_FL | linux.FS_DIRSYNC_FL | linux.FS_NOCOW_FL | linux.FS_PROJINHERIT_FL
+
+// getFlags implements ioctl(FS_IOC_GETFLAGS).
+func (d *dentry) getFlags(ctx context.Context) (uint32, error) {
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	return d.getFlagsLocked(ctx)
+}
+
+// Preconditions: d.metadataMu must be locked.
+func (d *dentry) getFlagsLocked(ctx context.Context) (uint32, error) {
+	if d.inodeFlagsCached {
+		return d.inodeFlags, nil
+	}
+	flags, err := d.file.getFlags(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if d.fs.opts.interop != InteropModeShared {
+		d.inodeFlags = flags
+		d.inodeFlagsCached = true
+	}
+	return flags, nil
+}
+
+// setFlags implements ioctl(FS_IOC_SETFLAGS).
+func (d *dentry) setFlags(ctx context.Context, creds *auth.Credentials, flags uint32, mnt *vfs.Mount) error {
+	if !vfs.CanActAsOwner(creds, auth.KUID(atomic.LoadUint32(&d.uid))) {
+		return syserror.EPERM
+	}
+	if err := d.fs.checkBeginWrite(mnt); err != nil {
+		return err
+	}
+	defer mnt.EndWrite()
+
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	oldFlags, err := d.getFlagsLocked(ctx)
+	if err != nil {
+		return err
+	}
+	changed := oldFlags ^ flags
+	if changed&^settableInodeFlags != 0 {
+		return syserror.EOPNOTSUPP
+	}
+	// As in Linux's vfs_ioc_setflags_prepare(), only privileged users may
+	// change the immutable and append-only flags.
+	if changed&(linux.FS_IMMUTABLE_FL|linux.FS_APPEND_FL) != 0 && !creds.HasCapability(linux.CAP_LINUX_IMMUTABLE) {
+		return syserror.EPERM
+	}
+	if err := d.file.setFlags(ctx, flags); err != nil {
+		// The server may have rejected the change because our cached flags
+		// are stale.
+		d.inodeFlagsCached = false
+		return err
+	}
+	if d.fs.opts.interop != InteropModeShared {
+		d.inodeFlags = flags
+		d.inodeFlagsCached = true
+	}
+	return nil
+}
+
+// By default, we only support xattrs prefixed with "user." (see
+// b/148380782). The "trusted." and "security." namespaces may be enabled by
+// the "xattr_namespaces" mount option, e.g. for SELinux labels or file
+// capabilities.
+//
+// Extended attributes are not cached by the client: each operation is
+// forwarded to the server, which is authoritative, so concurrent operations
+// need no synchronization here.
 func (d *dentry) listxattr(ctx context.Context, creds *auth.Credentials, size uint64) ([]string, error) {
 	xattrMap, err := d.file.listXattr(ctx, size)
 	if err != nil {
@@ -1034,56 +2530,67 @@ func (d *dentry) listxattr(ctx context.Context, creds *auth.Credentials, size ui
 	}
 	xattrs := make([]string, 0, len(xattrMap))
 	for x := range xattrMap {
-		if strings.HasPrefix(x, linux.XATTR_USER_PREFIX) {
-			xattrs = append(xattrs, x)
+		switch {
+		case strings.HasPrefix(x, linux.XATTR_USER_PREFIX):
+		case strings.HasPrefix(x, linux.XATTR_TRUSTED_PREFIX) && d.fs.opts.trustedXattrs:
+			// Linux only lists trusted xattrs to privileged callers.
+			if !hasTrustedXattrCapability(creds) {
+				continue
+			}
+		case strings.HasPrefix(x, linux.XATTR_SECURITY_PREFIX) && d.fs.opts.securityXattrs:
+		default:
+			continue
 		}
+		xattrs = append(xattrs, x)
 	}
 	return xattrs, nil
 }
 
 func (d *dentry) getxattr(ctx context.Context, creds *auth.Credentials, opts *vfs.GetxattrOptions) (string, error) {
-	if err := d.checkPermissions(creds, vfs.MayRead); err != nil {
+	if err := d.checkXattrPermissions(creds, opts.Name, vfs.MayRead); err != nil {
 		return "", err
 	}
-	if !strings.HasPrefix(opts.Name, linux.XATTR_USER_PREFIX) {
-		return "", syserror.EOPNOTSUPP
-	}
 	return d.file.getXattr(ctx, opts.Name, opts.Size)
 }
 
 func (d *dentry) setxattr(ctx context.Context, creds *auth.Credentials, opts *vfs.SetxattrOptions) error {
-	if err := d.checkPermissions(creds, vfs.MayWrite); err != nil {
+	if err := d.checkXattrPermissions(creds, opts.Name, vfs.MayWrite); err != nil {
 		return err
 	}
-	if !strings.HasPrefix(opts.Name, linux.XATTR_USER_PREFIX) {
-		return syserror.EOPNOTSUPP
+	if d.fs.opts.readonly {
+		return syserror.EROFS
 	}
 	return d.file.setXattr(ctx, opts.Name, opts.Value, opts.Flags)
 }
 
 func (d *dentry) removexattr(ctx context.Context, creds *auth.Credentials, name string) error {
-	if err := d.checkPermissions(creds, vfs.MayWrite); err != nil {
+	if err := d.checkXattrPermissions(creds, name, vfs.MayWrite); err != nil {
 		return err
 	}
-	if !strings.HasPrefix(name, linux.XATTR_USER_PREFIX) {
-		return syserror.EOPNOTSUPP
+	if d.fs.opts.readonly {
+		return syserror.EROFS
 	}
 	return d.file.removeXattr(ctx, name)
 }
 
 // Preconditions: d.isRegularFile() || d.isDirectory().
 func (d *dentry) ensureSharedHandle(ctx context.Context, read, write, trunc bool) error {
-	// O_TRUNC unconditionally requires us to obtain a new handle (opened with
-	// O_TRUNC).
-	if !trunc {
-		d.handleMu.RLock()
-		if (!read || d.handleReadable) && (!write || d.handleWritable) {
-			// The current handle is sufficient.
-			d.handleMu.RUnlock()
-			return nil
+	if (write || trunc) && d.fs.opts.readonly {
+		return syserror.EROFS
+	}
+	d.handleMu.RLock()
+	if (!read || d.handleReadable) && (!write || d.handleWritable) {
+		// The current handle is sufficient. O_TRUNC implies write, so if
+		// trunc is true, the file can be truncated through the current
+		// handle rather than by opening a new one with O_TRUNC.
+		var err error
+		if trunc {
+			err = d.handle.file.setAttr(ctx, p9.SetAttrMask{Size: true}, p9.SetAttr{Size: 0})
 		}
 		d.handleMu.RUnlock()
+		return err
 	}
+	d.handleMu.RUnlock()
 
 	haveOldFD := false
 	d.handleMu.Lock()
@@ -1096,7 +2603,9 @@ func (d *dentry) ensureSharedHandle(ctx context.Context, read, write, trunc bool
 			d.handleMu.Unlock()
 			return err
 		}
+		transition := "open"
 		if !d.handle.file.isNil() {
+			transition = "upgrade"
 			// Check that old and new handles are compatible: If the old handle
 			// includes a host file descriptor but the new one does not, or
 			// vice versa, old and new memory mappings may be incoherent.
@@ -1127,6 +2636,7 @@ func (d *dentry) ensureSharedHandle(ctx context.Context, read, write, trunc bool
 				}
 				syscall.Close(int(h.fd))
 				h.fd = d.handle.fd
+				transition = "dup3 swap"
 				if d.fs.opts.overlayfsStaleRead {
 					// Replace sentry mappings of the old FD with mappings of
 					// the new FD, since the two are not necessarily coherent.
@@ -1146,6 +2656,7 @@ func (d *dentry) ensureSharedHandle(ctx context.Context, read, write, trunc bool
 		d.handle = h
 		d.handleReadable = wantReadable
 		d.handleWritable = wantWritable
+		d.traceHandleLocked(transition)
 	}
 	d.handleMu.Unlock()
 
@@ -1162,6 +2673,17 @@ func (d *dentry) ensureSharedHandle(ctx context.Context, read, write, trunc bool
 	return nil
 }
 
+// traceHandleLocked logs a change to d's shared handle, if
+// d.fs.opts.traceHandles is true.
+//
+// Preconditions: d.handleMu must be locked.
+func (d *dentry) traceHandleLocked(transition string) {
+	if !d.fs.opts.traceHandles {
+		return
+	}
+	log.Infof("gofer.dentry %p (ino %d): handle %s: readable=%t, writable=%t, hostFD=%t", d, d.ino, transition, d.handleReadable, d.handleWritable, d.handle.fd >= 0)
+}
+
 // incLinks increments link count.
 //
 // Preconditions: d.nlink != 0 && d.nlink < math.MaxUint32.
@@ -1204,12 +2726,17 @@ func (fd *fileDescription) Stat(ctx context.Context, opts vfs.StatOptions) (linu
 	if d.fs.opts.interop == InteropModeShared && opts.Mask&(validMask) != 0 && opts.Sync != linux.AT_STATX_DONT_SYNC {
 		// TODO(jamieliu): Use specialFileFD.handle.file for the getattr if
 		// available?
-		if err := d.updateFromGetattr(ctx); err != nil {
+		if err := d.revalidate(ctx); err != nil {
+			return linux.Statx{}, err
+		}
+	} else if d.fs.opts.serverCtime && opts.Mask&linux.STATX_CTIME != 0 && opts.Sync != linux.AT_STATX_DONT_SYNC {
+		if err := d.updateCtimeFromServer(ctx); err != nil {
 			return linux.Statx{}, err
 		}
 	}
 	var stat linux.Statx
 	d.statTo(&stat)
+	d.statDIOAlignTo(opts.Mask, &stat)
 	return stat, nil
 }
 
@@ -1218,6 +2745,47 @@ func (fd *fileDescription) SetStat(ctx context.Context, opts vfs.SetStatOptions)
 	return fd.dentry().setStat(ctx, auth.CredentialsFromContext(ctx), &opts.Stat, fd.vfsfd.Mount())
 }
 
+// Ioctl implements vfs.FileDescriptionImpl.Ioctl.
+func (fd *fileDescription) Ioctl(ctx context.Context, uio usermem.IO, args arch.SyscallArguments) (uintptr, error) {
+	switch args[1].Uint() {
+	case linux.FS_IOC_GETFLAGS:
+		flags, err := fd.dentry().getFlags(ctx)
+		if err != nil {
+			return 0, err
+		}
+		_, err = usermem.CopyObjectOut(ctx, uio, args[2].Pointer(), flags, usermem.IOOpts{
+			AddressSpaceActive: true,
+		})
+		return 0, err
+	case linux.FS_IOC_SETFLAGS:
+		var flags uint32
+		if _, err := usermem.CopyObjectIn(ctx, uio, args[2].Pointer(), &flags, usermem.IOOpts{
+			AddressSpaceActive: true,
+		}); err != nil {
+			return 0, err
+		}
+		return 0, fd.dentry().setFlags(ctx, auth.CredentialsFromContext(ctx), flags, fd.vfsfd.Mount())
+	default:
+		return fd.FileDescriptionDefaultImpl.Ioctl(ctx, uio, args)
+	}
+}
+
+// StatFS implements vfs.FileDescriptionImpl.StatFS.
+func (fd *fileDescription) StatFS(ctx context.Context) (linux.Statfs, error) {
+	return fd.dentry().statfs(ctx)
+}
+
+// LockPOSIX implements vfs.FileDescriptionImpl.LockPOSIX.
+func (fd *fileDescription) LockPOSIX(ctx context.Context, uid fslock.UniqueID, t fslock.LockType, rng fslock.LockRange, block fslock.Blocker) error {
+	return fd.dentry().locks.LockPOSIX(uid, t, rng, block)
+}
+
+// UnlockPOSIX implements vfs.FileDescriptionImpl.UnlockPOSIX.
+func (fd *fileDescription) UnlockPOSIX(ctx context.Context, uid fslock.UniqueID, rng fslock.LockRange) error {
+	fd.dentry().locks.UnlockPOSIX(uid, rng)
+	return nil
+}
+
 // Listxattr implements vfs.FileDescriptionImpl.Listxattr.
 func (fd *fileDescription) Listxattr(ctx context.Context, size uint64) ([]string, error) {
 	return fd.dentry().listxattr(ctx, auth.CredentialsFromContext(ctx), size)
@@ -15,50 +15,991 @@
 package gofer
 
 import (
-	"sync/atomic"
+	gocontext "context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/fd"
+	"gvisor.dev/gvisor/pkg/fspath"
 	"gvisor.dev/gvisor/pkg/p9"
 	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+	"gvisor.dev/gvisor/pkg/sentry/memmap"
+	"gvisor.dev/gvisor/pkg/sentry/pgalloc"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/unet"
+	"gvisor.dev/gvisor/pkg/usermem"
 )
 
-func TestDestroyIdempotent(t *testing.T) {
-	fs := filesystem{
-		dentries: make(map[*dentry]struct{}),
-		opts: filesystemOptions{
-			// Test relies on no dentry being held in the cache.
-			maxCachedDentries: 0,
+// newTestFilesystem returns a filesystem that is not connected to a server,
+// for tests that only exercise client state.
+func newTestFilesystem(ctx context.Context, opts filesystemOptions) *filesystem {
+	// testP9File supports all optional operations.
+	opts.features = serverFeatures{
+		statFS:          true,
+		allocate:        true,
+		seek:            true,
+		copyRange:       true,
+		getAttrChildren: true,
+		multiWalk:       true,
+	}
+	return &filesystem{
+		opts:           opts,
+		mfp:            pgalloc.MemoryFileProviderFromContext(ctx),
+		clock:          ktime.RealtimeClockFromContext(ctx),
+		dentries:       make(map[*dentry]struct{}),
+		specialFileFDs: make(map[*specialFileFD]struct{}),
+		cachePolicy:    newDentryCachePolicy(&opts),
+	}
+}
+
+// newTestVFS returns an initialized VFS.
+func newTestVFS(t testing.TB) *vfs.VirtualFilesystem {
+	vfsObj := &vfs.VirtualFilesystem{}
+	if err := vfsObj.Init(); err != nil {
+		t.Fatalf("VFS init: %v", err)
+	}
+	return vfsObj
+}
+
+// newTestMount returns a vfs.Mount that test file descriptions may be
+// associated with.
+func newTestMount(t *testing.T) *vfs.Mount {
+	vfsObj := newTestVFS(t)
+	vd := vfsObj.NewAnonVirtualDentry("gofer_test")
+	t.Cleanup(vd.DecRef)
+	return vd.Mount()
+}
+
+// testP9File is a p9.File that isn't backed by a server. Walk, WalkGetAttr
+// and Open succeed without a host FD; all other methods panic.
+type testP9File struct {
+	p9.File
+
+	// attr and qid are returned by GetAttr, and by WalkGetAttr on the
+	// file's parent. getAttrs records the mask passed to each call to
+	// GetAttr. If attrMask is not empty, it is the valid mask returned by
+	// GetAttr. If getAttrGate is not nil, GetAttr blocks until it is closed.
+	attr        p9.Attr
+	attrMask    p9.AttrMask
+	qid         p9.QID
+	getAttrs    []p9.AttrMask
+	getAttrGate chan struct{}
+
+	// children are the files that may be reached by WalkGetAttr.
+	children map[string]*testP9File
+
+	// opens is the number of calls to Open.
+	opens int
+
+	// data is the file's contents, accessed by ReadAt and WriteAt. reads and
+	// writes are the number of calls to ReadAt and WriteAt respectively. If
+	// writeErr is non-nil, it is returned by WriteAt. All are protected by
+	// dataMu, since they may be accessed by the writeback worker. If
+	// writeGate is not nil, WriteAt blocks until it is closed.
+	dataMu    sync.Mutex
+	data      []byte
+	reads     int
+	writes    int
+	writeErr  error
+	writeGate chan struct{}
+
+	// fsyncs is the number of calls to FSync. fdatasyncs is the number of
+	// calls to FDataSync.
+	fsyncs     int
+	fdatasyncs int
+
+	// fsstat and statFSErr are returned by StatFS.
+	fsstat    p9.FSStat
+	statFSErr error
+
+	// dirents are returned by Readdir, and are kept sorted by name by Mkdir.
+	// readdirs is the number of calls to Readdir with offset 0, i.e. the
+	// number of times the directory has been read from the beginning.
+	dirents  []p9.Dirent
+	readdirs int
+
+	// setAttrMasks and setAttrs record the arguments to each call to
+	// SetAttr. If setAttrErr is not nil, SetAttr fails with it.
+	setAttrMasks []p9.SetAttrMask
+	setAttrs     []p9.SetAttr
+	setAttrErr   error
+
+	// xattrs contains the file's extended attributes. xattrs is protected by
+	// xattrMu.
+	xattrMu sync.Mutex
+	xattrs  map[string]string
+
+	// If allocateErr is not nil, Allocate fails with it.
+	allocateErr error
+
+	// holes are the ranges of data that Seek reports as holes. If seekErr is
+	// not nil, Seek fails with it. seeks is the number of calls to Seek.
+	holes   []memmap.MappableRange
+	seekErr error
+	seeks   int
+
+	// copies is the number of calls to CopyRange. If copyRangeErr is not
+	// nil, CopyRange fails with it.
+	copies       int
+	copyRangeErr error
+
+	// clones is the number of calls to CloneRange. If cloneRangeErr is not
+	// nil, CloneRange fails with it.
+	clones        int
+	cloneRangeErr error
+
+	// ino is returned by GetIno. If ino is 0, GetIno fails with EOPNOTSUPP.
+	ino uint64
+
+	// inodeFlags are returned by GetFlags and set by SetFlags. getFlagses is
+	// the number of calls to GetFlags.
+	inodeFlags uint32
+	getFlagses int
+
+	// target is returned by Readlink. readlinks is the number of calls to
+	// Readlink.
+	target    string
+	readlinks int
+
+	// socketAddr is the path of the host Unix domain socket that Connect
+	// connects to.
+	socketAddr string
+}
+
+// Walk implements p9.File.Walk. For simplicity, the returned file is f.
+func (f *testP9File) Walk(names []string) ([]p9.QID, p9.File, error) {
+	if len(names) == 0 {
+		// The p9 server requires walks that clone a file to return a single
+		// QID.
+		return []p9.QID{{}}, f, nil
+	}
+	return make([]p9.QID, len(names)), f, nil
+}
+
+// WalkGetAttr implements p9.File.WalkGetAttr.
+func (f *testP9File) WalkGetAttr(names []string) ([]p9.QID, p9.File, p9.AttrMask, p9.Attr, error) {
+	if len(names) != 1 {
+		return nil, nil, p9.AttrMask{}, p9.Attr{}, syserror.EINVAL
+	}
+	child, ok := f.children[names[0]]
+	if !ok {
+		return nil, nil, p9.AttrMask{}, p9.Attr{}, syserror.ENOENT
+	}
+	return []p9.QID{child.qid}, child, p9.AttrMask{Mode: true, Size: true, NLink: true}, child.attr, nil
+}
+
+// GetAttr implements p9.File.GetAttr.
+func (f *testP9File) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	f.getAttrs = append(f.getAttrs, req)
+	if f.getAttrGate != nil {
+		<-f.getAttrGate
+	}
+	if !f.attrMask.Empty() {
+		return f.qid, f.attrMask, f.attr, nil
+	}
+	return f.qid, p9.AttrMask{Mode: true, Size: true, NLink: true}, f.attr, nil
+}
+
+// GetAttrChildren implements p9.File.GetAttrChildren.
+func (f *testP9File) GetAttrChildren(names []string, req p9.AttrMask) ([]p9.FullStat, error) {
+	stats := make([]p9.FullStat, len(names))
+	for i, name := range names {
+		if child, ok := f.children[name]; ok {
+			stats[i] = p9.FullStat{
+				Valid: p9.AttrMask{Mode: true, Size: true, NLink: true},
+				Attr:  child.attr,
+			}
+		}
+	}
+	return stats, nil
+}
+
+// Open implements p9.File.Open.
+func (f *testP9File) Open(flags p9.OpenFlags) (*fd.FD, p9.QID, uint32, error) {
+	f.opens++
+	return nil, p9.QID{}, 0, nil
+}
+
+// ReadAt implements p9.File.ReadAt.
+func (f *testP9File) ReadAt(p []byte, offset uint64) (int, error) {
+	f.dataMu.Lock()
+	defer f.dataMu.Unlock()
+	f.reads++
+	if offset >= uint64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements p9.File.WriteAt.
+func (f *testP9File) WriteAt(p []byte, offset uint64) (int, error) {
+	if f.writeGate != nil {
+		<-f.writeGate
+	}
+	f.dataMu.Lock()
+	defer f.dataMu.Unlock()
+	f.writes++
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
+	if end := offset + uint64(len(p)); end > uint64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-uint64(len(f.data)))...)
+	}
+	return copy(f.data[offset:], p), nil
+}
+
+// contents returns a copy of f's contents.
+func (f *testP9File) contents() []byte {
+	f.dataMu.Lock()
+	defer f.dataMu.Unlock()
+	return append([]byte(nil), f.data...)
+}
+
+// FSync implements p9.File.FSync.
+func (f *testP9File) FSync() error {
+	f.fsyncs++
+	return nil
+}
+
+// RenameAt2 implements p9.File.RenameAt2 by moving or exchanging entries in
+// children.
+func (f *testP9File) RenameAt2(oldName string, newDir p9.File, newName string, flags uint32) error {
+	dir := newDir.(*testP9File)
+	renamed, ok := f.children[oldName]
+	if !ok {
+		return syserror.ENOENT
+	}
+	replaced, exists := dir.children[newName]
+	switch {
+	case flags&linux.RENAME_NOREPLACE != 0:
+		if exists {
+			return syserror.EEXIST
+		}
+		delete(f.children, oldName)
+	case flags&linux.RENAME_EXCHANGE != 0:
+		if !exists {
+			return syserror.ENOENT
+		}
+		f.children[oldName] = replaced
+	default:
+		delete(f.children, oldName)
+	}
+	if dir.children == nil {
+		dir.children = make(map[string]*testP9File)
+	}
+	dir.children[newName] = renamed
+	return nil
+}
+
+// Connect implements p9.File.Connect.
+func (f *testP9File) Connect(flags p9.ConnectFlags) (*fd.FD, error) {
+	var stype int
+	switch flags {
+	case p9.StreamSocket:
+		stype = syscall.SOCK_STREAM
+	case p9.DgramSocket:
+		stype = syscall.SOCK_DGRAM
+	case p9.SeqpacketSocket:
+		stype = syscall.SOCK_SEQPACKET
+	default:
+		return nil, syserror.EINVAL
+	}
+	s, err := syscall.Socket(syscall.AF_UNIX, stype|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Connect(s, &syscall.SockaddrUnix{Name: f.socketAddr}); err != nil {
+		syscall.Close(s)
+		return nil, err
+	}
+	return fd.New(s), nil
+}
+
+// Readlink implements p9.File.Readlink.
+func (f *testP9File) Readlink() (string, error) {
+	f.readlinks++
+	return f.target, nil
+}
+
+// FDataSync implements p9.File.FDataSync.
+func (f *testP9File) FDataSync() error {
+	f.fdatasyncs++
+	return nil
+}
+
+// StatFS implements p9.File.StatFS.
+func (f *testP9File) StatFS() (p9.FSStat, error) {
+	return f.fsstat, f.statFSErr
+}
+
+// Readdir implements p9.File.Readdir.
+func (f *testP9File) Readdir(offset uint64, count uint32) ([]p9.Dirent, error) {
+	if offset == 0 {
+		f.readdirs++
+	}
+	if offset >= uint64(len(f.dirents)) {
+		return nil, nil
+	}
+	var dirents []p9.Dirent
+	for i, dirent := range f.dirents[offset:] {
+		dirent.Offset = offset + uint64(i) + 1
+		dirents = append(dirents, dirent)
+	}
+	return dirents, nil
+}
+
+// Mkdir implements p9.File.Mkdir.
+func (f *testP9File) Mkdir(name string, mode p9.FileMode, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	i := sort.Search(len(f.dirents), func(i int) bool {
+		return f.dirents[i].Name >= name
+	})
+	dirent := p9.Dirent{Name: name, Type: p9.TypeDir}
+	f.dirents = append(f.dirents[:i], append([]p9.Dirent{dirent}, f.dirents[i:]...)...)
+	return p9.QID{}, nil
+}
+
+// Mknod implements p9.File.Mknod.
+func (f *testP9File) Mknod(name string, mode p9.FileMode, major uint32, minor uint32, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	if _, ok := f.children[name]; ok {
+		return p9.QID{}, syserror.EEXIST
+	}
+	f.children[name] = &testP9File{
+		attr: p9.Attr{
+			Mode:  mode,
+			NLink: 1,
+			RDev:  uint64(linux.MakeDeviceID(uint16(major), minor)),
 		},
 	}
+	return p9.QID{}, nil
+}
 
-	ctx := contexttest.Context(t)
-	attr := &p9.Attr{
-		Mode: p9.ModeRegular,
+// Create implements p9.File.Create. The returned open file is the created
+// file itself.
+func (f *testP9File) Create(name string, flags p9.OpenFlags, permissions p9.FileMode, uid p9.UID, gid p9.GID) (*fd.FD, p9.File, p9.QID, uint32, error) {
+	if _, ok := f.children[name]; ok {
+		return nil, nil, p9.QID{}, 0, syserror.EEXIST
+	}
+	child := &testP9File{
+		attr: p9.Attr{
+			Mode:  p9.ModeRegular | permissions.Permissions(),
+			NLink: 1,
+		},
+	}
+	f.children[name] = child
+	return nil, child, child.qid, 0, nil
+}
+
+// UnlinkAt implements p9.File.UnlinkAt.
+func (f *testP9File) UnlinkAt(name string, flags uint32) error {
+	child, ok := f.children[name]
+	if !ok {
+		return syserror.ENOENT
+	}
+	child.attr.NLink--
+	delete(f.children, name)
+	return nil
+}
+
+// Link implements p9.File.Link.
+func (f *testP9File) Link(target p9.File, newName string) error {
+	if _, ok := f.children[newName]; ok {
+		return syserror.EEXIST
+	}
+	t := target.(*testP9File)
+	t.attr.NLink++
+	f.children[newName] = t
+	return nil
+}
+
+// SetAttr implements p9.File.SetAttr.
+func (f *testP9File) SetAttr(valid p9.SetAttrMask, attr p9.SetAttr) error {
+	f.setAttrMasks = append(f.setAttrMasks, valid)
+	f.setAttrs = append(f.setAttrs, attr)
+	if f.setAttrErr != nil {
+		return f.setAttrErr
+	}
+	if valid.Size {
+		f.dataMu.Lock()
+		if attr.Size < uint64(len(f.data)) {
+			f.data = f.data[:attr.Size]
+		} else {
+			f.data = append(f.data, make([]byte, attr.Size-uint64(len(f.data)))...)
+		}
+		f.dataMu.Unlock()
+	}
+	return nil
+}
+
+// GetXattr implements p9.File.GetXattr.
+func (f *testP9File) GetXattr(name string, size uint64) (string, error) {
+	f.xattrMu.Lock()
+	defer f.xattrMu.Unlock()
+	val, ok := f.xattrs[name]
+	if !ok {
+		return "", syserror.ENODATA
+	}
+	return val, nil
+}
+
+// SetXattr implements p9.File.SetXattr.
+func (f *testP9File) SetXattr(name, value string, flags uint32) error {
+	f.xattrMu.Lock()
+	defer f.xattrMu.Unlock()
+	if f.xattrs == nil {
+		f.xattrs = make(map[string]string)
+	}
+	f.xattrs[name] = value
+	return nil
+}
+
+// ListXattr implements p9.File.ListXattr.
+func (f *testP9File) ListXattr(size uint64) (map[string]struct{}, error) {
+	f.xattrMu.Lock()
+	defer f.xattrMu.Unlock()
+	names := make(map[string]struct{}, len(f.xattrs))
+	for name := range f.xattrs {
+		names[name] = struct{}{}
+	}
+	return names, nil
+}
+
+// RemoveXattr implements p9.File.RemoveXattr.
+func (f *testP9File) RemoveXattr(name string) error {
+	f.xattrMu.Lock()
+	defer f.xattrMu.Unlock()
+	if _, ok := f.xattrs[name]; !ok {
+		return syserror.ENODATA
+	}
+	delete(f.xattrs, name)
+	return nil
+}
+
+// Allocate implements p9.File.Allocate.
+func (f *testP9File) Allocate(mode p9.AllocateMode, offset, length uint64) error {
+	if f.allocateErr != nil {
+		return f.allocateErr
+	}
+	f.dataMu.Lock()
+	defer f.dataMu.Unlock()
+	if end := offset + length; !mode.KeepSize && end > uint64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-uint64(len(f.data)))...)
+	}
+	return nil
+}
+
+// Seek implements p9.File.Seek.
+func (f *testP9File) Seek(offset uint64, whence p9.SeekWhence) (uint64, error) {
+	f.dataMu.Lock()
+	defer f.dataMu.Unlock()
+	f.seeks++
+	if f.seekErr != nil {
+		return 0, f.seekErr
+	}
+	size := uint64(len(f.data))
+	if offset >= size {
+		return 0, syserror.ENXIO
+	}
+	for _, hole := range f.holes {
+		if offset >= hole.End {
+			continue
+		}
+		switch whence {
+		case p9.SeekData:
+			if offset < hole.Start {
+				return offset, nil
+			}
+			offset = hole.End
+		case p9.SeekHole:
+			if offset < hole.Start {
+				return hole.Start, nil
+			}
+			return offset, nil
+		}
+	}
+	if whence == p9.SeekHole {
+		return size, nil
+	}
+	if offset >= size {
+		return 0, syserror.ENXIO
+	}
+	return offset, nil
+}
+
+// CopyRange implements p9.File.CopyRange.
+func (f *testP9File) CopyRange(offset uint64, dst p9.File, dstOffset, length uint64) (uint64, error) {
+	f.copies++
+	if f.copyRangeErr != nil {
+		return 0, f.copyRangeErr
+	}
+	data := f.contents()
+	if offset >= uint64(len(data)) {
+		return 0, nil
+	}
+	data = data[offset:]
+	if length < uint64(len(data)) {
+		data = data[:length]
+	}
+	n, err := dst.WriteAt(data, dstOffset)
+	return uint64(n), err
+}
+
+// CloneRange implements p9.File.CloneRange.
+func (f *testP9File) CloneRange(offset uint64, dst p9.File, dstOffset, length uint64) error {
+	f.clones++
+	if f.cloneRangeErr != nil {
+		return f.cloneRangeErr
 	}
-	mask := p9.AttrMask{
-		Mode: true,
-		Size: true,
+	data := f.contents()
+	if offset+length > uint64(len(data)) {
+		return syserror.EINVAL
 	}
-	parent, err := fs.newDentry(ctx, p9file{}, p9.QID{}, mask, attr)
+	if length == 0 {
+		length = uint64(len(data)) - offset
+	}
+	_, err := dst.WriteAt(data[offset:offset+length], dstOffset)
+	return err
+}
+
+// GetIno implements p9.File.GetIno.
+func (f *testP9File) GetIno() (uint64, error) {
+	if f.ino == 0 {
+		return 0, syserror.EOPNOTSUPP
+	}
+	return f.ino, nil
+}
+
+// GetFlags implements p9.File.GetFlags.
+func (f *testP9File) GetFlags() (uint32, error) {
+	f.getFlagses++
+	return f.inodeFlags, nil
+}
+
+// SetFlags implements p9.File.SetFlags.
+func (f *testP9File) SetFlags(flags uint32) error {
+	f.inodeFlags = flags
+	return nil
+}
+
+// Close implements p9.File.Close.
+func (f *testP9File) Close() error {
+	return nil
+}
+
+// testAttacher implements p9.Attacher by returning a fixed root file.
+type testAttacher struct {
+	root *testP9File
+}
+
+// Attach implements p9.Attacher.Attach.
+func (a testAttacher) Attach() (p9.File, error) {
+	return a.root, nil
+}
+
+// serveTestP9 serves root on a named unix domain socket, accepting a new
+// connection each time a client connects. It returns the socket's path, and a
+// channel that receives each accepted connection.
+func serveTestP9(t *testing.T, root *testP9File) (string, <-chan *unet.Socket) {
+	addr := filepath.Join(t.TempDir(), "gofer.sock")
+	ss, err := unet.BindAndListen(addr, false /* packet */)
+	if err != nil {
+		t.Fatalf("BindAndListen(%q): %v", addr, err)
+	}
+	t.Cleanup(func() { ss.Close() })
+	server := p9.NewServer(testAttacher{root})
+	conns := make(chan *unet.Socket, 4)
+	go func() {
+		for {
+			conn, err := ss.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go server.Handle(conn)
+		}
+	}()
+	return addr, conns
+}
+
+// mountTestP9 mounts a gofer filesystem with the given mount options, and
+// returns its root.
+func mountTestP9(ctx context.Context, t *testing.T, data string) vfs.VirtualDentry {
+	vfsObj := newTestVFS(t)
+	vfsObj.MustRegisterFilesystemType(Name, &FilesystemType{}, &vfs.RegisterFilesystemTypeOptions{})
+	mntns, err := vfsObj.NewMountNamespace(ctx, auth.CredentialsFromContext(ctx), "", Name, &vfs.GetFilesystemOptions{Data: data})
+	if err != nil {
+		t.Fatalf("NewMountNamespace(%q): %v", data, err)
+	}
+	return mntns.Root()
+}
+
+// testFilesystemType is a vfs.FilesystemType that returns a preconstructed
+// filesystem.
+type testFilesystemType struct {
+	fs   *filesystem
+	root *dentry
+}
+
+// GetFilesystem implements vfs.FilesystemType.GetFilesystem.
+func (fstype *testFilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.VirtualFilesystem, creds *auth.Credentials, source string, opts vfs.GetFilesystemOptions) (*vfs.Filesystem, *vfs.Dentry, error) {
+	fstype.fs.vfsfs.Init(vfsObj, fstype, fstype.fs)
+	return &fstype.fs.vfsfs, &fstype.root.vfsd, nil
+}
+
+// Name implements vfs.FilesystemType.Name.
+func (*testFilesystemType) Name() string {
+	return "gofer_test"
+}
+
+// newTestDentry returns a dentry on fs, which must have been returned by
+// newTestFilesystem, for a file backed by file with the given attributes. The
+// dentry is not linked into any directory.
+func newTestDentry(ctx context.Context, t testing.TB, fs *filesystem, file *testP9File, attr p9.Attr) *dentry {
+	d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &attr)
 	if err != nil {
 		t.Fatalf("fs.newDentry(): %v", err)
 	}
+	return d
+}
 
-	child, err := fs.newDentry(ctx, p9file{}, p9.QID{}, mask, attr)
+// newTestRoot mounts fs, which must have been returned by newTestFilesystem,
+// with a root directory backed by file and containing the given children,
+// and returns the root. Children are never revalidated, so fs must not use
+// InteropModeShared if any are given.
+func newTestRoot(ctx context.Context, t testing.TB, fs *filesystem, file *testP9File, children map[string]*dentry) vfs.VirtualDentry {
+	root, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeDirectory | 0755})
 	if err != nil {
 		t.Fatalf("fs.newDentry(): %v", err)
 	}
-	parent.IncRef() // reference held by child on its parent.
-	parent.vfsd.InsertChild(&child.vfsd, "child")
+	root.refs = 1
+	for name, child := range children {
+		root.IncRef() // reference held by child on its parent.
+		root.vfsd.InsertChild(&child.vfsd, name)
+	}
 
-	child.checkCachingLocked()
-	if got := atomic.LoadInt64(&child.refs); got != -1 {
-		t.Fatalf("child.refs=%d, want: -1", got)
+	vfsObj := newTestVFS(t)
+	fstype := &testFilesystemType{fs: fs, root: root}
+	vfsObj.MustRegisterFilesystemType(fstype.Name(), fstype, &vfs.RegisterFilesystemTypeOptions{})
+	mntns, err := vfsObj.NewMountNamespace(ctx, auth.CredentialsFromContext(ctx), "", fstype.Name(), &vfs.GetFilesystemOptions{})
+	if err != nil {
+		t.Fatalf("NewMountNamespace(): %v", err)
+	}
+	return mntns.Root()
+}
+
+// pathOp returns a vfs.PathOperation for path relative to root.
+func pathOp(root vfs.VirtualDentry, path string) *vfs.PathOperation {
+	return &vfs.PathOperation{
+		Root:  root,
+		Start: root,
+		Path:  fspath.Parse(path),
+	}
+}
+
+// openAt opens the file at path relative to root.
+func openAt(ctx context.Context, root vfs.VirtualDentry, path string, flags uint32) (*vfs.FileDescription, error) {
+	return root.Mount().Filesystem().VirtualFilesystem().OpenAt(ctx, auth.CredentialsFromContext(ctx), pathOp(root, path), &vfs.OpenOptions{
+		Flags: flags,
+	})
+}
+
+// openTestFile mounts fs with a root directory containing d as "file", and
+// opens it with the given flags. The returned file description and the root
+// are released when the test ends.
+func openTestFile(ctx context.Context, t testing.TB, fs *filesystem, d *dentry, flags uint32) *vfs.FileDescription {
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+	t.Cleanup(root.DecRef)
+	fd, err := openAt(ctx, root, "file", flags)
+	if err != nil {
+		t.Fatalf("OpenAt(%#x): %v", flags, err)
+	}
+	t.Cleanup(fd.DecRef)
+	return fd
+}
+
+// cancellableContext is a context.Context that can be cancelled.
+type cancellableContext struct {
+	context.Context
+	done chan struct{}
+}
+
+// Done implements context.Context.Done.
+func (ctx *cancellableContext) Done() <-chan struct{} {
+	return ctx.done
+}
+
+// Err implements context.Context.Err.
+func (ctx *cancellableContext) Err() error {
+	select {
+	case <-ctx.done:
+		return gocontext.Canceled
+	default:
+		return nil
+	}
+}
+
+func TestMountInfo(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		aname: "/export/a",
+	})
+	fs.rootQID = p9.QID{Type: p9.TypeDir, Version: 1, Path: 1234}
+
+	mi := fs.MountInfo()
+	if mi.AttachName != "/export/a" {
+		t.Errorf("MountInfo().AttachName: got %q, want %q", mi.AttachName, "/export/a")
+	}
+	if mi.RootQID.Path != 1234 {
+		t.Errorf("MountInfo().RootQID.Path: got %d, want %d", mi.RootQID.Path, 1234)
+	}
+	if got, want := mi.String(), `aname="/export/a" root=QID{Type: 128, Version: 1, Path: 1234}`; got != want {
+		t.Errorf("MountInfo().String(): got %q, want %q", got, want)
+	}
+}
+
+func TestMountInfoOptions(t *testing.T) {
+	ctx := contexttest.Context(t)
+	addr, _ := serveTestP9(t, &testP9File{attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}})
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",aname=/export/b,cache=remote_revalidating,msize=65536,version=9P2000.L.Google.12")
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+
+	mi := fs.MountInfo()
+	want := MountInfo{
+		AttachName:  "/export/b",
+		RootQID:     mi.RootQID,
+		Interop:     InteropModeShared,
+		MessageSize: 65536,
+		Version:     "9P2000.L.Google.12",
+	}
+	if mi != want {
+		t.Errorf("MountInfo(): got %+v, want %+v", mi, want)
+	}
+	if got, want := fs.SuperBlockOptions(), "aname=/export/b,cache=remote_revalidating,msize=65536,version=9P2000.L.Google.12"; got != want {
+		t.Errorf("SuperBlockOptions(): got %q, want %q", got, want)
+	}
+}
+
+func TestSuperBlockOptionsCache(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, cache := range []string{"fscache", "fscache_writethrough", "writeback", "remote_revalidating", "none"} {
+		addr, _ := serveTestP9(t, &testP9File{attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}})
+		root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",cache="+cache)
+		fs := root.Mount().Filesystem().Impl().(*filesystem)
+		if got, want := fs.cacheOption(), cache; got != want {
+			t.Errorf("cache=%s: got cache option %q, want %q", cache, got, want)
+		}
+		root.DecRef()
+	}
+}
+
+func TestSuperBlockOptionsNonDefault(t *testing.T) {
+	ctx := contexttest.Context(t)
+	opts := "aname=/,cache=writeback,msize=65536,rcvbuf=65536,sndbuf=32768,version=9P2000.L.Google.12," +
+		"dentry_cache_limit=100,dentry_cache_trim_interval_ns=5000000000,dentry_cache_low_water=10,dentry_cache_policy=2q," +
+		"writeback_limit=1048576,server_clock_offset_ns=-100,idle_handle_timeout_ns=60000000000,rpc_timeout_ns=30000000000," +
+		"max_inflight_rpcs=8,page_cache_limit=67108864,readahead=131072,prefetch_small_files=4096," +
+		"xattr_namespaces=user:trusted:security,ctime=server,ino_source=hash,noatime,force_page_cache," +
+		"limit_host_fd_translation,overlayfs_stale_read,sync,trace_handles,casefold,reconnect=true,restorable=true"
+	addr, _ := serveTestP9(t, &testP9File{attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}})
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+","+opts)
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+	if got := fs.SuperBlockOptions(); got != opts {
+		t.Errorf("SuperBlockOptions(): got %q, want %q", got, opts)
+	}
+}
+
+func TestEscapeMountOption(t *testing.T) {
+	for _, test := range []struct {
+		val  string
+		want string
+	}{
+		{"/export/b", "/export/b"},
+		{"/export/a,b", "/export/a\\054b"},
+		{"/my export", "/my\\040export"},
+		{"a\\b\tc\nd", "a\\134b\\011c\\012d"},
+	} {
+		if got := escapeMountOption(test.val); got != test.want {
+			t.Errorf("escapeMountOption(%q): got %q, want %q", test.val, got, test.want)
+		}
+	}
+}
+
+func TestServerFeatures(t *testing.T) {
+	ctx := contexttest.Context(t)
+	rootFile := &testP9File{
+		attr:      p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		statFSErr: syscall.ENOSYS,
+		children: map[string]*testP9File{
+			"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, NLink: 1}, statFSErr: syscall.EIO},
+		},
+	}
+	addr, _ := serveTestP9(t, rootFile)
+	// Version 12 permits Tallocate and Tseek, but not Tgetattrs, Tcopyrange or
+	// Tmultiwalk.
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",version=9P2000.L.Google.12")
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+
+	want := serverFeatures{
+		allocate: true,
+		seek:     true,
+	}
+	if fs.opts.features != want {
+		t.Errorf("got features %+v, want %+v", fs.opts.features, want)
+	}
+	if fs.seekUnsupported != 0 {
+		t.Errorf("got seekUnsupported %d, want 0", fs.seekUnsupported)
+	}
+	if fs.copyRangeUnsupported != 1 || fs.getAttrChildrenUnsupported != 1 || fs.multiWalkUnsupported != 1 {
+		t.Errorf("got copyRangeUnsupported %d, getAttrChildrenUnsupported %d, multiWalkUnsupported %d, want 1", fs.copyRangeUnsupported, fs.getAttrChildrenUnsupported, fs.multiWalkUnsupported)
+	}
+
+	// statfs succeeds with defaults without asking the server.
+	fd, err := openAt(ctx, root, "file", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDWR): %v", err)
+	}
+	defer fd.DecRef()
+	statfs, err := fd.StatFS(ctx)
+	if err != nil {
+		t.Fatalf("StatFS(): %v", err)
+	}
+	if statfs.Type != linux.V9FS_MAGIC || statfs.NameLength != maxFilenameLen {
+		t.Errorf("StatFS(): got %+v, want defaults", statfs)
+	}
+}
+
+func TestLockOrderChecker(t *testing.T) {
+	if !lockOrderChecking {
+		t.Skip("lock order checking requires a race build")
+	}
+	var d dentry
+
+	// Locking in the documented order is permitted.
+	d.metadataMu.Lock()
+	d.handleMu.RLock()
+	d.dataMu.Lock()
+	d.dataMu.Unlock()
+	d.handleMu.RUnlock()
+	d.metadataMu.Unlock()
+
+	// Locking dentry.metadataMu while holding dentry.dataMu is not.
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatalf("locking dentry.metadataMu while holding dentry.dataMu did not panic")
+		}
+		if msg := fmt.Sprint(r); !strings.Contains(msg, "dentry.metadataMu") || !strings.Contains(msg, "dentry.dataMu") {
+			t.Errorf("got panic %q, want a message naming dentry.metadataMu and dentry.dataMu", msg)
+		}
+	}()
+	d.metadataMu.Lock()
+	d.metadataMu.Unlock()
+}
+
+// clientFilesystemType is a vfs.FilesystemType that constructs gofer
+// filesystems using NewFilesystemWithClient, as an embedder would.
+type clientFilesystemType struct {
+	client *p9.Client
+}
+
+// GetFilesystem implements vfs.FilesystemType.GetFilesystem.
+func (fstype *clientFilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.VirtualFilesystem, creds *auth.Credentials, source string, opts vfs.GetFilesystemOptions) (*vfs.Filesystem, *vfs.Dentry, error) {
+	return NewFilesystemWithClient(ctx, vfsObj, creds, fstype.client, opts.Data)
+}
+
+// Name implements vfs.FilesystemType.Name.
+func (*clientFilesystemType) Name() string {
+	return "gofer_client_test"
+}
+
+func TestNewFilesystemWithClient(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	vfsObj := newTestVFS(t)
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, Size: 3, NLink: 1}, data: []byte("foo")},
+		},
+	}
+
+	// Serve rootFile over an in-process socket pair rather than a mount
+	// option-specified connection.
+	conn, peer, err := unet.SocketPair(false /* packet */)
+	if err != nil {
+		t.Fatalf("SocketPair(): %v", err)
+	}
+	go p9.NewServer(testAttacher{rootFile}).Handle(peer)
+	client, err := p9.NewClient(conn, 1024*1024, p9.HighestVersionString())
+	if err != nil {
+		conn.Close()
+		t.Fatalf("NewClient(): %v", err)
+	}
+
+	fstype := &clientFilesystemType{client: client}
+	vfsObj.MustRegisterFilesystemType(fstype.Name(), fstype, &vfs.RegisterFilesystemTypeOptions{})
+	mntns, err := vfsObj.NewMountNamespace(ctx, auth.CredentialsFromContext(ctx), "", fstype.Name(), &vfs.GetFilesystemOptions{Data: "cache=remote_revalidating"})
+	if err != nil {
+		t.Fatalf("NewMountNamespace(): %v", err)
+	}
+	root := mntns.Root()
+	defer root.DecRef()
+
+	// Mount options are parsed, and defaulted, as by GetFilesystem.
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+	if got, want := fs.opts.interop, InteropModeShared; got != want {
+		t.Errorf("interop: got %v, want %v", got, want)
+	}
+	if got, want := fs.opts.maxCachedDentries, uint64(defaultMaxCachedDentries); got != want {
+		t.Errorf("maxCachedDentries: got %d, want %d", got, want)
+	}
+	if got, want := fs.opts.msize, client.MessageSize(); got != want {
+		t.Errorf("msize: got %d, want %d", got, want)
+	}
+
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(file): %v", err)
+	}
+	defer fd.DecRef()
+	buf := make([]byte, 3)
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	if got, want := string(buf), "foo"; got != want {
+		t.Errorf("PRead(): got %q, want %q", got, want)
+	}
+
+	// Options that configure the connection are rejected.
+	conn, peer, err = unet.SocketPair(false /* packet */)
+	if err != nil {
+		t.Fatalf("SocketPair(): %v", err)
+	}
+	go p9.NewServer(testAttacher{rootFile}).Handle(peer)
+	client, err = p9.NewClient(conn, 1024*1024, p9.HighestVersionString())
+	if err != nil {
+		conn.Close()
+		t.Fatalf("NewClient(): %v", err)
 	}
-	// Parent will also be destroyed when child reference is removed.
-	if got := atomic.LoadInt64(&parent.refs); got != -1 {
-		t.Fatalf("parent.refs=%d, want: -1", got)
+	if _, _, err := NewFilesystemWithClient(ctx, vfsObj, auth.CredentialsFromContext(ctx), client, "msize=4096"); err != syserror.EINVAL {
+		t.Errorf("NewFilesystemWithClient(msize=4096): got %v, want EINVAL", err)
 	}
-	child.checkCachingLocked()
-	child.checkCachingLocked()
 }
@@ -31,19 +31,16 @@ type handle struct {
 
 // Preconditions: read || write.
 func openHandle(ctx context.Context, file p9file, read, write, trunc bool) (handle, error) {
+	// A fid can only be opened once, and each handle must have its own fid
+	// (in particular, each specialFileFD for a regular file with cache=none
+	// needs a distinct handle), so every handle costs a walk as well as an
+	// open. Walked fids can't be cached for reuse, since the open consumes
+	// the walked fid.
 	_, newfile, err := file.walk(ctx, nil)
 	if err != nil {
 		return handle{fd: -1}, err
 	}
-	var flags p9.OpenFlags
-	switch {
-	case read && !write:
-		flags = p9.ReadOnly
-	case !read && write:
-		flags = p9.WriteOnly
-	case read && write:
-		flags = p9.ReadWrite
-	}
+	flags := handleOpenFlags(read, write)
 	if trunc {
 		flags |= p9.OpenTruncate
 	}
@@ -62,6 +59,21 @@ func openHandle(ctx context.Context, file p9file, read, write, trunc bool) (hand
 	}, nil
 }
 
+// handleOpenFlags returns the p9.OpenFlags used to open a handle with the
+// given access.
+//
+// Preconditions: read || write.
+func handleOpenFlags(read, write bool) p9.OpenFlags {
+	switch {
+	case read && !write:
+		return p9.ReadOnly
+	case !read && write:
+		return p9.WriteOnly
+	default:
+		return p9.ReadWrite
+	}
+}
+
 func (h *handle) close(ctx context.Context) {
 	h.file.close(ctx)
 	h.file = p9file{}
@@ -72,6 +84,18 @@ func (h *handle) close(ctx context.Context) {
 }
 
 func (h *handle) readToBlocksAt(ctx context.Context, dsts safemem.BlockSeq, offset uint64) (uint64, error) {
+	return h.readToBlocksAtWith(ctx, dsts, offset, h.file.readAt)
+}
+
+// readToBlocksAtInterruptible is like readToBlocksAt, but reads from the
+// server may be interrupted, as for p9file.readAtInterruptible. It is used for
+// reads on behalf of read(2) and friends; reads that fill the page cache, e.g.
+// to handle page faults, must not be interrupted.
+func (h *handle) readToBlocksAtInterruptible(ctx context.Context, dsts safemem.BlockSeq, offset uint64) (uint64, error) {
+	return h.readToBlocksAtWith(ctx, dsts, offset, h.file.readAtInterruptible)
+}
+
+func (h *handle) readToBlocksAtWith(ctx context.Context, dsts safemem.BlockSeq, offset uint64, readAt func(context.Context, []byte, uint64) (int, error)) (uint64, error) {
 	if dsts.IsEmpty() {
 		return 0, nil
 	}
@@ -82,12 +106,12 @@ func (h *handle) readToBlocksAt(ctx context.Context, dsts safemem.BlockSeq, offs
 		return n, err
 	}
 	if dsts.NumBlocks() == 1 && !dsts.Head().NeedSafecopy() {
-		n, err := h.file.readAt(ctx, dsts.Head().ToSlice(), offset)
+		n, err := readAt(ctx, dsts.Head().ToSlice(), offset)
 		return uint64(n), err
 	}
 	// Buffer the read since p9.File.ReadAt() takes []byte.
 	buf := make([]byte, dsts.NumBytes())
-	n, err := h.file.readAt(ctx, buf, offset)
+	n, err := readAt(ctx, buf, offset)
 	if n == 0 {
 		return 0, err
 	}
@@ -97,7 +121,67 @@ func (h *handle) readToBlocksAt(ctx context.Context, dsts safemem.BlockSeq, offs
 	return uint64(n), err
 }
 
+// readToBlockRangesAt reads into each of dsts from the corresponding offset in
+// offsets, which must be increasing and describe non-overlapping ranges. If h
+// has no host FD, it does so using a single read from the server that spans
+// all of the ranges, discarding data between them. It returns the number of
+// bytes read into each of dsts; a short count for dsts[i] implies that nothing
+// was read into dsts[j] for j > i.
+func (h *handle) readToBlockRangesAt(ctx context.Context, dsts []safemem.BlockSeq, offsets []uint64) ([]uint64, error) {
+	ns := make([]uint64, len(dsts))
+	if len(dsts) == 0 {
+		return ns, nil
+	}
+	if h.fd >= 0 {
+		// Host reads don't require a round trip to the server.
+		for i := range dsts {
+			n, err := h.readToBlocksAt(ctx, dsts[i], offsets[i])
+			ns[i] = n
+			if n != dsts[i].NumBytes() || err != nil {
+				return ns, err
+			}
+		}
+		return ns, nil
+	}
+	start := offsets[0]
+	last := len(dsts) - 1
+	buf := make([]byte, offsets[last]+dsts[last].NumBytes()-start)
+	n, err := h.file.readAt(ctx, buf, start)
+	buf = buf[:n]
+	for i := range dsts {
+		bufStart := offsets[i] - start
+		if bufStart >= uint64(len(buf)) {
+			break
+		}
+		bufEnd := bufStart + dsts[i].NumBytes()
+		if bufEnd > uint64(len(buf)) {
+			bufEnd = uint64(len(buf))
+		}
+		cp, cperr := safemem.CopySeq(dsts[i], safemem.BlockSeqOf(safemem.BlockFromSafeSlice(buf[bufStart:bufEnd])))
+		ns[i] = cp
+		if cperr != nil {
+			return ns, cperr
+		}
+		if cp != dsts[i].NumBytes() {
+			break
+		}
+	}
+	return ns, err
+}
+
 func (h *handle) writeFromBlocksAt(ctx context.Context, srcs safemem.BlockSeq, offset uint64) (uint64, error) {
+	return h.writeFromBlocksAtWith(ctx, srcs, offset, h.file.writeAt)
+}
+
+// writeFromBlocksAtInterruptible is like writeFromBlocksAt, but writes to the
+// server may be interrupted, as for p9file.writeAtInterruptible. It is used
+// for writes on behalf of write(2) and friends; writeback of cached data must
+// not be interrupted.
+func (h *handle) writeFromBlocksAtInterruptible(ctx context.Context, srcs safemem.BlockSeq, offset uint64) (uint64, error) {
+	return h.writeFromBlocksAtWith(ctx, srcs, offset, h.file.writeAtInterruptible)
+}
+
+func (h *handle) writeFromBlocksAtWith(ctx context.Context, srcs safemem.BlockSeq, offset uint64, writeAt func(context.Context, []byte, uint64) (int, error)) (uint64, error) {
 	if srcs.IsEmpty() {
 		return 0, nil
 	}
@@ -108,7 +192,7 @@ func (h *handle) writeFromBlocksAt(ctx context.Context, srcs safemem.BlockSeq, o
 		return n, err
 	}
 	if srcs.NumBlocks() == 1 && !srcs.Head().NeedSafecopy() {
-		n, err := h.file.writeAt(ctx, srcs.Head().ToSlice(), offset)
+		n, err := writeAt(ctx, srcs.Head().ToSlice(), offset)
 		return uint64(n), err
 	}
 	// Buffer the write since p9.File.WriteAt() takes []byte.
@@ -117,8 +201,10 @@ func (h *handle) writeFromBlocksAt(ctx context.Context, srcs safemem.BlockSeq, o
 	if cp == 0 {
 		return 0, cperr
 	}
-	n, err := h.file.writeAt(ctx, buf[:cp], offset)
-	if err != nil {
+	n, err := writeAt(ctx, buf[:cp], offset)
+	if err != nil || uint64(n) < cp {
+		// Report a short write as the number of bytes actually written,
+		// rather than the number of bytes buffered.
 		return uint64(n), err
 	}
 	return cp, cperr
@@ -133,3 +219,13 @@ func (h *handle) sync(ctx context.Context) error {
 	}
 	return h.file.fsync(ctx)
 }
+
+func (h *handle) datasync(ctx context.Context) error {
+	if h.fd >= 0 {
+		ctx.UninterruptibleSleepStart(false)
+		err := syscall.Fdatasync(int(h.fd))
+		ctx.UninterruptibleSleepFinish(false)
+		return err
+	}
+	return h.file.fdatasync(ctx)
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+// testEmitter is a log.Emitter that records log messages.
+type testEmitter struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+// Emit implements log.Emitter.Emit.
+func (e *testEmitter) Emit(depth int, level log.Level, timestamp time.Time, format string, v ...interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.msgs = append(e.msgs, fmt.Sprintf(format, v...))
+}
+
+// handleTransitions returns the handle transitions logged to e.
+func (e *testEmitter) handleTransitions() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var transitions []string
+	for _, msg := range e.msgs {
+		if i := strings.Index(msg, ": handle "); i >= 0 {
+			transitions = append(transitions, msg[i+len(": handle "):])
+		}
+	}
+	return transitions
+}
+
+func TestTraceHandles(t *testing.T) {
+	ctx := contexttest.Context(t)
+	oldEmitter := log.Log().Emitter
+	defer log.SetTarget(oldEmitter)
+
+	for _, traceHandles := range []bool{false, true} {
+		emitter := &testEmitter{}
+		log.SetTarget(emitter)
+		fs := newTestFilesystem(ctx, filesystemOptions{traceHandles: traceHandles})
+		d := newTestDentry(ctx, t, fs, &testP9File{}, p9.Attr{Mode: p9.ModeRegular | 0666})
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+		// Open the file read-only, then upgrade its handle by opening it
+		// writably.
+		var fds []*vfs.FileDescription
+		for _, flags := range []uint32{linux.O_RDONLY, linux.O_RDWR} {
+			fd, err := openAt(ctx, root, "file", flags)
+			if err != nil {
+				t.Fatalf("OpenAt(%#x): %v", flags, err)
+			}
+			fds = append(fds, fd)
+		}
+		// Since fs.opts.maxCachedDentries is 0, dropping the last reference
+		// on d destroys it, closing its handle.
+		for _, fd := range fds {
+			fd.DecRef()
+		}
+		root.DecRef()
+
+		var want []string
+		if traceHandles {
+			want = []string{
+				"open: readable=true, writable=false, hostFD=false",
+				"upgrade: readable=true, writable=true, hostFD=false",
+				"close: readable=true, writable=true, hostFD=false",
+			}
+		}
+		if got := emitter.handleTransitions(); !reflect.DeepEqual(got, want) {
+			t.Errorf("traceHandles=%t: got handle transitions %q, want %q", traceHandles, got, want)
+		}
+	}
+}
+
+func TestCloseIdleHandles(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{idleHandleTimeout: time.Second})
+	file := &testP9File{}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+	defer root.DecRef()
+	// Since fs.opts.maxCachedDentries is 0, hold a reference on d so that it
+	// isn't destroyed (closing its handle) when the FD below is released.
+	d.IncRef()
+	defer d.DecRef()
+
+	fd, err := openAt(ctx, root, "file", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDWR): %v", err)
+	}
+	want := []byte("hello, world")
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(want), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite: %v", err)
+	}
+	hasHandle := func() bool {
+		d.handleMu.RLock()
+		defer d.handleMu.RUnlock()
+		return !d.handle.file.isNil() || d.handleReadable || d.handleWritable
+	}
+	later := func(dur time.Duration) int64 {
+		return fs.clock.Now().Nanoseconds() + dur.Nanoseconds()
+	}
+
+	// The handle of a file with open FDs is never closed.
+	fs.closeIdleHandles(ctx, later(time.Hour))
+	if !hasHandle() {
+		t.Fatalf("handle closed while FD is open")
+	}
+	fd.DecRef()
+
+	// Nor is it closed before the timeout elapses.
+	fs.closeIdleHandles(ctx, later(0))
+	if !hasHandle() {
+		t.Fatalf("handle closed before idle timeout")
+	}
+
+	// Once the timeout has elapsed, the handle is closed after writing back
+	// dirty data.
+	fs.closeIdleHandles(ctx, later(2*time.Second))
+	if hasHandle() {
+		t.Fatalf("handle not closed after idle timeout")
+	}
+	if d.handle.fd >= 0 {
+		t.Errorf("host FD %d not closed after idle timeout", d.handle.fd)
+	}
+	if got := file.contents(); !bytes.Equal(got, want) {
+		t.Errorf("server file contents: got %q, want %q", got, want)
+	}
+
+	// The handle is reopened on the next open.
+	fd, err = openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDONLY): %v", err)
+	}
+	defer fd.DecRef()
+	if !hasHandle() {
+		t.Fatalf("handle not reopened")
+	}
+	buf := make([]byte, len(want))
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead: %v", err)
+	}
+	if !bytes.Equal(buf, want) {
+		t.Errorf("PRead: got %q, want %q", buf, want)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/fs/fsutil"
+)
+
+// startIdleHandleReaper starts fs' idle handle reaper, which periodically
+// closes the shared handles of dentries that have had no regularFileFDs or
+// directoryFDs for at least fs.opts.idleHandleTimeout.
+//
+// Preconditions: fs.opts.idleHandleTimeout != 0. startIdleHandleReaper has
+// not been called previously.
+func (fs *filesystem) startIdleHandleReaper() {
+	fs.idleHandleStop = make(chan struct{})
+	fs.idleHandleDone = make(chan struct{})
+	go fs.idleHandleReaper() // S/R-SAFE: stopped by fs.Release().
+}
+
+// stopIdleHandleReaper stops fs' idle handle reaper, if one was started, and
+// waits for it to exit.
+func (fs *filesystem) stopIdleHandleReaper() {
+	if fs.idleHandleStop == nil {
+		return
+	}
+	close(fs.idleHandleStop)
+	<-fs.idleHandleDone
+}
+
+func (fs *filesystem) idleHandleReaper() {
+	defer close(fs.idleHandleDone)
+	ctx := context.Background()
+	ticker := time.NewTicker(fs.opts.idleHandleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fs.idleHandleStop:
+			return
+		case <-ticker.C:
+		}
+		fs.closeIdleHandles(ctx, fs.clock.Now().Nanoseconds())
+	}
+}
+
+// closeIdleHandles closes the shared handles of all dentries in fs that have
+// had no regularFileFDs or directoryFDs since before now -
+// fs.opts.idleHandleTimeout.
+func (fs *filesystem) closeIdleHandles(ctx context.Context, now int64) {
+	deadline := now - fs.opts.idleHandleTimeout.Nanoseconds()
+
+	// Holding fs.renameMu prevents dentries from being destroyed, which
+	// allows us to take references on dentries with no references.
+	fs.renameMu.RLock()
+	fs.syncMu.Lock()
+	var ds []*dentry
+	for d := range fs.dentries {
+		if atomic.LoadInt64(&d.openFDs) != 0 {
+			continue
+		}
+		if idleSince := atomic.LoadInt64(&d.idleSince); idleSince == 0 || idleSince > deadline {
+			continue
+		}
+		d.IncRef()
+		ds = append(ds, d)
+	}
+	fs.syncMu.Unlock()
+	fs.renameMu.RUnlock()
+
+	for _, d := range ds {
+		d.closeIdleHandle(ctx)
+		d.DecRef()
+	}
+}
+
+// closeIdleHandle writes back d's dirty cached data and closes d.handle, if d
+// has no regularFileFDs, directoryFDs, or application memory mappings. The
+// handle is reopened by the next call to d.ensureSharedHandle().
+func (d *dentry) closeIdleHandle(ctx context.Context) {
+	// Application memory mappings may refer to d.handle.fd even after all
+	// FDs have been closed.
+	d.mapsMu.Lock()
+	defer d.mapsMu.Unlock()
+	if !d.mappings.IsEmpty() {
+		return
+	}
+
+	d.handleMu.Lock()
+	defer d.handleMu.Unlock()
+	// Since d.openFDs is incremented before calls to d.ensureSharedHandle(),
+	// checking it while holding d.handleMu ensures that we don't close a
+	// handle that a concurrent open expects to use.
+	if d.handle.file.isNil() || atomic.LoadInt64(&d.openFDs) != 0 {
+		return
+	}
+	if d.handleWritable {
+		d.dataMu.Lock()
+		err := fsutil.SyncDirtyAll(ctx, &d.cache, &d.dirty, d.size, d.fs.mfp.MemoryFile(), d.handle.writeFromBlocksAt)
+		d.dataMu.Unlock()
+		if err != nil {
+			log.Warningf("gofer.dentry.closeIdleHandle: failed to write dirty data back: %v", err)
+			return
+		}
+	}
+	d.traceHandleLocked("idle close")
+	d.handle.close(ctx)
+	d.handleReadable = false
+	d.handleWritable = false
+}
+
+// incOpenFDs records that a regularFileFD or directoryFD is being opened on
+// d. It must be called before the corresponding call to
+// d.ensureSharedHandle(), and balanced by a later call to d.decOpenFDs().
+func (d *dentry) incOpenFDs() {
+	atomic.AddInt64(&d.openFDs, 1)
+}
+
+// decOpenFDs records that a regularFileFD or directoryFD on d has been
+// released, or failed to open.
+func (d *dentry) decOpenFDs() {
+	if atomic.AddInt64(&d.openFDs, -1) == 0 {
+		atomic.StoreInt64(&d.idleSince, d.fs.clock.Now().Nanoseconds())
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// insertChildLocked inserts child into d's children with the given name. If
+// d.fs.opts.hashIno is true, child's reported inode number is derived from its
+// path at this time; see filesystemOptions.hashIno.
+//
+// Preconditions: d.fs.renameMu must be locked. d.dirMu must be locked. child
+// must have been returned by d.fs.newDentry() and must not yet be reachable
+// by other goroutines.
+func (d *dentry) insertChildLocked(child *dentry, name string) {
+	d.vfsd.InsertChild(&child.vfsd, name)
+	if d.fs.opts.hashIno {
+		child.hashedIno = child.pathIno()
+	}
+}
+
+// pathIno returns an inode number for d derived from its path relative to
+// the filesystem root and its QID version.
+//
+// Preconditions: d.fs.renameMu must be locked.
+func (d *dentry) pathIno() uint64 {
+	var names []string
+	for vd := &d.vfsd; vd.Parent() != nil; vd = vd.Parent() {
+		names = append(names, vd.Name())
+	}
+	h := fnv.New64a()
+	for i := len(names) - 1; i >= 0; i-- {
+		h.Write([]byte{'/'})
+		h.Write([]byte(names[i]))
+	}
+	var version [4]byte
+	binary.LittleEndian.PutUint32(version[:], atomic.LoadUint32(&d.qidVersion))
+	h.Write(version[:])
+	if ino := h.Sum64(); ino != 0 {
+		return ino
+	}
+	// 0 means "no hashed inode number" to dentry.statIno().
+	return d.ino
+}
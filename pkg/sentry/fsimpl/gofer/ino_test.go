@@ -0,0 +1,119 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+)
+
+func TestRealIno(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	const (
+		qidPath = 0x0100000000000005
+		realIno = 5
+	)
+	for _, test := range []struct {
+		name    string
+		realIno bool
+		// serverIno is returned by GetIno; 0 means that GetIno is unsupported.
+		serverIno uint64
+		want      uint64
+	}{
+		{name: "disabled", serverIno: realIno, want: qidPath},
+		{name: "enabled", realIno: true, serverIno: realIno, want: realIno},
+		{name: "unsupported", realIno: true, want: qidPath},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := newTestFilesystem(ctx, filesystemOptions{realIno: test.realIno})
+			rootFile := &testP9File{
+				attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+				children: map[string]*testP9File{
+					"file": {
+						attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1},
+						qid:  p9.QID{Path: qidPath},
+						ino:  test.serverIno,
+					},
+				},
+			}
+			root := newTestRoot(ctx, t, fs, rootFile, nil)
+			defer root.DecRef()
+			pop := pathOp(root, "file")
+			stat, err := root.Mount().Filesystem().VirtualFilesystem().StatAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.StatOptions{Mask: linux.STATX_INO})
+			if err != nil {
+				t.Fatalf("StatAt(): %v", err)
+			}
+			if stat.Ino != test.want {
+				t.Errorf("got ino %#x, want %#x", stat.Ino, test.want)
+			}
+		})
+	}
+}
+
+func TestHashIno(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	// The server has recycled the QID path of a deleted file for another
+	// file, while the client still holds a dentry for the former.
+	const qidPath = 7
+	for _, test := range []struct {
+		name     string
+		hashIno  bool
+		wantSame bool
+	}{
+		{name: "qid", wantSame: true},
+		{name: "hash", hashIno: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := newTestFilesystem(ctx, filesystemOptions{hashIno: test.hashIno})
+			rootFile := &testP9File{
+				attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+				children: map[string]*testP9File{
+					"a": {
+						attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1},
+						qid:  p9.QID{Path: qidPath, Version: 1},
+					},
+					"b": {
+						attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1},
+						qid:  p9.QID{Path: qidPath, Version: 1},
+					},
+				},
+			}
+			root := newTestRoot(ctx, t, fs, rootFile, nil)
+			defer root.DecRef()
+			vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+			statIno := func(path string) uint64 {
+				t.Helper()
+				pop := pathOp(root, path)
+				stat, err := vfsObj.StatAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.StatOptions{Mask: linux.STATX_INO})
+				if err != nil {
+					t.Fatalf("StatAt(%q): %v", path, err)
+				}
+				return stat.Ino
+			}
+			inoA, inoB := statIno("a"), statIno("b")
+			if same := inoA == inoB; same != test.wantSame {
+				t.Errorf("got inode numbers %#x and %#x, want same: %t", inoA, inoB, test.wantSame)
+			}
+			if again := statIno("a"); again != inoA {
+				t.Errorf("inode number changed from %#x to %#x between stats", inoA, again)
+			}
+		})
+	}
+}
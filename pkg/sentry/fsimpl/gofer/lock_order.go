@@ -0,0 +1,194 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"sync"
+)
+
+// lockLevel is the position of a mutex in the lock order documented at the
+// top of gofer.go. A mutex may only be locked while holding mutexes at the
+// same or lower levels. Mutexes at the same level (e.g. filesystem.syncMu and
+// dentry.metadataMu, or dentry.dirMu in multiple dentries) are not ordered
+// with respect to each other by the lock order.
+type lockLevel int
+
+const (
+	lockLevelRename lockLevel = iota
+	lockLevelDir
+	lockLevelMetadata // also filesystem.syncMu
+	lockLevelMaps
+	lockLevelHandle
+	lockLevelData
+)
+
+// The following types wrap the mutexes covered by the lock order, so that
+// lock order violations are detected by lockOrderAcquire in race builds. In
+// other builds, they are equivalent to the wrapped mutexes.
+
+// renameMutex is the type of filesystem.renameMu.
+type renameMutex struct {
+	sync.RWMutex
+}
+
+// Lock locks m for writing.
+func (m *renameMutex) Lock() {
+	lockOrderAcquire(m, lockLevelRename, "filesystem.renameMu")
+	m.RWMutex.Lock()
+}
+
+// Unlock unlocks m for writing.
+func (m *renameMutex) Unlock() {
+	m.RWMutex.Unlock()
+	lockOrderRelease(m)
+}
+
+// RLock locks m for reading.
+func (m *renameMutex) RLock() {
+	lockOrderAcquire(m, lockLevelRename, "filesystem.renameMu")
+	m.RWMutex.RLock()
+}
+
+// RUnlock unlocks m for reading.
+func (m *renameMutex) RUnlock() {
+	m.RWMutex.RUnlock()
+	lockOrderRelease(m)
+}
+
+// dirMutex is the type of dentry.dirMu.
+type dirMutex struct {
+	sync.Mutex
+}
+
+// Lock locks m.
+func (m *dirMutex) Lock() {
+	lockOrderAcquire(m, lockLevelDir, "dentry.dirMu")
+	m.Mutex.Lock()
+}
+
+// Unlock unlocks m.
+func (m *dirMutex) Unlock() {
+	m.Mutex.Unlock()
+	lockOrderRelease(m)
+}
+
+// syncMutex is the type of filesystem.syncMu.
+type syncMutex struct {
+	sync.Mutex
+}
+
+// Lock locks m.
+func (m *syncMutex) Lock() {
+	lockOrderAcquire(m, lockLevelMetadata, "filesystem.syncMu")
+	m.Mutex.Lock()
+}
+
+// Unlock unlocks m.
+func (m *syncMutex) Unlock() {
+	m.Mutex.Unlock()
+	lockOrderRelease(m)
+}
+
+// metadataMutex is the type of dentry.metadataMu.
+type metadataMutex struct {
+	sync.Mutex
+}
+
+// Lock locks m.
+func (m *metadataMutex) Lock() {
+	lockOrderAcquire(m, lockLevelMetadata, "dentry.metadataMu")
+	m.Mutex.Lock()
+}
+
+// Unlock unlocks m.
+func (m *metadataMutex) Unlock() {
+	m.Mutex.Unlock()
+	lockOrderRelease(m)
+}
+
+// mapsMutex is the type of dentry.mapsMu.
+type mapsMutex struct {
+	sync.Mutex
+}
+
+// Lock locks m.
+func (m *mapsMutex) Lock() {
+	lockOrderAcquire(m, lockLevelMaps, "dentry.mapsMu")
+	m.Mutex.Lock()
+}
+
+// Unlock unlocks m.
+func (m *mapsMutex) Unlock() {
+	m.Mutex.Unlock()
+	lockOrderRelease(m)
+}
+
+// handleMutex is the type of dentry.handleMu.
+type handleMutex struct {
+	sync.RWMutex
+}
+
+// Lock locks m for writing.
+func (m *handleMutex) Lock() {
+	lockOrderAcquire(m, lockLevelHandle, "dentry.handleMu")
+	m.RWMutex.Lock()
+}
+
+// Unlock unlocks m for writing.
+func (m *handleMutex) Unlock() {
+	m.RWMutex.Unlock()
+	lockOrderRelease(m)
+}
+
+// RLock locks m for reading.
+func (m *handleMutex) RLock() {
+	lockOrderAcquire(m, lockLevelHandle, "dentry.handleMu")
+	m.RWMutex.RLock()
+}
+
+// RUnlock unlocks m for reading.
+func (m *handleMutex) RUnlock() {
+	m.RWMutex.RUnlock()
+	lockOrderRelease(m)
+}
+
+// dataMutex is the type of dentry.dataMu.
+type dataMutex struct {
+	sync.RWMutex
+}
+
+// Lock locks m for writing.
+func (m *dataMutex) Lock() {
+	lockOrderAcquire(m, lockLevelData, "dentry.dataMu")
+	m.RWMutex.Lock()
+}
+
+// Unlock unlocks m for writing.
+func (m *dataMutex) Unlock() {
+	m.RWMutex.Unlock()
+	lockOrderRelease(m)
+}
+
+// RLock locks m for reading.
+func (m *dataMutex) RLock() {
+	lockOrderAcquire(m, lockLevelData, "dentry.dataMu")
+	m.RWMutex.RLock()
+}
+
+// RUnlock unlocks m for reading.
+func (m *dataMutex) RUnlock() {
+	m.RWMutex.RUnlock()
+	lockOrderRelease(m)
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Only available in race builds, since goid is.
+// +build race
+
+package gofer
+
+import (
+	"fmt"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/goid"
+)
+
+// lockOrderChecking is true if lock order violations are detected.
+const lockOrderChecking = true
+
+// heldLock is a mutex held by a goroutine, as recorded by lockOrderAcquire.
+type heldLock struct {
+	m     interface{}
+	level lockLevel
+	name  string
+}
+
+// heldLocks maps the ID of each goroutine to the mutexes it holds, in the
+// order they were locked. heldLocks is protected by heldLocksMu.
+var (
+	heldLocksMu sync.Mutex
+	heldLocks   = make(map[int64][]heldLock)
+)
+
+// lockOrderAcquire is called before the calling goroutine locks m, which is
+// at the given level of the lock order. It panics if the goroutine holds a
+// mutex that follows m in the lock order.
+func lockOrderAcquire(m interface{}, level lockLevel, name string) {
+	id := goid.Get()
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+	for _, h := range heldLocks[id] {
+		if h.level > level {
+			panic(fmt.Sprintf("gofer: lock order violation: locking %s while holding %s", name, h.name))
+		}
+	}
+	heldLocks[id] = append(heldLocks[id], heldLock{m, level, name})
+}
+
+// lockOrderRelease is called after m is unlocked.
+func lockOrderRelease(m interface{}) {
+	id := goid.Get()
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+	if removeHeldLock(id, m) {
+		return
+	}
+	// m was locked by another goroutine, which handed it off to this one.
+	for otherID := range heldLocks {
+		if removeHeldLock(otherID, m) {
+			return
+		}
+	}
+}
+
+// removeHeldLock removes the most recently locked instance of m from the
+// mutexes held by goroutine id, and returns true if it did so.
+//
+// Preconditions: heldLocksMu must be locked.
+func removeHeldLock(id int64, m interface{}) bool {
+	held := heldLocks[id]
+	for i := len(held) - 1; i >= 0; i-- {
+		if held[i].m != m {
+			continue
+		}
+		held = append(held[:i], held[i+1:]...)
+		if len(held) == 0 {
+			delete(heldLocks, id)
+		} else {
+			heldLocks[id] = held
+		}
+		return true
+	}
+	return false
+}
@@ -15,6 +15,8 @@
 package gofer
 
 import (
+	"time"
+
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/fd"
 	"gvisor.dev/gvisor/pkg/p9"
@@ -23,83 +25,374 @@ import (
 
 // p9file is a wrapper around p9.File that provides methods that are
 // Context-aware.
+//
+// Most methods sleep uninterruptibly while waiting for the server. If the
+// "rpc_timeout_ns" mount option is set, the p9.Client bounds each such sleep
+// by flushing RPCs that the server does not respond to in time, which then
+// fail with ETIMEDOUT. If the "max_inflight_rpcs" mount option is set, methods
+// first wait, interruptibly, until fewer than that many RPCs are outstanding.
 type p9file struct {
 	file p9.File
+
+	// stats counts RPCs issued through this p9file, and is inherited by files
+	// walked to or created from it. If stats is nil, RPCs are only counted by
+	// sentry-wide metrics.
+	stats *rpcStats
+
+	// limiter bounds the number of concurrent RPCs issued through this p9file
+	// and all other p9files in the same filesystem, and is inherited by files
+	// walked to or created from it. If limiter is nil, RPCs are not limited.
+	limiter *rpcLimiter
 }
 
 func (f p9file) isNil() bool {
 	return f.file == nil
 }
 
+const (
+	// rpcRetries is the maximum number of times that an idempotent RPC is
+	// retried after failing with a transient error.
+	rpcRetries = 3
+
+	// rpcRetryMinBackoff is the delay before the first retry of an RPC, which
+	// doubles after each subsequent failure.
+	rpcRetryMinBackoff = time.Millisecond
+)
+
+// isTransientRPCError returns true if err, returned by an RPC, may not recur
+// if the RPC is retried; for example, if the connection to the server was
+// interrupted.
+func isTransientRPCError(err error) bool {
+	return err == syserror.EINTR || err == syserror.EAGAIN
+}
+
+// retryRPC calls rpc, and then retries it with exponential backoff while it
+// fails with a transient error, at most rpcRetries times. If ctx is cancelled
+// while waiting to retry, retryRPC returns the last error returned by rpc.
+// Retries are reported by reportRetries.
+//
+// rpc must be idempotent. RPCs for which EINTR or EAGAIN is a meaningful
+// result, such as reads and writes of non-blocking files, must not be retried.
+func retryRPC(ctx context.Context, rpc func() error) error {
+	var (
+		err     error
+		retries int
+	)
+	backoff := rpcRetryMinBackoff
+retry:
+	for {
+		err = rpc()
+		if err == nil || retries == rpcRetries || !isTransientRPCError(err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break retry
+		case <-time.After(backoff):
+		}
+		retries++
+		backoff *= 2
+	}
+	reportRetries(ctx, retries, err)
+	return err
+}
+
+// rpcLimiter bounds the number of concurrent RPCs issued by a filesystem, so
+// that bursts of file operations don't flood the server.
+type rpcLimiter struct {
+	// slots has a capacity equal to the maximum number of concurrent RPCs.
+	// Each in-flight RPC holds one element in slots.
+	slots chan struct{}
+}
+
+// newRPCLimiter returns an rpcLimiter that allows at most max concurrent RPCs.
+func newRPCLimiter(max int) *rpcLimiter {
+	return &rpcLimiter{
+		slots: make(chan struct{}, max),
+	}
+}
+
+// acquire blocks until an RPC may be issued. If l is nil, acquire returns
+// immediately. If ctx is interrupted or cancelled while waiting, acquire
+// returns ErrInterrupted. Each successful call to acquire must be balanced by
+// a call to release once the RPC completes.
+func (l *rpcLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	cancel := ctx.SleepStart()
+	select {
+	case l.slots <- struct{}{}:
+		ctx.SleepFinish(true)
+		return nil
+	case <-cancel:
+		ctx.SleepFinish(false)
+		return syserror.ErrInterrupted
+	case <-ctx.Done():
+		ctx.SleepFinish(true)
+		return syserror.ErrInterrupted
+	}
+}
+
+// acquireUninterruptible is equivalent to acquire, but can't be interrupted.
+// It is used for RPCs that must not fail, such as clunking fids, and for
+// reads, writes and syncs, whose callers (e.g. writeback and page cache
+// fills) can't handle ErrInterrupted.
+func (l *rpcLimiter) acquireUninterruptible(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	ctx.UninterruptibleSleepStart(false)
+	l.slots <- struct{}{}
+	ctx.UninterruptibleSleepFinish(false)
+}
+
+// release records the completion of an RPC permitted by a previous call to
+// acquire or acquireUninterruptible.
+func (l *rpcLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
 func (f p9file) walk(ctx context.Context, names []string) ([]p9.QID, p9file, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, p9file{}, err
+	}
+	defer f.limiter.release()
+	var (
+		qids    []p9.QID
+		newfile p9.File
+	)
 	ctx.UninterruptibleSleepStart(false)
-	qids, newfile, err := f.file.Walk(names)
+	err := retryRPC(ctx, func() (err error) {
+		f.stats.count(rpcWalk)
+		qids, newfile, err = f.file.Walk(names)
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
-	return qids, p9file{newfile}, err
+	return qids, p9file{newfile, f.stats, f.limiter}, err
 }
 
 func (f p9file) walkGetAttr(ctx context.Context, names []string) ([]p9.QID, p9file, p9.AttrMask, p9.Attr, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, p9file{}, p9.AttrMask{}, p9.Attr{}, err
+	}
+	defer f.limiter.release()
+	var (
+		qids     []p9.QID
+		newfile  p9.File
+		attrMask p9.AttrMask
+		attr     p9.Attr
+	)
 	ctx.UninterruptibleSleepStart(false)
-	qids, newfile, attrMask, attr, err := f.file.WalkGetAttr(names)
+	err := retryRPC(ctx, func() (err error) {
+		f.stats.count(rpcWalk)
+		qids, newfile, attrMask, attr, err = f.file.WalkGetAttr(names)
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
-	return qids, p9file{newfile}, attrMask, attr, err
+	return qids, p9file{newfile, f.stats, f.limiter}, attrMask, attr, err
 }
 
 // walkGetAttrOne is a wrapper around p9.File.WalkGetAttr that takes a single
 // path component and returns a single qid.
 func (f p9file) walkGetAttrOne(ctx context.Context, name string) (p9.QID, p9file, p9.AttrMask, p9.Attr, error) {
-	ctx.UninterruptibleSleepStart(false)
-	qids, newfile, attrMask, attr, err := f.file.WalkGetAttr([]string{name})
-	ctx.UninterruptibleSleepFinish(false)
+	qids, newfile, attrMask, attr, err := f.walkGetAttr(ctx, []string{name})
 	if err != nil {
 		return p9.QID{}, p9file{}, p9.AttrMask{}, p9.Attr{}, err
 	}
 	if len(qids) != 1 {
 		ctx.Warningf("p9.File.WalkGetAttr returned %d qids (%v), wanted 1", len(qids), qids)
-		if newfile != nil {
-			p9file{newfile}.close(ctx)
+		if !newfile.isNil() {
+			newfile.close(ctx)
 		}
 		return p9.QID{}, p9file{}, p9.AttrMask{}, p9.Attr{}, syserror.EIO
 	}
-	return qids[0], p9file{newfile}, attrMask, attr, nil
+	return qids[0], newfile, attrMask, attr, nil
+}
+
+// walkMultiple is a wrapper around p9.MultiWalker.MultiWalk that walks each
+// of names in a single RPC, returning a file and attributes for each name
+// walked. It returns ENOSYS if f does not implement p9.MultiWalker.
+func (f p9file) walkMultiple(ctx context.Context, names []string) ([]p9file, []p9.FullStat, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer f.limiter.release()
+	mw, ok := f.file.(p9.MultiWalker)
+	if !ok {
+		return nil, nil, syserror.ENOSYS
+	}
+	var (
+		newfiles []p9.File
+		stats    []p9.FullStat
+	)
+	ctx.UninterruptibleSleepStart(false)
+	err := retryRPC(ctx, func() (err error) {
+		f.stats.count(rpcWalk)
+		newfiles, stats, err = mw.MultiWalk(names)
+		return err
+	})
+	ctx.UninterruptibleSleepFinish(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]p9file, len(newfiles))
+	for i, newfile := range newfiles {
+		files[i] = p9file{newfile, f.stats, f.limiter}
+	}
+	return files, stats, nil
 }
 
 func (f p9file) statFS(ctx context.Context) (p9.FSStat, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return p9.FSStat{}, err
+	}
+	defer f.limiter.release()
+	var fsstat p9.FSStat
 	ctx.UninterruptibleSleepStart(false)
-	fsstat, err := f.file.StatFS()
+	err := retryRPC(ctx, func() (err error) {
+		fsstat, err = f.file.StatFS()
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
 	return fsstat, err
 }
 
 func (f p9file) getAttr(ctx context.Context, req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return p9.QID{}, p9.AttrMask{}, p9.Attr{}, err
+	}
+	defer f.limiter.release()
+	var (
+		qid      p9.QID
+		attrMask p9.AttrMask
+		attr     p9.Attr
+	)
 	ctx.UninterruptibleSleepStart(false)
-	qid, attrMask, attr, err := f.file.GetAttr(req)
+	err := retryRPC(ctx, func() (err error) {
+		f.stats.count(rpcGetAttr)
+		qid, attrMask, attr, err = f.file.GetAttr(req)
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
 	return qid, attrMask, attr, err
 }
 
+func (f p9file) getAttrChildren(ctx context.Context, names []string, req p9.AttrMask) ([]p9.FullStat, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer f.limiter.release()
+	var stats []p9.FullStat
+	ctx.UninterruptibleSleepStart(false)
+	err := retryRPC(ctx, func() (err error) {
+		f.stats.count(rpcGetAttr)
+		stats, err = f.file.GetAttrChildren(names, req)
+		return err
+	})
+	ctx.UninterruptibleSleepFinish(false)
+	return stats, err
+}
+
 func (f p9file) setAttr(ctx context.Context, valid p9.SetAttrMask, attr p9.SetAttr) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
+	f.stats.count(rpcSetAttr)
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.SetAttr(valid, attr)
 	ctx.UninterruptibleSleepFinish(false)
 	return err
 }
 
+func (f p9file) getIno(ctx context.Context) (uint64, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer f.limiter.release()
+	var ino uint64
+	ctx.UninterruptibleSleepStart(false)
+	err := retryRPC(ctx, func() (err error) {
+		f.stats.count(rpcGetAttr)
+		ino, err = f.file.GetIno()
+		return err
+	})
+	ctx.UninterruptibleSleepFinish(false)
+	return ino, err
+}
+
+func (f p9file) getFlags(ctx context.Context) (uint32, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer f.limiter.release()
+	var flags uint32
+	ctx.UninterruptibleSleepStart(false)
+	err := retryRPC(ctx, func() (err error) {
+		f.stats.count(rpcGetAttr)
+		flags, err = f.file.GetFlags()
+		return err
+	})
+	ctx.UninterruptibleSleepFinish(false)
+	return flags, err
+}
+
+func (f p9file) setFlags(ctx context.Context, flags uint32) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
+	f.stats.count(rpcSetAttr)
+	ctx.UninterruptibleSleepStart(false)
+	err := f.file.SetFlags(flags)
+	ctx.UninterruptibleSleepFinish(false)
+	return err
+}
+
 func (f p9file) listXattr(ctx context.Context, size uint64) (map[string]struct{}, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer f.limiter.release()
+	var xattrs map[string]struct{}
 	ctx.UninterruptibleSleepStart(false)
-	xattrs, err := f.file.ListXattr(size)
+	err := retryRPC(ctx, func() (err error) {
+		xattrs, err = f.file.ListXattr(size)
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
 	return xattrs, err
 }
 
 func (f p9file) getXattr(ctx context.Context, name string, size uint64) (string, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer f.limiter.release()
+	var val string
 	ctx.UninterruptibleSleepStart(false)
-	val, err := f.file.GetXattr(name, size)
+	err := retryRPC(ctx, func() (err error) {
+		val, err = f.file.GetXattr(name, size)
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
 	return val, err
 }
 
 func (f p9file) setXattr(ctx context.Context, name, value string, flags uint32) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.SetXattr(name, value, flags)
 	ctx.UninterruptibleSleepFinish(false)
@@ -107,6 +400,10 @@ func (f p9file) setXattr(ctx context.Context, name, value string, flags uint32)
 }
 
 func (f p9file) removeXattr(ctx context.Context, name string) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.RemoveXattr(name)
 	ctx.UninterruptibleSleepFinish(false)
@@ -114,13 +411,52 @@ func (f p9file) removeXattr(ctx context.Context, name string) error {
 }
 
 func (f p9file) allocate(ctx context.Context, mode p9.AllocateMode, offset, length uint64) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.Allocate(mode, offset, length)
 	ctx.UninterruptibleSleepFinish(false)
 	return err
 }
 
+func (f p9file) copyRange(ctx context.Context, offset uint64, dst p9file, dstOffset, length uint64) (uint64, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer f.limiter.release()
+	ctx.UninterruptibleSleepStart(false)
+	n, err := f.file.CopyRange(offset, dst.file, dstOffset, length)
+	ctx.UninterruptibleSleepFinish(false)
+	return n, err
+}
+
+func (f p9file) cloneRange(ctx context.Context, offset uint64, dst p9file, dstOffset, length uint64) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
+	ctx.UninterruptibleSleepStart(false)
+	err := f.file.CloneRange(offset, dst.file, dstOffset, length)
+	ctx.UninterruptibleSleepFinish(false)
+	return err
+}
+
+func (f p9file) seek(ctx context.Context, offset uint64, whence p9.SeekWhence) (uint64, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer f.limiter.release()
+	ctx.UninterruptibleSleepStart(false)
+	off, err := f.file.Seek(offset, whence)
+	ctx.UninterruptibleSleepFinish(false)
+	return off, err
+}
+
 func (f p9file) close(ctx context.Context) error {
+	f.limiter.acquireUninterruptible(ctx)
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.Close()
 	ctx.UninterruptibleSleepFinish(false)
@@ -128,6 +464,11 @@ func (f p9file) close(ctx context.Context) error {
 }
 
 func (f p9file) open(ctx context.Context, flags p9.OpenFlags) (*fd.FD, p9.QID, uint32, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, p9.QID{}, 0, err
+	}
+	defer f.limiter.release()
+	f.stats.count(rpcOpen)
 	ctx.UninterruptibleSleepStart(false)
 	fdobj, qid, iounit, err := f.file.Open(flags)
 	ctx.UninterruptibleSleepFinish(false)
@@ -135,6 +476,9 @@ func (f p9file) open(ctx context.Context, flags p9.OpenFlags) (*fd.FD, p9.QID, u
 }
 
 func (f p9file) readAt(ctx context.Context, p []byte, offset uint64) (int, error) {
+	f.limiter.acquireUninterruptible(ctx)
+	defer f.limiter.release()
+	f.stats.count(rpcRead)
 	ctx.UninterruptibleSleepStart(false)
 	n, err := f.file.ReadAt(p, offset)
 	ctx.UninterruptibleSleepFinish(false)
@@ -142,27 +486,99 @@ func (f p9file) readAt(ctx context.Context, p []byte, offset uint64) (int, error
 }
 
 func (f p9file) writeAt(ctx context.Context, p []byte, offset uint64) (int, error) {
+	f.limiter.acquireUninterruptible(ctx)
+	defer f.limiter.release()
+	f.stats.count(rpcWrite)
 	ctx.UninterruptibleSleepStart(false)
 	n, err := f.file.WriteAt(p, offset)
 	ctx.UninterruptibleSleepFinish(false)
 	return n, err
 }
 
+// readAtInterruptible is like readAt, but if ctx is interrupted while waiting
+// for the server, the read is cancelled. If the server confirms that it didn't
+// perform the read, readAtInterruptible returns ErrInterrupted along with the
+// number of bytes read before the interruption; otherwise, the read's result
+// is returned as usual.
+func (f p9file) readAtInterruptible(ctx context.Context, p []byte, offset uint64) (int, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer f.limiter.release()
+	f.stats.count(rpcRead)
+	cf, ok := f.file.(p9.CancellableFile)
+	if !ok {
+		ctx.UninterruptibleSleepStart(false)
+		n, err := f.file.ReadAt(p, offset)
+		ctx.UninterruptibleSleepFinish(false)
+		return n, err
+	}
+	n, err := cf.ReadAtCancellable(p, offset, ctx.SleepStart())
+	ctx.SleepFinish(err != syserror.EINTR)
+	if err == syserror.EINTR {
+		return n, syserror.ErrInterrupted
+	}
+	return n, err
+}
+
+// writeAtInterruptible is like writeAt, but interruptible in the same way as
+// readAtInterruptible.
+func (f p9file) writeAtInterruptible(ctx context.Context, p []byte, offset uint64) (int, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer f.limiter.release()
+	f.stats.count(rpcWrite)
+	cf, ok := f.file.(p9.CancellableFile)
+	if !ok {
+		ctx.UninterruptibleSleepStart(false)
+		n, err := f.file.WriteAt(p, offset)
+		ctx.UninterruptibleSleepFinish(false)
+		return n, err
+	}
+	n, err := cf.WriteAtCancellable(p, offset, ctx.SleepStart())
+	ctx.SleepFinish(err != syserror.EINTR)
+	if err == syserror.EINTR {
+		return n, syserror.ErrInterrupted
+	}
+	return n, err
+}
+
 func (f p9file) fsync(ctx context.Context) error {
+	f.limiter.acquireUninterruptible(ctx)
+	defer f.limiter.release()
+	ctx.UninterruptibleSleepStart(false)
+	err := retryRPC(ctx, f.file.FSync)
+	ctx.UninterruptibleSleepFinish(false)
+	return err
+}
+
+func (f p9file) fdatasync(ctx context.Context) error {
+	f.limiter.acquireUninterruptible(ctx)
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
-	err := f.file.FSync()
+	err := retryRPC(ctx, f.file.FDataSync)
 	ctx.UninterruptibleSleepFinish(false)
 	return err
 }
 
 func (f p9file) create(ctx context.Context, name string, flags p9.OpenFlags, permissions p9.FileMode, uid p9.UID, gid p9.GID) (*fd.FD, p9file, p9.QID, uint32, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, p9file{}, p9.QID{}, 0, err
+	}
+	defer f.limiter.release()
+	f.stats.count(rpcOpen)
 	ctx.UninterruptibleSleepStart(false)
 	fdobj, newfile, qid, iounit, err := f.file.Create(name, flags, permissions, uid, gid)
 	ctx.UninterruptibleSleepFinish(false)
-	return fdobj, p9file{newfile}, qid, iounit, err
+	return fdobj, p9file{newfile, f.stats, f.limiter}, qid, iounit, err
 }
 
 func (f p9file) mkdir(ctx context.Context, name string, permissions p9.FileMode, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return p9.QID{}, err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	qid, err := f.file.Mkdir(name, permissions, uid, gid)
 	ctx.UninterruptibleSleepFinish(false)
@@ -170,6 +586,10 @@ func (f p9file) mkdir(ctx context.Context, name string, permissions p9.FileMode,
 }
 
 func (f p9file) symlink(ctx context.Context, oldName string, newName string, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return p9.QID{}, err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	qid, err := f.file.Symlink(oldName, newName, uid, gid)
 	ctx.UninterruptibleSleepFinish(false)
@@ -177,6 +597,10 @@ func (f p9file) symlink(ctx context.Context, oldName string, newName string, uid
 }
 
 func (f p9file) link(ctx context.Context, target p9file, newName string) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.Link(target.file, newName)
 	ctx.UninterruptibleSleepFinish(false)
@@ -184,6 +608,10 @@ func (f p9file) link(ctx context.Context, target p9file, newName string) error {
 }
 
 func (f p9file) mknod(ctx context.Context, name string, mode p9.FileMode, major uint32, minor uint32, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return p9.QID{}, err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	qid, err := f.file.Mknod(name, mode, major, minor, uid, gid)
 	ctx.UninterruptibleSleepFinish(false)
@@ -191,13 +619,32 @@ func (f p9file) mknod(ctx context.Context, name string, mode p9.FileMode, major
 }
 
 func (f p9file) rename(ctx context.Context, newDir p9file, newName string) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.Rename(newDir.file, newName)
 	ctx.UninterruptibleSleepFinish(false)
 	return err
 }
 
+func (f p9file) renameAt2(ctx context.Context, oldName string, newDir p9file, newName string, flags uint32) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
+	ctx.UninterruptibleSleepStart(false)
+	err := f.file.RenameAt2(oldName, newDir.file, newName, flags)
+	ctx.UninterruptibleSleepFinish(false)
+	return err
+}
+
 func (f p9file) unlinkAt(ctx context.Context, name string, flags uint32) error {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	err := f.file.UnlinkAt(name, flags)
 	ctx.UninterruptibleSleepFinish(false)
@@ -205,15 +652,31 @@ func (f p9file) unlinkAt(ctx context.Context, name string, flags uint32) error {
 }
 
 func (f p9file) readdir(ctx context.Context, offset uint64, count uint32) ([]p9.Dirent, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer f.limiter.release()
+	var dirents []p9.Dirent
 	ctx.UninterruptibleSleepStart(false)
-	dirents, err := f.file.Readdir(offset, count)
+	err := retryRPC(ctx, func() (err error) {
+		dirents, err = f.file.Readdir(offset, count)
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
 	return dirents, err
 }
 
 func (f p9file) readlink(ctx context.Context) (string, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer f.limiter.release()
+	var target string
 	ctx.UninterruptibleSleepStart(false)
-	target, err := f.file.Readlink()
+	err := retryRPC(ctx, func() (err error) {
+		target, err = f.file.Readlink()
+		return err
+	})
 	ctx.UninterruptibleSleepFinish(false)
 	return target, err
 }
@@ -226,6 +689,10 @@ func (f p9file) flush(ctx context.Context) error {
 }
 
 func (f p9file) connect(ctx context.Context, flags p9.ConnectFlags) (*fd.FD, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer f.limiter.release()
 	ctx.UninterruptibleSleepStart(false)
 	fdobj, err := f.file.Connect(flags)
 	ctx.UninterruptibleSleepFinish(false)
@@ -0,0 +1,266 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestNegotiatedMessageSize(t *testing.T) {
+	ctx := contexttest.Context(t)
+	// The p9 server supports messages of at most 1 MB, so a request for 4 MB
+	// is reduced.
+	const (
+		requested  = 4 << 20
+		negotiated = 1 << 20
+	)
+	data := make([]byte, 2*negotiated)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, Size: uint64(len(data)), NLink: 1}, data: data},
+		},
+	}
+	addr, _ := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, fmt.Sprintf("trans=unix,addr=%s,msize=%d", addr, requested))
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+	if fs.opts.msize != negotiated {
+		t.Errorf("got msize %d, want %d", fs.opts.msize, negotiated)
+	}
+
+	// Reads larger than the negotiated message size are split into multiple
+	// RPCs.
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY|linux.O_DIRECT)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDONLY|O_DIRECT): %v", err)
+	}
+	defer fd.DecRef()
+	buf := make([]byte, len(data))
+	n, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{})
+	if err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	if int(n) != len(data) || !bytes.Equal(buf, data) {
+		t.Errorf("PRead(): got %d bytes that differ from the file's data", n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := contexttest.Context(t)
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, Size: usermem.PageSize, NLink: 1}, data: make([]byte, usermem.PageSize)},
+		},
+	}
+	addr, _ := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr)
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+
+	// Mounting gets the root's attributes.
+	want := Stats{GetAttrs: 1}
+	if got := fs.Stats(); got != want {
+		t.Fatalf("after mount: got %+v, want %+v", got, want)
+	}
+
+	// Opening a file walks to it, then clones and opens its fid.
+	fd, err := openAt(ctx, root, "file", linux.O_RDWR|linux.O_DIRECT)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDWR|O_DIRECT): %v", err)
+	}
+	defer fd.DecRef()
+	want.Walks += 2
+	want.Opens++
+	if got := fs.Stats(); got != want {
+		t.Fatalf("after open: got %+v, want %+v", got, want)
+	}
+
+	// O_DIRECT reads and writes of a single page each issue one RPC.
+	buf := make([]byte, usermem.PageSize)
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	want.Reads++
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(buf), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(): %v", err)
+	}
+	want.Writes++
+	if got := fs.Stats(); got != want {
+		t.Fatalf("after read and write: got %+v, want %+v", got, want)
+	}
+
+	// Changing the file's mode sets its attributes.
+	if err := fd.SetStat(ctx, vfs.SetStatOptions{Stat: linux.Statx{Mask: linux.STATX_MODE, Mode: 0600}}); err != nil {
+		t.Fatalf("SetStat(): %v", err)
+	}
+	want.SetAttrs++
+	if got := fs.Stats(); got != want {
+		t.Fatalf("after setattr: got %+v, want %+v", got, want)
+	}
+}
+
+// slowP9File is a testP9File whose GetAttr is slow, and which records the
+// maximum number of concurrent calls to GetAttr on all slowP9Files sharing
+// the same counters.
+type slowP9File struct {
+	*testP9File
+
+	// inflight and maxInflight are accessed using atomic memory operations.
+	inflight    *int32
+	maxInflight *int32
+}
+
+// GetAttr implements p9.File.GetAttr.
+func (f slowP9File) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	n := atomic.AddInt32(f.inflight, 1)
+	defer atomic.AddInt32(f.inflight, -1)
+	for {
+		max := atomic.LoadInt32(f.maxInflight)
+		if n <= max || atomic.CompareAndSwapInt32(f.maxInflight, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return p9.QID{}, p9.AttrMask{Mode: true}, p9.Attr{Mode: p9.ModeRegular | 0644}, nil
+}
+
+func TestMaxInflightRPCs(t *testing.T) {
+	const (
+		maxInflight = 2
+		callers     = 4 * maxInflight
+	)
+	var inflight, maxSeen int32
+	limiter := newRPCLimiter(maxInflight)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each file has its own testP9File, but all share limiter, as for
+			// files in the same filesystem.
+			f := p9file{file: slowP9File{&testP9File{}, &inflight, &maxSeen}, limiter: limiter}
+			if _, _, _, err := f.getAttr(context.Background(), p9.AttrMask{Mode: true}); err != nil {
+				t.Errorf("getAttr(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxSeen > maxInflight {
+		t.Errorf("got %d concurrent RPCs, want at most %d", maxSeen, maxInflight)
+	}
+	if maxSeen == 0 {
+		t.Errorf("no RPCs were issued")
+	}
+
+	// While all slots are held, further RPCs wait, and fail if their context
+	// is cancelled.
+	ctx := contexttest.Context(t)
+	for i := 0; i < maxInflight; i++ {
+		if err := limiter.acquire(ctx); err != nil {
+			t.Fatalf("acquire(): %v", err)
+		}
+	}
+	cctx := &cancellableContext{Context: ctx, done: make(chan struct{})}
+	errCh := make(chan error, 1)
+	go func() {
+		f := p9file{file: slowP9File{&testP9File{}, &inflight, &maxSeen}, limiter: limiter}
+		_, _, _, err := f.getAttr(cctx, p9.AttrMask{Mode: true})
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("getAttr() returned %v while all RPC slots were held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(cctx.done)
+	if err := <-errCh; err != syserror.ErrInterrupted {
+		t.Errorf("getAttr() after cancellation: got err %v, want %v", err, syserror.ErrInterrupted)
+	}
+
+	// Data RPCs, which may be issued by writeback, wait for a slot even if
+	// their context is cancelled.
+	go func() {
+		f := p9file{file: &testP9File{data: []byte("foo")}, limiter: limiter}
+		_, err := f.readAt(cctx, make([]byte, 3), 0)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("readAt() returned %v while all RPC slots were held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	limiter.release()
+	if err := <-errCh; err != nil {
+		t.Errorf("readAt() with cancelled context: got err %v, want nil", err)
+	}
+	for i := 1; i < maxInflight; i++ {
+		limiter.release()
+	}
+}
+
+func TestSpecialFileFDHandleRPCs(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		interop:                      InteropModeExclusive,
+		regularFilesUseSpecialFileFD: true,
+	})
+	fs.stats = &rpcStats{}
+	file := &testP9File{}
+	d, err := fs.newDentry(ctx, p9file{file: file, stats: fs.stats}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeRegular | 0644})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+
+	// Each FD on a regular file with cache=none has a distinct handle, which
+	// requires both a walk (to clone the dentry's fid) and an open, since
+	// each fid can only be opened once.
+	const numFDs = 3
+	for i := 0; i < numFDs; i++ {
+		fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+		if err != nil {
+			t.Fatalf("OpenAt(O_RDONLY): %v", err)
+		}
+		if _, ok := fd.Impl().(*specialFileFD); !ok {
+			t.Fatalf("OpenAt(O_RDONLY): got %T, want *specialFileFD", fd.Impl())
+		}
+		defer fd.DecRef()
+	}
+	stats := fs.Stats()
+	if stats.Walks != numFDs {
+		t.Errorf("got %d walks, want %d", stats.Walks, numFDs)
+	}
+	if stats.Opens != numFDs || file.opens != numFDs {
+		t.Errorf("got %d opens (%d on the server), want %d", stats.Opens, file.opens, numFDs)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/fs/fsutil"
+)
+
+// startPageCacheReclaim starts fs' page cache reclaimer, which releases
+// cached pages once fs.cachedBytes exceeds fs.opts.pageCacheLimit.
+//
+// Preconditions: fs.opts.pageCacheLimit != 0. startPageCacheReclaim has not
+// been called previously.
+func (fs *filesystem) startPageCacheReclaim() {
+	fs.pageCacheWake = make(chan struct{}, 1)
+	fs.pageCacheStop = make(chan struct{})
+	fs.pageCacheDone = make(chan struct{})
+	go fs.pageCacheReclaimWorker() // S/R-SAFE: stopped by fs.Release().
+}
+
+// stopPageCacheReclaim stops fs' page cache reclaimer, if one was started, and
+// waits for it to exit.
+func (fs *filesystem) stopPageCacheReclaim() {
+	if fs.pageCacheStop == nil {
+		return
+	}
+	close(fs.pageCacheStop)
+	<-fs.pageCacheDone
+}
+
+// queuePageCacheReclaim wakes fs' page cache reclaimer, if one was started.
+func (fs *filesystem) queuePageCacheReclaim() {
+	select {
+	case fs.pageCacheWake <- struct{}{}:
+	default:
+		// The reclaimer has already been woken, or was never started.
+	}
+}
+
+func (fs *filesystem) pageCacheReclaimWorker() {
+	defer close(fs.pageCacheDone)
+	ctx := context.Background()
+	for {
+		select {
+		case <-fs.pageCacheStop:
+			return
+		case <-fs.pageCacheWake:
+		}
+		fs.reclaimPageCache(ctx)
+	}
+}
+
+// reclaimPageCache releases cached pages from fs' dentries, starting with the
+// least recently used, until fs.cachedBytes no longer exceeds
+// fs.opts.pageCacheLimit. Dirty pages are written back before being released.
+// Pages that are memory-mapped are retained.
+func (fs *filesystem) reclaimPageCache(ctx context.Context) {
+	limit := int64(fs.opts.pageCacheLimit)
+	if atomic.LoadInt64(&fs.cachedBytes) <= limit {
+		return
+	}
+
+	type victim struct {
+		d       *dentry
+		lastUse uint64
+	}
+	var victims []victim
+	// Holding fs.renameMu prevents dentries from being destroyed, which
+	// allows us to take references on dentries with no references.
+	fs.renameMu.RLock()
+	fs.syncMu.Lock()
+	for d := range fs.dentries {
+		if atomic.LoadInt64(&d.cachedBytes) == 0 {
+			continue
+		}
+		d.IncRef()
+		victims = append(victims, victim{d, atomic.LoadUint64(&d.cacheLastUse)})
+	}
+	fs.syncMu.Unlock()
+	fs.renameMu.RUnlock()
+
+	sort.Slice(victims, func(i, j int) bool {
+		return victims[i].lastUse < victims[j].lastUse
+	})
+	for _, v := range victims {
+		if atomic.LoadInt64(&fs.cachedBytes) > limit {
+			v.d.reclaimCachedPages(ctx)
+		}
+		v.d.DecRef()
+	}
+}
+
+// reclaimCachedPages writes back d's dirty cached pages, then releases all of
+// its cached pages that are not memory-mapped.
+func (d *dentry) reclaimCachedPages(ctx context.Context) {
+	d.mapsMu.Lock()
+	defer d.mapsMu.Unlock()
+	d.handleMu.RLock()
+	defer d.handleMu.RUnlock()
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	mf := d.fs.mfp.MemoryFile()
+	if d.handleWritable && !d.dirty.IsEmpty() {
+		if err := fsutil.SyncDirtyAll(ctx, &d.cache, &d.dirty, d.size, mf, d.handle.writeFromBlocksAt); err != nil {
+			log.Warningf("gofer.dentry.reclaimCachedPages: failed to write dirty data back: %v", err)
+			d.recordWritebackErrLocked(err)
+		}
+	}
+	d.dropCleanPagesLocked(mf)
+	d.updateCachedBytesLocked()
+}
+
+// touchPageCache marks d's cached pages as the most recently used in
+// d.fs.
+func (d *dentry) touchPageCache() {
+	if d.fs.opts.pageCacheLimit == 0 {
+		return
+	}
+	atomic.StoreUint64(&d.cacheLastUse, atomic.AddUint64(&d.fs.cacheUses, 1))
+}
+
+// updateCachedBytesLocked updates d.cachedBytes and d.fs.cachedBytes to
+// account for changes to d.cache. If d.fs.opts.pageCacheLimit is exceeded as a
+// result, the page cache reclaimer is woken. Cached bytes are only tracked if
+// d.fs.opts.pageCacheLimit != 0.
+//
+// Preconditions: d.dataMu must be locked.
+func (d *dentry) updateCachedBytesLocked() {
+	limit := d.fs.opts.pageCacheLimit
+	if limit == 0 {
+		return
+	}
+	n := int64(d.cache.Span())
+	delta := n - d.cachedBytes
+	if delta == 0 {
+		return
+	}
+	atomic.StoreInt64(&d.cachedBytes, n)
+	total := atomic.AddInt64(&d.fs.cachedBytes, delta)
+	if delta > 0 {
+		d.touchPageCache()
+		if total > int64(limit) {
+			d.fs.queuePageCacheReclaim()
+		}
+	}
+}
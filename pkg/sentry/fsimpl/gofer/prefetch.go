@@ -0,0 +1,85 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/fspath"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// PrefetchProgress is called by Prefetch after it attempts to resolve each
+// path. err is the error that resolution failed with, or nil if it succeeded.
+type PrefetchProgress func(path string, err error)
+
+// Prefetch resolves each of the given paths, relative to root, so that the
+// dentries representing them and their ancestors are cached, avoiding remote
+// lookups on their first use. Symbolic links are not followed, and
+// permissions are not checked. Failure to resolve a path does not prevent
+// resolution of subsequent paths. If progress is not nil, it is called once
+// for each resolved path, in order.
+//
+// If ctx is cancelled, Prefetch returns ctx.Err() without resolving the
+// remaining paths. Dentries resolved before cancellation remain cached.
+//
+// Preconditions: root must be a dentry in a gofer filesystem.
+func Prefetch(ctx context.Context, root *vfs.Dentry, paths []string, progress PrefetchProgress) error {
+	d := root.Impl().(*dentry)
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := d.fs.prefetch(ctx, d, path)
+		if progress != nil {
+			progress(path, err)
+		}
+	}
+	return nil
+}
+
+// prefetch resolves path relative to root.
+func (fs *filesystem) prefetch(ctx context.Context, root *dentry, path string) error {
+	var ds *[]*dentry
+	fs.renameMu.RLock()
+	defer fs.renameMuRUnlockAndCheckCaching(&ds)
+
+	d := root
+	for it := fspath.Parse(path).Begin; it.Ok(); it = it.Next() {
+		if !d.isDir() {
+			return syserror.ENOTDIR
+		}
+		switch name := it.String(); name {
+		case ".":
+		case "..":
+			// Don't escape root.
+			if d != root {
+				d = d.vfsd.Parent().Impl().(*dentry)
+			}
+		default:
+			d.dirMu.Lock()
+			child, err := fs.revalidateChildLocked(ctx, fs.vfsfs.VirtualFilesystem(), d, name, d.vfsd.Child(name), &ds)
+			d.dirMu.Unlock()
+			if err != nil {
+				return err
+			}
+			if child == nil {
+				return syserror.ENOENT
+			}
+			d = child
+		}
+	}
+	return nil
+}
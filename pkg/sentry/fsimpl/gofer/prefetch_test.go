@@ -0,0 +1,146 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	gocontext "context"
+	"reflect"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestPrefetchCancel(t *testing.T) {
+	ctx := &cancellableContext{
+		Context: contexttest.Context(t),
+		done:    make(chan struct{}),
+	}
+	fs := newTestFilesystem(ctx, filesystemOptions{maxCachedDentries: 10})
+	rootFile := &testP9File{children: make(map[string]*testP9File)}
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		rootFile.children[name] = &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0644}}
+	}
+	root := newTestRoot(ctx, t, fs, rootFile, nil)
+	defer root.DecRef()
+
+	// Cancel the prefetch after the second path is resolved.
+	const cancelAfter = 2
+	var resolved []string
+	err := Prefetch(ctx, root.Dentry(), names, func(path string, err error) {
+		if err != nil {
+			t.Errorf("Prefetch(): resolving %q: %v", path, err)
+		}
+		resolved = append(resolved, path)
+		if len(resolved) == cancelAfter {
+			close(ctx.done)
+		}
+	})
+	if err != gocontext.Canceled {
+		t.Errorf("Prefetch(): got err %v, want %v", err, gocontext.Canceled)
+	}
+	if want := names[:cancelAfter]; !reflect.DeepEqual(resolved, want) {
+		t.Errorf("Prefetch(): progress called for %v, want %v", resolved, want)
+	}
+	for i, name := range names {
+		childVFSD := root.Dentry().Child(name)
+		if i >= cancelAfter {
+			if childVFSD != nil {
+				t.Errorf("%q was resolved after cancellation", name)
+			}
+			continue
+		}
+		if childVFSD == nil {
+			t.Errorf("%q was not resolved", name)
+			continue
+		}
+		if !childVFSD.Impl().(*dentry).cached {
+			t.Errorf("%q was resolved but not cached", name)
+		}
+	}
+}
+
+func TestPrefetchSmallFiles(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const threshold = 4 * usermem.PageSize
+	for _, test := range []struct {
+		desc      string
+		size      uint64
+		wantReads int // reads issued by opening the file
+	}{
+		{
+			desc:      "small",
+			size:      2*usermem.PageSize + 1,
+			wantReads: 1,
+		},
+		{
+			desc: "large",
+			size: threshold,
+		},
+	} {
+		fs := newTestFilesystem(ctx, filesystemOptions{prefetchSmallFiles: threshold})
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		file := &testP9File{data: append([]byte(nil), data...)}
+		d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0644, Size: test.size})
+		if err != nil {
+			t.Fatalf("%s: fs.newDentry(): %v", test.desc, err)
+		}
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"f": d})
+		fd, err := openAt(ctx, root, "f", linux.O_RDONLY)
+		if err != nil {
+			t.Fatalf("%s: OpenAt(f): %v", test.desc, err)
+		}
+		file.dataMu.Lock()
+		reads := file.reads
+		file.dataMu.Unlock()
+		if reads != test.wantReads {
+			t.Errorf("%s: opening the file issued %d reads to the server, want %d", test.desc, reads, test.wantReads)
+		}
+
+		// Read the file one page at a time; if it was prefetched, this must
+		// not require more reads from the server.
+		buf := make([]byte, test.size)
+		for off := uint64(0); off < test.size; off += usermem.PageSize {
+			end := off + usermem.PageSize
+			if end > test.size {
+				end = test.size
+			}
+			if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf[off:end]), int64(off), vfs.ReadOptions{}); err != nil {
+				t.Fatalf("%s: PRead(%d, %d): %v", test.desc, off, end-off, err)
+			}
+		}
+		if !bytes.Equal(buf, data) {
+			t.Errorf("%s: read data that differs from the file's data", test.desc)
+		}
+		if test.wantReads != 0 {
+			file.dataMu.Lock()
+			if file.reads != reads {
+				t.Errorf("%s: reading the prefetched file issued %d reads to the server, want 0", test.desc, file.reads-reads)
+			}
+			file.dataMu.Unlock()
+		}
+
+		fd.DecRef()
+		root.DecRef()
+	}
+}
@@ -0,0 +1,605 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/fd"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/unet"
+)
+
+const (
+	// reconnectAttempts is the maximum number of consecutive attempts the
+	// reconnect worker makes to re-establish a lost connection before giving
+	// up, leaving the filesystem permanently disconnected.
+	reconnectAttempts = 10
+
+	// reconnectMinBackoff and reconnectMaxBackoff bound the delay between
+	// reconnection attempts, which doubles after each failed attempt.
+	reconnectMinBackoff = 10 * time.Millisecond
+	reconnectMaxBackoff = time.Second
+)
+
+// errReconnectStopped is returned by filesystem.reconnect() if the reconnect
+// worker is stopped before a connection is re-established.
+var errReconnectStopped = errors.New("reconnect worker stopped")
+
+// startReconnect starts fs' reconnect worker, which re-establishes fs'
+// connection to the server after fs.client observes that it has been lost.
+//
+// Preconditions: fs.opts.reconnect is true. fs' reconnect worker is not
+// running.
+func (fs *filesystem) startReconnect() {
+	fs.reconnectStop = make(chan struct{})
+	fs.reconnectDone = make(chan struct{})
+	go fs.reconnectWorker() // S/R-SAFE: stopped by fs.Release().
+}
+
+// stopReconnect stops fs' reconnect worker, if one was started, and waits
+// for it to exit.
+func (fs *filesystem) stopReconnect() {
+	if fs.reconnectStop == nil {
+		return
+	}
+	close(fs.reconnectStop)
+	<-fs.reconnectDone
+	fs.reconnectStop = nil
+	fs.reconnectDone = nil
+}
+
+func (fs *filesystem) reconnectWorker() {
+	defer close(fs.reconnectDone)
+	ctx := context.Background()
+	for {
+		// fs.client is only replaced by this goroutine, so it can be read
+		// without locking fs.renameMu.
+		select {
+		case <-fs.reconnectStop:
+			return
+		case <-fs.client.Disconnected():
+		}
+		if err := fs.reconnect(ctx); err != nil {
+			if err != errReconnectStopped {
+				log.Warningf("gofer.filesystem.reconnectWorker: failed to reconnect to %q, giving up: %v", fs.opts.addr, err)
+			}
+			return
+		}
+	}
+}
+
+// reconnect replaces fs.client with a new connection to the server, and
+// rebuilds the remote files of all of fs' dentries from a new attach point.
+// Files that can no longer be reached, such as those of deleted dentries,
+// remain disconnected, and operations on them continue to fail with EIO.
+func (fs *filesystem) reconnect(ctx context.Context) error {
+	client, attached, err := fs.dial()
+	if err != nil {
+		return err
+	}
+	root := p9file{attached, fs.stats, fs.limiter}
+	defer root.close(ctx)
+
+	// Lock fs.renameMu to prevent path resolution, which may race with the
+	// replacement of remote files, and renames, which invalidate the paths
+	// used to walk to them.
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+	fs.syncMu.Lock()
+	ds := make([]*dentry, 0, len(fs.dentries))
+	for d := range fs.dentries {
+		ds = append(ds, d)
+	}
+	sffds := make([]*specialFileFD, 0, len(fs.specialFileFDs))
+	for sffd := range fs.specialFileFDs {
+		sffds = append(sffds, sffd)
+	}
+	fs.syncMu.Unlock()
+	for _, d := range ds {
+		d.reconnectLocked(ctx, root)
+	}
+	// Special files have per-FD handles, which aren't reopened with their
+	// dentries.
+	for _, sffd := range sffds {
+		if !sffd.vfsfd.TryIncRef() {
+			continue
+		}
+		sffd.reconnectLocked(ctx, root)
+		sffd.vfsfd.DecRef()
+	}
+	oldClient := fs.client
+	fs.client = client
+	oldClient.Close()
+	atomic.AddUint64(&fs.reconnects, 1)
+	log.Infof("gofer.filesystem.reconnect: reconnected to %q, reopened %d files and %d special files", fs.opts.addr, len(ds), len(sffds))
+	return nil
+}
+
+// dial establishes a new connection to the server, attaches to fs.opts.aname
+// and walks to fs.opts.rootPath, retrying with exponential backoff until
+// reconnectAttempts have failed or the reconnect worker is stopped.
+func (fs *filesystem) dial() (*p9.Client, p9.File, error) {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		client, attached, err := fs.dialOnce()
+		if err == nil {
+			return client, attached, nil
+		}
+		if attempt == reconnectAttempts {
+			return nil, nil, err
+		}
+		log.Debugf("gofer.filesystem.dial: attempt %d failed, retrying in %v: %v", attempt, backoff, err)
+		select {
+		case <-fs.reconnectStop:
+			return nil, nil, errReconnectStopped
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+func (fs *filesystem) dialOnce() (*p9.Client, p9.File, error) {
+	conn, err := unet.Connect(fs.opts.addr, false /* packet */)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := setSocketBufferSizes(conn, &fs.opts); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	client, err := p9.NewClient(conn, fs.opts.msize, fs.opts.version)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// Ownership of conn has been transferred to client.
+	client.SetTimeout(fs.opts.rpcTimeout)
+	attached, err := client.Attach(fs.opts.aname)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	if len(fs.opts.rootPath) != 0 {
+		_, root, err := attached.Walk(fs.opts.rootPath)
+		attached.Close()
+		if err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+		attached = root
+	}
+	return client, attached, nil
+}
+
+// reconnectLocked replaces d's remote file, and the remote file of its shared
+// handle if it has one, with files walked to from root.
+//
+// Preconditions: d.fs.renameMu must be locked for writing. d.fs.opts.reconnect
+// is true.
+func (d *dentry) reconnectLocked(ctx context.Context, root p9file) {
+	rf, ok := d.file.file.(*reconnectFile)
+	if !ok || d.isDeleted() {
+		return
+	}
+	names := d.remotePathLocked()
+	_, file, err := root.walk(ctx, names)
+	if err != nil {
+		log.Warningf("gofer.dentry.reconnectLocked: failed to walk to %q: %v", names, err)
+		return
+	}
+	rf.set(file.file)
+	d.reopenHandle(ctx, file, names)
+}
+
+// remotePathLocked returns the path from the filesystem root to d.
+//
+// Preconditions: d.fs.renameMu must be locked.
+func (d *dentry) remotePathLocked() []string {
+	var names []string
+	for vfsd := &d.vfsd; vfsd.Parent() != nil; vfsd = vfsd.Parent() {
+		names = append(names, vfsd.Name())
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return names
+}
+
+// reopenHandle replaces the remote file of d's shared handle, if it has one,
+// with a file opened from file, which must represent the same file as d.
+// names is the path to d, and is only used for logging.
+func (d *dentry) reopenHandle(ctx context.Context, file p9file, names []string) {
+	d.handleMu.Lock()
+	defer d.handleMu.Unlock()
+	hrf, ok := d.handle.file.file.(*reconnectFile)
+	if !ok {
+		return
+	}
+	_, hfile, err := file.walk(ctx, nil)
+	if err != nil {
+		log.Warningf("gofer.dentry.reopenHandle: failed to walk to %q: %v", names, err)
+		return
+	}
+	hfd, _, _, err := hfile.open(ctx, handleOpenFlags(d.handleReadable, d.handleWritable))
+	if err != nil {
+		log.Warningf("gofer.dentry.reopenHandle: failed to reopen %q: %v", names, err)
+		hfile.close(ctx)
+		return
+	}
+	// Host FDs remain valid across the loss of the connection, and may be
+	// mapped by the application, so d.handle.fd is retained.
+	if hfd != nil {
+		hfd.Close()
+	}
+	hrf.set(hfile.file)
+	d.traceHandleLocked("reconnect")
+}
+
+// reconnectLocked replaces the remote file of fd's handle with a file walked
+// to from root and opened with fd's access mode. If this fails, the stale
+// file is retained, so that operations on it continue to fail with EIO.
+//
+// Preconditions: fd's filesystem's renameMu must be locked for writing.
+// filesystemOptions.reconnect is true.
+func (fd *specialFileFD) reconnectLocked(ctx context.Context, root p9file) {
+	rf, ok := fd.handle.file.file.(*reconnectFile)
+	if !ok {
+		return
+	}
+	d := fd.dentry()
+	if d.isDeleted() {
+		return
+	}
+	if d.fileType() == linux.S_IFIFO {
+		// Opening a FIFO may block until it is opened for the complementary
+		// access mode, which would stall reconnection. Data is transferred
+		// through the FIFO's host FD, if it has one, which remains valid.
+		return
+	}
+	names := d.remotePathLocked()
+	_, file, err := root.walk(ctx, names)
+	if err != nil {
+		log.Warningf("gofer.specialFileFD.reconnectLocked: failed to walk to %q: %v", names, err)
+		return
+	}
+	hfd, _, _, err := file.open(ctx, handleOpenFlags(fd.vfsfd.IsReadable(), fd.vfsfd.IsWritable()))
+	if err != nil {
+		log.Warningf("gofer.specialFileFD.reconnectLocked: failed to reopen %q: %v", names, err)
+		file.close(ctx)
+		return
+	}
+	// As in dentry.reopenHandle, fd.handle.fd is retained.
+	if hfd != nil {
+		hfd.Close()
+	}
+	rf.set(file.file)
+}
+
+// reconnectFile is a p9.File whose underlying remote file may be replaced by
+// filesystem.reconnect() or filesystem.loadInternalState(). Files walked to or
+// created from a reconnectFile are also reconnectFiles.
+type reconnectFile struct {
+	// file and pending are protected by mu.
+	mu   sync.RWMutex
+	file p9.File
+
+	// If pending is not nil, file is stale, and is replaced by the file
+	// walked to by pending when f is next used.
+	pending *pendingWalk
+}
+
+// pendingWalk describes a deferred walk from a remote file.
+type pendingWalk struct {
+	from  p9file
+	names []string
+}
+
+func (f *reconnectFile) get() p9.File {
+	f.mu.RLock()
+	file, pending := f.file, f.pending != nil
+	f.mu.RUnlock()
+	if !pending {
+		return file
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pw := f.pending; pw != nil {
+		f.pending = nil
+		pw.from.stats.count(rpcWalk)
+		if _, file, err := pw.from.file.Walk(pw.names); err != nil {
+			// Leave the stale file in place, so that operations on it
+			// continue to fail.
+			log.Warningf("gofer.reconnectFile.get: failed to walk to %q: %v", pw.names, err)
+		} else {
+			f.file = file
+		}
+	}
+	return f.file
+}
+
+func (f *reconnectFile) set(file p9.File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.file = file
+	f.pending = nil
+}
+
+// setPending causes f's remote file to be replaced by the file walked to from
+// from by names when f is next used.
+func (f *reconnectFile) setPending(from p9file, names []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = &pendingWalk{from, names}
+}
+
+// unwrapFile returns the remote file underlying file, which is passed to
+// p9.File methods that take another file as an argument.
+func unwrapFile(file p9.File) p9.File {
+	if rf, ok := file.(*reconnectFile); ok {
+		return rf.get()
+	}
+	return file
+}
+
+// Walk implements p9.File.Walk.
+func (f *reconnectFile) Walk(names []string) ([]p9.QID, p9.File, error) {
+	qids, file, err := f.get().Walk(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	return qids, &reconnectFile{file: file}, nil
+}
+
+// WalkGetAttr implements p9.File.WalkGetAttr.
+func (f *reconnectFile) WalkGetAttr(names []string) ([]p9.QID, p9.File, p9.AttrMask, p9.Attr, error) {
+	qids, file, mask, attr, err := f.get().WalkGetAttr(names)
+	if err != nil {
+		return nil, nil, p9.AttrMask{}, p9.Attr{}, err
+	}
+	return qids, &reconnectFile{file: file}, mask, attr, nil
+}
+
+// MultiWalk implements p9.MultiWalker.MultiWalk.
+func (f *reconnectFile) MultiWalk(names []string) ([]p9.File, []p9.FullStat, error) {
+	mw, ok := f.get().(p9.MultiWalker)
+	if !ok {
+		return nil, nil, syserror.ENOSYS
+	}
+	files, stats, err := mw.MultiWalk(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range files {
+		files[i] = &reconnectFile{file: files[i]}
+	}
+	return files, stats, nil
+}
+
+// StatFS implements p9.File.StatFS.
+func (f *reconnectFile) StatFS() (p9.FSStat, error) {
+	return f.get().StatFS()
+}
+
+// GetAttr implements p9.File.GetAttr.
+func (f *reconnectFile) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	return f.get().GetAttr(req)
+}
+
+// GetAttrChildren implements p9.File.GetAttrChildren.
+func (f *reconnectFile) GetAttrChildren(names []string, req p9.AttrMask) ([]p9.FullStat, error) {
+	return f.get().GetAttrChildren(names, req)
+}
+
+// SetAttr implements p9.File.SetAttr.
+func (f *reconnectFile) SetAttr(valid p9.SetAttrMask, attr p9.SetAttr) error {
+	return f.get().SetAttr(valid, attr)
+}
+
+// GetIno implements p9.File.GetIno.
+func (f *reconnectFile) GetIno() (uint64, error) {
+	return f.get().GetIno()
+}
+
+// GetFlags implements p9.File.GetFlags.
+func (f *reconnectFile) GetFlags() (uint32, error) {
+	return f.get().GetFlags()
+}
+
+// SetFlags implements p9.File.SetFlags.
+func (f *reconnectFile) SetFlags(flags uint32) error {
+	return f.get().SetFlags(flags)
+}
+
+// GetXattr implements p9.File.GetXattr.
+func (f *reconnectFile) GetXattr(name string, size uint64) (string, error) {
+	return f.get().GetXattr(name, size)
+}
+
+// SetXattr implements p9.File.SetXattr.
+func (f *reconnectFile) SetXattr(name, value string, flags uint32) error {
+	return f.get().SetXattr(name, value, flags)
+}
+
+// ListXattr implements p9.File.ListXattr.
+func (f *reconnectFile) ListXattr(size uint64) (map[string]struct{}, error) {
+	return f.get().ListXattr(size)
+}
+
+// RemoveXattr implements p9.File.RemoveXattr.
+func (f *reconnectFile) RemoveXattr(name string) error {
+	return f.get().RemoveXattr(name)
+}
+
+// Allocate implements p9.File.Allocate.
+func (f *reconnectFile) Allocate(mode p9.AllocateMode, offset, length uint64) error {
+	return f.get().Allocate(mode, offset, length)
+}
+
+// Seek implements p9.File.Seek.
+func (f *reconnectFile) Seek(offset uint64, whence p9.SeekWhence) (uint64, error) {
+	return f.get().Seek(offset, whence)
+}
+
+// CopyRange implements p9.File.CopyRange.
+func (f *reconnectFile) CopyRange(offset uint64, dst p9.File, dstOffset, length uint64) (uint64, error) {
+	return f.get().CopyRange(offset, unwrapFile(dst), dstOffset, length)
+}
+
+// CloneRange implements p9.File.CloneRange.
+func (f *reconnectFile) CloneRange(offset uint64, dst p9.File, dstOffset, length uint64) error {
+	return f.get().CloneRange(offset, unwrapFile(dst), dstOffset, length)
+}
+
+// Close implements p9.File.Close.
+func (f *reconnectFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending != nil {
+		// The remote file was never walked to, and the stale file belongs to
+		// a connection that has already been closed, so there is nothing to
+		// close. Don't walk now: when the filesystem is released, the file
+		// walked from may already have been closed with the root dentry.
+		f.pending = nil
+		return nil
+	}
+	return f.file.Close()
+}
+
+// Open implements p9.File.Open.
+func (f *reconnectFile) Open(flags p9.OpenFlags) (*fd.FD, p9.QID, uint32, error) {
+	return f.get().Open(flags)
+}
+
+// ReadAt implements p9.File.ReadAt.
+func (f *reconnectFile) ReadAt(p []byte, offset uint64) (int, error) {
+	return f.get().ReadAt(p, offset)
+}
+
+// WriteAt implements p9.File.WriteAt.
+func (f *reconnectFile) WriteAt(p []byte, offset uint64) (int, error) {
+	return f.get().WriteAt(p, offset)
+}
+
+// ReadAtCancellable implements p9.CancellableFile.ReadAtCancellable.
+func (f *reconnectFile) ReadAtCancellable(p []byte, offset uint64, cancel <-chan struct{}) (int, error) {
+	file := f.get()
+	if cf, ok := file.(p9.CancellableFile); ok {
+		return cf.ReadAtCancellable(p, offset, cancel)
+	}
+	return file.ReadAt(p, offset)
+}
+
+// WriteAtCancellable implements p9.CancellableFile.WriteAtCancellable.
+func (f *reconnectFile) WriteAtCancellable(p []byte, offset uint64, cancel <-chan struct{}) (int, error) {
+	file := f.get()
+	if cf, ok := file.(p9.CancellableFile); ok {
+		return cf.WriteAtCancellable(p, offset, cancel)
+	}
+	return file.WriteAt(p, offset)
+}
+
+// FSync implements p9.File.FSync.
+func (f *reconnectFile) FSync() error {
+	return f.get().FSync()
+}
+
+// FDataSync implements p9.File.FDataSync.
+func (f *reconnectFile) FDataSync() error {
+	return f.get().FDataSync()
+}
+
+// Create implements p9.File.Create.
+func (f *reconnectFile) Create(name string, flags p9.OpenFlags, permissions p9.FileMode, uid p9.UID, gid p9.GID) (*fd.FD, p9.File, p9.QID, uint32, error) {
+	hostFD, file, qid, iounit, err := f.get().Create(name, flags, permissions, uid, gid)
+	if err != nil {
+		return nil, nil, p9.QID{}, 0, err
+	}
+	return hostFD, &reconnectFile{file: file}, qid, iounit, nil
+}
+
+// Mkdir implements p9.File.Mkdir.
+func (f *reconnectFile) Mkdir(name string, permissions p9.FileMode, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	return f.get().Mkdir(name, permissions, uid, gid)
+}
+
+// Symlink implements p9.File.Symlink.
+func (f *reconnectFile) Symlink(oldName string, newName string, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	return f.get().Symlink(oldName, newName, uid, gid)
+}
+
+// Link implements p9.File.Link.
+func (f *reconnectFile) Link(target p9.File, newName string) error {
+	return f.get().Link(unwrapFile(target), newName)
+}
+
+// Mknod implements p9.File.Mknod.
+func (f *reconnectFile) Mknod(name string, mode p9.FileMode, major uint32, minor uint32, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	return f.get().Mknod(name, mode, major, minor, uid, gid)
+}
+
+// Rename implements p9.File.Rename.
+func (f *reconnectFile) Rename(newDir p9.File, newName string) error {
+	return f.get().Rename(unwrapFile(newDir), newName)
+}
+
+// RenameAt implements p9.File.RenameAt.
+func (f *reconnectFile) RenameAt(oldName string, newDir p9.File, newName string) error {
+	return f.get().RenameAt(oldName, unwrapFile(newDir), newName)
+}
+
+// RenameAt2 implements p9.File.RenameAt2.
+func (f *reconnectFile) RenameAt2(oldName string, newDir p9.File, newName string, flags uint32) error {
+	return f.get().RenameAt2(oldName, unwrapFile(newDir), newName, flags)
+}
+
+// UnlinkAt implements p9.File.UnlinkAt.
+func (f *reconnectFile) UnlinkAt(name string, flags uint32) error {
+	return f.get().UnlinkAt(name, flags)
+}
+
+// Readdir implements p9.File.Readdir.
+func (f *reconnectFile) Readdir(offset uint64, count uint32) ([]p9.Dirent, error) {
+	return f.get().Readdir(offset, count)
+}
+
+// Readlink implements p9.File.Readlink.
+func (f *reconnectFile) Readlink() (string, error) {
+	return f.get().Readlink()
+}
+
+// Flush implements p9.File.Flush.
+func (f *reconnectFile) Flush() error {
+	return f.get().Flush()
+}
+
+// Connect implements p9.File.Connect.
+func (f *reconnectFile) Connect(flags p9.ConnectFlags) (*fd.FD, error) {
+	return f.get().Connect(flags)
+}
+
+// Renamed implements p9.File.Renamed.
+func (f *reconnectFile) Renamed(newDir p9.File, newName string) {
+	f.get().Renamed(unwrapFile(newDir), newName)
+}
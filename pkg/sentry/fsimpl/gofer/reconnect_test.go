@@ -0,0 +1,133 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestReconnect(t *testing.T) {
+	ctx := contexttest.Context(t)
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"a": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, Size: 3, NLink: 1}, data: []byte("foo")},
+			"b": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, Size: 3, NLink: 1}, data: []byte("bar")},
+		},
+	}
+
+	addr, conns := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",reconnect=1")
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+
+	afd, err := openAt(ctx, root, "a", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(a): %v", err)
+	}
+	defer afd.DecRef()
+
+	// Drop the connection, and wait for the client to re-establish it.
+	(<-conns).Shutdown()
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadUint64(&fs.reconnects) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("client did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Files opened after reconnection should be usable.
+	bfd, err := openAt(ctx, root, "b", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(b) after reconnection: %v", err)
+	}
+	defer bfd.DecRef()
+	buf := make([]byte, 3)
+	if _, err := bfd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(b) after reconnection: %v", err)
+	}
+	if got, want := string(buf), "bar"; got != want {
+		t.Errorf("PRead(b) after reconnection: got %q, want %q", got, want)
+	}
+
+	// Files opened before reconnection should have been reopened.
+	if _, err := afd.PWrite(ctx, usermem.BytesIOSequence([]byte("x")), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(a) after reconnection: %v", err)
+	}
+	if err := afd.Sync(ctx); err != nil {
+		t.Fatalf("Sync(a) after reconnection: %v", err)
+	}
+	if got, want := string(rootFile.children["a"].contents()), "xoo"; got != want {
+		t.Errorf("server contents of a after reconnection: got %q, want %q", got, want)
+	}
+}
+
+func TestReconnectSpecialFile(t *testing.T) {
+	ctx := contexttest.Context(t)
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"a": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, Size: 3, NLink: 1}, data: []byte("foo")},
+		},
+	}
+
+	// cache=none causes regular files to be represented by specialFileFDs.
+	addr, conns := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",reconnect=1,cache=none")
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+
+	afd, err := openAt(ctx, root, "a", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(a): %v", err)
+	}
+	defer afd.DecRef()
+	if _, ok := afd.Impl().(*specialFileFD); !ok {
+		t.Fatalf("OpenAt(a): got %T, want *specialFileFD", afd.Impl())
+	}
+
+	(<-conns).Shutdown()
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadUint64(&fs.reconnects) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("client did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The FD's handle should have been reopened.
+	if _, err := afd.PWrite(ctx, usermem.BytesIOSequence([]byte("x")), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(a) after reconnection: %v", err)
+	}
+	if got, want := string(rootFile.children["a"].contents()), "xoo"; got != want {
+		t.Errorf("server contents of a after reconnection: got %q, want %q", got, want)
+	}
+	buf := make([]byte, 3)
+	if _, err := afd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(a) after reconnection: %v", err)
+	}
+	if got, want := string(buf), "xoo"; got != want {
+		t.Errorf("PRead(a) after reconnection: got %q, want %q", got, want)
+	}
+}
@@ -24,8 +24,11 @@ import (
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/p9"
 	"gvisor.dev/gvisor/pkg/safemem"
+	"gvisor.dev/gvisor/pkg/sentry/arch"
 	"gvisor.dev/gvisor/pkg/sentry/fs/fsutil"
+	"gvisor.dev/gvisor/pkg/sentry/kernel"
 	"gvisor.dev/gvisor/pkg/sentry/memmap"
 	"gvisor.dev/gvisor/pkg/sentry/pgalloc"
 	"gvisor.dev/gvisor/pkg/sentry/platform"
@@ -49,6 +52,7 @@ type regularFileFD struct {
 
 // Release implements vfs.FileDescriptionImpl.Release.
 func (fd *regularFileFD) Release() {
+	fd.dentry().decOpenFDs()
 }
 
 // OnClose implements vfs.FileDescriptionImpl.OnClose.
@@ -57,14 +61,35 @@ func (fd *regularFileFD) OnClose(ctx context.Context) error {
 		return nil
 	}
 	// Skip flushing if writes may be buffered by the client, since (as with
-	// the VFS1 client) we don't flush buffered writes on close anyway.
+	// the VFS1 client) we don't flush buffered writes on close anyway. Writes
+	// that were coalesced in the cache are written back, however, so that
+	// coalescing doesn't delay writes that would otherwise have been sent to
+	// the remote file immediately beyond the lifetime of the FD.
+	//
+	// Errors from asynchronous writeback of dirty cached data are otherwise
+	// only observable by sync, so report (and clear) the first such error
+	// here, as Linux does for write-behind errors.
 	d := fd.dentry()
 	if d.fs.opts.interop == InteropModeExclusive {
-		return nil
+		d.handleMu.RLock()
+		defer d.handleMu.RUnlock()
+		d.dataMu.Lock()
+		defer d.dataMu.Unlock()
+		err := d.flushCoalescedWritesLocked(ctx)
+		if wbErr := d.takeWritebackErrLocked(); err == nil {
+			err = wbErr
+		}
+		return err
 	}
 	d.handleMu.RLock()
 	defer d.handleMu.RUnlock()
-	return d.handle.file.flush(ctx)
+	err := d.handle.file.flush(ctx)
+	d.dataMu.Lock()
+	if wbErr := d.takeWritebackErrLocked(); err == nil {
+		err = wbErr
+	}
+	d.dataMu.Unlock()
+	return err
 }
 
 // PRead implements vfs.FileDescriptionImpl.PRead.
@@ -72,13 +97,23 @@ func (fd *regularFileFD) PRead(ctx context.Context, dst usermem.IOSequence, offs
 	if offset < 0 {
 		return 0, syserror.EINVAL
 	}
-	if opts.Flags != 0 {
+	if opts.Flags&^linux.RWF_NOWAIT != 0 {
 		return 0, syserror.EOPNOTSUPP
 	}
+	nowait := opts.Flags&linux.RWF_NOWAIT != 0
+	d := fd.dentry()
+	if fd.vfsfd.StatusFlags()&linux.O_DIRECT != 0 {
+		if nowait {
+			// O_DIRECT reads always go to the remote file.
+			return 0, syserror.EAGAIN
+		}
+		if err := d.checkDirectIOAlignment(offset, dst.NumBytes()); err != nil {
+			return 0, err
+		}
+	}
 
 	// Check for reading at EOF before calling into MM (but not under
 	// InteropModeShared, which makes d.size unreliable).
-	d := fd.dentry()
 	if d.fs.opts.interop != InteropModeShared && uint64(offset) >= atomic.LoadUint64(&d.size) {
 		return 0, io.EOF
 	}
@@ -100,6 +135,7 @@ func (fd *regularFileFD) PRead(ctx context.Context, dst usermem.IOSequence, offs
 		// Require the read to go to the remote file.
 		rw.direct = true
 	}
+	rw.nowait = nowait
 	n, err := dst.CopyOutFrom(ctx, rw)
 	putDentryReadWriter(rw)
 	if d.fs.opts.interop != InteropModeShared {
@@ -120,21 +156,62 @@ func (fd *regularFileFD) Read(ctx context.Context, dst usermem.IOSequence, opts
 
 // PWrite implements vfs.FileDescriptionImpl.PWrite.
 func (fd *regularFileFD) PWrite(ctx context.Context, src usermem.IOSequence, offset int64, opts vfs.WriteOptions) (int64, error) {
+	n, _, err := fd.pwrite(ctx, src, offset, opts)
+	return n, err
+}
+
+// pwrite returns the file offset after the operation. The returned offset
+// may differ from offset+n if fd was opened with O_APPEND.
+func (fd *regularFileFD) pwrite(ctx context.Context, src usermem.IOSequence, offset int64, opts vfs.WriteOptions) (int64, int64, error) {
 	if offset < 0 {
-		return 0, syserror.EINVAL
+		return 0, offset, syserror.EINVAL
 	}
-	if opts.Flags != 0 {
-		return 0, syserror.EOPNOTSUPP
+	if opts.Flags&^linux.RWF_NOWAIT != 0 {
+		return 0, offset, syserror.EOPNOTSUPP
 	}
-	limit, err := vfs.CheckLimit(ctx, offset, src.NumBytes())
-	if err != nil {
-		return 0, err
+	appending := fd.vfsfd.StatusFlags()&linux.O_APPEND != 0
+	if !appending {
+		// Writes at or past RLIMIT_FSIZE fail before anything else is done.
+		// Appends are checked once the end of the file is known below.
+		limit, err := vfs.CheckLimit(ctx, offset, src.NumBytes())
+		if err != nil {
+			return 0, offset, err
+		}
+		src = src.TakeFirst64(limit)
 	}
-	src = src.TakeFirst64(limit)
-
 	d := fd.dentry()
+	syncWrite := d.fs.opts.sync || fd.vfsfd.StatusFlags()&(linux.O_DSYNC|linux.O_SYNC) != 0
+	nowait := opts.Flags&linux.RWF_NOWAIT != 0
+	if nowait && (syncWrite || fd.vfsfd.StatusFlags()&linux.O_DIRECT != 0) {
+		// These writes always go to the remote file.
+		return 0, offset, syserror.EAGAIN
+	}
+
 	d.metadataMu.Lock()
 	defer d.metadataMu.Unlock()
+	// Set offset to the file size if fd was opened with O_APPEND. Holding
+	// d.metadataMu from here until the write completes prevents concurrent
+	// appenders through this filesystem from writing at the same offset.
+	if appending {
+		if d.fs.opts.interop == InteropModeShared {
+			// Other remote filesystem users may have extended the file.
+			if err := d.updateFromGetattrLocked(ctx, p9.AttrMask{Size: true}); err != nil {
+				return 0, offset, err
+			}
+		}
+		offset = int64(atomic.LoadUint64(&d.size))
+		limit, err := vfs.CheckLimit(ctx, offset, src.NumBytes())
+		if err != nil {
+			return 0, offset, err
+		}
+		src = src.TakeFirst64(limit)
+	}
+	if fd.vfsfd.StatusFlags()&linux.O_DIRECT != 0 {
+		if err := d.checkDirectIOAlignment(offset, src.NumBytes()); err != nil {
+			return 0, offset, err
+		}
+	}
+
 	if d.fs.opts.interop != InteropModeShared {
 		// Compare Linux's mm/filemap.c:__generic_file_write_iter() =>
 		// file_update_time(). This is d.touchCMtime(), but without locking
@@ -142,35 +219,8 @@ func (fd *regularFileFD) PWrite(ctx context.Context, src usermem.IOSequence, off
 		d.touchCMtimeLocked()
 	}
 	if fd.vfsfd.StatusFlags()&linux.O_DIRECT != 0 {
-		// Write dirty cached pages that will be touched by the write back to
-		// the remote file.
-		if err := d.writeback(ctx, offset, src.NumBytes()); err != nil {
-			return 0, err
-		}
-		// Remove touched pages from the cache.
-		pgstart := pageRoundDown(uint64(offset))
-		pgend := pageRoundUp(uint64(offset + src.NumBytes()))
-		if pgend < pgstart {
-			return 0, syserror.EINVAL
-		}
-		mr := memmap.MappableRange{pgstart, pgend}
-		var freed []platform.FileRange
-		d.dataMu.Lock()
-		cseg := d.cache.LowerBoundSegment(mr.Start)
-		for cseg.Ok() && cseg.Start() < mr.End {
-			cseg = d.cache.Isolate(cseg, mr)
-			freed = append(freed, platform.FileRange{cseg.Value(), cseg.Value() + cseg.Range().Length()})
-			cseg = d.cache.Remove(cseg).NextSegment()
-		}
-		d.dataMu.Unlock()
-		// Invalidate mappings of removed pages.
-		d.mapsMu.Lock()
-		d.mappings.Invalidate(mr, memmap.InvalidateOpts{})
-		d.mapsMu.Unlock()
-		// Finally free pages removed from the cache.
-		mf := d.fs.mfp.MemoryFile()
-		for _, freedFR := range freed {
-			mf.DecRef(freedFR)
+		if err := d.writebackAndEvictLocked(ctx, offset, src.NumBytes()); err != nil {
+			return 0, offset, err
 		}
 	}
 	rw := getDentryReadWriter(ctx, d, offset)
@@ -178,36 +228,404 @@ func (fd *regularFileFD) PWrite(ctx context.Context, src usermem.IOSequence, off
 		// Require the write to go to the remote file.
 		rw.direct = true
 	}
+	rw.nowait = nowait
 	n, err := src.CopyInTo(ctx, rw)
 	putDentryReadWriter(rw)
-	if n != 0 && fd.vfsfd.StatusFlags()&(linux.O_DSYNC|linux.O_SYNC) != 0 {
+	if n != 0 && syncWrite {
 		// Write dirty cached pages touched by the write back to the remote
 		// file.
 		if err := d.writeback(ctx, offset, src.NumBytes()); err != nil {
-			return 0, err
+			return 0, offset, err
 		}
 		// Request the remote filesystem to sync the remote file.
 		if err := d.handle.file.fsync(ctx); err != nil {
-			return 0, err
+			return 0, offset, err
 		}
 	}
-	return n, err
+	return n, offset + n, err
 }
 
 // Write implements vfs.FileDescriptionImpl.Write.
 func (fd *regularFileFD) Write(ctx context.Context, src usermem.IOSequence, opts vfs.WriteOptions) (int64, error) {
 	fd.mu.Lock()
-	n, err := fd.PWrite(ctx, src, fd.off, opts)
-	fd.off += n
+	n, off, err := fd.pwrite(ctx, src, fd.off, opts)
+	fd.off = off
 	fd.mu.Unlock()
 	return n, err
 }
 
+// Allocate implements vfs.Allocator.Allocate. Only mode 0 and
+// FALLOC_FL_KEEP_SIZE are supported.
+func (fd *regularFileFD) Allocate(ctx context.Context, mode, offset, length uint64) error {
+	if mode&^linux.FALLOC_FL_KEEP_SIZE != 0 || !fd.dentry().fs.opts.features.allocate {
+		return syserror.EOPNOTSUPP
+	}
+	if length == 0 {
+		return syserror.EINVAL
+	}
+	if !fd.vfsfd.IsWritable() {
+		return syserror.EBADF
+	}
+	size := offset + length
+	if size < offset || size > math.MaxInt64 {
+		return syserror.EFBIG
+	}
+	keepSize := mode&linux.FALLOC_FL_KEEP_SIZE != 0
+	if !keepSize {
+		limit, err := vfs.CheckLimit(ctx, int64(offset), int64(length))
+		if err != nil {
+			return err
+		}
+		if uint64(limit) < length {
+			return syserror.ErrExceedsFileSizeLimit
+		}
+	}
+
+	d := fd.dentry()
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	d.handleMu.RLock()
+	err := d.handle.file.allocate(ctx, p9.AllocateMode{KeepSize: keepSize}, offset, length)
+	d.handleMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	// Allocation fills holes in the remote file, even if it doesn't change
+	// the file's size.
+	d.dataMu.Lock()
+	d.seekCache = nil
+	d.dataMu.Unlock()
+	if d.fs.opts.interop == InteropModeShared {
+		// d's metadata will be updated by revalidation.
+		return nil
+	}
+	// Since allocation can only grow the file, there are no cached pages or
+	// mappings beyond the old EOF to invalidate.
+	d.dataMu.Lock()
+	if keepSize {
+		if size > d.size && size > d.allocEnd {
+			atomic.StoreUint64(&d.allocEnd, size)
+		}
+	} else if size > d.size {
+		atomic.StoreUint64(&d.size, size)
+	}
+	d.dataMu.Unlock()
+	d.touchCMtimeLocked()
+	return nil
+}
+
+// extendCacheLocked updates d.cache after the remote file has been extended
+// from oldSize to d.size by truncation, which fills the extension with
+// zeroes. Cached bytes beyond oldSize, which may have been written through a
+// shared mapping of the last page, are zeroed. If the extension spans at most
+// fs.opts.msize bytes, such that it could have been read from the remote file
+// by a single RPC, gaps in the cache spanning it are also filled with zeroed
+// pages, so that reading it doesn't require an RPC.
+//
+// Preconditions: d.handleMu must be locked. d.dataMu must be locked.
+// d.size > oldSize.
+func (d *dentry) extendCacheLocked(oldSize uint64) {
+	mf := d.fs.mfp.MemoryFile()
+	d.cache.Truncate(oldSize, mf)
+	defer d.updateCachedBytesLocked()
+	if (d.handle.fd >= 0 && !d.fs.opts.forcePageCache) || !mf.ShouldCacheEvictable() {
+		// Reads don't fill the cache.
+		return
+	}
+	extMR := memmap.MappableRange{pageRoundUp(oldSize), pageRoundUp(d.size)}
+	if extMR.Length() == 0 || extMR.Length() > uint64(d.fs.opts.msize) {
+		return
+	}
+	gap := d.cache.LowerBoundGap(extMR.Start)
+	for gap.Ok() && gap.Start() < extMR.End {
+		gapMR := gap.Range().Intersect(extMR)
+		seg, err := d.allocateCachePagesLocked(gap, gapMR)
+		if err != nil {
+			// The extension will be read from the remote file instead.
+			return
+		}
+		mf.MarkEvictable(d, pgalloc.EvictableRange{gapMR.Start, gapMR.End})
+		gap = seg.NextGap()
+	}
+	d.fs.markEvictable()
+}
+
+// writebackAndEvictLocked writes dirty cached pages in the given range of d's
+// file back to the remote file, then removes them from the cache so that
+// subsequent accesses observe the remote file.
+//
+// Preconditions: d.metadataMu must be locked.
+func (d *dentry) writebackAndEvictLocked(ctx context.Context, offset, size int64) error {
+	if err := d.writeback(ctx, offset, size); err != nil {
+		return err
+	}
+	pgstart := pageRoundDown(uint64(offset))
+	pgend := pageRoundUp(uint64(offset + size))
+	if pgend < pgstart {
+		return syserror.EINVAL
+	}
+	mr := memmap.MappableRange{pgstart, pgend}
+	var freed []platform.FileRange
+	d.dataMu.Lock()
+	cseg := d.cache.LowerBoundSegment(mr.Start)
+	for cseg.Ok() && cseg.Start() < mr.End {
+		cseg = d.cache.Isolate(cseg, mr)
+		freed = append(freed, platform.FileRange{cseg.Value(), cseg.Value() + cseg.Range().Length()})
+		cseg = d.cache.Remove(cseg).NextSegment()
+	}
+	d.updateCachedBytesLocked()
+	d.dataMu.Unlock()
+	// Invalidate mappings of removed pages.
+	d.mapsMu.Lock()
+	d.mappings.Invalidate(mr, memmap.InvalidateOpts{})
+	d.mapsMu.Unlock()
+	// Finally free pages removed from the cache.
+	mf := d.fs.mfp.MemoryFile()
+	for _, freedFR := range freed {
+		mf.DecRef(freedFR)
+	}
+	return nil
+}
+
+// CopyRange implements vfs.RangeCopier.CopyRange. If dst is a file on the same
+// filesystem as fd and the server supports it, the copy is performed by the
+// server without passing data through the sentry. Otherwise, CopyRange
+// returns EXDEV.
+func (fd *regularFileFD) CopyRange(ctx context.Context, srcOff int64, dst *vfs.FileDescription, dstOff, length int64) (int64, error) {
+	if srcOff < 0 || dstOff < 0 || length < 0 {
+		return 0, syserror.EINVAL
+	}
+	if !fd.vfsfd.IsReadable() || !dst.IsWritable() || dst.StatusFlags()&linux.O_APPEND != 0 {
+		return 0, syserror.EBADF
+	}
+	dstFD, ok := dst.Impl().(*regularFileFD)
+	if !ok {
+		return 0, syserror.EXDEV
+	}
+	s := fd.dentry()
+	d := dstFD.dentry()
+	if s.fs != d.fs || atomic.LoadUint32(&s.fs.copyRangeUnsupported) != 0 {
+		return 0, syserror.EXDEV
+	}
+	if s == d && srcOff < dstOff+length && dstOff < srcOff+length {
+		// Compare Linux's fs/read_write.c:generic_copy_file_checks().
+		return 0, syserror.EINVAL
+	}
+	if fd.vfsfd.StatusFlags()&linux.O_DIRECT != 0 || dst.StatusFlags()&linux.O_DIRECT != 0 {
+		// Leave alignment checks to the generic copy.
+		return 0, syserror.EXDEV
+	}
+	limit, err := vfs.CheckLimit(ctx, dstOff, length)
+	if err != nil {
+		return 0, err
+	}
+	length = limit
+	if length == 0 {
+		return 0, nil
+	}
+
+	// Ensure that the server copies data written through the cache.
+	if s != d {
+		if err := s.writeback(ctx, srcOff, length); err != nil {
+			return 0, err
+		}
+	}
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	if s == d {
+		if err := d.writeback(ctx, srcOff, length); err != nil {
+			return 0, err
+		}
+	}
+	// The server will overwrite the destination range in the remote file, so
+	// cached pages in it must be discarded.
+	if err := d.writebackAndEvictLocked(ctx, dstOff, length); err != nil {
+		return 0, err
+	}
+	s.handleMu.RLock()
+	if s != d {
+		d.handleMu.RLock()
+	}
+	n, err := s.handle.file.copyRange(ctx, uint64(srcOff), d.handle.file, uint64(dstOff), uint64(length))
+	if s != d {
+		d.handleMu.RUnlock()
+	}
+	s.handleMu.RUnlock()
+	if err != nil {
+		if err == syserror.EOPNOTSUPP || err == syserror.ENOSYS {
+			// ENOSYS is returned by servers whose host kernel doesn't
+			// support copy_file_range(2).
+			atomic.StoreUint32(&s.fs.copyRangeUnsupported, 1)
+			return 0, syserror.EXDEV
+		}
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	d.dataMu.Lock()
+	d.seekCache = nil
+	d.dataMu.Unlock()
+	if d.fs.opts.interop == InteropModeShared {
+		// d's metadata will be updated by revalidation.
+		return int64(n), nil
+	}
+	d.dataMu.Lock()
+	if end := uint64(dstOff) + n; end > d.size {
+		atomic.StoreUint64(&d.size, end)
+	}
+	d.dataMu.Unlock()
+	d.touchCMtimeLocked()
+	return int64(n), nil
+}
+
+// Ioctl implements vfs.FileDescriptionImpl.Ioctl.
+func (fd *regularFileFD) Ioctl(ctx context.Context, uio usermem.IO, args arch.SyscallArguments) (uintptr, error) {
+	switch cmd := args[1].Uint(); cmd {
+	case linux.FICLONE, linux.FICLONERANGE:
+		t := kernel.TaskFromContext(ctx)
+		if t == nil {
+			return 0, syserror.ENOTTY
+		}
+		arg := linux.FileCloneRange{
+			SrcFD: int64(args[2].Int()),
+		}
+		if cmd == linux.FICLONERANGE {
+			if _, err := usermem.CopyObjectIn(ctx, uio, args[2].Pointer(), &arg, usermem.IOOpts{
+				AddressSpaceActive: true,
+			}); err != nil {
+				return 0, err
+			}
+		}
+		src := t.GetFileVFS2(int32(arg.SrcFD))
+		if src == nil {
+			return 0, syserror.EBADF
+		}
+		defer src.DecRef()
+		return 0, fd.CloneRange(ctx, src, int64(arg.SrcOffset), int64(arg.DestOffset), int64(arg.SrcLength))
+	default:
+		return fd.fileDescription.Ioctl(ctx, uio, args)
+	}
+}
+
+// CloneRange implements ioctl(FICLONERANGE) on fd, making length bytes at
+// dstOff in fd's file share storage with the bytes at srcOff in src's file. If
+// length is 0, all bytes from srcOff to the end of src's file are cloned. src
+// must be a file on the same filesystem as fd; otherwise CloneRange returns
+// EXDEV. If the server or its backing filesystem doesn't support cloning,
+// CloneRange returns EOPNOTSUPP.
+func (fd *regularFileFD) CloneRange(ctx context.Context, src *vfs.FileDescription, srcOff, dstOff, length int64) error {
+	if srcOff < 0 || dstOff < 0 || length < 0 {
+		return syserror.EINVAL
+	}
+	if !src.IsReadable() || !fd.vfsfd.IsWritable() || fd.vfsfd.StatusFlags()&linux.O_APPEND != 0 {
+		return syserror.EBADF
+	}
+	srcFD, ok := src.Impl().(*regularFileFD)
+	if !ok {
+		return syserror.EXDEV
+	}
+	s := srcFD.dentry()
+	d := fd.dentry()
+	if s.fs != d.fs {
+		return syserror.EXDEV
+	}
+	if length == 0 {
+		srcSize := int64(atomic.LoadUint64(&s.size))
+		if srcOff > srcSize {
+			return syserror.EINVAL
+		}
+		length = srcSize - srcOff
+		if length == 0 {
+			return nil
+		}
+	}
+	if srcOff+length < srcOff || dstOff+length < dstOff {
+		return syserror.EINVAL
+	}
+	if s == d && srcOff < dstOff+length && dstOff < srcOff+length {
+		// Compare Linux's fs/read_write.c:generic_remap_file_range_prep().
+		return syserror.EINVAL
+	}
+
+	// Ensure that the server clones data written through the cache.
+	if s != d {
+		if err := s.writeback(ctx, srcOff, length); err != nil {
+			return err
+		}
+	}
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	if s == d {
+		if err := d.writeback(ctx, srcOff, length); err != nil {
+			return err
+		}
+	}
+	// The server will replace the destination range in the remote file, so
+	// cached pages in it must be discarded.
+	if err := d.writebackAndEvictLocked(ctx, dstOff, length); err != nil {
+		return err
+	}
+	s.handleMu.RLock()
+	if s != d {
+		d.handleMu.RLock()
+	}
+	err := s.handle.file.cloneRange(ctx, uint64(srcOff), d.handle.file, uint64(dstOff), uint64(length))
+	if s != d {
+		d.handleMu.RUnlock()
+	}
+	s.handleMu.RUnlock()
+	if err != nil {
+		if err == syserror.ENOSYS {
+			return syserror.EOPNOTSUPP
+		}
+		return err
+	}
+	d.dataMu.Lock()
+	d.seekCache = nil
+	d.dataMu.Unlock()
+	if d.fs.opts.interop == InteropModeShared {
+		// d's metadata will be updated by revalidation.
+		return nil
+	}
+	d.dataMu.Lock()
+	if end := uint64(dstOff + length); end > d.size {
+		atomic.StoreUint64(&d.size, end)
+	}
+	d.dataMu.Unlock()
+	d.touchCMtimeLocked()
+	return nil
+}
+
+// checkDirectIOAlignment returns EINVAL if an O_DIRECT read or write of length
+// bytes at offset is not aligned to d's block size. Compare Linux's
+// fs/direct-io.c:do_blockdev_direct_IO().
+func (d *dentry) checkDirectIOAlignment(offset, length int64) error {
+	blockSize := int64(d.directIOAlignment())
+	if offset%blockSize != 0 || length%blockSize != 0 {
+		return syserror.EINVAL
+	}
+	return nil
+}
+
+// directIOAlignment returns the alignment required of offsets and lengths for
+// O_DIRECT I/O to d.
+func (d *dentry) directIOAlignment() uint32 {
+	if blockSize := atomic.LoadUint32(&d.blockSize); blockSize != 0 {
+		return blockSize
+	}
+	return usermem.PageSize
+}
+
 type dentryReadWriter struct {
 	ctx    context.Context
 	d      *dentry
 	off    uint64
 	direct bool
+
+	// If nowait is true, reads and writes that would require an RPC to the
+	// remote file fail with EAGAIN instead, as for RWF_NOWAIT.
+	nowait bool
 }
 
 var dentryReadWriterPool = sync.Pool{
@@ -222,6 +640,7 @@ func getDentryReadWriter(ctx context.Context, d *dentry, offset int64) *dentryRe
 	rw.d = d
 	rw.off = uint64(offset)
 	rw.direct = false
+	rw.nowait = false
 	return rw
 }
 
@@ -244,13 +663,18 @@ func (rw *dentryReadWriter) ReadToBlocks(dsts safemem.BlockSeq) (uint64, error)
 	// dentry.handle without locking dentry.dataMu.
 	rw.d.handleMu.RLock()
 	if (rw.d.handle.fd >= 0 && !rw.d.fs.opts.forcePageCache) || rw.d.fs.opts.interop == InteropModeShared || rw.direct {
-		n, err := rw.d.handle.readToBlocksAt(rw.ctx, dsts, rw.off)
+		if rw.nowait {
+			rw.d.handleMu.RUnlock()
+			return 0, syserror.EAGAIN
+		}
+		n, err := rw.d.handle.readToBlocksAtInterruptible(rw.ctx, dsts, rw.off)
 		rw.d.handleMu.RUnlock()
 		rw.off += n
 		return n, err
 	}
 
 	// Otherwise read from/through the cache.
+	rw.d.touchPageCache()
 	mf := rw.d.fs.mfp.MemoryFile()
 	fillCache := mf.ShouldCacheEvictable()
 	var dataMuUnlock func()
@@ -302,6 +726,13 @@ func (rw *dentryReadWriter) ReadToBlocks(dsts safemem.BlockSeq) (uint64, error)
 			seg, gap = seg.NextNonEmpty()
 
 		case gap.Ok():
+			if rw.nowait {
+				// Only data already in the cache can be read without
+				// blocking.
+				dataMuUnlock()
+				rw.d.handleMu.RUnlock()
+				return done, syserror.EAGAIN
+			}
 			gapMR := gap.Range().Intersect(mr)
 			if fillCache {
 				// Read into the cache, then re-enter the loop to read from the
@@ -311,8 +742,21 @@ func (rw *dentryReadWriter) ReadToBlocks(dsts safemem.BlockSeq) (uint64, error)
 					End:   pageRoundUp(gapMR.End),
 				}
 				optMR := gap.Range()
-				err := rw.d.cache.Fill(rw.ctx, reqMR, maxFillRange(reqMR, optMR), mf, usage.PageCache, rw.d.handle.readToBlocksAt)
+				readAt := rw.d.handle.readToBlocksAt
+				if rw.d.handle.fd < 0 {
+					// If the rest of the read spans multiple gaps, fill all
+					// of them using a single read from the server rather
+					// than one per gap.
+					if gapMRs := rw.d.cacheGapsLocked(memmap.MappableRange{reqMR.Start, pageRoundUp(end)}); len(gapMRs) > 1 {
+						reqMR.End = gapMRs[len(gapMRs)-1].End
+						optMR = reqMR
+						readAt = rw.d.prefetchGaps(rw.ctx, gapMRs)
+					}
+				}
+				err := rw.d.cache.Fill(rw.ctx, reqMR, rw.d.readaheadRange(reqMR, optMR), mf, usage.PageCache, readAt)
+				rw.d.updateCachedBytesLocked()
 				mf.MarkEvictable(rw.d, pgalloc.EvictableRange{optMR.Start, optMR.End})
+				rw.d.fs.markEvictable()
 				seg, gap = rw.d.cache.Find(rw.off)
 				if !seg.Ok() {
 					dataMuUnlock()
@@ -326,7 +770,7 @@ func (rw *dentryReadWriter) ReadToBlocks(dsts safemem.BlockSeq) (uint64, error)
 			} else {
 				// Read directly from the file.
 				gapDsts := dsts.TakeFirst64(gapMR.Length())
-				n, err := rw.d.handle.readToBlocksAt(rw.ctx, gapDsts, gapMR.Start)
+				n, err := rw.d.handle.readToBlocksAtInterruptible(rw.ctx, gapDsts, gapMR.Start)
 				done += n
 				rw.off += n
 				dsts = dsts.DropFirst64(n)
@@ -361,10 +805,17 @@ func (rw *dentryReadWriter) WriteFromBlocks(srcs safemem.BlockSeq) (uint64, erro
 	// opened with O_DIRECT, write directly to dentry.handle without locking
 	// dentry.dataMu.
 	rw.d.handleMu.RLock()
+	if rw.nowait && ((rw.d.handle.fd >= 0 && !rw.d.fs.opts.forcePageCache) || rw.d.fs.opts.interop != InteropModeExclusive || rw.direct) {
+		// Writes in these cases always go to the remote file; in particular,
+		// InteropModeWritethrough flushes writes synchronously.
+		rw.d.handleMu.RUnlock()
+		return 0, syserror.EAGAIN
+	}
 	if (rw.d.handle.fd >= 0 && !rw.d.fs.opts.forcePageCache) || rw.d.fs.opts.interop == InteropModeShared || rw.direct {
-		n, err := rw.d.handle.writeFromBlocksAt(rw.ctx, srcs, rw.off)
+		n, err := rw.d.handle.writeFromBlocksAtInterruptible(rw.ctx, srcs, rw.off)
 		rw.off += n
 		rw.d.dataMu.Lock()
+		rw.d.seekCache = nil
 		if rw.off > rw.d.size {
 			atomic.StoreUint64(&rw.d.size, rw.off)
 			// The remote file's size will implicitly be extended to the correct
@@ -376,8 +827,10 @@ func (rw *dentryReadWriter) WriteFromBlocks(srcs safemem.BlockSeq) (uint64, erro
 	}
 
 	// Otherwise write to/through the cache.
+	rw.d.touchPageCache()
 	mf := rw.d.fs.mfp.MemoryFile()
 	rw.d.dataMu.Lock()
+	rw.d.seekCache = nil
 
 	// Compute the range to write (overflow-checked).
 	start := rw.off
@@ -387,8 +840,9 @@ func (rw *dentryReadWriter) WriteFromBlocks(srcs safemem.BlockSeq) (uint64, erro
 	}
 
 	var (
-		done   uint64
-		retErr error
+		done      uint64
+		retErr    error
+		allocated bool
 	)
 	seg, gap := rw.d.cache.Find(rw.off)
 	for rw.off < end {
@@ -418,13 +872,31 @@ func (rw *dentryReadWriter) WriteFromBlocks(srcs safemem.BlockSeq) (uint64, erro
 			seg, gap = seg.NextNonEmpty()
 
 		case gap.Ok():
+			gapMR := gap.Range().Intersect(mr)
+			if rw.d.canCoalesceWriteLocked(gapMR) {
+				// Write to zero-filled cache pages instead, so that this
+				// write can be coalesced with adjacent writes.
+				var err error
+				seg, err = rw.d.allocateCachePagesLocked(gap, gapMR)
+				if err != nil {
+					retErr = err
+					goto exitLoop
+				}
+				allocated = true
+				gap = fsutil.FileRangeGapIterator{}
+				continue
+			}
+
 			// Write directly to the file. At present, we never fill the cache
 			// when writing, since doing so can convert small writes into
 			// inefficient read-modify-write cycles, and we have no mechanism
 			// for detecting or avoiding this.
-			gapMR := gap.Range().Intersect(mr)
+			if rw.nowait {
+				retErr = syserror.EAGAIN
+				goto exitLoop
+			}
 			gapSrcs := srcs.TakeFirst64(gapMR.Length())
-			n, err := rw.d.handle.writeFromBlocksAt(rw.ctx, gapSrcs, gapMR.Start)
+			n, err := rw.d.handle.writeFromBlocksAtInterruptible(rw.ctx, gapSrcs, gapMR.Start)
 			done += n
 			rw.off += n
 			srcs = srcs.DropFirst64(n)
@@ -444,6 +916,14 @@ exitLoop:
 		// The remote file's size will implicitly be extended to the correct
 		// value when we write back to it.
 	}
+	if allocated {
+		rw.d.updateCachedBytesLocked()
+	}
+	if rw.d.fs.opts.interop == InteropModeExclusive && done != 0 && !rw.nowait {
+		// Coalesced writes may be written back here, so skip this for
+		// RWF_NOWAIT writes. Their data remains dirty in the cache.
+		rw.d.coalesceWriteLocked(rw.ctx, memmap.MappableRange{start, rw.off}, allocated)
+	}
 	// If InteropModeWritethrough is in effect, flush written data back to the
 	// remote filesystem.
 	if rw.d.fs.opts.interop == InteropModeWritethrough && done != 0 {
@@ -457,6 +937,11 @@ exitLoop:
 			retErr = err
 		}
 	}
+	// If writeback is in effect, and too much dirty data has accumulated,
+	// have it written back in the background.
+	if rw.d.fs.opts.writebackLimit != 0 && done != 0 && rw.d.dirtyBytesLocked() > rw.d.fs.opts.writebackLimit {
+		rw.d.fs.queueWriteback(rw.d)
+	}
 	rw.d.dataMu.Unlock()
 	rw.d.handleMu.RUnlock()
 	return done, retErr
@@ -497,26 +982,23 @@ func (fd *regularFileFD) Seek(ctx context.Context, offset int64, whence int32) (
 		// Ensure file size is up to date.
 		d := fd.dentry()
 		if fd.filesystem().opts.interop == InteropModeShared {
-			if err := d.updateFromGetattr(ctx); err != nil {
+			if err := d.updateFromGetattrMask(ctx, p9.AttrMask{Size: true}); err != nil {
 				return 0, err
 			}
 		}
 		size := int64(atomic.LoadUint64(&d.size))
-		// For SEEK_DATA and SEEK_HOLE, treat the file as a single contiguous
-		// block of data.
 		switch whence {
 		case linux.SEEK_END:
 			offset += size
-		case linux.SEEK_DATA:
+		case linux.SEEK_DATA, linux.SEEK_HOLE:
 			if offset > size {
 				return 0, syserror.ENXIO
 			}
-			// Use offset as specified.
-		case linux.SEEK_HOLE:
-			if offset > size {
-				return 0, syserror.ENXIO
+			off, err := d.seekDataOrHole(ctx, offset, whence)
+			if err != nil {
+				return 0, err
 			}
-			offset = size
+			offset = off
 		}
 	default:
 		return 0, syserror.EINVAL
@@ -528,24 +1010,127 @@ func (fd *regularFileFD) Seek(ctx context.Context, offset int64, whence int32) (
 	return offset, nil
 }
 
+// seekCacheKey is the key type of dentry.seekCache.
+type seekCacheKey struct {
+	whence int32
+	offset int64
+}
+
+// seekDataOrHole returns the offset of the first data (for SEEK_DATA) or hole
+// (for SEEK_HOLE) in the regular file represented by d at or after offset, as
+// reported by the server. If the server does not support this query, the
+// whole file is treated as a single contiguous block of data.
+//
+// Preconditions: whence is SEEK_DATA or SEEK_HOLE. 0 <= offset <= d.size.
+func (d *dentry) seekDataOrHole(ctx context.Context, offset int64, whence int32) (int64, error) {
+	if atomic.LoadUint32(&d.fs.seekUnsupported) != 0 {
+		return seekDataOrHoleFallback(offset, whence, int64(atomic.LoadUint64(&d.size))), nil
+	}
+	p9whence := p9.SeekData
+	if whence == linux.SEEK_HOLE {
+		p9whence = p9.SeekHole
+	}
+	key := seekCacheKey{whence, offset}
+
+	d.handleMu.RLock()
+	defer d.handleMu.RUnlock()
+	if d.fs.opts.interop == InteropModeShared {
+		off, err := d.handle.file.seek(ctx, uint64(offset), p9whence)
+		return d.seekResult(off, err, offset, whence)
+	}
+
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	// Cached data that hasn't been written back isn't visible to the server.
+	if err := fsutil.SyncDirty(ctx, memmap.MappableRange{0, pageRoundUp(d.size)}, &d.cache, &d.dirty, d.size, d.fs.mfp.MemoryFile(), d.handle.writeFromBlocksAt); err != nil {
+		return 0, err
+	}
+	// Results can only be cached if all writes to the file are observed by
+	// d.dataMu; this isn't the case if the file has writable mappings, which
+	// keep pages dirty indefinitely, or if it is mapped through the host FD.
+	cacheable := d.dirty.IsEmpty() && (d.handle.fd < 0 || d.fs.opts.forcePageCache)
+	if cacheable {
+		if off, ok := d.seekCache[key]; ok {
+			return off, nil
+		}
+	}
+	off, err := d.handle.file.seek(ctx, uint64(offset), p9whence)
+	res, err := d.seekResult(off, err, offset, whence)
+	if err == nil && cacheable && atomic.LoadUint32(&d.fs.seekUnsupported) == 0 {
+		if d.seekCache == nil {
+			d.seekCache = make(map[seekCacheKey]int64)
+		}
+		d.seekCache[key] = res
+	}
+	return res, err
+}
+
+// seekResult converts the result of a server-side seek to the result of
+// dentry.seekDataOrHole.
+func (d *dentry) seekResult(off uint64, err error, offset int64, whence int32) (int64, error) {
+	if err == syserror.EOPNOTSUPP {
+		atomic.StoreUint32(&d.fs.seekUnsupported, 1)
+		return seekDataOrHoleFallback(offset, whence, int64(atomic.LoadUint64(&d.size))), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if off > math.MaxInt64 {
+		return 0, syserror.EOVERFLOW
+	}
+	return int64(off), nil
+}
+
+// seekDataOrHoleFallback implements SEEK_DATA and SEEK_HOLE for servers that
+// don't support p9.File.Seek by treating the file as a single contiguous block
+// of data.
+func seekDataOrHoleFallback(offset int64, whence int32, size int64) int64 {
+	if whence == linux.SEEK_HOLE {
+		return size
+	}
+	return offset
+}
+
 // Sync implements vfs.FileDescriptionImpl.Sync.
 func (fd *regularFileFD) Sync(ctx context.Context) error {
-	return fd.dentry().syncSharedHandle(ctx)
+	// fd may not be writable, but since all regularFileFDs for a dentry share
+	// its handle, this still writes back data dirtied through other FDs, as
+	// fsync(2) does on Linux.
+	return fd.dentry().syncSharedHandle(ctx, false /* dataOnly */)
+}
+
+// DataSync implements vfs.DataSyncer.DataSync.
+func (fd *regularFileFD) DataSync(ctx context.Context) error {
+	return fd.dentry().syncSharedHandle(ctx, true /* dataOnly */)
 }
 
-func (d *dentry) syncSharedHandle(ctx context.Context) error {
+// syncSharedHandle writes back dirty cached data for d and syncs the remote
+// file. If dataOnly is true, only the remote file's data, and the metadata
+// required to retrieve it, are synced, as for fdatasync(2). If d.handle is not
+// writable, no data can have been written through it, so syncSharedHandle
+// does nothing.
+func (d *dentry) syncSharedHandle(ctx context.Context, dataOnly bool) error {
 	d.handleMu.RLock()
 	if !d.handleWritable {
 		d.handleMu.RUnlock()
 		return nil
 	}
-	d.dataMu.Lock()
-	// Write dirty cached data to the remote file.
-	err := fsutil.SyncDirtyAll(ctx, &d.cache, &d.dirty, d.size, d.fs.mfp.MemoryFile(), d.handle.writeFromBlocksAt)
-	d.dataMu.Unlock()
+	var err error
+	// Under InteropModeWritethrough, writes have already written their data
+	// back to the remote file, so only the remote file needs to be synced.
+	if d.fs.opts.interop != InteropModeWritethrough {
+		d.dataMu.Lock()
+		// Write dirty cached data to the remote file.
+		err = fsutil.SyncDirtyAll(ctx, &d.cache, &d.dirty, d.size, d.fs.mfp.MemoryFile(), d.handle.writeFromBlocksAt)
+		d.dataMu.Unlock()
+	}
 	if err == nil {
 		// Sync the remote file.
-		err = d.handle.sync(ctx)
+		if dataOnly {
+			err = d.handle.datasync(ctx)
+		} else {
+			err = d.handle.sync(ctx)
+		}
 	}
 	d.handleMu.RUnlock()
 	return err
@@ -585,6 +1170,8 @@ func (fd *regularFileFD) ConfigureMMap(ctx context.Context, opts *memmap.MMapOpt
 	return vfs.GenericConfigureMMap(&fd.vfsfd, d, opts)
 }
 
+// mayCachePages returns true if memory mappings of d may be backed by cached
+// pages, rather than by the host FD, as determined by d.Translate().
 func (d *dentry) mayCachePages() bool {
 	if d.fs.opts.interop == InteropModeShared {
 		return false
@@ -595,7 +1182,7 @@ func (d *dentry) mayCachePages() bool {
 	d.handleMu.RLock()
 	haveFD := d.handle.fd >= 0
 	d.handleMu.RUnlock()
-	return haveFD
+	return !haveFD
 }
 
 // AddMapping implements memmap.Mappable.AddMapping.
@@ -639,6 +1226,7 @@ func (d *dentry) RemoveMapping(ctx context.Context, ms memmap.MappingSpace, ar u
 			mf.MarkEvictable(d, pgalloc.EvictableRange{r.Start, r.End})
 		}
 		d.dataMu.Unlock()
+		d.fs.markEvictable()
 	}
 	d.mapsMu.Unlock()
 }
@@ -688,6 +1276,7 @@ func (d *dentry) Translate(ctx context.Context, required, optional memmap.Mappab
 
 	mf := d.fs.mfp.MemoryFile()
 	cerr := d.cache.Fill(ctx, required, maxFillRange(required, optional), mf, usage.PageCache, d.handle.readToBlocksAt)
+	d.updateCachedBytesLocked()
 
 	var ts []memmap.Translation
 	var translatedEnd uint64
@@ -703,6 +1292,7 @@ func (d *dentry) Translate(ctx context.Context, required, optional memmap.Mappab
 			// From this point forward, this memory can be dirtied through the
 			// mapping at any time.
 			d.dirty.KeepDirty(segMR)
+			d.seekCache = nil
 			perms.Write = true
 		}
 		ts = append(ts, memmap.Translation{
@@ -744,6 +1334,127 @@ func maxFillRange(required, optional memmap.MappableRange) memmap.MappableRange
 	return optional
 }
 
+// cacheGapsLocked returns the non-empty ranges in mr that are not cached.
+//
+// Preconditions: d.dataMu must be locked.
+func (d *dentry) cacheGapsLocked(mr memmap.MappableRange) []memmap.MappableRange {
+	var gapMRs []memmap.MappableRange
+	for gap := d.cache.LowerBoundGap(mr.Start); gap.Ok() && gap.Start() < mr.End; gap = gap.NextGap() {
+		if gapMR := gap.Range().Intersect(mr); gapMR.Length() != 0 {
+			gapMRs = append(gapMRs, gapMR)
+		}
+	}
+	return gapMRs
+}
+
+// prefetchGaps reads the file ranges gapMRs, which must be increasing and
+// non-overlapping, using d.handle.readToBlockRangesAt. It returns a function,
+// with the same signature as d.handle.readToBlocksAt, that serves reads within
+// gapMRs from the prefetched data and forwards other reads to d.handle.
+//
+// Preconditions: d.handleMu must be locked.
+func (d *dentry) prefetchGaps(ctx context.Context, gapMRs []memmap.MappableRange) func(context.Context, safemem.BlockSeq, uint64) (uint64, error) {
+	bufs := make([][]byte, len(gapMRs))
+	dsts := make([]safemem.BlockSeq, len(gapMRs))
+	offsets := make([]uint64, len(gapMRs))
+	for i, gapMR := range gapMRs {
+		bufs[i] = make([]byte, gapMR.Length())
+		dsts[i] = safemem.BlockSeqOf(safemem.BlockFromSafeSlice(bufs[i]))
+		offsets[i] = gapMR.Start
+	}
+	ns, prefetchErr := d.handle.readToBlockRangesAt(ctx, dsts, offsets)
+	if prefetchErr == nil {
+		// Reads that extend past the prefetched data fail with prefetchErr;
+		// a short read without an error indicates EOF.
+		prefetchErr = io.EOF
+	}
+	return func(ctx context.Context, dsts safemem.BlockSeq, offset uint64) (uint64, error) {
+		for i, gapMR := range gapMRs {
+			if !gapMR.Contains(offset) {
+				continue
+			}
+			var src []byte
+			if bufOff := offset - gapMR.Start; bufOff < ns[i] {
+				src = bufs[i][bufOff:ns[i]]
+			}
+			n, err := safemem.CopySeq(dsts, safemem.BlockSeqOf(safemem.BlockFromSafeSlice(src)))
+			if err != nil {
+				return n, err
+			}
+			if n != dsts.NumBytes() {
+				return n, prefetchErr
+			}
+			return n, nil
+		}
+		return d.handle.readToBlocksAt(ctx, dsts, offset)
+	}
+}
+
+// prefetchSmallFile reads the whole of d into d.cache, using a single read
+// from the server if possible, if d is smaller than the
+// "prefetch_small_files" mount option. Errors are ignored, since data that
+// isn't prefetched is read on demand.
+//
+// Preconditions: d is a regular file. d.handle is readable.
+func (d *dentry) prefetchSmallFile(ctx context.Context) {
+	if d.fs.opts.prefetchSmallFiles == 0 || d.fs.opts.interop == InteropModeShared {
+		return
+	}
+	d.handleMu.RLock()
+	defer d.handleMu.RUnlock()
+	// Reads from files with host FDs don't go through the page cache.
+	if d.handle.fd >= 0 && !d.fs.opts.forcePageCache {
+		return
+	}
+	mf := d.fs.mfp.MemoryFile()
+	if !mf.ShouldCacheEvictable() {
+		return
+	}
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	if d.size == 0 || d.size >= d.fs.opts.prefetchSmallFiles {
+		return
+	}
+	mr := memmap.MappableRange{0, pageRoundUp(d.size)}
+	gapMRs := d.cacheGapsLocked(mr)
+	if len(gapMRs) == 0 {
+		return
+	}
+	readAt := d.handle.readToBlocksAt
+	if len(gapMRs) > 1 && d.handle.fd < 0 {
+		readAt = d.prefetchGaps(ctx, gapMRs)
+	}
+	d.touchPageCache()
+	d.cache.Fill(ctx, mr, mr, mf, usage.PageCache, readAt)
+	d.updateCachedBytesLocked()
+	mf.MarkEvictable(d, pgalloc.EvictableRange{mr.Start, mr.End})
+	d.fs.markEvictable()
+}
+
+// readaheadRange returns the range that should be filled into d.cache for a
+// read of required that misses the cache, where optional is the cache gap
+// containing required. Reading past required is best-effort: if it fails,
+// dentry.cache.Fill still succeeds as long as required was read.
+//
+// Preconditions: d.dataMu must be locked. required is a subset of optional.
+func (d *dentry) readaheadRange(required, optional memmap.MappableRange) memmap.MappableRange {
+	// If limitHostFDTranslation is in effect, keep the amount of file data
+	// cached per fill consistent with host FD mappings.
+	if d.fs.opts.readahead == 0 || d.fs.opts.limitHostFDTranslation {
+		return maxFillRange(required, optional)
+	}
+	mr := memmap.MappableRange{required.Start, required.End + d.fs.opts.readahead}
+	if mr.End < required.End {
+		// Overflow.
+		mr.End = math.MaxUint64
+	}
+	// Don't read ahead past EOF.
+	if eof := pageRoundUp(d.size); eof > required.End && eof < mr.End {
+		mr.End = eof
+	}
+	return mr.Intersect(optional)
+}
+
 // InvalidateUnsavable implements memmap.Mappable.InvalidateUnsavable.
 func (d *dentry) InvalidateUnsavable(ctx context.Context) error {
 	// Whether we have a host fd (and consequently what platform.File is
@@ -767,6 +1478,7 @@ func (d *dentry) InvalidateUnsavable(ctx context.Context) error {
 	// been returned after we invalidated all existing translations above.
 	d.cache.DropAll(mf)
 	d.dirty.RemoveAll()
+	d.updateCachedBytesLocked()
 
 	return nil
 }
@@ -792,6 +1504,7 @@ func (d *dentry) Evict(ctx context.Context, er pgalloc.EvictableRange) {
 		d.cache.Drop(mgapMR, mf)
 		d.dirty.KeepClean(mgapMR)
 	}
+	d.updateCachedBytesLocked()
 }
 
 // dentryPlatformFile implements platform.File. It exists solely because dentry
@@ -0,0 +1,1510 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/safemem"
+	"gvisor.dev/gvisor/pkg/sentry/arch"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/fs/lock"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/limits"
+	"gvisor.dev/gvisor/pkg/sentry/memmap"
+	"gvisor.dev/gvisor/pkg/sentry/pgalloc"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestFileSizeLimit(t *testing.T) {
+	const limit = 4096
+	ls := limits.NewLimitSet()
+	ls.SetUnchecked(limits.FileSize, limits.Limit{Cur: limit, Max: limit})
+	ctx := contexttest.WithLimitSet(contexttest.Context(t), ls)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	file := &testP9File{}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0644})
+	fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+
+	// Writes starting at or past RLIMIT_FSIZE must fail before any data is
+	// sent to the remote file.
+	src := usermem.BytesIOSequence(make([]byte, 10))
+	if _, err := fd.PWrite(ctx, src, limit, vfs.WriteOptions{}); err != syserror.ErrExceedsFileSizeLimit {
+		t.Errorf("PWrite at RLIMIT_FSIZE: got err %v, want %v", err, syserror.ErrExceedsFileSizeLimit)
+	}
+
+	// Truncating a file to a size larger than RLIMIT_FSIZE must also fail.
+	stat := linux.Statx{
+		Mask: linux.STATX_SIZE,
+		Size: limit + 1,
+	}
+	if err := fd.SetStat(ctx, vfs.SetStatOptions{Stat: stat}); err != syserror.ErrExceedsFileSizeLimit {
+		t.Errorf("SetStat(size=%d): got err %v, want %v", stat.Size, err, syserror.ErrExceedsFileSizeLimit)
+	}
+
+	if err := fd.Sync(ctx); err != nil {
+		t.Fatalf("Sync(): %v", err)
+	}
+	if got := len(file.contents()); got != 0 {
+		t.Errorf("remote file has size %d, want 0", got)
+	}
+}
+
+func TestSyncReadOnlyFD(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	file := &testP9File{data: []byte("hello, world")}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: uint64(len(file.data))})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+	defer root.DecRef()
+
+	// Dirty cached pages through a writable FD. Reading first fills the
+	// cache, so that the write is buffered rather than written through.
+	wfd, err := openAt(ctx, root, "file", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDWR): %v", err)
+	}
+	defer wfd.DecRef()
+	if _, err := wfd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 5)), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	if _, err := wfd.PWrite(ctx, usermem.BytesIOSequence([]byte("HELLO")), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(): %v", err)
+	}
+	if got, want := string(file.contents()), "hello, world"; got != want {
+		t.Fatalf("remote file contains %q before fsync, want %q", got, want)
+	}
+
+	// fsync through a read-only FD must succeed and write back the dirty
+	// pages.
+	rfd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDONLY): %v", err)
+	}
+	defer rfd.DecRef()
+	if err := rfd.Sync(ctx); err != nil {
+		t.Fatalf("Sync() on read-only FD: %v", err)
+	}
+	if got, want := string(file.contents()), "HELLO, world"; got != want {
+		t.Errorf("remote file contains %q after fsync, want %q", got, want)
+	}
+	if file.fsyncs != 1 {
+		t.Errorf("remote file synced %d times, want 1", file.fsyncs)
+	}
+}
+
+// testMappingSpace is a memmap.MappingSpace that ignores invalidations.
+type testMappingSpace struct{}
+
+// Invalidate implements memmap.MappingSpace.Invalidate.
+func (*testMappingSpace) Invalidate(ar usermem.AddrRange, opts memmap.InvalidateOpts) {}
+
+func TestMapFixedReplacesMapping(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	const size = 4 * usermem.PageSize
+	file := &testP9File{data: make([]byte, size)}
+	for i := range file.data {
+		file.data[i] = byte(i/usermem.PageSize + 1)
+	}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0644, Size: size})
+	// Use an open handle without a host FD, so that mappings are backed by
+	// cached pages.
+	d.handle.file = p9file{file: file}
+	d.handleReadable = true
+	d.handleWritable = true
+
+	// Map the whole file writably, and dirty its second page through the
+	// mapping.
+	ms := &testMappingSpace{}
+	const base = usermem.Addr(0x10000)
+	ar := usermem.AddrRange{base, base + size}
+	if err := d.AddMapping(ctx, ms, ar, 0, true /* writable */); err != nil {
+		t.Fatalf("AddMapping(): %v", err)
+	}
+	page1 := memmap.MappableRange{usermem.PageSize, 2 * usermem.PageSize}
+	if _, err := d.Translate(ctx, page1, page1, usermem.Write); err != nil {
+		t.Fatalf("Translate(%v, Write): %v", page1, err)
+	}
+
+	// Emulate mmap(MAP_FIXED) of the last page of the file, read-only, over
+	// the second page of the existing mapping: mm removes the replaced part
+	// of the old mapping before adding the new one.
+	fixedAR := usermem.AddrRange{base + usermem.PageSize, base + 2*usermem.PageSize}
+	d.RemoveMapping(ctx, ms, fixedAR, usermem.PageSize, true /* writable */)
+	if err := d.AddMapping(ctx, ms, fixedAR, 3*usermem.PageSize, false /* writable */); err != nil {
+		t.Fatalf("AddMapping(): %v", err)
+	}
+
+	want := map[memmap.MappableRange]memmap.MappingsOfRange{
+		{0, usermem.PageSize}: {
+			{ms, usermem.AddrRange{base, base + usermem.PageSize}, true}: struct{}{},
+		},
+		{2 * usermem.PageSize, 3 * usermem.PageSize}: {
+			{ms, usermem.AddrRange{base + 2*usermem.PageSize, base + 3*usermem.PageSize}, true}: struct{}{},
+		},
+		{3 * usermem.PageSize, 4 * usermem.PageSize}: {
+			{ms, usermem.AddrRange{base + 3*usermem.PageSize, base + 4*usermem.PageSize}, true}: struct{}{},
+			{ms, fixedAR, false}: struct{}{},
+		},
+	}
+	got := make(map[memmap.MappableRange]memmap.MappingsOfRange)
+	for seg := d.mappings.FirstSegment(); seg.Ok(); seg = seg.NextSegment() {
+		got[seg.Range()] = seg.Value()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("d.mappings: got %v, want %v", got, want)
+	}
+
+	// The dirty second page is no longer mapped, so it must be possible to
+	// clean it by writing it back.
+	for seg := d.dirty.FirstSegment(); seg.Ok(); seg = seg.NextSegment() {
+		if seg.Range().Overlaps(page1) && seg.Value().Keep {
+			t.Errorf("unmapped dirty range %v is still kept dirty", seg.Range())
+		}
+	}
+
+	// Reads through the new mapping return the last page of the file.
+	page3 := memmap.MappableRange{3 * usermem.PageSize, 4 * usermem.PageSize}
+	ts, err := d.Translate(ctx, page3, page3, usermem.Read)
+	if err != nil {
+		t.Fatalf("Translate(%v, Read): %v", page3, err)
+	}
+	buf := make([]byte, 0, usermem.PageSize)
+	for _, tr := range ts {
+		ims, err := tr.File.MapInternal(tr.FileRange(), usermem.Read)
+		if err != nil {
+			t.Fatalf("MapInternal(): %v", err)
+		}
+		chunk := make([]byte, ims.NumBytes())
+		if _, err := safemem.CopySeq(safemem.BlockSeqOf(safemem.BlockFromSafeSlice(chunk)), ims); err != nil {
+			t.Fatalf("CopySeq(): %v", err)
+		}
+		buf = append(buf, chunk...)
+	}
+	if want := file.data[3*usermem.PageSize:]; !bytes.Equal(buf, want) {
+		t.Errorf("read through new mapping returned wrong data: got %d bytes starting with %v, want %d bytes of %v", len(buf), buf[:1], len(want), want[0])
+	}
+}
+
+func TestMapFixedReplacesMapping(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	const size = 4 * usermem.PageSize
+	file := &testP9File{data: make([]byte, size)}
+	for i := range file.data {
+		file.data[i] = byte(i/usermem.PageSize + 1)
+	}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0644, Size: size})
+	// Use an open handle without a host FD, so that mappings are backed by
+	// cached pages.
+	d.handle.file = p9file{file: file}
+	d.handleReadable = true
+	d.handleWritable = true
+
+	// Map the whole file writably, and dirty its second page through the
+	// mapping.
+	ms := &testMappingSpace{}
+	const base = usermem.Addr(0x10000)
+	ar := usermem.AddrRange{base, base + size}
+	if err := d.AddMapping(ctx, ms, ar, 0, true /* writable */); err != nil {
+		t.Fatalf("AddMapping(): %v", err)
+	}
+	page1 := memmap.MappableRange{usermem.PageSize, 2 * usermem.PageSize}
+	if _, err := d.Translate(ctx, page1, page1, usermem.Write); err != nil {
+		t.Fatalf("Translate(%v, Write): %v", page1, err)
+	}
+
+	// Emulate mmap(MAP_FIXED) of the last page of the file, read-only, over
+	// the second page of the existing mapping: mm removes the replaced part
+	// of the old mapping before adding the new one.
+	fixedAR := usermem.AddrRange{base + usermem.PageSize, base + 2*usermem.PageSize}
+	d.RemoveMapping(ctx, ms, fixedAR, usermem.PageSize, true /* writable */)
+	if err := d.AddMapping(ctx, ms, fixedAR, 3*usermem.PageSize, false /* writable */); err != nil {
+		t.Fatalf("AddMapping(): %v", err)
+	}
+
+	want := map[memmap.MappableRange]memmap.MappingsOfRange{
+		{0, usermem.PageSize}: {
+			{ms, usermem.AddrRange{base, base + usermem.PageSize}, true}: struct{}{},
+		},
+		{2 * usermem.PageSize, 3 * usermem.PageSize}: {
+			{ms, usermem.AddrRange{base + 2*usermem.PageSize, base + 3*usermem.PageSize}, true}: struct{}{},
+		},
+		{3 * usermem.PageSize, 4 * usermem.PageSize}: {
+			{ms, usermem.AddrRange{base + 3*usermem.PageSize, base + 4*usermem.PageSize}, true}: struct{}{},
+			{ms, fixedAR, false}: struct{}{},
+		},
+	}
+	got := make(map[memmap.MappableRange]memmap.MappingsOfRange)
+	for seg := d.mappings.FirstSegment(); seg.Ok(); seg = seg.NextSegment() {
+		got[seg.Range()] = seg.Value()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("d.mappings: got %v, want %v", got, want)
+	}
+
+	// The dirty second page is no longer mapped, so it must be possible to
+	// clean it by writing it back.
+	for seg := d.dirty.FirstSegment(); seg.Ok(); seg = seg.NextSegment() {
+		if seg.Range().Overlaps(page1) && seg.Value().Keep {
+			t.Errorf("unmapped dirty range %v is still kept dirty", seg.Range())
+		}
+	}
+
+	// Reads through the new mapping return the last page of the file.
+	page3 := memmap.MappableRange{3 * usermem.PageSize, 4 * usermem.PageSize}
+	ts, err := d.Translate(ctx, page3, page3, usermem.Read)
+	if err != nil {
+		t.Fatalf("Translate(%v, Read): %v", page3, err)
+	}
+	buf := make([]byte, 0, usermem.PageSize)
+	for _, tr := range ts {
+		ims, err := tr.File.MapInternal(tr.FileRange(), usermem.Read)
+		if err != nil {
+			t.Fatalf("MapInternal(): %v", err)
+		}
+		chunk := make([]byte, ims.NumBytes())
+		if _, err := safemem.CopySeq(safemem.BlockSeqOf(safemem.BlockFromSafeSlice(chunk)), ims); err != nil {
+			t.Fatalf("CopySeq(): %v", err)
+		}
+		buf = append(buf, chunk...)
+	}
+	if want := file.data[3*usermem.PageSize:]; !bytes.Equal(buf, want) {
+		t.Errorf("read through new mapping returned wrong data: got %d bytes starting with %v, want %d bytes of %v", len(buf), buf[:1], len(want), want[0])
+	}
+}
+
+func TestTruncateRejectedByServer(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		interop: InteropModeExclusive,
+	})
+	const size = 2 * usermem.PageSize
+	// The file is append-only on the server, which rejects truncation.
+	file := &testP9File{
+		data:       bytes.Repeat([]byte{'a'}, size),
+		setAttrErr: syserror.EPERM,
+	}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: size})
+	fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+	// Fill the page cache, so that a truncation would drop cached pages.
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, size)), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+
+	err = fd.SetStat(ctx, vfs.SetStatOptions{Stat: linux.Statx{
+		Mask: linux.STATX_SIZE,
+		Size: 0,
+	}})
+	if err != syserror.EPERM {
+		t.Fatalf("SetStat(size=0): got error %v, want %v", err, syserror.EPERM)
+	}
+	if got := atomic.LoadUint64(&d.size); got != size {
+		t.Errorf("cached size after rejected truncate: got %d, want %d", got, size)
+	}
+	// Reads are still served with the file's full contents.
+	buf := make([]byte, size)
+	n, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{})
+	if err != nil && err != io.EOF {
+		t.Fatalf("PRead(): %v", err)
+	}
+	if want := bytes.Repeat([]byte{'a'}, size); n != size || !bytes.Equal(buf, want) {
+		t.Errorf("PRead() after rejected truncate: got %d bytes, want %d bytes of 'a'", n, size)
+	}
+}
+
+func TestTruncateCache(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		interop: InteropModeExclusive,
+		msize:   1 << 20,
+	})
+	file := &testP9File{data: []byte("hello")}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: 5})
+	fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+	reads := func() int {
+		file.dataMu.Lock()
+		defer file.dataMu.Unlock()
+		return file.reads
+	}
+	read := func(offset int64, length int) []byte {
+		buf := make([]byte, length)
+		n, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), offset, vfs.ReadOptions{})
+		if err != nil && err != io.EOF {
+			t.Fatalf("PRead(offset=%d, length=%d): %v", offset, length, err)
+		}
+		return buf[:n]
+	}
+	truncate := func(size uint64) {
+		if err := fd.SetStat(ctx, vfs.SetStatOptions{Stat: linux.Statx{
+			Mask: linux.STATX_SIZE,
+			Size: size,
+		}}); err != nil {
+			t.Fatalf("SetStat(size=%d): %v", size, err)
+		}
+		stat, err := fd.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_SIZE | linux.STATX_BLOCKS})
+		if err != nil {
+			t.Fatalf("Stat(): %v", err)
+		}
+		if stat.Size != size || stat.Blocks != (size+511)/512 {
+			t.Errorf("Stat() after truncate to %d: got size %d, blocks %d; want size %d, blocks %d", size, stat.Size, stat.Blocks, size, (size+511)/512)
+		}
+	}
+
+	// Fill the page cache, then dirty the cached page beyond EOF, as a
+	// shared mapping of the file may.
+	if got := read(0, 5); string(got) != "hello" {
+		t.Fatalf("PRead(): got %q, want %q", got, "hello")
+	}
+	d.dataMu.Lock()
+	seg := d.cache.FindSegment(0)
+	ims, err := fs.mfp.MemoryFile().MapInternal(seg.FileRangeOf(memmap.MappableRange{5, 8}), usermem.Write)
+	if err != nil {
+		t.Fatalf("MapInternal(): %v", err)
+	}
+	if _, err := safemem.CopySeq(ims, safemem.BlockSeqOf(safemem.BlockFromSafeSlice([]byte("xyz")))); err != nil {
+		t.Fatalf("CopySeq(): %v", err)
+	}
+	d.dataMu.Unlock()
+	before := reads()
+
+	// Growing the file exposes zeroes, read from the cache.
+	const grownSize = 2*usermem.PageSize + 100
+	truncate(grownSize)
+	want := append([]byte("hello"), make([]byte, grownSize-5)...)
+	if got := read(0, grownSize+10); !bytes.Equal(got, want) {
+		t.Errorf("PRead() after growing truncate: got %d bytes %q..., want %d bytes %q...", len(got), got[:8], len(want), want[:8])
+	}
+	if got := reads(); got != before {
+		t.Errorf("got %d read RPCs after growing truncate, want %d", got, before)
+	}
+
+	// Shrinking the file hides data beyond the new EOF, and growing it again
+	// exposes zeroes.
+	truncate(3)
+	if got, want := read(1, 10), "el"; string(got) != want {
+		t.Errorf("PRead() across EOF after shrinking truncate: got %q, want %q", got, want)
+	}
+	truncate(8)
+	if got, want := read(0, 10), "hel\x00\x00\x00\x00\x00"; string(got) != want {
+		t.Errorf("PRead() across old EOF after growing truncate: got %q, want %q", got, want)
+	}
+	if got := reads(); got != before {
+		t.Errorf("got %d read RPCs after truncates, want %d", got, before)
+	}
+	if got, want := string(file.contents()), "hel\x00\x00\x00\x00\x00"; got != want {
+		t.Errorf("remote file contains %q, want %q", got, want)
+	}
+}
+
+func TestTruncateOpenReusesHandle(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	file := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeRegular | 0644, NLink: 1, Size: 5},
+		data: []byte("hello"),
+	}
+	root := newTestRoot(ctx, t, fs, &testP9File{
+		attr:     p9.Attr{Mode: p9.ModeDirectory | 0755},
+		children: map[string]*testP9File{"file": file},
+	}, nil)
+	defer root.DecRef()
+
+	for i := 1; i <= 2; i++ {
+		fd, err := openAt(ctx, root, "file", linux.O_WRONLY|linux.O_CREAT|linux.O_TRUNC)
+		if err != nil {
+			t.Fatalf("OpenAt(O_WRONLY|O_CREAT|O_TRUNC) #%d: %v", i, err)
+		}
+		if _, err := fd.Write(ctx, usermem.BytesIOSequence([]byte("abc")), vfs.WriteOptions{}); err != nil {
+			t.Fatalf("Write() #%d: %v", i, err)
+		}
+		fd.DecRef()
+		// The first open needs a writable handle, which is opened with
+		// O_TRUNC. The second reuses it, truncating the file through it.
+		if file.opens != 1 {
+			t.Errorf("after open #%d: got %d Open RPCs, want 1", i, file.opens)
+		}
+	}
+	if len(file.setAttrMasks) != 1 || !file.setAttrMasks[0].Size || file.setAttrs[0].Size != 0 {
+		t.Errorf("got SetAttr masks %+v, attrs %+v; want a single truncation to size 0", file.setAttrMasks, file.setAttrs)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	const size = 2 * usermem.PageSize
+	file := &testP9File{data: make([]byte, size)}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: size, BlockSize: usermem.PageSize})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+	defer root.DecRef()
+	cachedFD, err := openAt(ctx, root, "file", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDWR): %v", err)
+	}
+	defer cachedFD.DecRef()
+	directFD, err := openAt(ctx, root, "file", linux.O_RDWR|linux.O_DIRECT)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDWR|O_DIRECT): %v", err)
+	}
+	defer directFD.DecRef()
+
+	// Fill the page cache through the cached FD.
+	if _, err := cachedFD.PRead(ctx, usermem.BytesIOSequence(make([]byte, size)), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(cached): %v", err)
+	}
+
+	// An O_DIRECT write is visible on the server without a sync.
+	want := bytes.Repeat([]byte{'a'}, usermem.PageSize)
+	if _, err := directFD.PWrite(ctx, usermem.BytesIOSequence(want), usermem.PageSize, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(direct): %v", err)
+	}
+	if got := file.contents()[usermem.PageSize:]; !bytes.Equal(got, want) {
+		t.Errorf("server contents after O_DIRECT write: got %q..., want %q...", got[:8], want[:8])
+	}
+	// It is also visible through the cached FD.
+	buf := make([]byte, usermem.PageSize)
+	if _, err := cachedFD.PRead(ctx, usermem.BytesIOSequence(buf), usermem.PageSize, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(cached): %v", err)
+	}
+	if !bytes.Equal(buf, want) {
+		t.Errorf("cached read after O_DIRECT write: got %q..., want %q...", buf[:8], want[:8])
+	}
+
+	// O_DIRECT I/O must be aligned to the block size.
+	for _, test := range []struct {
+		off, len int64
+	}{
+		{off: 1, len: usermem.PageSize},
+		{off: 0, len: usermem.PageSize - 1},
+	} {
+		if _, err := directFD.PWrite(ctx, usermem.BytesIOSequence(make([]byte, test.len)), test.off, vfs.WriteOptions{}); err != syserror.EINVAL {
+			t.Errorf("PWrite(direct, off=%d, len=%d): got error %v, want %v", test.off, test.len, err, syserror.EINVAL)
+		}
+		if _, err := directFD.PRead(ctx, usermem.BytesIOSequence(make([]byte, test.len)), test.off, vfs.ReadOptions{}); err != syserror.EINVAL {
+			t.Errorf("PRead(direct, off=%d, len=%d): got error %v, want %v", test.off, test.len, err, syserror.EINVAL)
+		}
+	}
+	// Misaligned I/O through the cached FD is unaffected.
+	if _, err := cachedFD.PWrite(ctx, usermem.BytesIOSequence([]byte{'b'}), 1, vfs.WriteOptions{}); err != nil {
+		t.Errorf("PWrite(cached, off=1, len=1): %v", err)
+	}
+}
+
+// testBlocker is a lock.Blocker that blocks until woken or cancelled.
+type testBlocker struct {
+	cancel <-chan struct{}
+}
+
+// Block implements lock.Blocker.Block.
+func (b testBlocker) Block(c <-chan struct{}) error {
+	select {
+	case <-c:
+		return nil
+	case <-b.cancel:
+		return syserror.ErrInterrupted
+	}
+}
+
+func TestLockPOSIX(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	d := newTestDentry(ctx, t, fs, &testP9File{}, p9.Attr{Mode: p9.ModeRegular | 0666})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+	defer root.DecRef()
+	var fds [2]*vfs.FileDescription
+	for i := range fds {
+		fd, err := openAt(ctx, root, "file", linux.O_RDWR)
+		if err != nil {
+			t.Fatalf("OpenAt(O_RDWR): %v", err)
+		}
+		defer fd.DecRef()
+		fds[i] = fd
+	}
+	const (
+		uid1 = lock.UniqueID(1)
+		uid2 = lock.UniqueID(2)
+	)
+	rng := lock.LockRange{0, 10}
+
+	// Conflicting locks through different FDs are rejected.
+	if err := fds[0].Impl().LockPOSIX(ctx, uid1, lock.WriteLock, rng, nil /* block */); err != nil {
+		t.Fatalf("LockPOSIX(uid1, write): %v", err)
+	}
+	if err := fds[1].Impl().LockPOSIX(ctx, uid2, lock.ReadLock, rng, nil /* block */); err != syserror.ErrWouldBlock {
+		t.Fatalf("LockPOSIX(uid2, read): got error %v, want %v", err, syserror.ErrWouldBlock)
+	}
+	// Non-overlapping locks don't conflict.
+	if err := fds[1].Impl().LockPOSIX(ctx, uid2, lock.WriteLock, lock.LockRange{10, 20}, nil /* block */); err != nil {
+		t.Fatalf("LockPOSIX(uid2, write, non-overlapping): %v", err)
+	}
+
+	// A cancelled blocking lock fails.
+	cancel := make(chan struct{})
+	close(cancel)
+	if err := fds[1].Impl().LockPOSIX(ctx, uid2, lock.ReadLock, rng, testBlocker{cancel}); err != syserror.ErrWouldBlock {
+		t.Fatalf("LockPOSIX(uid2, read, cancelled): got error %v, want %v", err, syserror.ErrWouldBlock)
+	}
+
+	// A blocking lock is granted once the conflicting lock is released.
+	errC := make(chan error, 1)
+	go func() {
+		errC <- fds[1].Impl().LockPOSIX(ctx, uid2, lock.ReadLock, rng, testBlocker{})
+	}()
+	select {
+	case err := <-errC:
+		t.Fatalf("blocking LockPOSIX(uid2, read) returned %v before conflicting lock was released", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := fds[0].Impl().UnlockPOSIX(ctx, uid1, rng); err != nil {
+		t.Fatalf("UnlockPOSIX(uid1): %v", err)
+	}
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Fatalf("blocking LockPOSIX(uid2, read): %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("blocking LockPOSIX(uid2, read) was not granted after conflicting lock was released")
+	}
+	// uid2 now holds the lock, so uid1 can't take it.
+	if err := fds[0].Impl().LockPOSIX(ctx, uid1, lock.WriteLock, rng, nil /* block */); err != syserror.ErrWouldBlock {
+		t.Fatalf("LockPOSIX(uid1, write): got error %v, want %v", err, syserror.ErrWouldBlock)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, test := range []struct {
+		name        string
+		mode        uint64
+		allocateErr error
+		wantErr     error
+		wantSize    uint64
+		wantBlocks  uint64
+	}{
+		{
+			name:       "extend",
+			mode:       0,
+			wantSize:   3 * usermem.PageSize,
+			wantBlocks: 3 * usermem.PageSize / 512,
+		},
+		{
+			name:       "keep size",
+			mode:       linux.FALLOC_FL_KEEP_SIZE,
+			wantSize:   usermem.PageSize,
+			wantBlocks: 3 * usermem.PageSize / 512,
+		},
+		{
+			name:       "unsupported mode",
+			mode:       linux.FALLOC_FL_PUNCH_HOLE | linux.FALLOC_FL_KEEP_SIZE,
+			wantErr:    syserror.EOPNOTSUPP,
+			wantSize:   usermem.PageSize,
+			wantBlocks: usermem.PageSize / 512,
+		},
+		{
+			name:        "unsupported by server",
+			mode:        0,
+			allocateErr: syserror.EOPNOTSUPP,
+			wantErr:     syserror.EOPNOTSUPP,
+			wantSize:    usermem.PageSize,
+			wantBlocks:  usermem.PageSize / 512,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := newTestFilesystem(ctx, filesystemOptions{})
+			file := &testP9File{
+				data:        make([]byte, usermem.PageSize),
+				allocateErr: test.allocateErr,
+			}
+			d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: usermem.PageSize})
+			fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+
+			// Allocate past EOF.
+			if err := fd.Allocate(ctx, test.mode, 2*usermem.PageSize, usermem.PageSize); err != test.wantErr {
+				t.Fatalf("Allocate(): got error %v, want %v", err, test.wantErr)
+			}
+			stat, err := fd.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_SIZE | linux.STATX_BLOCKS})
+			if err != nil {
+				t.Fatalf("Stat(): %v", err)
+			}
+			if stat.Size != test.wantSize {
+				t.Errorf("Stat(): got size %d, want %d", stat.Size, test.wantSize)
+			}
+			if stat.Blocks != test.wantBlocks {
+				t.Errorf("Stat(): got %d blocks, want %d", stat.Blocks, test.wantBlocks)
+			}
+			if got := uint64(len(file.contents())); got != test.wantSize {
+				t.Errorf("server file size: got %d, want %d", got, test.wantSize)
+			}
+
+			// Truncation frees preallocated blocks beyond the new size.
+			if err := fd.SetStat(ctx, vfs.SetStatOptions{Stat: linux.Statx{Mask: linux.STATX_SIZE, Size: usermem.PageSize}}); err != nil {
+				t.Fatalf("SetStat(size): %v", err)
+			}
+			if stat, err := fd.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_BLOCKS}); err != nil || stat.Blocks != usermem.PageSize/512 {
+				t.Errorf("Stat() after truncation: got (%d blocks, %v), want (%d blocks, nil)", stat.Blocks, err, usermem.PageSize/512)
+			}
+		})
+	}
+}
+
+func TestSeekDataHole(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, test := range []struct {
+		name    string
+		seekErr error
+		whence  int32
+		offset  int64
+		want    int64
+		wantErr error
+	}{
+		{
+			name:   "data at start",
+			whence: linux.SEEK_DATA,
+			offset: 0,
+			want:   0,
+		},
+		{
+			name:   "data after hole",
+			whence: linux.SEEK_DATA,
+			offset: usermem.PageSize + 1,
+			want:   2 * usermem.PageSize,
+		},
+		{
+			name:   "hole after data",
+			whence: linux.SEEK_HOLE,
+			offset: 1,
+			want:   usermem.PageSize,
+		},
+		{
+			name:   "hole in hole",
+			whence: linux.SEEK_HOLE,
+			offset: usermem.PageSize + 1,
+			want:   usermem.PageSize + 1,
+		},
+		{
+			name:   "hole at EOF",
+			whence: linux.SEEK_HOLE,
+			offset: 2 * usermem.PageSize,
+			want:   3 * usermem.PageSize,
+		},
+		{
+			name:    "data at EOF",
+			whence:  linux.SEEK_DATA,
+			offset:  3 * usermem.PageSize,
+			wantErr: syserror.ENXIO,
+		},
+		{
+			name:    "data unsupported by server",
+			seekErr: syserror.EOPNOTSUPP,
+			whence:  linux.SEEK_DATA,
+			offset:  usermem.PageSize + 1,
+			want:    usermem.PageSize + 1,
+		},
+		{
+			name:    "hole unsupported by server",
+			seekErr: syserror.EOPNOTSUPP,
+			whence:  linux.SEEK_HOLE,
+			offset:  1,
+			want:    3 * usermem.PageSize,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := newTestFilesystem(ctx, filesystemOptions{})
+			// The file contains data in its first and third pages, and a hole
+			// in its second.
+			file := &testP9File{
+				data:    make([]byte, 3*usermem.PageSize),
+				holes:   []memmap.MappableRange{{usermem.PageSize, 2 * usermem.PageSize}},
+				seekErr: test.seekErr,
+			}
+			d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: 3 * usermem.PageSize})
+			fd := openTestFile(ctx, t, fs, d, linux.O_RDONLY)
+
+			// Repeat the query to check that results are cached, and that
+			// servers that don't support it are only asked once.
+			for i := 0; i < 2; i++ {
+				got, err := fd.Seek(ctx, test.offset, test.whence)
+				if err != test.wantErr {
+					t.Fatalf("Seek(%d, %d): got error %v, want %v", test.offset, test.whence, err, test.wantErr)
+				}
+				if err == nil && got != test.want {
+					t.Errorf("Seek(%d, %d): got offset %d, want %d", test.offset, test.whence, got, test.want)
+				}
+			}
+			wantSeeks := 1
+			if test.wantErr != nil {
+				// Errors are not cached.
+				wantSeeks = 2
+			}
+			if file.seeks != wantSeeks {
+				t.Errorf("got %d server seeks, want %d", file.seeks, wantSeeks)
+			}
+		})
+	}
+}
+
+func TestSeekDataHoleCacheInvalidatedByWrite(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	file := &testP9File{
+		data:  make([]byte, 3*usermem.PageSize),
+		holes: []memmap.MappableRange{{usermem.PageSize, 2 * usermem.PageSize}},
+	}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: 3 * usermem.PageSize})
+	fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+
+	if got, err := fd.Seek(ctx, 0, linux.SEEK_HOLE); err != nil || got != usermem.PageSize {
+		t.Fatalf("Seek(0, SEEK_HOLE): got (%d, %v), want (%d, nil)", got, err, usermem.PageSize)
+	}
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence([]byte("x")), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(): %v", err)
+	}
+	if got, err := fd.Seek(ctx, 0, linux.SEEK_HOLE); err != nil || got != usermem.PageSize {
+		t.Fatalf("Seek(0, SEEK_HOLE) after write: got (%d, %v), want (%d, nil)", got, err, usermem.PageSize)
+	}
+	if file.seeks != 2 {
+		t.Errorf("got %d server seeks, want 2", file.seeks)
+	}
+}
+
+func TestWriteMsizeBoundaries(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const msize = 4096
+	for _, size := range []int{msize - 1, msize, msize + 1} {
+		t.Run(fmt.Sprintf("size=%d", size), func(t *testing.T) {
+			file := &testP9File{attr: p9.Attr{Mode: p9.ModeRegular | 0666, NLink: 1}}
+			rootFile := &testP9File{
+				attr:     p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+				children: map[string]*testP9File{"file": file},
+			}
+			addr, _ := serveTestP9(t, rootFile)
+			// With cache=none, each write is sent to the server immediately,
+			// split into as many Twrites as required to fit in msize.
+			root := mountTestP9(ctx, t, fmt.Sprintf("trans=unix,addr=%s,msize=%d,cache=none", addr, msize))
+			defer root.DecRef()
+			fd, err := openAt(ctx, root, "file", linux.O_RDWR)
+			if err != nil {
+				t.Fatalf("OpenAt(file, O_RDWR): %v", err)
+			}
+			defer fd.DecRef()
+
+			want := make([]byte, size)
+			for i := range want {
+				want[i] = byte('a' + i%26)
+			}
+			n, err := fd.PWrite(ctx, usermem.BytesIOSequence(want), 0, vfs.WriteOptions{})
+			if err != nil || n != int64(size) {
+				t.Fatalf("PWrite(): got (%d, %v), want (%d, nil)", n, err, size)
+			}
+			if got := file.contents(); !bytes.Equal(got, want) {
+				t.Errorf("remote file: got %d bytes that differ from the written data", len(got))
+			}
+			file.dataMu.Lock()
+			writes := file.writes
+			file.dataMu.Unlock()
+			if wantMin := 1 + (size-1)/msize; writes < wantMin {
+				t.Errorf("got %d write RPCs, want at least %d", writes, wantMin)
+			}
+		})
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const (
+		size      = 64 * usermem.PageSize
+		readahead = 8 * usermem.PageSize
+	)
+	for _, test := range []struct {
+		desc      string
+		size      uint64
+		readahead uint64
+		want      uint64 // bytes cached by a 1-byte read at offset 0
+	}{
+		{
+			desc: "default",
+			size: size,
+			want: 64 << 10,
+		},
+		{
+			desc:      "readahead",
+			size:      size,
+			readahead: readahead,
+			want:      usermem.PageSize + readahead,
+		},
+		{
+			desc:      "readahead past EOF",
+			size:      4*usermem.PageSize + 1,
+			readahead: readahead,
+			want:      5 * usermem.PageSize,
+		},
+	} {
+		fs := newTestFilesystem(ctx, filesystemOptions{readahead: test.readahead})
+		file := &testP9File{data: make([]byte, test.size)}
+		d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0644, Size: test.size})
+		if err != nil {
+			t.Fatalf("%s: fs.newDentry(): %v", test.desc, err)
+		}
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"f": d})
+		fd, err := openAt(ctx, root, "f", linux.O_RDONLY)
+		if err != nil {
+			t.Fatalf("%s: OpenAt(f): %v", test.desc, err)
+		}
+
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 1)), 0, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("%s: PRead(0, 1): %v", test.desc, err)
+		}
+		d.dataMu.RLock()
+		seg := d.cache.FindSegment(0)
+		var cached uint64
+		if seg.Ok() {
+			cached = seg.End()
+		}
+		d.dataMu.RUnlock()
+		if cached != test.want {
+			t.Errorf("%s: got %d bytes cached after 1-byte read, want %d", test.desc, cached, test.want)
+		}
+
+		// Reading the rest of the cached range must not require more reads
+		// from the server.
+		file.dataMu.Lock()
+		reads := file.reads
+		file.dataMu.Unlock()
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, cached-1)), 1, vfs.ReadOptions{}); err != nil && err != io.EOF {
+			t.Errorf("%s: PRead(1, %d): %v", test.desc, cached-1, err)
+		}
+		file.dataMu.Lock()
+		if file.reads != reads {
+			t.Errorf("%s: reading cached pages issued %d reads to the server, want 0", test.desc, file.reads-reads)
+		}
+		file.dataMu.Unlock()
+
+		fd.DecRef()
+		root.DecRef()
+	}
+}
+
+func TestReadFragmentedCache(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const pages = 8
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	data := make([]byte, pages*usermem.PageSize)
+	for i := range data {
+		data[i] = byte(i / usermem.PageSize)
+	}
+	file := &testP9File{data: append([]byte(nil), data...)}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0644, Size: uint64(len(data))})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"f": d})
+	defer root.DecRef()
+	fd, err := openAt(ctx, root, "f", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(f): %v", err)
+	}
+	defer fd.DecRef()
+
+	// Cache the whole file, then evict odd pages so that cached and uncached
+	// pages alternate.
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, len(data))), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	for i := uint64(1); i < pages; i += 2 {
+		d.Evict(ctx, pgalloc.EvictableRange{i * usermem.PageSize, (i + 1) * usermem.PageSize})
+	}
+	// Change the remote file's data everywhere. Since the filesystem is in
+	// InteropModeExclusive, cached pages must continue to be read from the
+	// cache, while evicted pages are read from the server.
+	want := append([]byte(nil), data...)
+	file.dataMu.Lock()
+	for i := range file.data {
+		file.data[i] += pages
+		if page := i / usermem.PageSize; page%2 == 1 {
+			want[i] = file.data[i]
+		}
+	}
+	reads := file.reads
+	file.dataMu.Unlock()
+
+	// All evicted pages are filled by a single read from the server.
+	got := make([]byte, len(data))
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(got), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("PRead(): got data that differs from cached and remote pages")
+	}
+	file.dataMu.Lock()
+	if got := file.reads - reads; got != 1 {
+		t.Errorf("reading %d uncached pages issued %d reads to the server, want 1", pages/2, got)
+	}
+	file.dataMu.Unlock()
+}
+
+func BenchmarkSequentialRead(b *testing.B) {
+	ctx := contexttest.Context(b)
+	const size = 4 << 20
+	for _, readahead := range []uint64{0, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("readahead=%d", readahead), func(b *testing.B) {
+			fs := newTestFilesystem(ctx, filesystemOptions{readahead: readahead})
+			file := &testP9File{data: make([]byte, size)}
+			d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0644, Size: size})
+			if err != nil {
+				b.Fatalf("fs.newDentry(): %v", err)
+			}
+			root := newTestRoot(ctx, b, fs, &testP9File{}, map[string]*dentry{"f": d})
+			defer root.DecRef()
+			fd, err := openAt(ctx, root, "f", linux.O_RDONLY)
+			if err != nil {
+				b.Fatalf("OpenAt(f): %v", err)
+			}
+			defer fd.DecRef()
+
+			buf := make([]byte, usermem.PageSize)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Drop cached pages so that each iteration reads from the
+				// server.
+				d.Evict(ctx, pgalloc.EvictableRange{0, size})
+				for off := int64(0); off < size; off += int64(len(buf)) {
+					if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), off, vfs.ReadOptions{}); err != nil {
+						b.Fatalf("PRead(%d): %v", off, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCopyRange(t *testing.T) {
+	ctx := contexttest.Context(t)
+	newFile := func(fs *filesystem, file *testP9File, name string) (vfs.VirtualDentry, *vfs.FileDescription) {
+		d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: uint64(len(file.data))})
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{name: d})
+		fd, err := openAt(ctx, root, name, linux.O_RDWR)
+		if err != nil {
+			t.Fatalf("OpenAt(%s, O_RDWR): %v", name, err)
+		}
+		return root, fd
+	}
+	want := []byte("hello, world")
+
+	for _, test := range []struct {
+		name         string
+		sameMount    bool
+		copyRangeErr error
+		wantCopies   int
+	}{
+		{
+			name:       "same mount",
+			sameMount:  true,
+			wantCopies: 1,
+		},
+		{
+			name:         "unsupported by server",
+			sameMount:    true,
+			copyRangeErr: syserror.EOPNOTSUPP,
+			wantCopies:   1,
+		},
+		{
+			name:       "cross mount",
+			wantCopies: 0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srcFS := newTestFilesystem(ctx, filesystemOptions{})
+			dstFS := srcFS
+			if !test.sameMount {
+				dstFS = newTestFilesystem(ctx, filesystemOptions{})
+			}
+			srcFile := &testP9File{
+				data:         make([]byte, len(want)),
+				copyRangeErr: test.copyRangeErr,
+			}
+			dstFile := &testP9File{data: make([]byte, usermem.PageSize)}
+			srcRoot, srcFD := newFile(srcFS, srcFile, "src")
+			defer srcRoot.DecRef()
+			defer srcFD.DecRef()
+			dstRoot, dstFD := newFile(dstFS, dstFile, "dst")
+			defer dstRoot.DecRef()
+			defer dstFD.DecRef()
+
+			// Write to the source through the cache, so that the copy must
+			// observe dirty cached data.
+			if _, err := srcFD.PWrite(ctx, usermem.BytesIOSequence(want), 0, vfs.WriteOptions{}); err != nil {
+				t.Fatalf("PWrite(src): %v", err)
+			}
+			// Populate the destination's cache over the copied range.
+			if _, err := dstFD.PRead(ctx, usermem.BytesIOSequence(make([]byte, usermem.PageSize)), 0, vfs.ReadOptions{}); err != nil {
+				t.Fatalf("PRead(dst): %v", err)
+			}
+
+			dstOff := int64(usermem.PageSize - 4)
+			n, err := srcFD.CopyRange(ctx, 0, dstFD, dstOff, int64(len(want)))
+			if test.copyRangeErr != nil || !test.sameMount {
+				// The caller is expected to fall back to the generic copy.
+				if err != syserror.EXDEV {
+					t.Fatalf("CopyRange(): got (%d, %v), want EXDEV", n, err)
+				}
+			} else {
+				if err != nil || n != int64(len(want)) {
+					t.Fatalf("CopyRange(): got (%d, %v), want (%d, nil)", n, err, len(want))
+				}
+				if got := dstFile.contents()[dstOff:]; !bytes.Equal(got, want) {
+					t.Errorf("server destination file: got %q, want %q", got, want)
+				}
+				stat, err := dstFD.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_SIZE})
+				if err != nil {
+					t.Fatalf("Stat(dst): %v", err)
+				}
+				if wantSize := uint64(dstOff) + uint64(len(want)); stat.Size != wantSize {
+					t.Errorf("Stat(dst): got size %d, want %d", stat.Size, wantSize)
+				}
+				// Reads of the destination must not be served from stale
+				// cached pages.
+				buf := make([]byte, len(want))
+				if _, err := dstFD.PRead(ctx, usermem.BytesIOSequence(buf), dstOff, vfs.ReadOptions{}); err != nil && err != io.EOF {
+					t.Fatalf("PRead(dst): %v", err)
+				}
+				if !bytes.Equal(buf, want) {
+					t.Errorf("PRead(dst): got %q, want %q", buf, want)
+				}
+			}
+			if srcFile.copies != test.wantCopies {
+				t.Errorf("server CopyRange calls: got %d, want %d", srcFile.copies, test.wantCopies)
+			}
+
+			if test.copyRangeErr != nil {
+				// The server's lack of support should be remembered.
+				if _, err := srcFD.CopyRange(ctx, 0, dstFD, dstOff, int64(len(want))); err != syserror.EXDEV {
+					t.Fatalf("second CopyRange(): got error %v, want EXDEV", err)
+				}
+				if srcFile.copies != test.wantCopies {
+					t.Errorf("server CopyRange calls after retry: got %d, want %d", srcFile.copies, test.wantCopies)
+				}
+			}
+		})
+	}
+}
+
+func TestCloneRange(t *testing.T) {
+	ctx := contexttest.Context(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	want := []byte("hello, world")
+
+	for _, test := range []struct {
+		name          string
+		cloneRangeErr error
+		wantErr       error
+	}{
+		{
+			name: "supported",
+		},
+		{
+			name:          "unsupported by server",
+			cloneRangeErr: syserror.EOPNOTSUPP,
+			wantErr:       syserror.EOPNOTSUPP,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srcFile := &testP9File{
+				data:          make([]byte, len(want)),
+				cloneRangeErr: test.cloneRangeErr,
+			}
+			dstFile := &testP9File{}
+			srcD, err := fs.newDentry(ctx, p9file{file: srcFile}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0666, Size: uint64(len(srcFile.data))})
+			if err != nil {
+				t.Fatalf("fs.newDentry(src): %v", err)
+			}
+			dstD, err := fs.newDentry(ctx, p9file{file: dstFile}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0666})
+			if err != nil {
+				t.Fatalf("fs.newDentry(dst): %v", err)
+			}
+			root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"src": srcD, "dst": dstD})
+			defer root.DecRef()
+			srcFD, err := openAt(ctx, root, "src", linux.O_RDWR)
+			if err != nil {
+				t.Fatalf("OpenAt(src, O_RDWR): %v", err)
+			}
+			defer srcFD.DecRef()
+			dstFD, err := openAt(ctx, root, "dst", linux.O_RDWR)
+			if err != nil {
+				t.Fatalf("OpenAt(dst, O_RDWR): %v", err)
+			}
+			defer dstFD.DecRef()
+
+			// Write to the source through the cache, so that the clone must
+			// observe dirty cached data.
+			if _, err := srcFD.PWrite(ctx, usermem.BytesIOSequence(want), 0, vfs.WriteOptions{}); err != nil {
+				t.Fatalf("PWrite(src): %v", err)
+			}
+
+			// As for ioctl(FICLONE), clone the whole file.
+			err = dstFD.Impl().(*regularFileFD).CloneRange(ctx, srcFD, 0, 0, 0)
+			if srcFile.clones != 1 {
+				t.Errorf("server CloneRange calls: got %d, want 1", srcFile.clones)
+			}
+			if err != test.wantErr {
+				t.Fatalf("CloneRange(): got error %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				return
+			}
+			if got := dstFile.contents(); !bytes.Equal(got, want) {
+				t.Errorf("server destination file: got %q, want %q", got, want)
+			}
+			stat, err := dstFD.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_SIZE})
+			if err != nil {
+				t.Fatalf("Stat(dst): %v", err)
+			}
+			if stat.Size != uint64(len(want)) {
+				t.Errorf("Stat(dst): got size %d, want %d", stat.Size, len(want))
+			}
+			buf := make([]byte, len(want))
+			if _, err := dstFD.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil && err != io.EOF {
+				t.Fatalf("PRead(dst): %v", err)
+			}
+			if !bytes.Equal(buf, want) {
+				t.Errorf("PRead(dst): got %q, want %q", buf, want)
+			}
+		})
+	}
+}
+
+func TestDataSync(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, test := range []struct {
+		name           string
+		interop        InteropMode
+		dataOnly       bool
+		wantFsyncs     int
+		wantFdatasyncs int
+	}{
+		{"exclusive fsync", InteropModeExclusive, false, 1, 0},
+		{"exclusive fdatasync", InteropModeExclusive, true, 0, 1},
+		{"writethrough fsync", InteropModeWritethrough, false, 1, 0},
+		{"writethrough fdatasync", InteropModeWritethrough, true, 0, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := newTestFilesystem(ctx, filesystemOptions{interop: test.interop})
+			file := &testP9File{data: []byte("hello, world")}
+			d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: uint64(len(file.data))})
+			fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+
+			// Reading first fills the cache, so that the write is buffered
+			// under InteropModeExclusive.
+			if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 5)), 0, vfs.ReadOptions{}); err != nil {
+				t.Fatalf("PRead(): %v", err)
+			}
+			if _, err := fd.PWrite(ctx, usermem.BytesIOSequence([]byte("HELLO")), 0, vfs.WriteOptions{}); err != nil {
+				t.Fatalf("PWrite(): %v", err)
+			}
+			if test.dataOnly {
+				err = fd.DataSync(ctx)
+			} else {
+				err = fd.Sync(ctx)
+			}
+			if err != nil {
+				t.Fatalf("sync failed: %v", err)
+			}
+			if got, want := string(file.contents()), "HELLO, world"; got != want {
+				t.Errorf("remote file contains %q after sync, want %q", got, want)
+			}
+			if file.fsyncs != test.wantFsyncs || file.fdatasyncs != test.wantFdatasyncs {
+				t.Errorf("got %d fsyncs and %d fdatasyncs, want %d and %d", file.fsyncs, file.fdatasyncs, test.wantFsyncs, test.wantFdatasyncs)
+			}
+		})
+	}
+}
+
+func TestPageCacheLimit(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const (
+		limit     = 8 * usermem.PageSize
+		readahead = 4 * usermem.PageSize
+		size      = 16 * usermem.PageSize
+	)
+	fs := newTestFilesystem(ctx, filesystemOptions{pageCacheLimit: limit, readahead: readahead})
+	files := map[string]*testP9File{
+		"a": {data: make([]byte, size)},
+		"b": {data: make([]byte, size)},
+	}
+	children := make(map[string]*dentry)
+	fds := make(map[string]*vfs.FileDescription)
+	for name, file := range files {
+		d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: size})
+		children[name] = d
+	}
+	root := newTestRoot(ctx, t, fs, &testP9File{}, children)
+	defer root.DecRef()
+	for name := range files {
+		fd, err := openAt(ctx, root, name, linux.O_RDWR)
+		if err != nil {
+			t.Fatalf("OpenAt(%s): %v", name, err)
+		}
+		defer fd.DecRef()
+		fds[name] = fd
+	}
+	checkCachedBytes := func(when string) {
+		var span uint64
+		for _, d := range children {
+			d.dataMu.RLock()
+			span += d.cache.Span()
+			d.dataMu.RUnlock()
+		}
+		got := atomic.LoadInt64(&fs.cachedBytes)
+		if uint64(got) != span {
+			t.Errorf("%s: fs.cachedBytes is %d, but dentries cache %d bytes", when, got, span)
+		}
+		if got > limit {
+			t.Errorf("%s: %d bytes cached, want at most %d", when, got, limit)
+		}
+	}
+
+	// Dirty a cached page of b.
+	buf := make([]byte, usermem.PageSize)
+	if _, err := fds["b"].PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(b): %v", err)
+	}
+	want := []byte("dirty")
+	if _, err := fds["b"].PWrite(ctx, usermem.BytesIOSequence(want), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(b): %v", err)
+	}
+
+	// Read all of a, more than the limit, reclaiming after each read as the
+	// reclaimer would.
+	for off := int64(0); off < size; off += readahead {
+		if _, err := fds["a"].PRead(ctx, usermem.BytesIOSequence(make([]byte, readahead)), off, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("PRead(a, %d): %v", off, err)
+		}
+		fs.reclaimPageCache(ctx)
+		checkCachedBytes(fmt.Sprintf("after reading a at %d", off))
+	}
+
+	// b was least recently used, so its dirty page must have been written
+	// back before being released.
+	if got := files["b"].contents()[:len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("b contents: got %q, want %q", got, want)
+	}
+	children["b"].dataMu.RLock()
+	bCached := children["b"].cache.Span()
+	children["b"].dataMu.RUnlock()
+	if bCached != 0 {
+		t.Errorf("b has %d bytes cached, want 0", bCached)
+	}
+}
+
+func TestNowait(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const size = 4 * usermem.PageSize
+	nowaitRead := vfs.ReadOptions{Flags: linux.RWF_NOWAIT}
+	nowaitWrite := vfs.WriteOptions{Flags: linux.RWF_NOWAIT}
+	for _, interop := range []InteropMode{InteropModeExclusive, InteropModeWritethrough} {
+		fs := newTestFilesystem(ctx, filesystemOptions{interop: interop, readahead: usermem.PageSize})
+		file := &testP9File{data: make([]byte, size)}
+		d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0644, Size: size})
+		if err != nil {
+			t.Fatalf("%v: fs.newDentry(): %v", interop, err)
+		}
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"f": d})
+		fd, err := openAt(ctx, root, "f", linux.O_RDWR)
+		if err != nil {
+			t.Fatalf("%v: OpenAt(f): %v", interop, err)
+		}
+		rpcs := func() (int, int) {
+			file.dataMu.Lock()
+			defer file.dataMu.Unlock()
+			return file.reads, file.writes
+		}
+		buf := make([]byte, usermem.PageSize)
+
+		// Reads and writes of uncached data fail without issuing RPCs.
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, nowaitRead); err != syserror.EAGAIN {
+			t.Errorf("%v: PRead(RWF_NOWAIT) of uncached data: got err %v, want %v", interop, err, syserror.EAGAIN)
+		}
+		if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(buf), 0, nowaitWrite); err != syserror.EAGAIN {
+			t.Errorf("%v: PWrite(RWF_NOWAIT) of uncached data: got err %v, want %v", interop, err, syserror.EAGAIN)
+		}
+		if reads, writes := rpcs(); reads != 0 || writes != 0 {
+			t.Errorf("%v: RWF_NOWAIT cache misses issued %d reads and %d writes, want 0", interop, reads, writes)
+		}
+
+		// Cache the first two pages of the file.
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("%v: PRead(): %v", interop, err)
+		}
+		reads, writes := rpcs()
+
+		// Cached data can be read, and reads that extend past cached data
+		// return what is cached.
+		if n, err := fd.PRead(ctx, usermem.BytesIOSequence(buf), 0, nowaitRead); n != usermem.PageSize || err != nil {
+			t.Errorf("%v: PRead(RWF_NOWAIT) of cached data: got (%d, %v), want (%d, nil)", interop, n, err, usermem.PageSize)
+		}
+		if n, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 3*usermem.PageSize)), usermem.PageSize, nowaitRead); n != usermem.PageSize || err != syserror.EAGAIN {
+			t.Errorf("%v: PRead(RWF_NOWAIT) of partially cached data: got (%d, %v), want (%d, %v)", interop, n, err, usermem.PageSize, syserror.EAGAIN)
+		}
+
+		// Cached data can be written, except in InteropModeWritethrough,
+		// which requires writes to be flushed to the remote file.
+		_, err = fd.PWrite(ctx, usermem.BytesIOSequence(buf), 0, nowaitWrite)
+		if interop == InteropModeWritethrough {
+			if err != syserror.EAGAIN {
+				t.Errorf("%v: PWrite(RWF_NOWAIT) of cached data: got err %v, want %v", interop, err, syserror.EAGAIN)
+			}
+		} else if err != nil {
+			t.Errorf("%v: PWrite(RWF_NOWAIT) of cached data: %v", interop, err)
+		}
+		if r, w := rpcs(); r != reads || w != writes {
+			t.Errorf("%v: RWF_NOWAIT cache hits issued %d reads and %d writes, want 0", interop, r-reads, w-writes)
+		}
+
+		fd.DecRef()
+		root.DecRef()
+	}
+}
+
+func TestStatDIOAlign(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	const blockSize = 512
+	file, err := fs.newDentry(ctx, p9file{file: &testP9File{}}, p9.QID{Path: 1}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0644, BlockSize: blockSize})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	dir, err := fs.newDentry(ctx, p9file{file: &testP9File{}}, p9.QID{Type: p9.TypeDir, Path: 2}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeDirectory | 0755})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": file, "dir": dir})
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	stat := func(path string, mask uint32) linux.Statx {
+		t.Helper()
+		pop := pathOp(root, path)
+		stat, err := vfsObj.StatAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.StatOptions{Mask: mask})
+		if err != nil {
+			t.Fatalf("StatAt(%q): %v", path, err)
+		}
+		return stat
+	}
+
+	got := stat("file", linux.STATX_BASIC_STATS|linux.STATX_DIOALIGN)
+	if got.Mask&linux.STATX_DIOALIGN == 0 {
+		t.Errorf("StatAt(file) with STATX_DIOALIGN: mask %#x does not include STATX_DIOALIGN", got.Mask)
+	}
+	if got.DioMemAlign != blockSize || got.DioOffsetAlign != blockSize {
+		t.Errorf("StatAt(file): got DioMemAlign %d, DioOffsetAlign %d; want %d, %d", got.DioMemAlign, got.DioOffsetAlign, blockSize, blockSize)
+	}
+
+	fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(O_RDONLY): %v", err)
+	}
+	defer fd.DecRef()
+	fdStat, err := fd.Stat(ctx, vfs.StatOptions{Mask: linux.STATX_DIOALIGN})
+	if err != nil {
+		t.Fatalf("Stat(): %v", err)
+	}
+	if fdStat.Mask&linux.STATX_DIOALIGN == 0 || fdStat.DioOffsetAlign != blockSize {
+		t.Errorf("Stat() with STATX_DIOALIGN: got mask %#x, DioOffsetAlign %d; want STATX_DIOALIGN, %d", fdStat.Mask, fdStat.DioOffsetAlign, blockSize)
+	}
+
+	// Alignment isn't reported unless requested, or for files that don't
+	// support O_DIRECT.
+	if got := stat("file", linux.STATX_BASIC_STATS); got.Mask&linux.STATX_DIOALIGN != 0 || got.DioOffsetAlign != 0 {
+		t.Errorf("StatAt(file) without STATX_DIOALIGN: got mask %#x, DioOffsetAlign %d", got.Mask, got.DioOffsetAlign)
+	}
+	if got := stat("dir", linux.STATX_BASIC_STATS|linux.STATX_DIOALIGN); got.Mask&linux.STATX_DIOALIGN != 0 {
+		t.Errorf("StatAt(dir): mask %#x includes STATX_DIOALIGN", got.Mask)
+	}
+}
+
+func TestInodeFlags(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	// getFlags and setFlags invoke FS_IOC_GETFLAGS and FS_IOC_SETFLAGS on fd,
+	// with the argument in a 4-byte buffer at address 0.
+	getFlags := func(fd *vfs.FileDescription) (uint32, error) {
+		var buf usermem.BytesIO
+		buf.Bytes = make([]byte, 4)
+		if _, err := fd.Ioctl(ctx, &buf, arch.SyscallArguments{{}, {Value: linux.FS_IOC_GETFLAGS}, {Value: 0}}); err != nil {
+			return 0, err
+		}
+		return usermem.ByteOrder.Uint32(buf.Bytes), nil
+	}
+	setFlags := func(fd *vfs.FileDescription, flags uint32) error {
+		var buf usermem.BytesIO
+		buf.Bytes = make([]byte, 4)
+		usermem.ByteOrder.PutUint32(buf.Bytes, flags)
+		_, err := fd.Ioctl(ctx, &buf, arch.SyscallArguments{{}, {Value: linux.FS_IOC_SETFLAGS}, {Value: 0}})
+		return err
+	}
+
+	// FS_EXTENT_FL is reported by the server but can't be changed.
+	const extentFlag = 0x00080000
+	for _, interop := range []InteropMode{InteropModeExclusive, InteropModeShared} {
+		fs := newTestFilesystem(ctx, filesystemOptions{interop: interop})
+		file := &testP9File{inodeFlags: extentFlag}
+		d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeRegular | 0644})
+		if err != nil {
+			t.Fatalf("fs.newDentry(): %v", err)
+		}
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"file": d})
+		fd, err := openAt(ctx, root, "file", linux.O_RDONLY)
+		if err != nil {
+			t.Fatalf("interop=%v: OpenAt(O_RDONLY): %v", interop, err)
+		}
+
+		if err := setFlags(fd, extentFlag|linux.FS_APPEND_FL); err != nil {
+			t.Fatalf("interop=%v: FS_IOC_SETFLAGS(FS_APPEND_FL): %v", interop, err)
+		}
+		if want := uint32(extentFlag | linux.FS_APPEND_FL); file.inodeFlags != want {
+			t.Errorf("interop=%v: got server flags %#x, want %#x", interop, file.inodeFlags, want)
+		}
+		getFlagses := file.getFlagses
+		got, err := getFlags(fd)
+		if err != nil {
+			t.Fatalf("interop=%v: FS_IOC_GETFLAGS: %v", interop, err)
+		}
+		if want := uint32(extentFlag | linux.FS_APPEND_FL); got != want {
+			t.Errorf("interop=%v: FS_IOC_GETFLAGS: got %#x, want %#x", interop, got, want)
+		}
+		// Flags are cached unless the remote filesystem is shared.
+		wantGetFlagses := getFlagses
+		if interop == InteropModeShared {
+			wantGetFlagses++
+		}
+		if file.getFlagses != wantGetFlagses {
+			t.Errorf("interop=%v: got %d GetFlags calls, want %d", interop, file.getFlagses, wantGetFlagses)
+		}
+
+		// Flags that the server reports but that can't be set are rejected.
+		if err := setFlags(fd, linux.FS_APPEND_FL); err != syserror.EOPNOTSUPP {
+			t.Errorf("interop=%v: FS_IOC_SETFLAGS without FS_EXTENT_FL: got err %v, want %v", interop, err, syserror.EOPNOTSUPP)
+		}
+		fd.DecRef()
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/metric"
+)
+
+// rpcRetryMetric counts RPCs retried by all gofer filesystems.
+var rpcRetryMetric = metric.MustCreateNewUint64Metric("/gofer/rpc_retries", false /* sync */, "Number of times VFS2 gofer clients retried RPCs that failed with a transient error.")
+
+// reportRetries records that an RPC was reissued retries times before
+// completing with err, which is nil if the last attempt succeeded. RPCs that
+// were retried at least once are logged at debug level, so that a flaky
+// server can be identified.
+func reportRetries(ctx context.Context, retries int, err error) {
+	if retries == 0 {
+		return
+	}
+	rpcRetryMetric.IncrementBy(uint64(retries))
+	ctx.Debugf("gofer: RPC retried %d times, last error: %v", retries, err)
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+func TestReportRetries(t *testing.T) {
+	ctx := contexttest.Context(t)
+	before := rpcRetryMetric.Value()
+	reportRetries(ctx, 0, nil)
+	if got := rpcRetryMetric.Value(); got != before {
+		t.Errorf("reportRetries(0 retries): got metric %d, want %d", got, before)
+	}
+	reportRetries(ctx, 2, syserror.EINTR)
+	if got, want := rpcRetryMetric.Value(), before+2; got != want {
+		t.Errorf("reportRetries(2 retries): got metric %d, want %d", got, want)
+	}
+}
+
+// flakyP9File is a p9.File whose GetAttr fails with err for the first
+// failures calls.
+type flakyP9File struct {
+	testP9File
+
+	err      error
+	failures int
+	calls    int
+}
+
+// GetAttr implements p9.File.GetAttr.
+func (f *flakyP9File) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return p9.QID{}, p9.AttrMask{}, p9.Attr{}, f.err
+	}
+	return f.testP9File.GetAttr(req)
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		failures  int
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "EINTR", err: syserror.EINTR, failures: 2, wantErr: nil, wantCalls: 3},
+		{name: "EAGAIN", err: syserror.EAGAIN, failures: 2, wantErr: nil, wantCalls: 3},
+		{name: "persistent EINTR", err: syserror.EINTR, failures: rpcRetries + 1, wantErr: syserror.EINTR, wantCalls: rpcRetries + 1},
+		{name: "EIO", err: syserror.EIO, failures: 2, wantErr: syserror.EIO, wantCalls: 1},
+		{name: "ENOENT", err: syserror.ENOENT, failures: 2, wantErr: syserror.ENOENT, wantCalls: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := contexttest.Context(t)
+			file := &flakyP9File{err: test.err, failures: test.failures}
+			retries := rpcRetryMetric.Value()
+			_, _, _, err := p9file{file: file}.getAttr(ctx, p9.AttrMask{Mode: true})
+			if err != test.wantErr {
+				t.Errorf("getAttr(): got err %v, want %v", err, test.wantErr)
+			}
+			if file.calls != test.wantCalls {
+				t.Errorf("getAttr(): got %d calls, want %d", file.calls, test.wantCalls)
+			}
+			if got, want := rpcRetryMetric.Value()-retries, uint64(test.wantCalls-1); got != want {
+				t.Errorf("getAttr(): got %d retries, want %d", got, want)
+			}
+		})
+	}
+
+	// Retries stop when the context is cancelled.
+	ctx := &cancellableContext{
+		Context: contexttest.Context(t),
+		done:    make(chan struct{}),
+	}
+	close(ctx.done)
+	file := &flakyP9File{err: syserror.EINTR, failures: 2}
+	retries := rpcRetryMetric.Value()
+	if _, _, _, err := (p9file{file: file}).getAttr(ctx, p9.AttrMask{Mode: true}); err != syserror.EINTR {
+		t.Errorf("getAttr() with cancelled context: got err %v, want %v", err, syserror.EINTR)
+	}
+	if file.calls != 1 {
+		t.Errorf("getAttr() with cancelled context: got %d calls, want 1", file.calls)
+	}
+	if got := rpcRetryMetric.Value() - retries; got != 0 {
+		t.Errorf("getAttr() with cancelled context: got %d retries, want 0", got)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// savedDentry is the cached metadata of a dentry, as preserved by
+// filesystem.saveInternalState().
+type savedDentry struct {
+	ino        uint64
+	qidVersion uint32
+	mode       uint32
+	uid        uint32
+	gid        uint32
+	blockSize  uint32
+	atime      int64
+	mtime      int64
+	ctime      int64
+	btime      int64
+	size       uint64
+	nlink      uint32
+}
+
+// savedState is the state of a filesystem's dentry tree, as preserved by
+// filesystem.PrepareSave(). Cached file contents are not preserved.
+type savedState struct {
+	// dentries maps the path of each dentry, relative to the filesystem root
+	// and with components separated by "/", to its saved metadata.
+	dentries map[string]savedDentry
+}
+
+// PrepareSave implements vfs.SaveRestorer.PrepareSave.
+func (fs *filesystem) PrepareSave(ctx context.Context) error {
+	if !fs.opts.restorable {
+		ctx.Warningf("gofer.filesystem.PrepareSave: filesystem cannot be restored without restorable=true")
+		return syserror.EINVAL
+	}
+	state, err := fs.saveInternalState(ctx)
+	if err != nil {
+		return err
+	}
+	fs.saved = state
+	return nil
+}
+
+// CompleteRestore implements vfs.SaveRestorer.CompleteRestore.
+func (fs *filesystem) CompleteRestore(ctx context.Context) error {
+	state := fs.saved
+	if state == nil {
+		ctx.Warningf("gofer.filesystem.CompleteRestore: filesystem was not saved")
+		return syserror.EINVAL
+	}
+	fs.saved = nil
+	return fs.loadInternalState(ctx, state)
+}
+
+// saveInternalState writes back all dirty cached data, stops fs' reconnect
+// worker if one is running, and returns the metadata of all of fs' dentries
+// that have not been deleted. Remote files are not closed, so fs remains
+// usable until it is restored by loadInternalState.
+//
+// Preconditions: fs.opts.restorable is true.
+func (fs *filesystem) saveInternalState(ctx context.Context) (*savedState, error) {
+	// Cached file contents are not preserved, so dirty data would be lost.
+	if err := fs.Sync(ctx); err != nil {
+		return nil, err
+	}
+	// The connection is replaced by loadInternalState, so the reconnect
+	// worker must not race with it.
+	fs.stopReconnect()
+
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+	fs.syncMu.Lock()
+	ds := make([]*dentry, 0, len(fs.dentries))
+	for d := range fs.dentries {
+		ds = append(ds, d)
+	}
+	fs.syncMu.Unlock()
+	state := &savedState{
+		dentries: make(map[string]savedDentry, len(ds)),
+	}
+	for _, d := range ds {
+		if d.isDeleted() {
+			continue
+		}
+		d.metadataMu.Lock()
+		state.dentries[strings.Join(d.remotePathLocked(), "/")] = savedDentry{
+			ino:        d.ino,
+			qidVersion: atomic.LoadUint32(&d.qidVersion),
+			mode:       atomic.LoadUint32(&d.mode),
+			uid:        atomic.LoadUint32(&d.uid),
+			gid:        atomic.LoadUint32(&d.gid),
+			blockSize:  atomic.LoadUint32(&d.blockSize),
+			atime:      atomic.LoadInt64(&d.atime),
+			mtime:      atomic.LoadInt64(&d.mtime),
+			ctime:      atomic.LoadInt64(&d.ctime),
+			btime:      atomic.LoadInt64(&d.btime),
+			size:       atomic.LoadUint64(&d.size),
+			nlink:      atomic.LoadUint32(&d.nlink),
+		}
+		d.metadataMu.Unlock()
+	}
+	return state, nil
+}
+
+// loadInternalState re-establishes fs' connection to the server, attaches to
+// the filesystem root, and restores the metadata of fs' dentries from state.
+// Dentries' remote files are walked to from the new root when they are next
+// used, rather than immediately; only files backing open shared handles are
+// reopened eagerly. Dentries absent from state retain their metadata.
+//
+// Preconditions: state was returned by fs.saveInternalState(). There has
+// been no filesystem activity since then.
+func (fs *filesystem) loadInternalState(ctx context.Context, state *savedState) error {
+	client, attached, err := fs.dial()
+	if err != nil {
+		return err
+	}
+
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+	fs.syncMu.Lock()
+	ds := make([]*dentry, 0, len(fs.dentries))
+	var root *dentry
+	for d := range fs.dentries {
+		if d.vfsd.Parent() == nil {
+			root = d
+		} else {
+			ds = append(ds, d)
+		}
+	}
+	fs.syncMu.Unlock()
+	// Pending walks are from the root's remote file, which is owned by the
+	// root dentry. The root dentry is never evicted, so it outlives every
+	// dentry that may still have a pending walk.
+	var rootRF *reconnectFile
+	if root != nil {
+		rootRF, _ = root.file.file.(*reconnectFile)
+	}
+	if rootRF == nil {
+		ctx.Warningf("gofer.filesystem.loadInternalState: filesystem root is not restorable")
+		client.Close()
+		return syserror.EINVAL
+	}
+	rootRF.set(attached)
+	root.restoreLocked(ctx, rootRF, state, nil)
+	rootFile := p9file{attached, fs.stats, fs.limiter}
+	for _, d := range ds {
+		rf, ok := d.file.file.(*reconnectFile)
+		if !ok || d.isDeleted() {
+			continue
+		}
+		names := d.remotePathLocked()
+		rf.setPending(rootFile, names)
+		d.restoreLocked(ctx, rf, state, names)
+	}
+	oldClient := fs.client
+	fs.client = client
+	oldClient.Close()
+	if fs.opts.reconnect {
+		fs.startReconnect()
+	}
+	log.Infof("gofer.filesystem.loadInternalState: restored %d dentries from %q", len(state.dentries), fs.opts.addr)
+	return nil
+}
+
+// restoreLocked restores d's metadata from state, and reopens d's shared
+// handle, if it has one, from rf. names is the path to d.
+//
+// Preconditions: d.fs.renameMu must be locked for writing. rf is d's remote
+// file.
+func (d *dentry) restoreLocked(ctx context.Context, rf *reconnectFile, state *savedState, names []string) {
+	if sd, ok := state.dentries[strings.Join(names, "/")]; ok {
+		d.restoreMetadata(&sd)
+	}
+	d.handleMu.RLock()
+	hasHandle := !d.handle.file.isNil()
+	d.handleMu.RUnlock()
+	if hasHandle {
+		// Walk to the new remote file now, since the handle must be
+		// reopened from it.
+		d.reopenHandle(ctx, p9file{rf.get(), d.fs.stats, d.fs.limiter}, names)
+	}
+}
+
+// restoreMetadata sets d's cached metadata to sd.
+func (d *dentry) restoreMetadata(sd *savedDentry) {
+	d.metadataMu.Lock()
+	defer d.metadataMu.Unlock()
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	// d.ino is immutable, and the file type cannot change, so a mismatch means
+	// that sd describes a different file.
+	if sd.ino != d.ino || sd.mode&linux.S_IFMT != atomic.LoadUint32(&d.mode)&linux.S_IFMT {
+		return
+	}
+	atomic.StoreUint32(&d.qidVersion, sd.qidVersion)
+	atomic.StoreUint32(&d.mode, sd.mode)
+	atomic.StoreUint32(&d.uid, sd.uid)
+	atomic.StoreUint32(&d.gid, sd.gid)
+	atomic.StoreUint32(&d.blockSize, sd.blockSize)
+	atomic.StoreInt64(&d.atime, sd.atime)
+	atomic.StoreInt64(&d.mtime, sd.mtime)
+	atomic.StoreInt64(&d.ctime, sd.ctime)
+	atomic.StoreInt64(&d.btime, sd.btime)
+	atomic.StoreUint64(&d.size, sd.size)
+	atomic.StoreUint32(&d.nlink, sd.nlink)
+}
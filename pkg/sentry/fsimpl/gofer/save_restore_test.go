@@ -0,0 +1,144 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestSaveRestore(t *testing.T) {
+	ctx := contexttest.Context(t)
+	rootFile := &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 3},
+		children: map[string]*testP9File{
+			"a": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, NLink: 1}, qid: p9.QID{Path: 1}},
+			"dir": {
+				attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+				qid:  p9.QID{Type: p9.TypeDir, Path: 2},
+				children: map[string]*testP9File{
+					"f": {attr: p9.Attr{Mode: p9.ModeRegular | 0644, Size: 3, NLink: 1}, qid: p9.QID{Path: 3}, data: []byte("foo")},
+				},
+			},
+		},
+	}
+	addr, conns := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",restorable=true")
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+	<-conns
+	stat := func(path string) linux.Statx {
+		pop := pathOp(root, path)
+		stat, err := vfsObj.StatAt(ctx, creds, pop, &vfs.StatOptions{Mask: linux.STATX_BASIC_STATS})
+		if err != nil {
+			t.Fatalf("StatAt(%s): %v", path, err)
+		}
+		return stat
+	}
+
+	afd, err := openAt(ctx, root, "a", linux.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenAt(a): %v", err)
+	}
+	defer afd.DecRef()
+	if _, err := afd.PWrite(ctx, usermem.BytesIOSequence([]byte("bar")), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(a): %v", err)
+	}
+	paths := []string{"a", "dir", "dir/f"}
+	want := make(map[string]linux.Statx)
+	for _, path := range paths {
+		want[path] = stat(path)
+	}
+
+	// Dirty data must be written back before saving.
+	if err := vfsObj.PrepareSave(ctx); err != nil {
+		t.Fatalf("PrepareSave(): %v", err)
+	}
+	if got, want := string(rootFile.children["a"].contents()), "bar"; got != want {
+		t.Errorf("server contents of a after save: got %q, want %q", got, want)
+	}
+	if got, want := len(fs.saved.dentries), len(paths)+1; got != want {
+		t.Errorf("saved %d dentries, want %d", got, want)
+	}
+
+	if err := vfsObj.CompleteRestore(ctx); err != nil {
+		t.Fatalf("CompleteRestore(): %v", err)
+	}
+	select {
+	case <-conns:
+	default:
+		t.Errorf("CompleteRestore() did not reconnect to the server")
+	}
+
+	// Restored metadata is used without contacting the server.
+	before := fs.Stats()
+	for _, path := range paths {
+		if got := stat(path); got != want[path] {
+			t.Errorf("StatAt(%s) after restore: got %+v, want %+v", path, got, want[path])
+		}
+	}
+	if got := fs.Stats(); got.GetAttrs != before.GetAttrs || got.Walks != before.Walks {
+		t.Errorf("RPCs issued by stat after restore: got %+v, want %+v", got, before)
+	}
+
+	// Remote files are walked to when they are next used.
+	ffd, err := openAt(ctx, root, "dir/f", linux.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenAt(dir/f) after restore: %v", err)
+	}
+	defer ffd.DecRef()
+	buf := make([]byte, 3)
+	if _, err := ffd.PRead(ctx, usermem.BytesIOSequence(buf), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(dir/f) after restore: %v", err)
+	}
+	if got, want := string(buf), "foo"; got != want {
+		t.Errorf("PRead(dir/f) after restore: got %q, want %q", got, want)
+	}
+
+	// Handles open before saving have been reopened.
+	if _, err := afd.PWrite(ctx, usermem.BytesIOSequence([]byte("z")), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(a) after restore: %v", err)
+	}
+	if err := afd.Sync(ctx); err != nil {
+		t.Fatalf("Sync(a) after restore: %v", err)
+	}
+	if got, want := string(rootFile.children["a"].contents()), "zar"; got != want {
+		t.Errorf("server contents of a after restore: got %q, want %q", got, want)
+	}
+}
+
+func TestSaveRestoreRequiresRestorable(t *testing.T) {
+	ctx := contexttest.Context(t)
+	rootFile := &testP9File{attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}}
+	addr, _ := serveTestP9(t, rootFile)
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr)
+	defer root.DecRef()
+	fs := root.Mount().Filesystem().Impl().(*filesystem)
+	if _, ok := root.Dentry().Impl().(*dentry).file.file.(*reconnectFile); ok {
+		t.Errorf("remote files are replaceable without restorable=true or reconnect=true")
+	}
+	if err := fs.PrepareSave(ctx); err != syserror.EINVAL {
+		t.Errorf("PrepareSave(): got %v, want %v", err, syserror.EINVAL)
+	}
+}
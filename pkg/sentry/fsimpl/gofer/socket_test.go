@@ -0,0 +1,159 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/socket/unix/transport"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/unet"
+)
+
+func TestUnixTransport(t *testing.T) {
+	ctx := contexttest.Context(t)
+	vfsObj := newTestVFS(t)
+	creds := auth.CredentialsFromContext(ctx)
+
+	addr, _ := serveTestP9(t, &testP9File{attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}})
+
+	for _, data := range []string{
+		"trans=unix",
+		"trans=unix,addr=",
+		"trans=unix,addr=" + addr + ",rfdno=3",
+		"trans=unix,addr=" + addr + ",wfdno=3",
+	} {
+		if _, _, err := (FilesystemType{}).GetFilesystem(ctx, vfsObj, creds, "", vfs.GetFilesystemOptions{Data: data}); err != syserror.EINVAL {
+			t.Errorf("GetFilesystem(%q): got error %v, want %v", data, err, syserror.EINVAL)
+		}
+	}
+
+	fs, root, err := (FilesystemType{}).GetFilesystem(ctx, vfsObj, creds, "", vfs.GetFilesystemOptions{Data: "trans=unix,addr=" + addr})
+	if err != nil {
+		t.Fatalf("GetFilesystem(trans=unix): %v", err)
+	}
+	defer fs.DecRef()
+	defer root.DecRef()
+	if got := root.Impl().(*dentry).fileType(); got != linux.S_IFDIR {
+		t.Errorf("root file type: got %#o, want %#o", got, linux.S_IFDIR)
+	}
+}
+
+func TestSocketBufferSizes(t *testing.T) {
+	ctx := contexttest.Context(t)
+	vfsObj := newTestVFS(t)
+	creds := auth.CredentialsFromContext(ctx)
+	addr, _ := serveTestP9(t, &testP9File{attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2}})
+	for _, opt := range []string{"rcvbuf=0", "rcvbuf=foo", "sndbuf=-1", "sndbuf=4294967296"} {
+		data := "trans=unix,addr=" + addr + "," + opt
+		if _, _, err := (FilesystemType{}).GetFilesystem(ctx, vfsObj, creds, "", vfs.GetFilesystemOptions{Data: data}); err != syserror.EINVAL {
+			t.Errorf("GetFilesystem(%q): got error %v, want %v", opt, err, syserror.EINVAL)
+		}
+	}
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr+",rcvbuf=65536,sndbuf=32768")
+	root.DecRef()
+
+	// Check the effective sizes of buffers set on a connected socket.
+	conn, peer, err := unet.SocketPair(false /* packet */)
+	if err != nil {
+		t.Fatalf("SocketPair(): %v", err)
+	}
+	defer conn.Close()
+	defer peer.Close()
+	opts := filesystemOptions{rcvbuf: 65536, sndbuf: 32768}
+	if err := setSocketBufferSizes(conn, &opts); err != nil {
+		t.Fatalf("setSocketBufferSizes(): %v", err)
+	}
+	for _, buf := range []struct {
+		name string
+		opt  int
+		want uint32
+	}{
+		{"SO_RCVBUF", syscall.SO_RCVBUF, opts.rcvbuf},
+		{"SO_SNDBUF", syscall.SO_SNDBUF, opts.sndbuf},
+	} {
+		got, err := socketBufferSize(conn, buf.opt)
+		if err != nil {
+			t.Fatalf("socketBufferSize(%s): %v", buf.name, err)
+		}
+		if got < buf.want {
+			t.Errorf("%s: got effective size %d, want at least %d", buf.name, got, buf.want)
+		}
+	}
+}
+
+func TestBoundEndpoint(t *testing.T) {
+	ctx := contexttest.Context(t)
+
+	// Bind a host socket, which the server connects to.
+	sockAddr := filepath.Join(t.TempDir(), "host.sock")
+	hostSock, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socket(): %v", err)
+	}
+	defer syscall.Close(hostSock)
+	if err := syscall.Bind(hostSock, &syscall.SockaddrUnix{Name: sockAddr}); err != nil {
+		t.Fatalf("Bind(%q): %v", sockAddr, err)
+	}
+
+	addr, _ := serveTestP9(t, &testP9File{
+		attr: p9.Attr{Mode: p9.ModeDirectory | 0755, NLink: 2},
+		children: map[string]*testP9File{
+			"sock": {attr: p9.Attr{Mode: p9.ModeSocket | 0777, NLink: 1}, socketAddr: sockAddr},
+			"file": {attr: p9.Attr{Mode: p9.ModeRegular | 0666, NLink: 1}},
+		},
+	})
+	root := mountTestP9(ctx, t, "trans=unix,addr="+addr)
+	defer root.DecRef()
+	vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+	creds := auth.CredentialsFromContext(ctx)
+
+	if _, err := vfsObj.BoundEndpointAt(ctx, creds, pathOp(root, "file")); err != syserror.ECONNREFUSED {
+		t.Errorf("BoundEndpointAt(file): got err %v, want %v", err, syserror.ECONNREFUSED)
+	}
+
+	// Connect to the host socket via the gofer dentry, and send a message.
+	ep, err := vfsObj.BoundEndpointAt(ctx, creds, pathOp(root, "sock"))
+	if err != nil {
+		t.Fatalf("BoundEndpointAt(sock): %v", err)
+	}
+	defer ep.Release()
+	ce, serr := ep.UnidirectionalConnect(ctx)
+	if serr != nil {
+		t.Fatalf("UnidirectionalConnect(): %v", serr)
+	}
+	defer ce.Release()
+	want := []byte("hello")
+	if _, _, serr := ce.Send([][]byte{want}, transport.ControlMessages{}, tcpip.FullAddress{}); serr != nil {
+		t.Fatalf("Send(): %v", serr)
+	}
+	buf := make([]byte, 16)
+	n, _, err := syscall.Recvfrom(hostSock, buf, 0)
+	if err != nil {
+		t.Fatalf("Recvfrom(): %v", err)
+	}
+	if got := buf[:n]; !bytes.Equal(got, want) {
+		t.Errorf("host socket received %q, want %q", got, want)
+	}
+}
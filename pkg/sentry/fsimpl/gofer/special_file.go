@@ -44,6 +44,25 @@ type specialFileFD struct {
 	off int64
 }
 
+// newSpecialFileFD returns a specialFileFD representing d that takes
+// ownership of h. It registers the new FD in d.fs.specialFileFDs, so that it
+// is synced by filesystem.Sync() and reopened by filesystem.reconnect().
+//
+// Preconditions: d.refs includes a reference to be held by the returned file
+// description.
+func newSpecialFileFD(h handle, mnt *vfs.Mount, d *dentry, flags uint32) (*specialFileFD, error) {
+	fd := &specialFileFD{
+		handle: h,
+	}
+	if err := fd.vfsfd.Init(fd, flags, mnt, &d.vfsd, &vfs.FileDescriptionOptions{}); err != nil {
+		return nil, err
+	}
+	d.fs.syncMu.Lock()
+	d.fs.specialFileFDs[fd] = struct{}{}
+	d.fs.syncMu.Unlock()
+	return fd, nil
+}
+
 // Release implements vfs.FileDescriptionImpl.Release.
 func (fd *specialFileFD) Release() {
 	fd.handle.close(context.Background())
@@ -79,7 +98,7 @@ func (fd *specialFileFD) PRead(ctx context.Context, dst usermem.IOSequence, offs
 		d.touchAtime(fd.vfsfd.Mount())
 	}
 	buf := make([]byte, dst.NumBytes())
-	n, err := fd.handle.readToBlocksAt(ctx, safemem.BlockSeqOf(safemem.BlockFromSafeSlice(buf)), uint64(offset))
+	n, err := fd.handle.readToBlocksAtInterruptible(ctx, safemem.BlockSeqOf(safemem.BlockFromSafeSlice(buf)), uint64(offset))
 	if n == 0 {
 		return 0, err
 	}
@@ -124,7 +143,7 @@ func (fd *specialFileFD) PWrite(ctx context.Context, src usermem.IOSequence, off
 	if _, err := src.CopyIn(ctx, buf); err != nil {
 		return 0, err
 	}
-	n, err := fd.handle.writeFromBlocksAt(ctx, safemem.BlockSeqOf(safemem.BlockFromSafeSlice(buf)), uint64(offset))
+	n, err := fd.handle.writeFromBlocksAtInterruptible(ctx, safemem.BlockSeqOf(safemem.BlockFromSafeSlice(buf)), uint64(offset))
 	return int64(n), err
 }
 
@@ -165,3 +184,11 @@ func (fd *specialFileFD) Sync(ctx context.Context) error {
 	}
 	return fd.handle.sync(ctx)
 }
+
+// DataSync implements vfs.DataSyncer.DataSync.
+func (fd *specialFileFD) DataSync(ctx context.Context) error {
+	if !fd.vfsfd.IsWritable() {
+		return nil
+	}
+	return fd.handle.datasync(ctx)
+}
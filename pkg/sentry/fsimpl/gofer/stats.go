@@ -0,0 +1,170 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/metric"
+)
+
+// rpcKind identifies a kind of RPC counted by rpcStats.
+type rpcKind int
+
+const (
+	rpcWalk rpcKind = iota
+	rpcGetAttr
+	rpcSetAttr
+	rpcOpen
+	rpcRead
+	rpcWrite
+	numRPCKinds
+)
+
+// rpcMetrics count RPCs of each kind issued by all gofer filesystems.
+var rpcMetrics = [numRPCKinds]*metric.Uint64Metric{
+	rpcWalk:    metric.MustCreateNewUint64Metric("/gofer/rpcs_walk", false /* sync */, "Number of walk RPCs issued by VFS2 gofer clients."),
+	rpcGetAttr: metric.MustCreateNewUint64Metric("/gofer/rpcs_getattr", false /* sync */, "Number of getattr RPCs issued by VFS2 gofer clients."),
+	rpcSetAttr: metric.MustCreateNewUint64Metric("/gofer/rpcs_setattr", false /* sync */, "Number of setattr RPCs issued by VFS2 gofer clients."),
+	rpcOpen:    metric.MustCreateNewUint64Metric("/gofer/rpcs_open", false /* sync */, "Number of open and create RPCs issued by VFS2 gofer clients."),
+	rpcRead:    metric.MustCreateNewUint64Metric("/gofer/rpcs_read", false /* sync */, "Number of read RPCs issued by VFS2 gofer clients."),
+	rpcWrite:   metric.MustCreateNewUint64Metric("/gofer/rpcs_write", false /* sync */, "Number of write RPCs issued by VFS2 gofer clients."),
+}
+
+// rpcStats counts RPCs issued by a single filesystem.
+type rpcStats struct {
+	// counts is accessed using atomic memory operations.
+	counts [numRPCKinds]uint64
+}
+
+// count records that an RPC of the given kind is being issued. s may be nil.
+func (s *rpcStats) count(kind rpcKind) {
+	rpcMetrics[kind].Increment()
+	if s != nil {
+		atomic.AddUint64(&s.counts[kind], 1)
+	}
+}
+
+func (s *rpcStats) load(kind rpcKind) uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.counts[kind])
+}
+
+// Stats contains the number of RPCs of each kind that a filesystem has issued
+// to its server. Walks include combined walk-and-getattr RPCs, and opens
+// include creates. Reads and writes performed on host FDs donated by the
+// server are not RPCs, and are not counted.
+type Stats struct {
+	Walks    uint64
+	GetAttrs uint64
+	SetAttrs uint64
+	Opens    uint64
+	Reads    uint64
+	Writes   uint64
+}
+
+// Stats returns the number of RPCs fs has issued to its server.
+func (fs *filesystem) Stats() Stats {
+	return Stats{
+		Walks:    fs.stats.load(rpcWalk),
+		GetAttrs: fs.stats.load(rpcGetAttr),
+		SetAttrs: fs.stats.load(rpcSetAttr),
+		Opens:    fs.stats.load(rpcOpen),
+		Reads:    fs.stats.load(rpcRead),
+		Writes:   fs.stats.load(rpcWrite),
+	}
+}
+
+// dentryCacheEvent identifies an event counted by dentryCacheStats.
+type dentryCacheEvent int
+
+const (
+	// dentryCacheHit is counted when path resolution finds a cached dentry
+	// that is still valid.
+	dentryCacheHit dentryCacheEvent = iota
+
+	// dentryCacheMiss is counted when path resolution finds no valid cached
+	// dentry, and must look the file up on the server.
+	dentryCacheMiss
+
+	// dentryCacheInsert is counted when a dentry with no references is added
+	// to filesystem.cachedDentries.
+	dentryCacheInsert
+
+	// dentryCacheEvict is counted when a valid dentry is removed from
+	// filesystem.cachedDentries to respect filesystemOptions.maxCachedDentries
+	// or under memory pressure.
+	dentryCacheEvict
+
+	// dentryCacheInvalidate is counted when a dentry is dropped because the
+	// file it represents was replaced or removed.
+	dentryCacheInvalidate
+
+	numDentryCacheEvents
+)
+
+// dentryCacheMetrics count dentry cache events of each kind in all gofer
+// filesystems.
+var dentryCacheMetrics = [numDentryCacheEvents]*metric.Uint64Metric{
+	dentryCacheHit:        metric.MustCreateNewUint64Metric("/gofer/dentry_cache_hits", false /* sync */, "Number of path resolution lookups satisfied by VFS2 gofer clients' dentry caches."),
+	dentryCacheMiss:       metric.MustCreateNewUint64Metric("/gofer/dentry_cache_misses", false /* sync */, "Number of path resolution lookups not satisfied by VFS2 gofer clients' dentry caches."),
+	dentryCacheInsert:     metric.MustCreateNewUint64Metric("/gofer/dentry_cache_insertions", false /* sync */, "Number of unreferenced dentries cached by VFS2 gofer clients."),
+	dentryCacheEvict:      metric.MustCreateNewUint64Metric("/gofer/dentry_cache_evictions", false /* sync */, "Number of cached dentries evicted by VFS2 gofer clients due to cache size limits or memory pressure."),
+	dentryCacheInvalidate: metric.MustCreateNewUint64Metric("/gofer/dentry_cache_invalidations", false /* sync */, "Number of dentries dropped by VFS2 gofer clients because their files were replaced or removed."),
+}
+
+// dentryCacheStats counts dentry cache events in a single filesystem.
+type dentryCacheStats struct {
+	// counts is accessed using atomic memory operations.
+	counts [numDentryCacheEvents]uint64
+}
+
+// count records that an event of the given kind has occurred.
+func (s *dentryCacheStats) count(event dentryCacheEvent) {
+	dentryCacheMetrics[event].Increment()
+	atomic.AddUint64(&s.counts[event], 1)
+}
+
+func (s *dentryCacheStats) load(event dentryCacheEvent) uint64 {
+	return atomic.LoadUint64(&s.counts[event])
+}
+
+// DentryCacheStats contains the number of dentry cache events of each kind
+// that have occurred in a filesystem. Hits and misses are counted by path
+// resolution; a lookup that is satisfied by a cached dentry after
+// revalidating it with the server is a hit. Evictions count valid dentries
+// dropped to bound the size of the cache, while invalidations count dentries
+// dropped because the files they represent were replaced or removed.
+type DentryCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Insertions    uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+// DentryCacheStats returns the number of dentry cache events that have
+// occurred in fs.
+func (fs *filesystem) DentryCacheStats() DentryCacheStats {
+	return DentryCacheStats{
+		Hits:          fs.dentryCacheStats.load(dentryCacheHit),
+		Misses:        fs.dentryCacheStats.load(dentryCacheMiss),
+		Insertions:    fs.dentryCacheStats.load(dentryCacheInsert),
+		Evictions:     fs.dentryCacheStats.load(dentryCacheEvict),
+		Invalidations: fs.dentryCacheStats.load(dentryCacheInvalidate),
+	}
+}
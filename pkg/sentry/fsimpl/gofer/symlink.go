@@ -15,6 +15,8 @@
 package gofer
 
 import (
+	"sync/atomic"
+
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
@@ -28,20 +30,26 @@ func (d *dentry) isSymlink() bool {
 func (d *dentry) readlink(ctx context.Context, mnt *vfs.Mount) (string, error) {
 	if d.fs.opts.interop != InteropModeShared {
 		d.touchAtime(mnt)
-		d.dataMu.Lock()
-		if d.haveTarget {
-			target := d.target
-			d.dataMu.Unlock()
-			return target, nil
-		}
+	}
+	// Under InteropModeShared, the remote symlink may have been replaced since
+	// its target was cached. Path resolution revalidates d, updating
+	// d.qidVersion, so the cached target can be used if the server reports
+	// the same non-zero QID version. (Servers that don't version files always
+	// report 0.)
+	version := atomic.LoadUint32(&d.qidVersion)
+	if d.fs.opts.interop == InteropModeShared && version == 0 {
+		return d.file.readlink(ctx)
+	}
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	if d.haveTarget && d.targetVersion == version {
+		return d.target, nil
 	}
 	target, err := d.file.readlink(ctx)
-	if d.fs.opts.interop != InteropModeShared {
-		if err == nil {
-			d.haveTarget = true
-			d.target = target
-		}
-		d.dataMu.Unlock()
+	if err == nil {
+		d.haveTarget = true
+		d.target = target
+		d.targetVersion = version
 	}
 	return target, err
 }
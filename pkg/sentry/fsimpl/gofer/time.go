@@ -15,16 +15,61 @@
 package gofer
 
 import (
+	"math"
 	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
 )
 
 func dentryTimestampFromP9(s, ns uint64) int64 {
 	return int64(s*1e9 + ns)
 }
 
+// dentryTimestampFromServer converts a timestamp reported by the server to the
+// sandbox's clock.
+func (fs *filesystem) dentryTimestampFromServer(s, ns uint64) int64 {
+	return dentryTimestampFromP9(s, ns) + fs.opts.serverClockOffset
+}
+
+// p9TimestampFromStatx converts a timestamp from the sandbox's clock to the
+// server's, for sending to the server. UTIME_NOW and UTIME_OMIT are passed
+// through unchanged. Although 9P timestamps are unsigned, times before the
+// epoch are passed through as the two's complement of their seconds, which
+// the server converts back to a signed time; timestamps that can't be
+// represented after adjustment by the server clock offset are rejected with
+// EINVAL.
+func (fs *filesystem) p9TimestampFromStatx(ts linux.StatxTimestamp) (s, ns uint64, err error) {
+	offset := fs.opts.serverClockOffset
+	if ts.Nsec == linux.UTIME_NOW || ts.Nsec == linux.UTIME_OMIT || offset == 0 {
+		return uint64(ts.Sec), uint64(ts.Nsec), nil
+	}
+	// Adjust seconds and nanoseconds separately, since ts may not be
+	// representable in nanoseconds.
+	offsetSec := offset / 1e9
+	sec := ts.Sec - offsetSec
+	if (offsetSec > 0 && sec > ts.Sec) || (offsetSec < 0 && sec < ts.Sec) {
+		return 0, 0, syserror.EINVAL
+	}
+	nsec := int64(ts.Nsec) - offset%1e9
+	switch {
+	case nsec < 0:
+		if sec == math.MinInt64 {
+			return 0, 0, syserror.EINVAL
+		}
+		sec--
+		nsec += 1e9
+	case nsec >= 1e9:
+		if sec == math.MaxInt64 {
+			return 0, 0, syserror.EINVAL
+		}
+		sec++
+		nsec -= 1e9
+	}
+	return uint64(sec), uint64(nsec), nil
+}
+
 func dentryTimestampFromStatx(ts linux.StatxTimestamp) int64 {
 	return ts.Sec*1e9 + int64(ts.Nsec)
 }
@@ -36,14 +81,54 @@ func statxTimestampFromDentry(ns int64) linux.StatxTimestamp {
 	}
 }
 
+// atimePolicy controls when reads update a file's atime.
+type atimePolicy uint8
+
+const (
+	// atimeStrict causes every read to update atime. This is the behavior of
+	// the "strictatime" mount option.
+	atimeStrict atimePolicy = iota
+
+	// atimeRelative causes reads to update atime only if atime is earlier
+	// than mtime or ctime, or is more than relatimeInterval in the past. This
+	// is the behavior of the "relatime" mount option.
+	atimeRelative
+
+	// atimeNone causes reads to never update atime. This is the behavior of
+	// the "noatime" mount option.
+	atimeNone
+)
+
+// relatimeInterval is the maximum age of atime before a read updates it under
+// atimeRelative, from Linux's fs/inode.c:relatime_need_update().
+const relatimeInterval = 24 * 60 * 60 * 1e9 // 24 hours, in nanoseconds
+
+// Preconditions: d.metadataMu must be locked.
+func (d *dentry) atimeNeedsUpdateLocked(now int64) bool {
+	switch d.fs.opts.atime {
+	case atimeNone:
+		return false
+	case atimeRelative:
+		atime := atomic.LoadInt64(&d.atime)
+		return atime <= atomic.LoadInt64(&d.mtime) || atime <= atomic.LoadInt64(&d.ctime) || now-atime >= relatimeInterval
+	default:
+		return true
+	}
+}
+
 // Preconditions: fs.interop != InteropModeShared.
 func (d *dentry) touchAtime(mnt *vfs.Mount) {
-	if err := mnt.CheckBeginWrite(); err != nil {
+	if d.fs.opts.atime == atimeNone {
+		return
+	}
+	if err := d.fs.checkBeginWrite(mnt); err != nil {
 		return
 	}
 	now := d.fs.clock.Now().Nanoseconds()
 	d.metadataMu.Lock()
-	atomic.StoreInt64(&d.atime, now)
+	if d.atimeNeedsUpdateLocked(now) {
+		atomic.StoreInt64(&d.atime, now)
+	}
 	d.metadataMu.Unlock()
 	mnt.EndWrite()
 }
@@ -0,0 +1,359 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestServerClockOffset(t *testing.T) {
+	ctx := contexttest.Context(t)
+	// The server's clock is 100 seconds ahead of the sandbox's.
+	const offset = -100 * int64(time.Second)
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		interop:           InteropModeShared,
+		serverClockOffset: offset,
+	})
+	file := &testP9File{}
+	d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, Size: true, MTime: true}, &p9.Attr{
+		Mode:             p9.ModeRegular | 0644,
+		MTimeSeconds:     1000,
+		MTimeNanoSeconds: 5,
+	})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+
+	// Timestamps reported by the server are compensated.
+	var stat linux.Statx
+	d.statTo(&stat)
+	if want := (linux.StatxTimestamp{Sec: 900, Nsec: 5}); stat.Mtime != want {
+		t.Errorf("statTo(): got mtime %+v, want %+v", stat.Mtime, want)
+	}
+
+	// Timestamps sent to the server are converted back to its clock.
+	setStat := linux.Statx{
+		Mask:  linux.STATX_MTIME,
+		Mtime: linux.StatxTimestamp{Sec: 2000, Nsec: 7},
+	}
+	if err := d.setStat(ctx, auth.CredentialsFromContext(ctx), &setStat, newTestMount(t)); err != nil {
+		t.Fatalf("setStat(): %v", err)
+	}
+	if len(file.setAttrs) != 1 {
+		t.Fatalf("got %d SetAttr calls, want 1", len(file.setAttrs))
+	}
+	if got := file.setAttrs[0]; got.MTimeSeconds != 2100 || got.MTimeNanoSeconds != 7 {
+		t.Errorf("SetAttr(): got mtime %d.%09d, want 2100.000000007", got.MTimeSeconds, got.MTimeNanoSeconds)
+	}
+}
+
+func TestSetStatNegativeTime(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, offset := range []int64{0, 100 * int64(time.Second), -1500 * int64(time.Millisecond)} {
+		fs := newTestFilesystem(ctx, filesystemOptions{
+			interop:           InteropModeShared,
+			serverClockOffset: offset,
+		})
+		file := &testP9File{}
+		d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0644})
+
+		// Times before the epoch are sent to the server as the two's
+		// complement of their seconds, which the server converts back.
+		setStat := linux.Statx{
+			Mask:  linux.STATX_ATIME | linux.STATX_MTIME,
+			Atime: linux.StatxTimestamp{Sec: -1, Nsec: 5},
+			Mtime: linux.StatxTimestamp{Sec: -1000, Nsec: 999999999},
+		}
+		if err := d.setStat(ctx, auth.CredentialsFromContext(ctx), &setStat, newTestMount(t)); err != nil {
+			t.Fatalf("offset=%d: setStat(atime=%+v, mtime=%+v): %v", offset, setStat.Atime, setStat.Mtime, err)
+		}
+		if len(file.setAttrs) != 1 {
+			t.Fatalf("offset=%d: got %d SetAttr calls, want 1", offset, len(file.setAttrs))
+		}
+		got := file.setAttrs[0]
+		for _, ts := range []struct {
+			name string
+			set  linux.StatxTimestamp
+			sec  uint64
+			nsec uint64
+		}{
+			{name: "atime", set: setStat.Atime, sec: got.ATimeSeconds, nsec: got.ATimeNanoSeconds},
+			{name: "mtime", set: setStat.Mtime, sec: got.MTimeSeconds, nsec: got.MTimeNanoSeconds},
+		} {
+			want := dentryTimestampFromStatx(ts.set) - offset
+			if gotNs := int64(ts.sec)*1e9 + int64(ts.nsec); ts.nsec >= 1e9 || gotNs != want {
+				t.Errorf("offset=%d: SetAttr(): got %s %d.%09d, want %d ns", offset, ts.name, int64(ts.sec), ts.nsec, want)
+			}
+		}
+
+		if offset == 0 {
+			continue
+		}
+		// Times that overflow when converted to the server's clock are
+		// rejected.
+		ts := linux.StatxTimestamp{Sec: math.MinInt64}
+		if offset < 0 {
+			ts = linux.StatxTimestamp{Sec: math.MaxInt64, Nsec: 999999999}
+		}
+		setStat = linux.Statx{
+			Mask:  linux.STATX_MTIME,
+			Mtime: ts,
+		}
+		if err := d.setStat(ctx, auth.CredentialsFromContext(ctx), &setStat, newTestMount(t)); err != syserror.EINVAL {
+			t.Errorf("offset=%d: setStat(mtime=%+v): got %v, want EINVAL", offset, ts, err)
+		}
+		if len(file.setAttrs) != 1 {
+			t.Errorf("offset=%d: got %d SetAttr calls, want 1", offset, len(file.setAttrs))
+		}
+	}
+}
+
+func TestServerCtime(t *testing.T) {
+	ctx := contexttest.Context(t)
+	for _, serverCtime := range []bool{false, true} {
+		fs := newTestFilesystem(ctx, filesystemOptions{serverCtime: serverCtime})
+		file := &testP9File{
+			attr: p9.Attr{
+				Mode:         p9.ModeRegular | 0644,
+				MTimeSeconds: 1000,
+				CTimeSeconds: 1000,
+			},
+			attrMask: p9.AttrMask{Mode: true, MTime: true, CTime: true},
+		}
+		d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, file.attrMask, &file.attr)
+		if err != nil {
+			t.Fatalf("serverCtime=%t: fs.newDentry(): %v", serverCtime, err)
+		}
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"f": d})
+		vfsObj := root.Mount().Filesystem().VirtualFilesystem()
+		pop := pathOp(root, "f")
+
+		// Another user of the remote filesystem modifies the file.
+		file.attr.MTimeSeconds = 2000
+		file.attr.CTimeSeconds = 2000
+
+		stat, err := vfsObj.StatAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.StatOptions{Mask: linux.STATX_BASIC_STATS})
+		if err != nil {
+			t.Fatalf("serverCtime=%t: StatAt(): %v", serverCtime, err)
+		}
+		wantCtime := int64(1000)
+		if serverCtime {
+			wantCtime = 2000
+		}
+		if stat.Ctime.Sec != wantCtime {
+			t.Errorf("serverCtime=%t: got ctime %d, want %d", serverCtime, stat.Ctime.Sec, wantCtime)
+		}
+		// mtime remains client-side.
+		if stat.Mtime.Sec != 1000 {
+			t.Errorf("serverCtime=%t: got mtime %d, want 1000", serverCtime, stat.Mtime.Sec)
+		}
+
+		// Stats that don't sync with the server return the cached ctime.
+		file.attr.CTimeSeconds = 3000
+		stat, err = vfsObj.StatAt(ctx, auth.CredentialsFromContext(ctx), pop, &vfs.StatOptions{Mask: linux.STATX_BASIC_STATS, Sync: linux.AT_STATX_DONT_SYNC})
+		if err != nil {
+			t.Fatalf("serverCtime=%t: StatAt(AT_STATX_DONT_SYNC): %v", serverCtime, err)
+		}
+		if stat.Ctime.Sec != wantCtime {
+			t.Errorf("serverCtime=%t: AT_STATX_DONT_SYNC: got ctime %d, want %d", serverCtime, stat.Ctime.Sec, wantCtime)
+		}
+		root.DecRef()
+	}
+}
+
+func TestAtimePolicy(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const hour = int64(time.Hour)
+	for _, test := range []struct {
+		desc   string
+		policy atimePolicy
+		// atime, mtime and ctime are relative to the current time.
+		atime, mtime, ctime int64
+		wantUpdate          bool
+	}{
+		{
+			desc:       "strictatime",
+			policy:     atimeStrict,
+			atime:      -hour,
+			mtime:      -2 * hour,
+			ctime:      -2 * hour,
+			wantUpdate: true,
+		},
+		{
+			desc:       "relatime with recent atime",
+			policy:     atimeRelative,
+			atime:      -hour,
+			mtime:      -2 * hour,
+			ctime:      -2 * hour,
+			wantUpdate: false,
+		},
+		{
+			desc:       "relatime with atime before mtime",
+			policy:     atimeRelative,
+			atime:      -2 * hour,
+			mtime:      -hour,
+			ctime:      -3 * hour,
+			wantUpdate: true,
+		},
+		{
+			desc:       "relatime with atime before ctime",
+			policy:     atimeRelative,
+			atime:      -2 * hour,
+			mtime:      -3 * hour,
+			ctime:      -hour,
+			wantUpdate: true,
+		},
+		{
+			desc:       "relatime with old atime",
+			policy:     atimeRelative,
+			atime:      -25 * hour,
+			mtime:      -26 * hour,
+			ctime:      -26 * hour,
+			wantUpdate: true,
+		},
+		{
+			desc:       "noatime",
+			policy:     atimeNone,
+			atime:      -25 * hour,
+			mtime:      -hour,
+			ctime:      -hour,
+			wantUpdate: false,
+		},
+	} {
+		fs := newTestFilesystem(ctx, filesystemOptions{atime: test.policy})
+		file := &testP9File{data: []byte("data")}
+		d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, Size: true}, &p9.Attr{Mode: p9.ModeRegular | 0644, Size: 4})
+		if err != nil {
+			t.Fatalf("%s: fs.newDentry(): %v", test.desc, err)
+		}
+		root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"f": d})
+		fd, err := openAt(ctx, root, "f", linux.O_RDONLY)
+		if err != nil {
+			t.Fatalf("%s: OpenAt(f): %v", test.desc, err)
+		}
+
+		now := fs.clock.Now().Nanoseconds()
+		atime := now + test.atime
+		atomic.StoreInt64(&d.atime, atime)
+		atomic.StoreInt64(&d.mtime, now+test.mtime)
+		atomic.StoreInt64(&d.ctime, now+test.ctime)
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 4)), 0, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("%s: PRead: %v", test.desc, err)
+		}
+		if updated := atomic.LoadInt64(&d.atime) != atime; updated != test.wantUpdate {
+			t.Errorf("%s: read updated atime: got %t, want %t", test.desc, updated, test.wantUpdate)
+		}
+
+		fd.DecRef()
+		root.DecRef()
+	}
+}
+
+func TestSetStatUtimeOmit(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	setStat := linux.Statx{
+		Mask:  linux.STATX_ATIME | linux.STATX_MTIME,
+		Atime: linux.StatxTimestamp{Nsec: linux.UTIME_OMIT},
+		Mtime: linux.StatxTimestamp{Sec: 2000, Nsec: 7},
+	}
+	for _, interop := range []InteropMode{InteropModeExclusive, InteropModeShared} {
+		fs := newTestFilesystem(ctx, filesystemOptions{interop: interop})
+		file := &testP9File{}
+		d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true, ATime: true, MTime: true}, &p9.Attr{
+			Mode:             p9.ModeRegular | 0644,
+			ATimeSeconds:     1000,
+			ATimeNanoSeconds: 3,
+			MTimeSeconds:     1000,
+			MTimeNanoSeconds: 5,
+		})
+		if err != nil {
+			t.Fatalf("fs.newDentry(): %v", err)
+		}
+		stat := setStat
+		if err := d.setStat(ctx, auth.CredentialsFromContext(ctx), &stat, newTestMount(t)); err != nil {
+			t.Fatalf("interop=%v: setStat(): %v", interop, err)
+		}
+
+		if interop == InteropModeShared {
+			// Timestamps are updated by the server.
+			if len(file.setAttrMasks) != 1 {
+				t.Fatalf("interop=%v: got %d SetAttr calls, want 1", interop, len(file.setAttrMasks))
+			}
+			if mask := file.setAttrMasks[0]; mask.ATime || !mask.MTime {
+				t.Errorf("interop=%v: SetAttr(): got mask %+v, want MTime only", interop, mask)
+			}
+			continue
+		}
+		var got linux.Statx
+		d.statTo(&got)
+		if want := (linux.StatxTimestamp{Sec: 1000, Nsec: 3}); got.Atime != want {
+			t.Errorf("interop=%v: got atime %+v, want %+v", interop, got.Atime, want)
+		}
+		if want := (linux.StatxTimestamp{Sec: 2000, Nsec: 7}); got.Mtime != want {
+			t.Errorf("interop=%v: got mtime %+v, want %+v", interop, got.Mtime, want)
+		}
+	}
+}
+
+func TestSetStatCtime(t *testing.T) {
+	ctx := contexttest.RootContext(t)
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	file := &testP9File{}
+	d, err := fs.newDentry(ctx, p9file{file: file}, p9.QID{}, p9.AttrMask{Mode: true}, &p9.Attr{Mode: p9.ModeRegular | 0644})
+	if err != nil {
+		t.Fatalf("fs.newDentry(): %v", err)
+	}
+	mnt := newTestMount(t)
+	creds := auth.CredentialsFromContext(ctx)
+
+	// Setting ctime explicitly fails, even alongside other attributes, and
+	// changes nothing.
+	for _, mask := range []uint32{linux.STATX_CTIME, linux.STATX_CTIME | linux.STATX_MODE} {
+		stat := linux.Statx{
+			Mask:  mask,
+			Mode:  0600,
+			Ctime: linux.StatxTimestamp{Sec: 1000},
+		}
+		if err := d.setStat(ctx, creds, &stat, mnt); err != syserror.EPERM {
+			t.Errorf("setStat(mask=%#x): got err %v, want %v", mask, err, syserror.EPERM)
+		}
+	}
+	if len(file.setAttrMasks) != 0 {
+		t.Errorf("got %d SetAttr calls after failed setStat, want 0", len(file.setAttrMasks))
+	}
+	if got, want := atomic.LoadUint32(&d.mode), uint32(linux.S_IFREG|0644); got != want {
+		t.Errorf("got mode %#o after failed setStat, want %#o", got, want)
+	}
+
+	// Without STATX_CTIME, the remaining attributes are set.
+	stat := linux.Statx{Mask: linux.STATX_MODE, Mode: 0600}
+	if err := d.setStat(ctx, creds, &stat, mnt); err != nil {
+		t.Fatalf("setStat(STATX_MODE): %v", err)
+	}
+	if got, want := atomic.LoadUint32(&d.mode), uint32(linux.S_IFREG|0600); got != want {
+		t.Errorf("got mode %#o after setStat, want %#o", got, want)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/fs/fsutil"
+)
+
+// defaultWritebackLimit is the default value of
+// filesystemOptions.writebackLimit for cache=writeback.
+const defaultWritebackLimit = 4 << 20 // 4 MiB
+
+// startWriteback starts fs' writeback worker, which writes back dirty cached
+// data for dentries queued by fs.queueWriteback().
+//
+// Preconditions: fs.opts.writebackLimit != 0. startWriteback has not been
+// called previously.
+func (fs *filesystem) startWriteback() {
+	fs.writebackQueue = make(map[*dentry]struct{})
+	fs.writebackWake = make(chan struct{}, 1)
+	fs.writebackStop = make(chan struct{})
+	fs.writebackDone = make(chan struct{})
+	go fs.writebackWorker() // S/R-SAFE: stopped by fs.Release().
+}
+
+// stopWriteback stops fs' writeback worker, if one was started, and waits
+// for it to exit. Dentries that are still queued are not written back.
+func (fs *filesystem) stopWriteback() {
+	if fs.writebackStop == nil {
+		return
+	}
+	close(fs.writebackStop)
+	<-fs.writebackDone
+}
+
+// queueWriteback requests that fs' writeback worker write back d's dirty
+// cached data.
+//
+// Preconditions: fs.opts.writebackLimit != 0. d.dataMu must be locked.
+func (fs *filesystem) queueWriteback(d *dentry) {
+	fs.writebackMu.Lock()
+	fs.writebackQueue[d] = struct{}{}
+	fs.writebackMu.Unlock()
+	select {
+	case fs.writebackWake <- struct{}{}:
+	default:
+		// The worker has already been woken.
+	}
+}
+
+func (fs *filesystem) writebackWorker() {
+	defer close(fs.writebackDone)
+	ctx := context.Background()
+	for {
+		select {
+		case <-fs.writebackStop:
+			return
+		case <-fs.writebackWake:
+		}
+
+		fs.writebackMu.Lock()
+		ds := make([]*dentry, 0, len(fs.writebackQueue))
+		for d := range fs.writebackQueue {
+			ds = append(ds, d)
+		}
+		fs.writebackQueue = make(map[*dentry]struct{})
+		fs.writebackMu.Unlock()
+
+		for _, d := range ds {
+			if err := fs.writebackQueued(ctx, d); err != nil {
+				log.Warningf("gofer.filesystem.writebackWorker: failed to write dirty data back: %v", err)
+				fs.writebackMu.Lock()
+				if fs.writebackErr == nil {
+					fs.writebackErr = err
+				}
+				fs.writebackMu.Unlock()
+			}
+		}
+	}
+}
+
+// writebackQueued writes back the dirty cached data of d, which was queued by
+// queueWriteback.
+func (fs *filesystem) writebackQueued(ctx context.Context, d *dentry) error {
+	if d.TryIncRef() {
+		defer d.DecRef()
+		return d.writebackDirty(ctx)
+	}
+	// d has no references; for example, it may be a file that was written
+	// and then closed. Dentries without references can neither gain
+	// references nor be destroyed without fs.renameMu locked for writing (see
+	// dentry.checkCachingLocked()), so holding it keeps d.handle valid, as in
+	// fs.evictCachedDentryLocked().
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+	if atomic.LoadInt64(&d.refs) == -1 {
+		// d's dirty data was written back when it was destroyed.
+		return nil
+	}
+	return d.writebackDirty(ctx)
+}
+
+// drainWriteback removes all dentries from fs' writeback queue, since the
+// caller is about to write back all dirty data, and returns the first error
+// encountered by the writeback worker since the last call to drainWriteback.
+// In-flight writeback by the worker is serialized with the caller's by
+// dentry.dataMu.
+func (fs *filesystem) drainWriteback() error {
+	if fs.opts.writebackLimit == 0 {
+		return nil
+	}
+	fs.writebackMu.Lock()
+	defer fs.writebackMu.Unlock()
+	fs.writebackQueue = make(map[*dentry]struct{})
+	err := fs.writebackErr
+	fs.writebackErr = nil
+	return err
+}
+
+// writebackDirty writes back all of d's dirty cached data, without syncing the
+// remote file.
+func (d *dentry) writebackDirty(ctx context.Context) error {
+	d.handleMu.RLock()
+	defer d.handleMu.RUnlock()
+	if !d.handleWritable {
+		return nil
+	}
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	err := fsutil.SyncDirtyAll(ctx, &d.cache, &d.dirty, d.size, d.fs.mfp.MemoryFile(), d.handle.writeFromBlocksAt)
+	d.recordWritebackErrLocked(err)
+	return err
+}
+
+// recordWritebackErrLocked records err, if it is non-nil, as an asynchronous
+// writeback error to be reported by the next close of a writable FD for d.
+// Only the first such error is retained.
+//
+// Preconditions: d.dataMu must be locked.
+func (d *dentry) recordWritebackErrLocked(err error) {
+	if err != nil && d.writebackErr == nil {
+		d.writebackErr = err
+	}
+}
+
+// takeWritebackErrLocked returns the error recorded by
+// recordWritebackErrLocked, if any, and clears it so that it is reported only
+// once.
+//
+// Preconditions: d.dataMu must be locked.
+func (d *dentry) takeWritebackErrLocked() error {
+	err := d.writebackErr
+	d.writebackErr = nil
+	return err
+}
+
+// dirtyBytesLocked returns the number of bytes of d's cached data that are
+// dirty.
+//
+// Preconditions: d.dataMu must be locked.
+func (d *dentry) dirtyBytesLocked() uint64 {
+	var n uint64
+	for seg := d.dirty.FirstSegment(); seg.Ok(); seg = seg.NextSegment() {
+		n += seg.Range().Length()
+	}
+	return n
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofer
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/p9"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+func TestWritebackLimit(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const limit = usermem.PageSize
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		writebackLimit: limit,
+	})
+	file := &testP9File{data: make([]byte, 2*limit)}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: 2 * limit})
+	fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+	fs.startWriteback()
+	defer fs.stopWriteback()
+
+	// Reading the file fills the cache, so that the following write dirties
+	// cached pages rather than being written through.
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 2*limit)), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	// A write that dirties no more than the limit is not written back.
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(bytes.Repeat([]byte{'a'}, limit)), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(): %v", err)
+	}
+	if got := file.contents(); got[0] != 0 {
+		t.Fatalf("remote file was written back with %d dirty bytes, limit %d", limit, limit)
+	}
+	// Exceeding the limit causes all dirty data to be written back, without
+	// an explicit sync.
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(bytes.Repeat([]byte{'b'}, limit)), limit, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(): %v", err)
+	}
+	want := append(bytes.Repeat([]byte{'a'}, limit), bytes.Repeat([]byte{'b'}, limit)...)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if bytes.Equal(file.contents(), want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dirty data was not written back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWritebackErrorReportedOnClose(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const size = usermem.PageSize
+	fs := newTestFilesystem(ctx, filesystemOptions{})
+	file := &testP9File{data: make([]byte, size)}
+	d := newTestDentry(ctx, t, fs, file, p9.Attr{Mode: p9.ModeRegular | 0666, Size: size})
+	fd := openTestFile(ctx, t, fs, d, linux.O_RDWR)
+
+	// Fill the cache, then dirty it.
+	if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, size)), 0, vfs.ReadOptions{}); err != nil {
+		t.Fatalf("PRead(): %v", err)
+	}
+	if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(bytes.Repeat([]byte{'a'}, size)), 0, vfs.WriteOptions{}); err != nil {
+		t.Fatalf("PWrite(): %v", err)
+	}
+
+	// Fail asynchronous writeback of the dirty data.
+	file.dataMu.Lock()
+	file.writeErr = syserror.EIO
+	file.dataMu.Unlock()
+	if err := d.writebackDirty(ctx); err != syserror.EIO {
+		t.Fatalf("writebackDirty(): got %v, want %v", err, syserror.EIO)
+	}
+	file.dataMu.Lock()
+	file.writeErr = nil
+	file.dataMu.Unlock()
+
+	// The error is reported by the next close, and only once.
+	if err := fd.OnClose(ctx); err != syserror.EIO {
+		t.Errorf("first OnClose(): got %v, want %v", err, syserror.EIO)
+	}
+	if err := fd.OnClose(ctx); err != nil {
+		t.Errorf("second OnClose(): got %v, want nil", err)
+	}
+}
+
+func TestWritebackUnreferencedDentry(t *testing.T) {
+	ctx := contexttest.Context(t)
+	const limit = usermem.PageSize
+	fs := newTestFilesystem(ctx, filesystemOptions{
+		writebackLimit:    limit,
+		maxCachedDentries: 10,
+	})
+	// Writeback of "a" blocks until aFile.writeGate is closed.
+	aFile := &testP9File{data: make([]byte, 2*limit), writeGate: make(chan struct{})}
+	bFile := &testP9File{data: make([]byte, 2*limit)}
+	a := newTestDentry(ctx, t, fs, aFile, p9.Attr{Mode: p9.ModeRegular | 0666, Size: 2 * limit})
+	b := newTestDentry(ctx, t, fs, bFile, p9.Attr{Mode: p9.ModeRegular | 0666, Size: 2 * limit})
+	root := newTestRoot(ctx, t, fs, &testP9File{}, map[string]*dentry{"a": a, "b": b})
+	defer root.DecRef()
+	fs.startWriteback()
+	defer fs.stopWriteback()
+
+	// dirty fills the cache of the file at path, then dirties more than limit
+	// bytes of it, causing it to be queued for writeback.
+	want := bytes.Repeat([]byte{'a'}, 2*limit)
+	dirty := func(path string) *vfs.FileDescription {
+		fd, err := openAt(ctx, root, path, linux.O_RDWR)
+		if err != nil {
+			t.Fatalf("OpenAt(%s): %v", path, err)
+		}
+		if _, err := fd.PRead(ctx, usermem.BytesIOSequence(make([]byte, 2*limit)), 0, vfs.ReadOptions{}); err != nil {
+			t.Fatalf("PRead(%s): %v", path, err)
+		}
+		if _, err := fd.PWrite(ctx, usermem.BytesIOSequence(want), 0, vfs.WriteOptions{}); err != nil {
+			t.Fatalf("PWrite(%s): %v", path, err)
+		}
+		return fd
+	}
+
+	// Keep the writeback worker busy with "a" while "b" is dirtied and
+	// closed, so that "b" has no references when the worker reaches it.
+	aFD := dirty("a")
+	defer aFD.DecRef()
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		fs.writebackMu.Lock()
+		queued := len(fs.writebackQueue)
+		fs.writebackMu.Unlock()
+		if queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("writeback of a did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dirty("b").DecRef()
+	if refs := atomic.LoadInt64(&b.refs); refs != 0 {
+		t.Fatalf("b has %d references after close, want 0", refs)
+	}
+	close(aFile.writeGate)
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		b.dataMu.Lock()
+		dirtyBytes := b.dirtyBytesLocked()
+		b.dataMu.Unlock()
+		if dirtyBytes == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("b still has %d dirty bytes after close, limit %d", dirtyBytes, limit)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := bFile.contents(); !bytes.Equal(got, want) {
+		t.Errorf("b was written back with %q, want %q", got, want)
+	}
+}
@@ -396,6 +396,15 @@ func (k *Kernel) SaveTo(w io.Writer) error {
 		return err
 	}
 
+	// Capture the state of VFS2 filesystems that must be re-established on
+	// restore. This must come after flushing writes, which may write back
+	// cached data.
+	if VFS2Enabled {
+		if err := k.vfs.PrepareSave(ctx); err != nil {
+			return err
+		}
+	}
+
 	// Remove all epoll waiter objects from underlying wait queues.
 	// NOTE: for programs to resume execution in future snapshot scenarios,
 	// we will need to re-establish these waiter objects after saving.
@@ -631,6 +640,13 @@ func (k *Kernel) LoadFrom(r io.Reader, net inet.Stack, clocks sentrytime.Clocks)
 	}
 	log.Infof("Memory load took [%s].", time.Since(memoryStart))
 
+	// Re-establish the state of VFS2 filesystems captured before save.
+	if VFS2Enabled {
+		if err := k.vfs.CompleteRestore(k.SupervisorContext()); err != nil {
+			return err
+		}
+	}
+
 	log.Infof("Overall load took [%s]", time.Since(loadStart))
 
 	k.Timekeeper().SetClocks(clocks)
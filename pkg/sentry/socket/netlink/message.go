@@ -15,6 +15,7 @@
 package netlink
 
 import (
+	"errors"
 	"fmt"
 	"math"
 
@@ -85,6 +86,57 @@ func ParseMessage(buf []byte) (msg *Message, rest []byte, ok bool) {
 	}, []byte(b), true
 }
 
+// ParseMessageFrom is like ParseMessage, but additionally requires that the
+// message's header.PortID is expectedPortID, where 0 identifies the kernel.
+// This allows consumers to reject messages that claim to come from a port
+// other than the one they are communicating with.
+func ParseMessageFrom(buf []byte, expectedPortID uint32) (msg *Message, rest []byte, ok bool) {
+	msg, rest, ok = ParseMessage(buf)
+	if !ok || msg.hdr.PortID != expectedPortID {
+		return nil, nil, false
+	}
+	return msg, rest, true
+}
+
+// ParseAll parses the sequence of messages in buf, such as a multipart
+// (NLM_F_MULTI) dump. Parsing stops at an NLMSG_DONE message, which is not
+// included in the result, or at the end of buf. An error is returned if buf
+// contains a malformed message before either.
+func ParseAll(buf []byte) ([]Message, error) {
+	var msgs []Message
+	for off := 0; len(buf) > 0; {
+		msg, rest, ok := ParseMessage(buf)
+		if !ok {
+			return nil, fmt.Errorf("malformed netlink message at offset %d", off)
+		}
+		if msg.hdr.Type == linux.NLMSG_DONE {
+			break
+		}
+		msgs = append(msgs, *msg)
+		off += len(buf) - len(rest)
+		buf = rest
+	}
+	return msgs, nil
+}
+
+// BuildAck returns a serialized NLMSG_ERROR message acknowledging req, as sent
+// in response to requests with NLM_F_ACK set. err is the negated errno with
+// which the request failed, or 0 if it succeeded. As for Linux with
+// NETLINK_CAP_ACK set, only req's header is echoed, not its payload. See
+// net/netlink/af_netlink.c:netlink_ack.
+func BuildAck(req linux.NetlinkMessageHeader, err int32) []byte {
+	m := NewMessage(linux.NetlinkMessageHeader{
+		Type:   linux.NLMSG_ERROR,
+		Seq:    req.Seq,
+		PortID: req.PortID,
+	})
+	m.Put(linux.NetlinkErrorMessage{
+		Error:  err,
+		Header: req,
+	})
+	return m.Finalize()
+}
+
 // Header returns the header of this message.
 func (m *Message) Header() linux.NetlinkMessageHeader {
 	return m.hdr
@@ -136,6 +188,13 @@ func (m *Message) Finalize() []byte {
 	return m.buf
 }
 
+// Bytes returns the message serialized so far. Unlike Finalize, Bytes does
+// not set the length in the message header or align the message, so the
+// Message may still be modified; the returned slice is only valid until then.
+func (m *Message) Bytes() []byte {
+	return m.buf
+}
+
 // putZeros adds n zeros to the message.
 func (m *Message) putZeros(n int) {
 	for n > 0 {
@@ -187,6 +246,62 @@ func (m *Message) PutAttrString(atype uint16, s string) {
 	m.putZeros(aligned - l)
 }
 
+// PutAttrUint32 adds v to the message as a netlink attribute.
+func (m *Message) PutAttrUint32(atype uint16, v uint32) {
+	m.PutAttr(atype, v)
+}
+
+// MessageBuilder serializes a netlink message from a header and a sequence of
+// payload structures, handling the message length and alignment that callers
+// would otherwise need to compute by hand. The message can be parsed by
+// ParseMessage and Message.GetData.
+//
+// The zero value of MessageBuilder is empty, and ready for PutHeader.
+type MessageBuilder struct {
+	buf []byte
+}
+
+// PutHeader serializes hdr as the message header. The header's Length is
+// ignored, and will be set by Finalize.
+//
+// Preconditions: PutHeader has not been called previously.
+func (b *MessageBuilder) PutHeader(hdr linux.NetlinkMessageHeader) {
+	if b.buf != nil {
+		panic("netlink.MessageBuilder.PutHeader called twice")
+	}
+	b.buf = binary.Marshal(make([]byte, 0, linux.NetlinkMessageHeaderSize), usermem.ByteOrder, hdr)
+}
+
+// PutData serializes v into the message payload. Each call to PutData starts
+// at the next NLMSG_ALIGNTO-aligned offset in the message.
+//
+// Preconditions: PutHeader has been called.
+func (b *MessageBuilder) PutData(v interface{}) {
+	if b.buf == nil {
+		panic("netlink.MessageBuilder.PutData called before PutHeader")
+	}
+	b.buf = append(b.buf, make([]byte, alignPad(len(b.buf), linux.NLMSG_ALIGNTO))...)
+	b.buf = binary.Marshal(b.buf, usermem.ByteOrder, v)
+}
+
+// Finalize returns the serialized message, with its length set in the
+// message header and padding appended to NLMSG_ALIGNTO, as for
+// Message.Finalize. The MessageBuilder must not be used after calling
+// Finalize.
+//
+// Preconditions: PutHeader has been called.
+func (b *MessageBuilder) Finalize() []byte {
+	if b.buf == nil {
+		panic("netlink.MessageBuilder.Finalize called before PutHeader")
+	}
+	// Update length, which is the first 4 bytes of the header. As in
+	// Message.Finalize, this excludes trailing padding.
+	usermem.ByteOrder.PutUint32(b.buf, uint32(len(b.buf)))
+	buf := append(b.buf, make([]byte, alignPad(len(b.buf), linux.NLMSG_ALIGNTO))...)
+	b.buf = nil
+	return buf
+}
+
 // MessageSet contains a series of netlink messages.
 type MessageSet struct {
 	// Multi indicates that this a multi-part message, to be terminated by
@@ -266,6 +381,79 @@ func (v AttrsView) ParseFirst() (hdr linux.NetlinkAttrHeader, value []byte, rest
 	return hdr, value, AttrsView(b), ok
 }
 
+// ParseNested parses the first netlink attribute at the beginning of v, which
+// must have NLA_F_NESTED set, and returns a view of the attributes nested
+// within it. The returned hdr.Type has the NLA_F_NESTED and
+// NLA_F_NET_BYTEORDER flags masked off. If the first attribute is malformed or
+// not nested, ok is false.
+func (v AttrsView) ParseNested() (hdr linux.NetlinkAttrHeader, nested AttrsView, rest AttrsView, ok bool) {
+	hdr, value, rest, ok := v.ParseFirst()
+	if !ok || hdr.Type&linux.NLA_F_NESTED == 0 {
+		return linux.NetlinkAttrHeader{}, nil, nil, false
+	}
+	hdr.Type &= linux.NLA_TYPE_MASK
+	return hdr, AttrsView(value), rest, true
+}
+
+// Lookup returns the value of the first attribute in v with the given type,
+// ignoring the NLA_F_NESTED and NLA_F_NET_BYTEORDER flags. If v contains no
+// such attribute, or a malformed attribute precedes it, ok is false.
+func (v AttrsView) Lookup(attrType uint16) (value []byte, ok bool) {
+	for !v.Empty() {
+		var hdr linux.NetlinkAttrHeader
+		hdr, value, v, ok = v.ParseFirst()
+		if !ok {
+			return nil, false
+		}
+		if hdr.Type&linux.NLA_TYPE_MASK == attrType {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// ErrMalformedAttr is returned by AttrsView.ForEach if it encounters a
+// malformed attribute.
+var ErrMalformedAttr = errors.New("malformed netlink attribute")
+
+// ErrUnexpectedAttr is returned by AttrsView.ParseFirstExpecting if it
+// encounters an attribute of a type that the caller does not expect.
+var ErrUnexpectedAttr = errors.New("unexpected netlink attribute type")
+
+// ParseFirstExpecting is like ParseFirst, but additionally requires that the
+// type of the first attribute, ignoring the NLA_F_NESTED and
+// NLA_F_NET_BYTEORDER flags, is in valid. If the first attribute is
+// malformed, ParseFirstExpecting returns ErrMalformedAttr; if it has any other
+// type, ParseFirstExpecting returns ErrUnexpectedAttr.
+func (v AttrsView) ParseFirstExpecting(valid map[uint16]bool) (hdr linux.NetlinkAttrHeader, value []byte, rest AttrsView, err error) {
+	hdr, value, rest, ok := v.ParseFirst()
+	if !ok {
+		return linux.NetlinkAttrHeader{}, nil, nil, ErrMalformedAttr
+	}
+	if !valid[hdr.Type&linux.NLA_TYPE_MASK] {
+		return linux.NetlinkAttrHeader{}, nil, nil, ErrUnexpectedAttr
+	}
+	return hdr, value, rest, nil
+}
+
+// ForEach calls fn for each attribute in v, in order. If fn returns a non-nil
+// error, ForEach stops and returns it. If a malformed attribute is
+// encountered before the end of v, ForEach returns ErrMalformedAttr after
+// calling fn for all preceding attributes.
+func (v AttrsView) ForEach(fn func(hdr linux.NetlinkAttrHeader, value []byte) error) error {
+	for !v.Empty() {
+		hdr, value, rest, ok := v.ParseFirst()
+		if !ok {
+			return ErrMalformedAttr
+		}
+		if err := fn(hdr, value); err != nil {
+			return err
+		}
+		v = rest
+	}
+	return nil
+}
+
 // BytesView supports extracting data from a byte slice with bounds checking.
 type BytesView []byte
 
@@ -16,7 +16,9 @@ package message_test
 
 import (
 	"bytes"
+	"errors"
 	"reflect"
+	"syscall"
 	"testing"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
@@ -195,6 +197,204 @@ func TestParseMessage(t *testing.T) {
 	}
 }
 
+func TestParseMessageFrom(t *testing.T) {
+	fromPort4 := []byte{
+		0x14, 0x00, 0x00, 0x00, // Length
+		0x01, 0x00, // Type
+		0x02, 0x00, // Flags
+		0x03, 0x00, 0x00, 0x00, // Seq
+		0x04, 0x00, 0x00, 0x00, // PortID
+		0x30, 0x31, 0x00, 0x00, // Data message with 2 bytes padding
+		0xFF, // Next message (rest)
+	}
+	fromKernel := []byte{
+		0x14, 0x00, 0x00, 0x00, // Length
+		0x01, 0x00, // Type
+		0x02, 0x00, // Flags
+		0x03, 0x00, 0x00, 0x00, // Seq
+		0x00, 0x00, 0x00, 0x00, // PortID
+		0x30, 0x31, 0x00, 0x00, // Data message with 2 bytes padding
+	}
+	malformed := []byte{
+		0xFF, 0xFF, 0x00, 0x00, // Length too long
+		0x01, 0x00, // Type
+		0x02, 0x00, // Flags
+		0x03, 0x00, 0x00, 0x00, // Seq
+		0x04, 0x00, 0x00, 0x00, // PortID
+		0x30, 0x31, 0x00, 0x00, // Data message with 2 bytes padding
+	}
+
+	tests := []struct {
+		desc           string
+		input          []byte
+		expectedPortID uint32
+
+		restLen int
+		ok      bool
+	}{
+		{
+			desc:           "matching PortID",
+			input:          fromPort4,
+			expectedPortID: 4,
+			restLen:        1,
+			ok:             true,
+		},
+		{
+			desc:           "mismatching PortID",
+			input:          fromPort4,
+			expectedPortID: 5,
+			ok:             false,
+		},
+		{
+			desc:           "user PortID when expecting kernel",
+			input:          fromPort4,
+			expectedPortID: 0,
+			ok:             false,
+		},
+		{
+			desc:           "kernel PortID when expecting kernel",
+			input:          fromKernel,
+			expectedPortID: 0,
+			ok:             true,
+		},
+		{
+			desc:           "kernel PortID when expecting user",
+			input:          fromKernel,
+			expectedPortID: 4,
+			ok:             false,
+		},
+		{
+			desc:           "malformed message with matching PortID",
+			input:          malformed,
+			expectedPortID: 4,
+			ok:             false,
+		},
+	}
+	for _, test := range tests {
+		msg, rest, ok := netlink.ParseMessageFrom(test.input, test.expectedPortID)
+		if ok != test.ok {
+			t.Errorf("%v: got ok = %v, want = %v", test.desc, ok, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if got, want := msg.Header().PortID, test.expectedPortID; got != want {
+			t.Errorf("%v: got PortID = %d, want = %d", test.desc, got, want)
+		}
+		if got, want := rest, test.input[len(test.input)-test.restLen:]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got rest = %v, want = %v", test.desc, got, want)
+		}
+	}
+}
+
+type dummyNetlinkAttrs struct {
+	Bar uint32
+	Baz uint8
+}
+
+func TestMessageBuilder(t *testing.T) {
+	tests := []struct {
+		desc   string
+		header linux.NetlinkMessageHeader
+		data   []interface{}
+
+		wantLength uint32
+		wantBytes  int
+	}{
+		{
+			desc: "header only",
+			header: linux.NetlinkMessageHeader{
+				Type:   1,
+				Flags:  2,
+				Seq:    3,
+				PortID: 4,
+			},
+			wantLength: 16,
+			wantBytes:  16,
+		},
+		{
+			desc: "unaligned data",
+			header: linux.NetlinkMessageHeader{
+				Type:   1,
+				Flags:  2,
+				Seq:    3,
+				PortID: 4,
+			},
+			data:       []interface{}{&dummyNetlinkMsg{Foo: 0x3130}},
+			wantLength: 18,
+			wantBytes:  20,
+		},
+		{
+			desc: "aligned data after unaligned data",
+			header: linux.NetlinkMessageHeader{
+				Type:   1,
+				Flags:  2,
+				Seq:    3,
+				PortID: 4,
+			},
+			data:       []interface{}{&dummyNetlinkMsg{Foo: 0x3130}, &dummyNetlinkAttrs{Bar: 5, Baz: 6}},
+			wantLength: 25,
+			wantBytes:  28,
+		},
+		{
+			desc: "length is overwritten",
+			header: linux.NetlinkMessageHeader{
+				Length: 0xFFFF,
+				Type:   1,
+			},
+			data:       []interface{}{&dummyNetlinkMsg{Foo: 0x3130}},
+			wantLength: 18,
+			wantBytes:  20,
+		},
+	}
+	for _, test := range tests {
+		var b netlink.MessageBuilder
+		b.PutHeader(test.header)
+		for _, v := range test.data {
+			b.PutData(v)
+		}
+		buf := b.Finalize()
+		if len(buf) != test.wantBytes {
+			t.Errorf("%v: got %d bytes, want %d", test.desc, len(buf), test.wantBytes)
+		}
+
+		msg, rest, ok := netlink.ParseMessage(buf)
+		if !ok {
+			t.Errorf("%v: ParseMessage failed on %v", test.desc, buf)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("%v: got rest = %v, want empty", test.desc, rest)
+		}
+		wantHdr := test.header
+		wantHdr.Length = test.wantLength
+		if !reflect.DeepEqual(msg.Header(), wantHdr) {
+			t.Errorf("%v: got hdr = %+v, want = %+v", test.desc, msg.Header(), wantHdr)
+		}
+		if len(test.data) == 0 {
+			continue
+		}
+
+		dataMsg := &dummyNetlinkMsg{}
+		attrs, dataOk := msg.GetData(dataMsg)
+		if !dataOk {
+			t.Errorf("%v: GetData.ok = %v, want = true", test.desc, dataOk)
+			continue
+		}
+		if !reflect.DeepEqual(dataMsg, test.data[0]) {
+			t.Errorf("%v: GetData.msg = %+v, want = %+v", test.desc, dataMsg, test.data[0])
+		}
+		if len(test.data) > 1 {
+			// dummyNetlinkAttrs is packed, so it is not padded after Baz.
+			want := []byte{0x05, 0x00, 0x00, 0x00, 0x06}
+			if !bytes.Equal(attrs, want) {
+				t.Errorf("%v: got remaining payload = %v, want = %v", test.desc, attrs, want)
+			}
+		}
+	}
+}
+
 func TestAttrView(t *testing.T) {
 	tests := []struct {
 		desc  string
@@ -310,3 +510,681 @@ func TestAttrView(t *testing.T) {
 		}
 	}
 }
+
+func TestMessagePutAttr(t *testing.T) {
+	msg := netlink.NewMessage(linux.NetlinkMessageHeader{Type: 1})
+	msg.PutAttr(1, []byte{0x30, 0x31})
+	msg.PutAttrString(2, "abc")
+	msg.PutAttrUint32(3, 0x33323130)
+	msg.PutAttr(4, []byte{})
+
+	attrsBuf := msg.Bytes()[linux.NetlinkMessageHeaderSize:]
+	if got, want := attrsBuf, []byte{
+		0x06, 0x00, // Length
+		0x01, 0x00, // Type
+		0x30, 0x31, 0x00, 0x00, // Data with 2 bytes padding
+		0x08, 0x00, // Length
+		0x02, 0x00, // Type
+		'a', 'b', 'c', 0x00, // NUL-terminated string
+		0x08, 0x00, // Length
+		0x03, 0x00, // Type
+		0x30, 0x31, 0x32, 0x33, // Data
+		0x04, 0x00, // Length
+		0x04, 0x00, // Type
+	}; !bytes.Equal(got, want) {
+		t.Fatalf("got attributes = %v, want = %v", got, want)
+	}
+
+	attrs := netlink.AttrsView(attrsBuf)
+	for _, want := range []struct {
+		hdr   linux.NetlinkAttrHeader
+		value []byte
+	}{
+		{hdr: linux.NetlinkAttrHeader{Length: 6, Type: 1}, value: []byte{0x30, 0x31}},
+		{hdr: linux.NetlinkAttrHeader{Length: 8, Type: 2}, value: []byte{'a', 'b', 'c', 0x00}},
+		{hdr: linux.NetlinkAttrHeader{Length: 8, Type: 3}, value: []byte{0x30, 0x31, 0x32, 0x33}},
+		{hdr: linux.NetlinkAttrHeader{Length: 4, Type: 4}, value: []byte{}},
+	} {
+		hdr, value, rest, ok := attrs.ParseFirst()
+		if !ok {
+			t.Fatalf("ParseFirst() for attribute type %d: got ok = false, want = true", want.hdr.Type)
+		}
+		if !reflect.DeepEqual(hdr, want.hdr) {
+			t.Errorf("got hdr = %+v, want = %+v", hdr, want.hdr)
+		}
+		if !bytes.Equal(value, want.value) {
+			t.Errorf("attribute type %d: got value = %v, want = %v", want.hdr.Type, value, want.value)
+		}
+		attrs = rest
+	}
+	if !attrs.Empty() {
+		t.Errorf("got %d bytes after the last attribute, want = 0", len(attrs))
+	}
+}
+
+func TestAttrViewParseNested(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []byte
+
+		hdr     linux.NetlinkAttrHeader
+		nested  []byte
+		restLen int
+		ok      bool
+	}{
+		{
+			desc: "valid",
+			input: []byte{
+				0x0C, 0x00, // Length
+				0x01, 0x80, // Type with NLA_F_NESTED
+				0x06, 0x00, // Nested attribute length
+				0x02, 0x00, // Nested attribute type
+				0x30, 0x31, 0x00, 0x00, // Nested attribute data with 2 bytes padding
+			},
+			hdr: linux.NetlinkAttrHeader{
+				Length: 12,
+				Type:   1,
+			},
+			nested:  []byte{0x06, 0x00, 0x02, 0x00, 0x30, 0x31, 0x00, 0x00},
+			restLen: 0,
+			ok:      true,
+		},
+		{
+			desc: "valid with NLA_F_NET_BYTEORDER and rest data",
+			input: []byte{
+				0x0C, 0x00, // Length
+				0x01, 0xC0, // Type with NLA_F_NESTED and NLA_F_NET_BYTEORDER
+				0x06, 0x00, // Nested attribute length
+				0x02, 0x00, // Nested attribute type
+				0x30, 0x31, 0x00, 0x00, // Nested attribute data with 2 bytes padding
+				0xFF, 0xFE, // Rest data
+			},
+			hdr: linux.NetlinkAttrHeader{
+				Length: 12,
+				Type:   1,
+			},
+			nested:  []byte{0x06, 0x00, 0x02, 0x00, 0x30, 0x31, 0x00, 0x00},
+			restLen: 2,
+			ok:      true,
+		},
+		{
+			desc: "empty nested attributes",
+			input: []byte{
+				0x04, 0x00, // Length
+				0x01, 0x80, // Type with NLA_F_NESTED
+			},
+			hdr: linux.NetlinkAttrHeader{
+				Length: 4,
+				Type:   1,
+			},
+			nested:  []byte{},
+			restLen: 0,
+			ok:      true,
+		},
+		{
+			desc: "not nested",
+			input: []byte{
+				0x08, 0x00, // Length
+				0x01, 0x00, // Type
+				0x30, 0x31, 0x32, 0x33, // Data
+			},
+			ok: false,
+		},
+		{
+			desc: "hdr.Length too long",
+			input: []byte{
+				0xFF, 0x00, // Length
+				0x01, 0x80, // Type with NLA_F_NESTED
+				0x30, 0x31, 0x32, 0x33, // Data
+			},
+			ok: false,
+		},
+		{
+			desc:  "empty",
+			input: []byte{},
+			ok:    false,
+		},
+	}
+	for _, test := range tests {
+		hdr, nested, rest, ok := netlink.AttrsView(test.input).ParseNested()
+		if ok != test.ok {
+			t.Errorf("%v: got ok = %v, want = %v", test.desc, ok, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if !reflect.DeepEqual(hdr, test.hdr) {
+			t.Errorf("%v: got hdr = %+v, want = %+v", test.desc, hdr, test.hdr)
+		}
+		if !bytes.Equal(nested, test.nested) {
+			t.Errorf("%v: got nested = %v, want = %v", test.desc, nested, test.nested)
+		}
+		if wantRest := test.input[len(test.input)-test.restLen:]; !bytes.Equal(rest, wantRest) {
+			t.Errorf("%v: got rest = %v, want = %v", test.desc, rest, wantRest)
+		}
+	}
+}
+
+func TestAttrViewParseNestedTwoLevels(t *testing.T) {
+	attrs := netlink.AttrsView([]byte{
+		0x18, 0x00, // Outer length
+		0x01, 0x80, // Outer type with NLA_F_NESTED
+		0x0C, 0x00, // Inner length
+		0x02, 0x80, // Inner type with NLA_F_NESTED
+		0x06, 0x00, // Leaf length
+		0x03, 0x00, // Leaf type
+		0x30, 0x31, 0x00, 0x00, // Leaf data with 2 bytes padding
+		0x08, 0x00, // Sibling length
+		0x04, 0x00, // Sibling type
+		0x32, 0x33, 0x34, 0x35, // Sibling data
+	})
+
+	outerHdr, outer, rest, ok := attrs.ParseNested()
+	if !ok {
+		t.Fatalf("outer ParseNested: got ok = false, want = true")
+	}
+	if want := (linux.NetlinkAttrHeader{Length: 24, Type: 1}); outerHdr != want {
+		t.Errorf("outer ParseNested: got hdr = %+v, want = %+v", outerHdr, want)
+	}
+	if !rest.Empty() {
+		t.Errorf("outer ParseNested: got rest = %v, want empty", rest)
+	}
+
+	innerHdr, inner, outer, ok := outer.ParseNested()
+	if !ok {
+		t.Fatalf("inner ParseNested: got ok = false, want = true")
+	}
+	if want := (linux.NetlinkAttrHeader{Length: 12, Type: 2}); innerHdr != want {
+		t.Errorf("inner ParseNested: got hdr = %+v, want = %+v", innerHdr, want)
+	}
+
+	leafHdr, leaf, inner, ok := inner.ParseFirst()
+	if !ok {
+		t.Fatalf("leaf ParseFirst: got ok = false, want = true")
+	}
+	if want := (linux.NetlinkAttrHeader{Length: 6, Type: 3}); leafHdr != want {
+		t.Errorf("leaf ParseFirst: got hdr = %+v, want = %+v", leafHdr, want)
+	}
+	if want := []byte{0x30, 0x31}; !bytes.Equal(leaf, want) {
+		t.Errorf("leaf ParseFirst: got value = %v, want = %v", leaf, want)
+	}
+	if !inner.Empty() {
+		t.Errorf("inner attributes: got %v left over, want empty", inner)
+	}
+
+	// A flat attribute is not nested.
+	if _, _, _, ok := outer.ParseNested(); ok {
+		t.Errorf("sibling ParseNested: got ok = true, want = false")
+	}
+	siblingHdr, sibling, outer, ok := outer.ParseFirst()
+	if !ok {
+		t.Fatalf("sibling ParseFirst: got ok = false, want = true")
+	}
+	if want := (linux.NetlinkAttrHeader{Length: 8, Type: 4}); siblingHdr != want {
+		t.Errorf("sibling ParseFirst: got hdr = %+v, want = %+v", siblingHdr, want)
+	}
+	if want := []byte{0x32, 0x33, 0x34, 0x35}; !bytes.Equal(sibling, want) {
+		t.Errorf("sibling ParseFirst: got value = %v, want = %v", sibling, want)
+	}
+	if !outer.Empty() {
+		t.Errorf("outer attributes: got %v left over, want empty", outer)
+	}
+}
+
+func TestAttrHeaderAccessors(t *testing.T) {
+	tests := []struct {
+		desc  string
+		hdr   linux.NetlinkAttrHeader
+		value []byte
+
+		u16   uint16
+		u16Ok bool
+		u32   uint32
+		u32Ok bool
+		str   string
+		strOk bool
+	}{
+		{
+			desc:  "four bytes",
+			hdr:   linux.NetlinkAttrHeader{Length: 8, Type: 1},
+			value: []byte{0x30, 0x31, 0x32, 0x33},
+			u16:   0x3130,
+			u16Ok: true,
+			u32:   0x33323130,
+			u32Ok: true,
+			str:   "0123",
+			strOk: true,
+		},
+		{
+			desc:  "network byte order",
+			hdr:   linux.NetlinkAttrHeader{Length: 8, Type: 1 | linux.NLA_F_NET_BYTEORDER},
+			value: []byte{0x30, 0x31, 0x32, 0x33},
+			u16:   0x3031,
+			u16Ok: true,
+			u32:   0x30313233,
+			u32Ok: true,
+			str:   "0123",
+			strOk: true,
+		},
+		{
+			desc:  "truncated uint32",
+			hdr:   linux.NetlinkAttrHeader{Length: 7, Type: 1},
+			value: []byte{0x30, 0x31, 0x00},
+			u16:   0x3130,
+			u16Ok: true,
+			u32Ok: false,
+			str:   "01",
+			strOk: true,
+		},
+		{
+			desc:  "truncated uint16",
+			hdr:   linux.NetlinkAttrHeader{Length: 5, Type: 1},
+			value: []byte{0x00},
+			u16Ok: false,
+			u32Ok: false,
+			str:   "",
+			strOk: true,
+		},
+		{
+			desc:  "string with trailing garbage",
+			hdr:   linux.NetlinkAttrHeader{Length: 10, Type: 1},
+			value: []byte{'e', 't', 'h', '0', 0x00, 'x'},
+			u16:   0x7465,
+			u16Ok: true,
+			u32:   0x30687465,
+			u32Ok: true,
+			str:   "eth0",
+			strOk: true,
+		},
+		{
+			desc:  "empty",
+			hdr:   linux.NetlinkAttrHeader{Length: 4, Type: 1},
+			value: []byte{},
+			u16Ok: false,
+			u32Ok: false,
+			strOk: false,
+		},
+	}
+	for _, test := range tests {
+		if got, ok := test.hdr.Uint16(test.value); ok != test.u16Ok {
+			t.Errorf("%v: Uint16: got ok = %v, want = %v", test.desc, ok, test.u16Ok)
+		} else if ok && got != test.u16 {
+			t.Errorf("%v: Uint16: got %#x, want %#x", test.desc, got, test.u16)
+		}
+		if got, ok := test.hdr.Uint32(test.value); ok != test.u32Ok {
+			t.Errorf("%v: Uint32: got ok = %v, want = %v", test.desc, ok, test.u32Ok)
+		} else if ok && got != test.u32 {
+			t.Errorf("%v: Uint32: got %#x, want %#x", test.desc, got, test.u32)
+		}
+		if got, ok := test.hdr.String(test.value); ok != test.strOk {
+			t.Errorf("%v: String: got ok = %v, want = %v", test.desc, ok, test.strOk)
+		} else if ok && got != test.str {
+			t.Errorf("%v: String: got %q, want %q", test.desc, got, test.str)
+		}
+	}
+}
+
+func TestAttrViewLookup(t *testing.T) {
+	msg := netlink.NewMessage(linux.NetlinkMessageHeader{Type: 1})
+	msg.Put(&dummyNetlinkMsg{Foo: 0x3130})
+	msg.Put([]byte{0x00, 0x00}) // Pad the data message to NLMSG_ALIGNTO.
+	msg.PutAttr(1, uint32(5))
+	msg.PutAttrString(2, "eth0")
+	msg.PutAttr(3|linux.NLA_F_NESTED, uint16(6))
+	parsed, _, ok := netlink.ParseMessage(msg.Finalize())
+	if !ok {
+		t.Fatalf("ParseMessage failed")
+	}
+	attrs, ok := parsed.GetData(&dummyNetlinkMsg{})
+	if !ok {
+		t.Fatalf("GetData failed")
+	}
+
+	value, ok := attrs.Lookup(1)
+	if !ok {
+		t.Fatalf("Lookup(1): got ok = false, want = true")
+	}
+	if got, ok := (linux.NetlinkAttrHeader{Type: 1}).Uint32(value); !ok || got != 5 {
+		t.Errorf("Lookup(1): got (%d, %v), want (5, true)", got, ok)
+	}
+
+	value, ok = attrs.Lookup(2)
+	if !ok {
+		t.Fatalf("Lookup(2): got ok = false, want = true")
+	}
+	if got, ok := (linux.NetlinkAttrHeader{Type: 2}).String(value); !ok || got != "eth0" {
+		t.Errorf("Lookup(2): got (%q, %v), want (%q, true)", got, ok, "eth0")
+	}
+
+	// Lookup ignores NLA_F_NESTED.
+	if _, ok := attrs.Lookup(3); !ok {
+		t.Errorf("Lookup(3): got ok = false, want = true")
+	}
+
+	if _, ok := attrs.Lookup(4); ok {
+		t.Errorf("Lookup(4): got ok = true, want = false")
+	}
+
+	// Malformed attributes end the search.
+	truncated := netlink.AttrsView([]byte{
+		0xFF, 0x00, // Length too long
+		0x01, 0x00, // Type
+		0x30, 0x31, 0x32, 0x33, // Data
+	})
+	if _, ok := truncated.Lookup(1); ok {
+		t.Errorf("Lookup on truncated attributes: got ok = true, want = false")
+	}
+}
+
+func TestAttrViewParseFirstExpecting(t *testing.T) {
+	valid := map[uint16]bool{1: true, 2: true}
+	tests := []struct {
+		desc  string
+		input []byte
+
+		hdr     linux.NetlinkAttrHeader
+		value   []byte
+		restLen int
+		err     error
+	}{
+		{
+			desc: "expected",
+			input: []byte{
+				0x06, 0x00, // Length
+				0x01, 0x00, // Type
+				0x30, 0x31, 0x00, 0x00, // Data with 2 bytes padding
+				0x04, 0x00, // Length
+				0x03, 0x00, // Type
+			},
+			hdr:     linux.NetlinkAttrHeader{Length: 6, Type: 1},
+			value:   []byte{0x30, 0x31},
+			restLen: 4,
+		},
+		{
+			desc: "expected nested",
+			input: []byte{
+				0x08, 0x00, // Length
+				0x02, 0x80, // Type with NLA_F_NESTED
+				0x30, 0x31, 0x32, 0x33, // Data
+			},
+			hdr:   linux.NetlinkAttrHeader{Length: 8, Type: 2 | linux.NLA_F_NESTED},
+			value: []byte{0x30, 0x31, 0x32, 0x33},
+		},
+		{
+			desc: "unexpected",
+			input: []byte{
+				0x04, 0x00, // Length
+				0x03, 0x00, // Type
+			},
+			err: netlink.ErrUnexpectedAttr,
+		},
+		{
+			desc: "unexpected nested",
+			input: []byte{
+				0x04, 0x00, // Length
+				0x03, 0x80, // Type with NLA_F_NESTED
+			},
+			err: netlink.ErrUnexpectedAttr,
+		},
+		{
+			desc: "malformed",
+			input: []byte{
+				0xFF, 0x00, // Length too long
+				0x01, 0x00, // Type
+				0x30, 0x31, 0x32, 0x33, // Data
+			},
+			err: netlink.ErrMalformedAttr,
+		},
+	}
+	for _, test := range tests {
+		hdr, value, rest, err := netlink.AttrsView(test.input).ParseFirstExpecting(valid)
+		if err != test.err {
+			t.Errorf("%v: got err = %v, want = %v", test.desc, err, test.err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(hdr, test.hdr) {
+			t.Errorf("%v: got hdr = %+v, want = %+v", test.desc, hdr, test.hdr)
+		}
+		if !bytes.Equal(value, test.value) {
+			t.Errorf("%v: got value = %v, want = %v", test.desc, value, test.value)
+		}
+		if wantRest := test.input[len(test.input)-test.restLen:]; !bytes.Equal(rest, wantRest) {
+			t.Errorf("%v: got rest = %v, want = %v", test.desc, rest, wantRest)
+		}
+	}
+}
+
+func TestAttrViewForEach(t *testing.T) {
+	attrs := []byte{
+		0x06, 0x00, // Length
+		0x01, 0x00, // Type
+		0x30, 0x31, 0x00, 0x00, // Data with 2 bytes padding
+		0x08, 0x00, // Length
+		0x02, 0x00, // Type
+		0x32, 0x33, 0x34, 0x35, // Data
+		0x05, 0x00, // Length
+		0x03, 0x00, // Type
+		0x36, 0x00, 0x00, 0x00, // Data with 3 bytes padding
+	}
+	malformed := []byte{
+		0xFF, 0x00, // Length too long
+		0x04, 0x00, // Type
+		0x30, 0x31, 0x32, 0x33, // Data
+	}
+	errStop := errors.New("stop")
+
+	tests := []struct {
+		desc  string
+		input []byte
+		// stopAt is the attribute type for which the callback returns errStop,
+		// or 0 if it never returns an error.
+		stopAt uint16
+
+		types  []uint16
+		values [][]byte
+		err    error
+	}{
+		{
+			desc:  "empty",
+			input: []byte{},
+		},
+		{
+			desc:   "all attributes",
+			input:  attrs,
+			types:  []uint16{1, 2, 3},
+			values: [][]byte{{0x30, 0x31}, {0x32, 0x33, 0x34, 0x35}, {0x36}},
+		},
+		{
+			desc:   "early stop",
+			input:  attrs,
+			stopAt: 2,
+			types:  []uint16{1, 2},
+			values: [][]byte{{0x30, 0x31}, {0x32, 0x33, 0x34, 0x35}},
+			err:    errStop,
+		},
+		{
+			desc:   "malformed trailing attribute",
+			input:  append(append([]byte{}, attrs[:16]...), malformed...),
+			types:  []uint16{1, 2},
+			values: [][]byte{{0x30, 0x31}, {0x32, 0x33, 0x34, 0x35}},
+			err:    netlink.ErrMalformedAttr,
+		},
+	}
+	for _, test := range tests {
+		var types []uint16
+		var values [][]byte
+		err := netlink.AttrsView(test.input).ForEach(func(hdr linux.NetlinkAttrHeader, value []byte) error {
+			types = append(types, hdr.Type)
+			values = append(values, value)
+			if hdr.Type == test.stopAt {
+				return errStop
+			}
+			return nil
+		})
+		if err != test.err {
+			t.Errorf("%v: got err = %v, want = %v", test.desc, err, test.err)
+		}
+		if !reflect.DeepEqual(types, test.types) {
+			t.Errorf("%v: got types = %v, want = %v", test.desc, types, test.types)
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%v: got values = %v, want = %v", test.desc, values, test.values)
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	msg1 := []byte{
+		0x14, 0x00, 0x00, 0x00, // Length
+		0x01, 0x00, // Type
+		0x02, 0x00, // Flags (NLM_F_MULTI)
+		0x03, 0x00, 0x00, 0x00, // Seq
+		0x04, 0x00, 0x00, 0x00, // PortID
+		0x30, 0x31, 0x00, 0x00, // Data message with 2 bytes padding
+	}
+	msg2 := []byte{
+		0x12, 0x00, 0x00, 0x00, // Length
+		0x01, 0x00, // Type
+		0x02, 0x00, // Flags (NLM_F_MULTI)
+		0x03, 0x00, 0x00, 0x00, // Seq
+		0x04, 0x00, 0x00, 0x00, // PortID
+		0x32, 0x33, 0x00, 0x00, // Data message with 2 bytes padding
+	}
+	done := []byte{
+		0x14, 0x00, 0x00, 0x00, // Length
+		0x03, 0x00, // Type (NLMSG_DONE)
+		0x02, 0x00, // Flags (NLM_F_MULTI)
+		0x03, 0x00, 0x00, 0x00, // Seq
+		0x04, 0x00, 0x00, 0x00, // PortID
+		0x00, 0x00, 0x00, 0x00, // Error code
+	}
+	cat := func(bufs ...[]byte) []byte {
+		var b []byte
+		for _, buf := range bufs {
+			b = append(b, buf...)
+		}
+		return b
+	}
+
+	tests := []struct {
+		desc  string
+		input []byte
+
+		data []uint16
+		ok   bool
+	}{
+		{
+			desc:  "empty",
+			input: []byte{},
+			data:  nil,
+			ok:    true,
+		},
+		{
+			desc:  "single message",
+			input: msg1,
+			data:  []uint16{0x3130},
+			ok:    true,
+		},
+		{
+			desc:  "multiple messages",
+			input: cat(msg1, msg2),
+			data:  []uint16{0x3130, 0x3332},
+			ok:    true,
+		},
+		{
+			desc:  "multiple messages with done",
+			input: cat(msg1, msg2, done),
+			data:  []uint16{0x3130, 0x3332},
+			ok:    true,
+		},
+		{
+			desc:  "data after done",
+			input: cat(msg1, done, msg2, []byte{0xFF}),
+			data:  []uint16{0x3130},
+			ok:    true,
+		},
+		{
+			desc:  "malformed trailing fragment",
+			input: cat(msg1, []byte{0xFF}),
+			ok:    false,
+		},
+		{
+			desc:  "truncated second message",
+			input: cat(msg1, msg2[:10]),
+			ok:    false,
+		},
+	}
+	for _, test := range tests {
+		msgs, err := netlink.ParseAll(test.input)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%v: got err = %v, want ok = %v", test.desc, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if len(msgs) != len(test.data) {
+			t.Errorf("%v: got %d messages, want %d", test.desc, len(msgs), len(test.data))
+			continue
+		}
+		for i := range msgs {
+			if got, want := msgs[i].Header().Type, uint16(1); got != want {
+				t.Errorf("%v: message %d: got type = %d, want = %d", test.desc, i, got, want)
+			}
+			dataMsg := &dummyNetlinkMsg{}
+			if _, ok := msgs[i].GetData(dataMsg); !ok {
+				t.Errorf("%v: message %d: GetData.ok = false, want = true", test.desc, i)
+			} else if dataMsg.Foo != test.data[i] {
+				t.Errorf("%v: message %d: got data = %#x, want = %#x", test.desc, i, dataMsg.Foo, test.data[i])
+			}
+		}
+	}
+}
+
+func TestBuildAck(t *testing.T) {
+	req := linux.NetlinkMessageHeader{
+		Length: 20,
+		Type:   linux.RTM_GETLINK,
+		Flags:  linux.NLM_F_REQUEST | linux.NLM_F_ACK,
+		Seq:    3,
+		PortID: 4,
+	}
+
+	for _, errno := range []int32{0, -int32(syscall.EINVAL)} {
+		buf := netlink.BuildAck(req, errno)
+		// struct nlmsghdr followed by struct nlmsgerr is already aligned.
+		wantLen := linux.NetlinkMessageHeaderSize + 4 + linux.NetlinkMessageHeaderSize
+		if len(buf) != wantLen {
+			t.Errorf("BuildAck(%d): got %d bytes, want %d", errno, len(buf), wantLen)
+		}
+
+		msg, rest, ok := netlink.ParseMessage(buf)
+		if !ok {
+			t.Fatalf("ParseMessage(BuildAck(%d)) failed", errno)
+		}
+		if len(rest) != 0 {
+			t.Errorf("ParseMessage(BuildAck(%d)): got %d remaining bytes, want 0", errno, len(rest))
+		}
+		wantHdr := linux.NetlinkMessageHeader{
+			Length: uint32(wantLen),
+			Type:   linux.NLMSG_ERROR,
+			Seq:    req.Seq,
+			PortID: req.PortID,
+		}
+		if got := msg.Header(); got != wantHdr {
+			t.Errorf("BuildAck(%d) header: got %+v, want %+v", errno, got, wantHdr)
+		}
+
+		var errMsg linux.NetlinkErrorMessage
+		if _, ok := msg.GetData(&errMsg); !ok {
+			t.Fatalf("BuildAck(%d): GetData failed", errno)
+		}
+		if want := (linux.NetlinkErrorMessage{Error: errno, Header: req}); errMsg != want {
+			t.Errorf("BuildAck(%d) payload: got %+v, want %+v", errno, errMsg, want)
+		}
+	}
+}
@@ -96,7 +96,10 @@ func (cb *getdentsCallback) Handle(dirent vfs.Dirent) error {
 		//     unsigned char  d_type;   /* File type */
 		//     char           d_name[]; /* Filename (null-terminated) */
 		// };
-		size := 8 + 8 + 2 + 1 + 1 + len(dirent.Name)
+		//
+		// Compare Linux's fs/readdir.c:filldir64(), which aligns d_reclen to
+		// sizeof(u64).
+		size := direntRecordLen(8 + 8 + 2 + 1 + 1 + len(dirent.Name))
 		if size > cb.remaining {
 			return syserror.EINVAL
 		}
@@ -105,8 +108,8 @@ func (cb *getdentsCallback) Handle(dirent vfs.Dirent) error {
 		usermem.ByteOrder.PutUint64(buf[8:16], uint64(dirent.NextOff))
 		usermem.ByteOrder.PutUint16(buf[16:18], uint16(size))
 		buf[18] = dirent.Type
-		copy(buf[19:], dirent.Name)
-		buf[size-1] = 0 // NUL terminator
+		n := copy(buf[19:], dirent.Name)
+		zeroBytes(buf[19+n:]) // NUL terminator and padding
 	} else {
 		// struct linux_dirent {
 		//     unsigned long  d_ino;     /* Inode number */
@@ -124,7 +127,10 @@ func (cb *getdentsCallback) Handle(dirent vfs.Dirent) error {
 		if cb.t.Arch().Width() != 8 {
 			panic(fmt.Sprintf("unsupported sizeof(unsigned long): %d", cb.t.Arch().Width()))
 		}
-		size := 8 + 8 + 2 + 1 + 1 + 1 + len(dirent.Name)
+		//
+		// Compare Linux's fs/readdir.c:filldir(), which aligns d_reclen to
+		// sizeof(long).
+		size := direntRecordLen(8 + 8 + 2 + 1 + 1 + len(dirent.Name))
 		if size > cb.remaining {
 			return syserror.EINVAL
 		}
@@ -132,9 +138,8 @@ func (cb *getdentsCallback) Handle(dirent vfs.Dirent) error {
 		usermem.ByteOrder.PutUint64(buf[0:8], dirent.Ino)
 		usermem.ByteOrder.PutUint64(buf[8:16], uint64(dirent.NextOff))
 		usermem.ByteOrder.PutUint16(buf[16:18], uint16(size))
-		copy(buf[18:], dirent.Name)
-		buf[size-3] = 0 // NUL terminator
-		buf[size-2] = 0 // zero padding byte
+		n := copy(buf[18:], dirent.Name)
+		zeroBytes(buf[18+n : size-1]) // NUL terminator and padding
 		buf[size-1] = dirent.Type
 	}
 	n, err := cb.t.CopyOutBytes(cb.addr, buf)
@@ -147,3 +152,17 @@ func (cb *getdentsCallback) Handle(dirent vfs.Dirent) error {
 	cb.remaining -= n
 	return nil
 }
+
+// direntRecordLen returns the length of a dirent record whose unpadded length
+// is n. A record that doesn't fit in the remaining buffer space is never
+// partially written, so getdents returns only whole records, and fails with
+// EINVAL only if not even the first record fits.
+func direntRecordLen(n int) int {
+	return (n + 7) &^ 7
+}
+
+func zeroBytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
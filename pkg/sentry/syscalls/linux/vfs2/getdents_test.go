@@ -0,0 +1,38 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs2
+
+import "testing"
+
+func TestDirentRecordLen(t *testing.T) {
+	// The fixed-size fields of a struct linux_dirent64 and the NUL terminator
+	// of its name occupy 20 bytes.
+	const fixed = 8 + 8 + 2 + 1 + 1
+	for _, test := range []struct {
+		nameLen int
+		want    int
+	}{
+		{nameLen: 1, want: 24},
+		{nameLen: 4, want: 24},
+		{nameLen: 5, want: 32},
+		{nameLen: 12, want: 32},
+		{nameLen: 13, want: 40},
+		{nameLen: 255, want: 280},
+	} {
+		if got := direntRecordLen(fixed + test.nameLen); got != test.want {
+			t.Errorf("direntRecordLen(%d) for a %d-byte name: got %d, want %d", fixed+test.nameLen, test.nameLen, got, test.want)
+		}
+	}
+}
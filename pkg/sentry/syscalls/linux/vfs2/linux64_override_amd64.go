@@ -141,7 +141,7 @@ func Override(table map[uintptr]kernel.Syscall) {
 	delete(table, 282) // signalfd
 	table[283] = syscalls.Supported("timerfd_create", TimerfdCreate)
 	delete(table, 284) // eventfd
-	delete(table, 285) // fallocate
+	table[285] = syscalls.PartiallySupported("fallocate", Fallocate, "Not all options are supported.", nil)
 	table[286] = syscalls.Supported("timerfd_settime", TimerfdSettime)
 	table[287] = syscalls.Supported("timerfd_gettime", TimerfdGettime)
 	delete(table, 288) // accept4
@@ -159,7 +159,9 @@ func Override(table map[uintptr]kernel.Syscall) {
 	table[316] = syscalls.Supported("renameat2", Renameat2)
 	delete(table, 319) // memfd_create
 	table[322] = syscalls.Supported("execveat", Execveat)
+	table[326] = syscalls.Supported("copy_file_range", CopyFileRange)
 	table[327] = syscalls.Supported("preadv2", Preadv2)
 	table[328] = syscalls.Supported("pwritev2", Pwritev2)
 	table[332] = syscalls.Supported("statx", Statx)
+	table[439] = syscalls.Supported("faccessat2", Faccessat2)
 }
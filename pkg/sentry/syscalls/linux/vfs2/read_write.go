@@ -15,6 +15,8 @@
 package vfs2
 
 import (
+	"io"
+
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/sentry/arch"
 	"gvisor.dev/gvisor/pkg/sentry/kernel"
@@ -494,6 +496,147 @@ func pwrite(t *kernel.Task, file *vfs.FileDescription, src usermem.IOSequence, o
 	return total, err
 }
 
+// CopyFileRange implements Linux syscall copy_file_range(2).
+func CopyFileRange(t *kernel.Task, args arch.SyscallArguments) (uintptr, *kernel.SyscallControl, error) {
+	inFD := args[0].Int()
+	inOffAddr := args[1].Pointer()
+	outFD := args[2].Int()
+	outOffAddr := args[3].Pointer()
+	length := args[4].SizeT()
+	flags := args[5].Uint()
+
+	if flags != 0 {
+		return 0, nil, syserror.EINVAL
+	}
+
+	inFile := t.GetFileVFS2(inFD)
+	if inFile == nil {
+		return 0, nil, syserror.EBADF
+	}
+	defer inFile.DecRef()
+	outFile := t.GetFileVFS2(outFD)
+	if outFile == nil {
+		return 0, nil, syserror.EBADF
+	}
+	defer outFile.DecRef()
+
+	if !inFile.IsReadable() || !outFile.IsWritable() || outFile.StatusFlags()&linux.O_APPEND != 0 {
+		return 0, nil, syserror.EBADF
+	}
+	// Compare Linux's fs/read_write.c:generic_file_rw_checks().
+	for _, file := range []*vfs.FileDescription{inFile, outFile} {
+		stat, err := file.Stat(t, vfs.StatOptions{Mask: linux.STATX_TYPE})
+		if err != nil {
+			return 0, nil, err
+		}
+		switch stat.Mode & linux.S_IFMT {
+		case linux.S_IFREG:
+		case linux.S_IFDIR:
+			return 0, nil, syserror.EISDIR
+		default:
+			return 0, nil, syserror.EINVAL
+		}
+	}
+
+	inOff, err := copyFileRangeOffset(t, inFile, inOffAddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	outOff, err := copyFileRangeOffset(t, outFile, outOffAddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > uint(kernel.MAX_RW_COUNT) {
+		length = uint(kernel.MAX_RW_COUNT)
+	}
+	if inFile.Dentry() == outFile.Dentry() && inOff < outOff+int64(length) && outOff < inOff+int64(length) {
+		return 0, nil, syserror.EINVAL
+	}
+
+	n, err := inFile.CopyRange(t, inOff, outFile, outOff, int64(length))
+	if err == syserror.EXDEV {
+		n, err = copyFileRangeBuffered(t, inFile, inOff, outFile, outOff, int64(length))
+	}
+	if n != 0 {
+		if uerr := copyFileRangeUpdateOffset(t, inFile, inOffAddr, inOff+n); uerr != nil && err == nil {
+			err = uerr
+		}
+		if uerr := copyFileRangeUpdateOffset(t, outFile, outOffAddr, outOff+n); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	t.IOUsage().AccountReadSyscall(n)
+	t.IOUsage().AccountWriteSyscall(n)
+	return uintptr(n), nil, slinux.HandleIOErrorVFS2(t, n != 0, err, kernel.ERESTARTSYS, "copy_file_range", inFile)
+}
+
+// copyFileRangeOffset returns the offset in file used by copy_file_range(2):
+// the offset at offAddr if it is not 0, or file's offset otherwise.
+func copyFileRangeOffset(t *kernel.Task, file *vfs.FileDescription, offAddr usermem.Addr) (int64, error) {
+	if offAddr == 0 {
+		return file.Seek(t, 0, linux.SEEK_CUR)
+	}
+	var off int64
+	if _, err := t.CopyIn(offAddr, &off); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, syserror.EINVAL
+	}
+	return off, nil
+}
+
+// copyFileRangeUpdateOffset advances the offset used by copy_file_range(2) to
+// off, as returned by copyFileRangeOffset.
+func copyFileRangeUpdateOffset(t *kernel.Task, file *vfs.FileDescription, offAddr usermem.Addr, off int64) error {
+	if offAddr == 0 {
+		_, err := file.Seek(t, off, linux.SEEK_SET)
+		return err
+	}
+	_, err := t.CopyOut(offAddr, off)
+	return err
+}
+
+// copyFileRangeBuffered implements copy_file_range(2) by reading from inFile
+// and writing to outFile through a buffer in the sentry. It is used when the
+// files' implementations can't copy between them directly.
+func copyFileRangeBuffered(t *kernel.Task, inFile *vfs.FileDescription, inOff int64, outFile *vfs.FileDescription, outOff, length int64) (int64, error) {
+	const maxBufSize = 64 * 1024
+	bufSize := length
+	if bufSize > maxBufSize {
+		bufSize = maxBufSize
+	}
+	buf := make([]byte, bufSize)
+	var total int64
+	for total < length {
+		chunk := buf
+		if rem := length - total; rem < int64(len(chunk)) {
+			chunk = chunk[:rem]
+		}
+		rn, rerr := inFile.PRead(t, usermem.BytesIOSequence(chunk), inOff+total, vfs.ReadOptions{})
+		if rn != 0 {
+			wn, werr := outFile.PWrite(t, usermem.BytesIOSequence(chunk[:rn]), outOff+total, vfs.WriteOptions{})
+			total += wn
+			if werr != nil {
+				return total, werr
+			}
+			if wn < rn {
+				return total, nil
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+		if rn < int64(len(chunk)) {
+			return total, nil
+		}
+	}
+	return total, nil
+}
+
 // Lseek implements Linux syscall lseek(2).
 func Lseek(t *kernel.Task, args arch.SyscallArguments) (uintptr, *kernel.SyscallControl, error) {
 	fd := args[0].Int()
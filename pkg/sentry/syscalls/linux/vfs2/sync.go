@@ -54,8 +54,15 @@ func Fsync(t *kernel.Task, args arch.SyscallArguments) (uintptr, *kernel.Syscall
 
 // Fdatasync implements Linux syscall fdatasync(2).
 func Fdatasync(t *kernel.Task, args arch.SyscallArguments) (uintptr, *kernel.SyscallControl, error) {
-	// TODO(gvisor.dev/issue/1897): Avoid writeback of unnecessary metadata.
-	return Fsync(t, args)
+	fd := args[0].Int()
+
+	file := t.GetFileVFS2(fd)
+	if file == nil {
+		return 0, nil, syserror.EBADF
+	}
+	defer file.DecRef()
+
+	return 0, nil, file.DataSync(t)
 }
 
 // SyncFileRange implements Linux syscall sync_file_range(2).
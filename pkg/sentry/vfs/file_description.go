@@ -592,6 +592,63 @@ func (fd *FileDescription) Sync(ctx context.Context) error {
 	return fd.impl.Sync(ctx)
 }
 
+// DataSyncer is an optional interface implemented by FileDescriptionImpls
+// that can synchronize a file's data without also synchronizing metadata that
+// isn't required to retrieve it.
+type DataSyncer interface {
+	// DataSync has the semantics of fdatasync(2).
+	DataSync(ctx context.Context) error
+}
+
+// DataSync has the semantics of fdatasync(2). If fd's FileDescriptionImpl
+// does not implement DataSyncer, DataSync is equivalent to Sync.
+func (fd *FileDescription) DataSync(ctx context.Context) error {
+	if ds, ok := fd.impl.(DataSyncer); ok {
+		return ds.DataSync(ctx)
+	}
+	return fd.impl.Sync(ctx)
+}
+
+// Allocator is an optional interface implemented by FileDescriptionImpls
+// that support fallocate(2).
+type Allocator interface {
+	// Allocate has the semantics of fallocate(2). mode contains FALLOC_FL_*
+	// flags.
+	Allocate(ctx context.Context, mode, offset, length uint64) error
+}
+
+// Allocate has the semantics of fallocate(2). If fd's FileDescriptionImpl
+// does not implement Allocator, Allocate returns ENODEV.
+func (fd *FileDescription) Allocate(ctx context.Context, mode, offset, length uint64) error {
+	if !fd.IsWritable() {
+		return syserror.EBADF
+	}
+	if a, ok := fd.impl.(Allocator); ok {
+		return a.Allocate(ctx, mode, offset, length)
+	}
+	return syserror.ENODEV
+}
+
+// RangeCopier is an optional interface implemented by FileDescriptionImpls
+// that can copy data to another file without passing it through the caller.
+type RangeCopier interface {
+	// CopyRange copies up to length bytes from srcOff in the file to dstOff
+	// in dst's file, with the semantics of copy_file_range(2). If it can't
+	// copy to dst, it returns EXDEV.
+	CopyRange(ctx context.Context, srcOff int64, dst *FileDescription, dstOff, length int64) (int64, error)
+}
+
+// CopyRange has the semantics of copy_file_range(2), from fd to dst. If fd's
+// FileDescriptionImpl does not implement RangeCopier, or can't copy to dst,
+// CopyRange returns EXDEV, and the caller should fall back to PRead and
+// PWrite.
+func (fd *FileDescription) CopyRange(ctx context.Context, srcOff int64, dst *FileDescription, dstOff, length int64) (int64, error) {
+	if rc, ok := fd.impl.(RangeCopier); ok {
+		return rc.CopyRange(ctx, srcOff, dst, dstOff, length)
+	}
+	return 0, syserror.EXDEV
+}
+
 // ConfigureMMap mutates opts to implement mmap(2) for the file represented by
 // fd.
 func (fd *FileDescription) ConfigureMMap(ctx context.Context, opts *memmap.MMapOpts) error {
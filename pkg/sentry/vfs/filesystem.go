@@ -520,6 +520,27 @@ type FilesystemImpl interface {
 	// TODO(gvisor.dev/issue/1479): inotify_add_watch()
 }
 
+// SuperBlockOptioner is an optional interface implemented by FilesystemImpls
+// that report filesystem-specific super block options.
+type SuperBlockOptioner interface {
+	// SuperBlockOptions returns a comma-separated list of options, not
+	// including "ro" or "rw", to be shown in /proc/[pid]/mountinfo.
+	SuperBlockOptions() string
+}
+
+// SaveRestorer is an optional interface implemented by FilesystemImpls that
+// hold state outside of the sentry, such as connections to remote servers,
+// which must be captured before save and re-established after restore.
+type SaveRestorer interface {
+	// PrepareSave is called before the sentry is saved. If it returns an
+	// error, save fails.
+	PrepareSave(ctx context.Context) error
+
+	// CompleteRestore is called after the sentry is restored, before
+	// application code resumes. If it returns an error, restore fails.
+	CompleteRestore(ctx context.Context) error
+}
+
 // PrependPathAtVFSRootError is returned by implementations of
 // FilesystemImpl.PrependPath() when they encounter the contextual VFS root.
 type PrependPathAtVFSRootError struct{}
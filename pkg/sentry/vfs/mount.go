@@ -844,5 +844,11 @@ func superBlockOpts(mountPath string, mnt *Mount) string {
 		cgroupType := splitPath[len(splitPath)-1]
 		opts += "," + cgroupType
 	}
+
+	if sbo, ok := mnt.fs.Impl().(SuperBlockOptioner); ok {
+		if fsOpts := sbo.SuperBlockOptions(); fsOpts != "" {
+			opts += "," + fsOpts
+		}
+	}
 	return opts
 }
@@ -214,6 +214,17 @@ func (rp *ResolvingPath) Component() string {
 	return rp.pit.String()
 }
 
+// PeekComponents returns up to n path components, starting with the current
+// one, without advancing rp. Components from path segments after the current
+// one (e.g. those that follow a symlink's target) are not returned.
+func (rp *ResolvingPath) PeekComponents(n int) []string {
+	var names []string
+	for it := rp.pit; it.Ok() && len(names) < n; it = it.Next() {
+		names = append(names, it.String())
+	}
+	return names
+}
+
 // Advance advances the stream of path components represented by rp.
 //
 // Preconditions: !rp.Done().
@@ -335,7 +335,7 @@ func (vfs *VirtualFilesystem) MknodAt(ctx context.Context, creds *auth.Credentia
 	rp := vfs.getResolvingPath(creds, pop)
 	for {
 		err := rp.mount.fs.impl.MknodAt(ctx, rp, *opts)
-		if err != nil {
+		if err == nil {
 			vfs.putResolvingPath(rp)
 			return nil
 		}
@@ -774,6 +774,40 @@ func (vfs *VirtualFilesystem) SyncAllFilesystems(ctx context.Context) error {
 	return retErr
 }
 
+// PrepareSave calls SaveRestorer.PrepareSave on all Filesystems whose
+// FilesystemImpls implement it, and returns the first error.
+func (vfs *VirtualFilesystem) PrepareSave(ctx context.Context) error {
+	for _, sr := range vfs.saveRestorers() {
+		if err := sr.PrepareSave(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompleteRestore calls SaveRestorer.CompleteRestore on all Filesystems whose
+// FilesystemImpls implement it, and returns the first error.
+func (vfs *VirtualFilesystem) CompleteRestore(ctx context.Context) error {
+	for _, sr := range vfs.saveRestorers() {
+		if err := sr.CompleteRestore(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vfs *VirtualFilesystem) saveRestorers() []SaveRestorer {
+	vfs.filesystemsMu.Lock()
+	defer vfs.filesystemsMu.Unlock()
+	var srs []SaveRestorer
+	for fs := range vfs.filesystems {
+		if sr, ok := fs.impl.(SaveRestorer); ok {
+			srs = append(srs, sr)
+		}
+	}
+	return srs
+}
+
 // A VirtualDentry represents a node in a VFS tree, by combining a Dentry
 // (which represents a node in a Filesystem's tree) and a Mount (which
 // represents the Filesystem's position in a VFS mount tree).
@@ -38,7 +38,17 @@ var allowedSyscalls = seccomp.SyscallRules{
 					syscall.CLONE_THREAD),
 		},
 	},
-	syscall.SYS_CLOSE:     {},
+	syscall.SYS_CLOSE: {},
+	unix.SYS_COPY_FILE_RANGE: []seccomp.Rule{
+		{
+			seccomp.AllowAny{},
+			seccomp.AllowAny{},
+			seccomp.AllowAny{},
+			seccomp.AllowAny{},
+			seccomp.AllowAny{},
+			seccomp.AllowValue(0),
+		},
+	},
 	syscall.SYS_DUP:       {},
 	syscall.SYS_EPOLL_CTL: {},
 	syscall.SYS_EPOLL_PWAIT: []seccomp.Rule{
@@ -85,6 +95,7 @@ var allowedSyscalls = seccomp.SyscallRules{
 			seccomp.AllowValue(unix.F_ADD_SEALS),
 		},
 	},
+	syscall.SYS_FDATASYNC: {},
 	syscall.SYS_FSTAT:     {},
 	syscall.SYS_FSTATFS:   {},
 	syscall.SYS_FSYNC:     {},
@@ -123,11 +134,25 @@ var allowedSyscalls = seccomp.SyscallRules{
 	unix.SYS_GETRANDOM:       {},
 	syscall.SYS_GETTID:       {},
 	syscall.SYS_GETTIMEOFDAY: {},
-	syscall.SYS_LINKAT:       {},
-	syscall.SYS_LSEEK:        {},
-	syscall.SYS_MADVISE:      {},
-	unix.SYS_MEMFD_CREATE:    {}, /// Used by flipcall.PacketWindowAllocator.Init().
-	syscall.SYS_MKDIRAT:      {},
+	syscall.SYS_IOCTL: []seccomp.Rule{
+		{
+			seccomp.AllowAny{},
+			seccomp.AllowValue(linux.FICLONERANGE),
+		},
+		{
+			seccomp.AllowAny{},
+			seccomp.AllowValue(linux.FS_IOC_GETFLAGS),
+		},
+		{
+			seccomp.AllowAny{},
+			seccomp.AllowValue(linux.FS_IOC_SETFLAGS),
+		},
+	},
+	syscall.SYS_LINKAT:    {},
+	syscall.SYS_LSEEK:     {},
+	syscall.SYS_MADVISE:   {},
+	unix.SYS_MEMFD_CREATE: {}, /// Used by flipcall.PacketWindowAllocator.Init().
+	syscall.SYS_MKDIRAT:   {},
 	// Used by the Go runtime as a temporarily workaround for a Linux
 	// 5.2-5.4 bug.
 	//
@@ -182,6 +207,7 @@ var allowedSyscalls = seccomp.SyscallRules{
 		},
 	},
 	syscall.SYS_RENAMEAT:        {},
+	unix.SYS_RENAMEAT2:          {},
 	syscall.SYS_RESTART_SYSCALL: {},
 	syscall.SYS_RT_SIGPROCMASK:  {},
 	syscall.SYS_RT_SIGRETURN:    {},
@@ -592,13 +592,83 @@ func (l *localFile) FSync() error {
 	return nil
 }
 
+// FDataSync implements p9.File.
+func (l *localFile) FDataSync() error {
+	if !l.isOpen() {
+		return syscall.EBADF
+	}
+	if err := syscall.Fdatasync(l.file.FD()); err != nil {
+		return extractErrno(err)
+	}
+	return nil
+}
+
 // GetAttr implements p9.File.
 func (l *localFile) GetAttr(_ p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
 	stat, err := stat(l.file.FD())
 	if err != nil {
 		return p9.QID{}, p9.AttrMask{}, p9.Attr{}, extractErrno(err)
 	}
+	valid, attr := attrFromStat(stat)
+	return l.attachPoint.makeQID(stat), valid, attr, nil
+}
 
+// GetIno implements p9.File.GetIno.
+func (l *localFile) GetIno() (uint64, error) {
+	stat, err := stat(l.file.FD())
+	if err != nil {
+		return 0, extractErrno(err)
+	}
+	return stat.Ino, nil
+}
+
+// GetFlags implements p9.File.GetFlags.
+func (l *localFile) GetFlags() (uint32, error) {
+	// Inode flags can only be accessed through a file opened for I/O, so
+	// they are unavailable for symlinks and special files, as on Linux.
+	if l.ft != regular && l.ft != directory {
+		return 0, syscall.ENOTTY
+	}
+	var flags uint32
+	if err := ioctlInodeFlags(l.file.FD(), linux.FS_IOC_GETFLAGS, &flags); err != nil {
+		return 0, err
+	}
+	return flags, nil
+}
+
+// SetFlags implements p9.File.SetFlags.
+func (l *localFile) SetFlags(flags uint32) error {
+	conf := l.attachPoint.conf
+	if conf.ROMount {
+		if conf.PanicOnWrite {
+			panic("attempt to write to RO mount")
+		}
+		return syscall.EBADF
+	}
+	if l.ft != regular && l.ft != directory {
+		return syscall.ENOTTY
+	}
+	return ioctlInodeFlags(l.file.FD(), linux.FS_IOC_SETFLAGS, &flags)
+}
+
+// GetAttrChildren implements p9.File.
+func (l *localFile) GetAttrChildren(names []string, _ p9.AttrMask) ([]p9.FullStat, error) {
+	stats := make([]p9.FullStat, len(names))
+	for i, name := range names {
+		stat, err := statAt(l.file.FD(), name)
+		if err != nil {
+			// Leave stats[i] empty; the client will fall back to walking to
+			// the child.
+			continue
+		}
+		stats[i].QID = l.attachPoint.makeQID(stat)
+		stats[i].Valid, stats[i].Attr = attrFromStat(stat)
+	}
+	return stats, nil
+}
+
+// attrFromStat returns the p9 attributes represented by stat.
+func attrFromStat(stat syscall.Stat_t) (p9.AttrMask, p9.Attr) {
 	attr := p9.Attr{
 		Mode:             p9.FileMode(stat.Mode),
 		UID:              p9.UID(stat.Uid),
@@ -627,8 +697,7 @@ func (l *localFile) GetAttr(_ p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error)
 		MTime:  true,
 		CTime:  true,
 	}
-
-	return l.attachPoint.makeQID(stat), valid, attr, nil
+	return valid, attr
 }
 
 // SetAttr implements p9.File. Due to mismatch in file API, options
@@ -795,6 +864,75 @@ func (l *localFile) Allocate(mode p9.AllocateMode, offset, length uint64) error
 	return nil
 }
 
+// Seek implements p9.File.
+func (l *localFile) Seek(offset uint64, whence p9.SeekWhence) (uint64, error) {
+	if !l.isOpen() {
+		return 0, syscall.EBADF
+	}
+
+	off, err := syscall.Seek(l.file.FD(), int64(offset), int(whence))
+	if err != nil {
+		return 0, extractErrno(err)
+	}
+	return uint64(off), nil
+}
+
+// CopyRange implements p9.File.
+func (l *localFile) CopyRange(offset uint64, dst p9.File, dstOffset, length uint64) (uint64, error) {
+	if l.mode != p9.ReadOnly && l.mode != p9.ReadWrite {
+		return 0, syscall.EBADF
+	}
+	if !l.isOpen() {
+		return 0, syscall.EBADF
+	}
+	dstFile, ok := dst.(*localFile)
+	if !ok {
+		return 0, syscall.EXDEV
+	}
+	if dstFile.mode != p9.WriteOnly && dstFile.mode != p9.ReadWrite {
+		return 0, syscall.EBADF
+	}
+
+	srcOff := int64(offset)
+	dstOff := int64(dstOffset)
+	n, err := unix.CopyFileRange(l.file.FD(), &srcOff, dstFile.file.FD(), &dstOff, int(length), 0)
+	if err != nil {
+		return 0, extractErrno(err)
+	}
+	return uint64(n), nil
+}
+
+// CloneRange implements p9.File.
+func (l *localFile) CloneRange(offset uint64, dst p9.File, dstOffset, length uint64) error {
+	if l.mode != p9.ReadOnly && l.mode != p9.ReadWrite {
+		return syscall.EBADF
+	}
+	if !l.isOpen() {
+		return syscall.EBADF
+	}
+	dstFile, ok := dst.(*localFile)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if dstFile.mode != p9.WriteOnly && dstFile.mode != p9.ReadWrite {
+		return syscall.EBADF
+	}
+
+	if err := ioctlFileCloneRange(dstFile.file.FD(), &linux.FileCloneRange{
+		SrcFD:      int64(l.file.FD()),
+		SrcOffset:  offset,
+		SrcLength:  length,
+		DestOffset: dstOffset,
+	}); err != nil {
+		if err == syscall.ENOTTY {
+			// Kernels that predate FICLONERANGE don't recognize it.
+			return syscall.EOPNOTSUPP
+		}
+		return err
+	}
+	return nil
+}
+
 // Rename implements p9.File; this should never be called.
 func (*localFile) Rename(p9.File, string) error {
 	panic("rename called directly")
@@ -817,6 +955,23 @@ func (l *localFile) RenameAt(oldName string, directory p9.File, newName string)
 	return nil
 }
 
+// RenameAt2 implements p9.File.
+func (l *localFile) RenameAt2(oldName string, directory p9.File, newName string, flags uint32) error {
+	conf := l.attachPoint.conf
+	if conf.ROMount {
+		if conf.PanicOnWrite {
+			panic("attempt to write to RO mount")
+		}
+		return syscall.EBADF
+	}
+
+	newParent := directory.(*localFile)
+	if err := unix.Renameat2(l.file.FD(), oldName, newParent.file.FD(), newName, uint(flags)); err != nil {
+		return extractErrno(err)
+	}
+	return nil
+}
+
 // ReadAt implements p9.File.
 func (l *localFile) ReadAt(p []byte, offset uint64) (int, error) {
 	if l.mode != p9.ReadOnly && l.mode != p9.ReadWrite {
@@ -18,6 +18,7 @@ import (
 	"syscall"
 	"unsafe"
 
+	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/syserr"
 )
 
@@ -80,3 +81,27 @@ func renameat(oldDirFD int, oldName string, newDirFD int, newName string) error
 	}
 	return nil
 }
+
+func ioctlFileCloneRange(fd int, arg *linux.FileCloneRange) error {
+	if _, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		linux.FICLONERANGE,
+		uintptr(unsafe.Pointer(arg))); errno != 0 {
+
+		return errno
+	}
+	return nil
+}
+
+func ioctlInodeFlags(fd int, cmd uintptr, flags *uint32) error {
+	if _, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		cmd,
+		uintptr(unsafe.Pointer(flags))); errno != 0 {
+
+		return errno
+	}
+	return nil
+}
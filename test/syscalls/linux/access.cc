@@ -16,14 +16,27 @@
 #include <fcntl.h>
 #include <stdlib.h>
 #include <sys/stat.h>
+#include <sys/syscall.h>
 #include <sys/types.h>
 #include <unistd.h>
 
 #include "gtest/gtest.h"
+#include "absl/flags/flag.h"
 #include "test/util/capability_util.h"
 #include "test/util/fs_util.h"
 #include "test/util/temp_path.h"
 #include "test/util/test_util.h"
+#include "test/util/thread_util.h"
+
+#ifndef SYS_faccessat2
+#define SYS_faccessat2 439
+#endif
+
+#ifndef AT_EACCESS
+#define AT_EACCESS 0x200
+#endif
+
+ABSL_FLAG(int32_t, scratch_uid, 65534, "scratch UID");
 
 using ::testing::Ge;
 
@@ -164,6 +177,49 @@ TEST_F(AccessTest, UsrReadWriteExec) {
   EXPECT_THAT(unlink(filename.c_str()), SyscallSucceeds());
 }
 
+// faccessat2 checks permissions using the real UID unless AT_EACCESS is
+// specified, in which case it uses the effective UID.
+TEST_F(AccessTest, Faccessat2EffectiveUID) {
+  SKIP_IF(!ASSERT_NO_ERRNO_AND_VALUE(HaveCapability(CAP_SETUID)));
+  SKIP_IF(getuid() != 0);
+  if (syscall(SYS_faccessat2, AT_FDCWD, relfile_.c_str(), F_OK, 0) < 0 &&
+      errno == ENOSYS) {
+    GTEST_SKIP() << "faccessat2 not supported";
+  }
+
+  // Only the owner (root) can read the file.
+  const std::string filename = CreateTempFile(0600);
+
+  // Change the effective UID only in a child thread, or else this parent
+  // thread won't be able to open some log files after the test ends.
+  ScopedThread([&] {
+    EXPECT_THAT(
+        syscall(SYS_setresuid, -1, absl::GetFlag(FLAGS_scratch_uid), -1),
+        SyscallSucceeds());
+
+    // The real UID is still root, which can access the file.
+    EXPECT_THAT(syscall(SYS_faccessat2, AT_FDCWD, filename.c_str(), R_OK, 0),
+                SyscallSucceeds());
+    EXPECT_THAT(access(filename.c_str(), R_OK), SyscallSucceeds());
+
+    // The effective UID can't.
+    EXPECT_THAT(syscall(SYS_faccessat2, AT_FDCWD, filename.c_str(), R_OK,
+                        AT_EACCESS),
+                SyscallFailsWithErrno(EACCES));
+  });
+
+  EXPECT_THAT(unlink(filename.c_str()), SyscallSucceeds());
+}
+
+TEST_F(AccessTest, Faccessat2InvalidFlags) {
+  int ret = syscall(SYS_faccessat2, AT_FDCWD, relfile_.c_str(), F_OK, 0);
+  if (ret < 0 && errno == ENOSYS) {
+    GTEST_SKIP() << "faccessat2 not supported";
+  }
+  EXPECT_THAT(syscall(SYS_faccessat2, AT_FDCWD, relfile_.c_str(), F_OK, 0x1),
+              SyscallFailsWithErrno(EINVAL));
+}
+
 }  // namespace
 
 }  // namespace testing